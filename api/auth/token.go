@@ -16,15 +16,21 @@ import (
 	"github.com/google/uuid"
 )
 
-func CreateToken(user_id uuid.UUID, username string, email string, role string, deviceID string) (models.LoginResponse, models.Refresh_Token, error) {
+func CreateToken(user_id uuid.UUID, username string, email string, role string, permissions []string, deviceID string) (models.LoginResponse, models.Refresh_Token, error) {
 	claims := jwt.MapClaims{}
 	claims["authorized"] = true
 	claims["user_id"] = user_id.String()
 	claims["username"] = username
 	claims["email"] = email
 	claims["role"] = role
+	claims["permissions"] = permissions
+	now := time.Now()
+	claims["iat"] = now.Unix()
+	// iat only has whole seconds, too coarse to tell a token from a
+	// revocation in the same second.
+	claims["iat_ms"] = now.UnixNano() / int64(time.Millisecond)
 	tokenExpiry, _ := strconv.Atoi(os.Getenv("ACCESS_TOKEN_EXPIRY_IN_MILLISECOND")) 
-	expiry := time.Now().Add(time.Millisecond * time.Duration(tokenExpiry)).Unix() //Token expires after defined time interval
+	expiry := now.Add(time.Millisecond * time.Duration(tokenExpiry)).Unix() //Token expires after defined time interval
 	claims["exp"] = expiry
 	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
 	var accessToken string
@@ -122,6 +128,17 @@ func ExtractTokenExpiry(r *http.Request) (int64) {
 	return int64(0)
 }
 
+// sessionsRevokedSince looks up when all sessions of a user were last
+// revoked, see SetSessionRevocationLookup.
+var sessionsRevokedSince func(uid uuid.UUID) (*time.Time, error)
+
+// SetSessionRevocationLookup makes CheckBlacklistedJWT reject access tokens
+// issued before the sessions of their user were revoked, for example after a
+// "this wasn't me" answer to a login alert or a password reset.
+func SetSessionRevocationLookup(lookup func(uid uuid.UUID) (*time.Time, error)) {
+	sessionsRevokedSince = lookup
+}
+
 func CheckBlacklistedJWT(cache *ttlcache.Cache, r *http.Request) (error) {
 	tokenString := ExtractToken(r)
 	token, _ := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
@@ -139,10 +156,34 @@ func CheckBlacklistedJWT(cache *ttlcache.Cache, r *http.Request) (error) {
 				return fmt.Errorf("User either already logged out of the device or accesstoken inactive: %v", uid)
 			}
 		}
+		if sessionsRevokedSince != nil {
+			userID, err := uuid.Parse(uid)
+			if err != nil {
+				return err
+			}
+			revokedAt, err := sessionsRevokedSince(userID)
+			if err != nil {
+				return err
+			}
+			if revokedAt != nil && issuedBefore(claims, *revokedAt) {
+				return fmt.Errorf("User sessions have been revoked, please log in again: %v", uid)
+			}
+		}
 	}
 	return nil
 }
 
+// issuedBefore tells whether the token of claims was issued before t, to the
+// millisecond. Tokens issued before iat_ms was added are compared by the
+// second, and those before iat was added predate every revocation.
+func issuedBefore(claims jwt.MapClaims, t time.Time) bool {
+	if issuedAt, ok := claims["iat_ms"].(float64); ok {
+		return time.Unix(0, int64(issuedAt)*int64(time.Millisecond)).Before(t.Truncate(time.Millisecond))
+	}
+	issuedAt, _ := claims["iat"].(float64)
+	return time.Unix(int64(issuedAt), 0).Before(t.Truncate(time.Second))
+}
+
 //Pretty display the claims nicely in the terminal
 func Pretty(data interface{}) {
 	b, err := json.MarshalIndent(data, "", " ")
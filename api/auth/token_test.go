@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ReneKroon/ttlcache/v2"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+// checkRevoked checks accessToken of uid against a revocation of its
+// sessions at revokedAt.
+func checkRevoked(t *testing.T, uid uuid.UUID, accessToken string, revokedAt time.Time) error {
+	t.Helper()
+	SetSessionRevocationLookup(func(id uuid.UUID) (*time.Time, error) {
+		if id != uid {
+			t.Errorf("Revocations of %s looked up, want %s", id, uid)
+		}
+		return &revokedAt, nil
+	})
+	defer SetSessionRevocationLookup(nil)
+	cache := ttlcache.NewCache()
+	defer cache.Close()
+	return CheckBlacklistedJWT(cache, httptest.NewRequest("GET", "/user/me?token="+accessToken, nil))
+}
+
+func TestCheckBlacklistedJWTRevokedSessions(t *testing.T) {
+	os.Setenv("API_SECRET", "test-secret")
+	defer os.Unsetenv("API_SECRET")
+	uid := uuid.New()
+
+	// A login right after a password reset, within the same second.
+	revokedAt := time.Now()
+	login, _, err := CreateToken(uid, "jane", "jane@example.com", "User", nil, "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRevoked(t, uid, login.AccessToken, revokedAt); err != nil {
+		t.Errorf("Token issued after the revocation rejected: %v", err)
+	}
+	if err := checkRevoked(t, uid, login.AccessToken, time.Now().Add(time.Millisecond)); err == nil {
+		t.Error("Token issued before the revocation accepted")
+	}
+}
+
+func TestCheckBlacklistedJWTRevokedSessionsBySecond(t *testing.T) {
+	os.Setenv("API_SECRET", "test-secret")
+	defer os.Unsetenv("API_SECRET")
+	uid := uuid.New()
+	revokedAt := time.Unix(1700000000, 500*int64(time.Millisecond))
+
+	// Tokens issued before iat_ms was added only have whole seconds.
+	tokens := []struct {
+		iat     interface{}
+		revoked bool
+	}{
+		{int64(1700000000), false},
+		{int64(1699999999), true},
+		{nil, true},
+	}
+	for _, tt := range tokens {
+		claims := jwt.MapClaims{"user_id": uid.String(), "exp": time.Now().Add(time.Minute).Unix()}
+		if tt.iat != nil {
+			claims["iat"] = tt.iat
+		}
+		accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte("test-secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkRevoked(t, uid, accessToken, revokedAt); (err != nil) != tt.revoked {
+			t.Errorf("Token issued at %v: CheckBlacklistedJWT = %v", tt.iat, err)
+		}
+	}
+}
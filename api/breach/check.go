@@ -0,0 +1,65 @@
+package breach
+
+import (
+	"strings"
+	"sync"
+)
+
+// Mode decides what happens to a password that is found in the index.
+type Mode string
+
+const (
+	Off   Mode = "off"
+	Warn  Mode = "warn"
+	Block Mode = "block"
+)
+
+func ParseMode(value string) Mode {
+	switch Mode(strings.ToLower(strings.TrimSpace(value))) {
+	case Warn:
+		return Warn
+	case Block:
+		return Block
+	}
+	return Off
+}
+
+var (
+	mu      sync.RWMutex
+	current *Index
+)
+
+// Load opens the index at path and makes it the one used by Check, closing
+// the index it replaces.
+func Load(path string, inMemory bool) error {
+	idx, err := Open(path, inMemory)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	previous := current
+	current = idx
+	mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// Loaded reports whether an index is available to Check.
+func Loaded() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current != nil
+}
+
+// Check reports whether the password appears in the loaded index. Without an
+// index every password passes.
+func Check(password string) (bool, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if current == nil {
+		return false, nil
+	}
+	return current.ContainsPassword(password)
+}
@@ -0,0 +1,254 @@
+// Package breach looks passwords up in a local index of SHA-1 hashes taken
+// from known breach corpora, so that no password or hash prefix ever leaves
+// the service.
+//
+// The index is a header, a prefix table with one entry per two-byte hash
+// prefix and the sorted 20-byte hashes. A lookup only touches the bucket of
+// its prefix, in the spirit of the k-anonymity range API it replaces.
+package breach
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	magic       = "TVBPIDX1"
+	hashSize    = sha1.Size
+	buckets     = 1 << 16
+	headerSize  = len(magic) + 8
+	tableSize   = (buckets + 1) * 4
+	recordsFrom = int64(headerSize + tableSize)
+)
+
+// Index answers whether a password hash appears in the breach corpus.
+type Index struct {
+	count   uint64
+	table   []uint32
+	records io.ReaderAt
+	closer  io.Closer
+}
+
+// Open loads an index built by Build. With inMemory the whole file is read
+// into memory, otherwise hashes are read from disk on demand and the OS page
+// cache keeps the hot buckets around.
+func Open(path string, inMemory bool) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize+tableSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("breach index %s: %v", path, err)
+	}
+	if string(header[:len(magic)]) != magic {
+		f.Close()
+		return nil, fmt.Errorf("breach index %s: not an index file", path)
+	}
+	idx := &Index{
+		count: binary.BigEndian.Uint64(header[len(magic):headerSize]),
+		table: make([]uint32, buckets+1),
+	}
+	for i := range idx.table {
+		idx.table[i] = binary.BigEndian.Uint32(header[headerSize+i*4:])
+	}
+	if uint64(idx.table[buckets]) != idx.count {
+		f.Close()
+		return nil, fmt.Errorf("breach index %s: corrupt prefix table", path)
+	}
+
+	if !inMemory {
+		idx.records = io.NewSectionReader(f, recordsFrom, int64(idx.count)*hashSize)
+		idx.closer = f
+		return idx, nil
+	}
+	defer f.Close()
+	data := make([]byte, int64(idx.count)*hashSize)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, fmt.Errorf("breach index %s: %v", path, err)
+	}
+	idx.records = bytes.NewReader(data)
+	return idx, nil
+}
+
+// Close releases the file held by an on-disk index.
+func (idx *Index) Close() error {
+	if idx.closer != nil {
+		return idx.closer.Close()
+	}
+	return nil
+}
+
+// Len is the number of hashes in the index.
+func (idx *Index) Len() uint64 {
+	return idx.count
+}
+
+// ContainsPassword hashes the password and looks it up.
+func (idx *Index) ContainsPassword(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	return idx.ContainsHash(sum)
+}
+
+func (idx *Index) ContainsHash(sum [hashSize]byte) (bool, error) {
+	bucket := binary.BigEndian.Uint16(sum[:2])
+	lo, hi := int(idx.table[bucket]), int(idx.table[int(bucket)+1])
+	record := make([]byte, hashSize)
+	var readErr error
+	i := sort.Search(hi-lo, func(i int) bool {
+		if readErr != nil {
+			return true
+		}
+		if _, err := idx.records.ReadAt(record, int64(lo+i)*hashSize); err != nil {
+			readErr = err
+			return true
+		}
+		return bytes.Compare(record, sum[:]) >= 0
+	})
+	if readErr != nil {
+		return false, readErr
+	}
+	if i == hi-lo {
+		return false, nil
+	}
+	if _, err := idx.records.ReadAt(record, int64(lo+i)*hashSize); err != nil {
+		return false, err
+	}
+	return bytes.Equal(record, sum[:]), nil
+}
+
+// Build converts a dump with one hex SHA-1 per line, optionally followed by
+// ":count" as in the Have I Been Pwned downloads, into an index. The dump
+// must be sorted by hash unless sortInput is set, in which case it is sorted
+// in memory first. Duplicate hashes are written once.
+func Build(dump io.Reader, out io.WriteSeeker, sortInput bool) (uint64, error) {
+	if sortInput {
+		hashes, err := readAll(dump)
+		if err != nil {
+			return 0, err
+		}
+		sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+		next := 0
+		return write(out, func() ([hashSize]byte, bool, error) {
+			if next == len(hashes) {
+				return [hashSize]byte{}, false, nil
+			}
+			next++
+			return hashes[next-1], true, nil
+		})
+	}
+
+	scanner := bufio.NewScanner(dump)
+	line := 0
+	return write(out, func() ([hashSize]byte, bool, error) {
+		for scanner.Scan() {
+			line++
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			sum, err := parseLine(scanner.Text())
+			if err != nil {
+				return sum, false, fmt.Errorf("line %d: %v", line, err)
+			}
+			return sum, true, nil
+		}
+		return [hashSize]byte{}, false, scanner.Err()
+	})
+}
+
+func write(out io.WriteSeeker, next func() ([hashSize]byte, bool, error)) (uint64, error) {
+	if _, err := out.Seek(recordsFrom, io.SeekStart); err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriterSize(out, 1<<20)
+	counts := make([]uint32, buckets)
+	var count uint64
+	var previous []byte
+	for {
+		sum, ok, err := next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		if previous != nil {
+			switch bytes.Compare(previous, sum[:]) {
+			case 0:
+				continue
+			case 1:
+				return 0, errors.New("dump is not sorted by hash, rebuild with sorting enabled")
+			}
+		}
+		previous = append(previous[:0], sum[:]...)
+		if _, err := w.Write(sum[:]); err != nil {
+			return 0, err
+		}
+		counts[binary.BigEndian.Uint16(sum[:2])]++
+		count++
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, headerSize+tableSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint64(header[len(magic):], count)
+	var offset uint32
+	for i := 0; i <= buckets; i++ {
+		binary.BigEndian.PutUint32(header[headerSize+i*4:], offset)
+		if i < buckets {
+			offset += counts[i]
+		}
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := out.Write(header); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func readAll(dump io.Reader) ([][hashSize]byte, error) {
+	hashes := [][hashSize]byte{}
+	scanner := bufio.NewScanner(dump)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		sum, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		hashes = append(hashes, sum)
+	}
+	return hashes, scanner.Err()
+}
+
+func parseLine(line string) ([hashSize]byte, error) {
+	var sum [hashSize]byte
+	line = strings.TrimSpace(line)
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	if len(line) != hex.EncodedLen(hashSize) {
+		return sum, errors.New("expected a hex encoded SHA-1 hash")
+	}
+	if _, err := hex.Decode(sum[:], []byte(line)); err != nil {
+		return sum, err
+	}
+	return sum, nil
+}
@@ -0,0 +1,136 @@
+package breach
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// SHA-1 of "password".
+const passwordHash = "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"
+
+// dump is sorted by hash the way the Have I Been Pwned downloads are, with
+// counts, a blank line, a lower case hash and a duplicate. Bucket 5BAA holds
+// three hashes, 0000 and FFFF the first and last of the prefix table.
+var dump = []string{
+	"0000000000000000000000000000000000000001:3",
+	"5BAA000000000000000000000000000000000000:1",
+	"",
+	"5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8:9545824",
+	passwordHash + ":1",
+	"5BAAFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+	"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:2",
+}
+
+func hash(t *testing.T, s string) [hashSize]byte {
+	t.Helper()
+	var sum [hashSize]byte
+	if _, err := hex.Decode(sum[:], []byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+// build writes the index of lines to a file and returns its path.
+func build(t *testing.T, lines []string, sortInput bool) (string, uint64, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "breached.idx")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	count, err := Build(strings.NewReader(strings.Join(lines, "\n")), out, sortInput)
+	return path, count, err
+}
+
+func TestIndex(t *testing.T) {
+	path, count, err := build(t, dump, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("Build wrote %d hashes, want 5", count)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"first bucket", "0000000000000000000000000000000000000001", true},
+		{"first in bucket", "5BAA000000000000000000000000000000000000", true},
+		{"middle of bucket", passwordHash, true},
+		{"last in bucket", "5BAAFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", true},
+		{"last bucket", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", true},
+		{"before a hit in its bucket", "0000000000000000000000000000000000000000", false},
+		{"between hits in its bucket", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD7", false},
+		{"after the last hash of its bucket", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFE", false},
+		{"empty bucket", "5BAB61E4C9B93F3F0682250B6CF8331B7EE68FD8", false},
+	}
+	for _, inMemory := range []bool{false, true} {
+		idx, err := Open(path, inMemory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if idx.Len() != 5 {
+			t.Errorf("in memory %v: Len = %d, want 5", inMemory, idx.Len())
+		}
+		for _, tt := range tests {
+			got, err := idx.ContainsHash(hash(t, tt.hash))
+			if err != nil || got != tt.want {
+				t.Errorf("in memory %v, %s: ContainsHash(%s) = %v, %v, want %v", inMemory, tt.name, tt.hash, got, err, tt.want)
+			}
+		}
+		if found, err := idx.ContainsPassword("password"); err != nil || !found {
+			t.Errorf("in memory %v: ContainsPassword(password) = %v, %v", inMemory, found, err)
+		}
+		if found, err := idx.ContainsPassword("correct horse battery staple"); err != nil || found {
+			t.Errorf("in memory %v: ContainsPassword of an unbreached password = %v, %v", inMemory, found, err)
+		}
+		if err := idx.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestBuildUnsorted(t *testing.T) {
+	unsorted := []string{dump[4], dump[0], dump[6]}
+	if _, _, err := build(t, unsorted, false); err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Errorf("Build of an unsorted dump = %v", err)
+	}
+
+	path, count, err := build(t, unsorted, true)
+	if err != nil || count != 3 {
+		t.Fatalf("Build with sorting = %d, %v", count, err)
+	}
+	idx, err := Open(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := idx.ContainsHash(hash(t, dump[0][:40])); err != nil || !found {
+		t.Errorf("Sorted index misses %s: %v", dump[0][:40], err)
+	}
+}
+
+func TestBuildInvalidLine(t *testing.T) {
+	for _, sortInput := range []bool{false, true} {
+		if _, _, err := build(t, []string{dump[0], "5BAA61E4C9B93F3F:12"}, sortInput); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("sorting %v: Build of a truncated hash = %v", sortInput, err)
+		}
+	}
+}
+
+func TestOpenNotAnIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.txt")
+	data := []byte(strings.Repeat(passwordHash+"\n", headerSize+tableSize))
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, false); err == nil || !strings.Contains(err.Error(), "not an index file") {
+		t.Errorf("Open of a dump = %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Package broker publishes domain events to a message broker. The outbox
+// relay hands it messages in order and only marks them as sent once Publish
+// returned without error, so every adapter must only return once the broker
+// acknowledged the messages.
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// Message is one event. Messages with the same Key are published in order,
+// adapters map Key to whatever keeps that order on their broker.
+type Message struct {
+	ID      string
+	Key     string
+	Event   string
+	Payload []byte
+}
+
+type Broker interface {
+	Name() string
+	Publish(ctx context.Context, messages ...Message) error
+	Close() error
+}
+
+// Memory keeps published messages in memory. It is meant for tests and for
+// running the service without a broker.
+type Memory struct {
+	mu          sync.Mutex
+	messages    []Message
+	subscribers []chan Message
+	// Fail, when set, is returned by Publish instead of storing messages.
+	Fail error
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Name() string {
+	return "memory"
+}
+
+func (m *Memory) Publish(ctx context.Context, messages ...Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Fail != nil {
+		return m.Fail
+	}
+	m.messages = append(m.messages, messages...)
+	for _, subscriber := range m.subscribers {
+		for _, message := range messages {
+			select {
+			case subscriber <- message:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// Messages returns everything published so far, in order.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Subscribe returns a channel receiving messages published from now on.
+// Messages are dropped for a subscriber whose buffer is full.
+func (m *Memory) Subscribe(buffer int) <-chan Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subscriber := make(chan Message, buffer)
+	m.subscribers = append(m.subscribers, subscriber)
+	return subscriber
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, subscriber := range m.subscribers {
+		close(subscriber)
+	}
+	m.subscribers = nil
+	return nil
+}
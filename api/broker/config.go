@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// FromEnv builds the broker named by OUTBOX_BROKER: nats (NATS_URL,
+// NATS_SUBJECT_PREFIX), kafka (KAFKA_BROKERS, KAFKA_TOPIC) or memory. It
+// returns nil when OUTBOX_BROKER is empty.
+func FromEnv() (Broker, error) {
+	switch os.Getenv("OUTBOX_BROKER") {
+	case "":
+		return nil, nil
+	case "memory":
+		return NewMemory(), nil
+	case "nats":
+		url := os.Getenv("NATS_URL")
+		if url == "" {
+			url = "nats://127.0.0.1:4222"
+		}
+		return NewNATS(url, envOr("NATS_SUBJECT_PREFIX", "identity"))
+	case "kafka":
+		brokers := []string{}
+		for _, address := range strings.Split(os.Getenv("KAFKA_BROKERS"), ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				brokers = append(brokers, address)
+			}
+		}
+		if len(brokers) == 0 {
+			return nil, errors.New("KAFKA_BROKERS is required for the kafka outbox broker")
+		}
+		return NewKafka(brokers, envOr("KAFKA_TOPIC", "identity.users")), nil
+	default:
+		return nil, errors.New("Unsupported OUTBOX_BROKER " + os.Getenv("OUTBOX_BROKER"))
+	}
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes every event to one topic, keyed so that all events with
+// the same Key land on the same partition, in order. Writes wait for all
+// in-sync replicas.
+type Kafka struct {
+	writer *kafka.Writer
+}
+
+func NewKafka(brokers []string, topic string) *Kafka {
+	return &Kafka{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+	}}
+}
+
+func (k *Kafka) Name() string {
+	return "kafka"
+}
+
+func (k *Kafka) Publish(ctx context.Context, messages ...Message) error {
+	records := make([]kafka.Message, len(messages))
+	for i, message := range messages {
+		records[i] = kafka.Message{
+			Key:   []byte(message.Key),
+			Value: message.Payload,
+			Headers: []kafka.Header{
+				{Key: "Event", Value: []byte(message.Event)},
+				{Key: "Message-ID", Value: []byte(message.ID)},
+			},
+		}
+	}
+	return k.writer.WriteMessages(ctx, records...)
+}
+
+func (k *Kafka) Close() error {
+	return k.writer.Close()
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATS publishes to JetStream, on the subject prefix + "." + event, e.g.
+// identity.user.created. A stream has to capture those subjects. Messages are
+// published one by one, each waiting for its ack, which keeps their order,
+// and carry their ID as Nats-Msg-Id so JetStream drops redeliveries within
+// its duplicate window.
+type NATS struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	prefix string
+}
+
+func NewNATS(url string, prefix string) (*NATS, error) {
+	conn, err := nats.Connect(url, nats.Name("truvest-identity-outbox"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &NATS{conn: conn, js: js, prefix: prefix}, nil
+}
+
+func (n *NATS) Name() string {
+	return "nats"
+}
+
+func (n *NATS) Publish(ctx context.Context, messages ...Message) error {
+	for _, message := range messages {
+		msg := nats.NewMsg(n.prefix + "." + message.Event)
+		msg.Data = message.Payload
+		msg.Header.Set("Event", message.Event)
+		msg.Header.Set("Key", message.Key)
+		_, err := n.js.PublishMsg(msg, nats.MsgId(message.ID), nats.Context(ctx))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *NATS) Close() error {
+	n.conn.Close()
+	return nil
+}
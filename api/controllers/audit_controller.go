@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/events"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// GetAuditEvents godoc
+// @Summary Get the audit log
+// @Description Get administrative changes to users, roles and permissions, newest first. Each event names the actor, the action, the target, the state before and after the change, the request ID and the source IP. In order to access this API, someone must have "AUDIT_VIEW" Permission tagged to its role.
+// @Tags Audit
+// @Accept  json
+// @Produce  json
+// @Param actor query string false "ID of the user who made the change"
+// @Param action query string false "Action, e.g. user.update"
+// @Param target_type query string false "Type of the changed entity, e.g. user, role or permission"
+// @Param target_id query string false "ID of the changed entity"
+// @Param from query string false "Earliest time, RFC 3339"
+// @Param to query string false "Latest time (exclusive), RFC 3339"
+// @Param page query int false "Page number, starting at 1"
+// @Param per_page query int false "Events per page, at most 100"
+// @Success 200 {object} models.Page
+// @Security ApiKeyAuth
+// @Router /audit-events [get]
+func (server *Server) GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"AUDIT_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := models.Audit_Event_Filter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+	}
+	if actor := query.Get("actor"); actor != "" {
+		actorID, err := uuid.Parse(actor)
+		if err != nil {
+			responses.ERROR(w, http.StatusBadRequest, errors.New("Invalid actor"))
+			return
+		}
+		filter.ActorID = &actorID
+	}
+	if from := query.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			responses.ERROR(w, http.StatusBadRequest, errors.New("Invalid from, expected RFC 3339"))
+			return
+		}
+		filter.From = &t
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			responses.ERROR(w, http.StatusBadRequest, errors.New("Invalid to, expected RFC 3339"))
+			return
+		}
+		filter.To = &t
+	}
+	page, perPage := pageParams(r)
+	event := models.Audit_Event{}
+	events, err := event.FindAuditEvents(server.DB, filter, page, perPage)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, events)
+}
+
+// withAudit runs change in a transaction and records event in the same
+// transaction, so that a change is never stored without its audit event or
+// the other way round. change fills in whatever the event only learns while
+// the change is made, such as the ID of a created entity.
+func (server *Server) withAudit(r *http.Request, event *models.Audit_Event, change func(tx *gorm.DB) error) error {
+	var actorID *uuid.UUID
+	ledgerActor := ""
+	if client := scimClient(r); client != nil {
+		actorID = &client.ID
+		ledgerActor = client.ID.String()
+	} else if authID, err := auth.ExtractTokenID(r); err == nil {
+		if id, err := uuid.Parse(authID); err == nil {
+			actorID = &id
+			ledgerActor = id.String()
+		}
+	}
+	requestID := r.Header.Get("X-Request-ID")
+	err := server.DB.Transaction(func(tx *gorm.DB) error {
+		err := models.SetLedgerContext(tx, ledgerActor, requestID)
+		if err != nil {
+			return err
+		}
+		err = change(tx)
+		if err != nil {
+			return err
+		}
+		err = event.Prepare(actorID, requestID, utils.ClientIP(r))
+		if err != nil {
+			return err
+		}
+		return event.SaveAuditEvent(tx)
+	})
+	if err != nil {
+		return err
+	}
+	publishAuditEvent(event, ledgerActor)
+	return nil
+}
+
+// publishAuditEvent streams an audit event once the transaction that
+// recorded it is committed.
+func publishAuditEvent(event *models.Audit_Event, actor string) {
+	events.Publish(events.Event{
+		Time:       event.CreatedAt,
+		Category:   events.CategoryAdmin,
+		Action:     event.Action,
+		Success:    true,
+		ActorID:    actor,
+		TargetType: event.TargetType,
+		TargetID:   event.TargetID,
+		SourceIP:   event.SourceIP,
+		RequestID:  event.RequestID,
+		Changes:    json.RawMessage(event.Changes),
+	})
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// externalLoginError tells why a user vouched for by an external provider
+// cannot log in. Unlike other login errors it is shown as is.
+type externalLoginError struct {
+	message string
+}
+
+func (e *externalLoginError) Error() string {
+	return e.message
+}
+
+// provisionExternalUser returns the account of a user an external provider
+// vouched for, matched by email. The account is created when create is set,
+// and its names follow the provider. Accounts of other providers are not
+// taken over.
+func provisionExternalUser(tx *gorm.DB, provider string, profile models.User, create bool) (*models.User, error) {
+	fetchUser := models.User{}
+	existing, err := fetchUser.FindUserByEmail(tx, html.EscapeString(strings.TrimSpace(profile.Email)))
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if err == nil {
+		if existing.Provider != provider {
+			return nil, &externalLoginError{"An account with this email already signs in with " + existing.Provider}
+		}
+		user := models.User{
+			UserName:  html.EscapeString(strings.TrimSpace(profile.UserName)),
+			FirstName: html.EscapeString(strings.TrimSpace(profile.FirstName)),
+			LastName:  html.EscapeString(strings.TrimSpace(profile.LastName)),
+			Email:     existing.Email,
+			Enabled:   existing.Enabled,
+		}
+		if user.UserName == "" {
+			user.UserName = existing.UserName
+		}
+		if user.FirstName == "" {
+			user.FirstName = existing.FirstName
+		}
+		if user.UserName == existing.UserName && user.FirstName == existing.FirstName && user.LastName == existing.LastName {
+			return existing, nil
+		}
+		updatedUser, err := user.ProvisionUser(tx, existing.ID, existing.ID)
+		if err != nil {
+			return nil, err
+		}
+		err = models.PublishUserEvent(tx, models.EventUserUpdated, updatedUser.ID, models.UserEventData(updatedUser))
+		if err != nil {
+			return nil, err
+		}
+		return updatedUser, nil
+	}
+	if !create {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	user := models.User{
+		UserName:  profile.UserName,
+		FirstName: profile.FirstName,
+		LastName:  profile.LastName,
+		Email:     profile.Email,
+	}
+	if user.UserName == "" {
+		user.UserName = user.Email
+	}
+	if user.FirstName == "" {
+		user.FirstName = user.UserName
+	}
+	user.PrepareSignUp()
+	user.Provider = provider
+	err = user.Validate("")
+	if err != nil {
+		return nil, err
+	}
+	userCreated, err := user.SaveUser(tx)
+	if err != nil {
+		return nil, err
+	}
+	err = models.PublishUserEvent(tx, models.EventUserCreated, userCreated.ID, models.UserEventData(userCreated))
+	if err != nil {
+		return nil, err
+	}
+	return userCreated, nil
+}
+
+// syncMappedRoles gives the user the mapped roles it is wanted to hold and
+// takes away the mapped roles it is not, but only the grants source made.
+// Roles granted otherwise are left alone, they are managed through /roles.
+// Every change is audited without an actor, the events are returned to be
+// published once the login is committed.
+func syncMappedRoles(tx *gorm.DB, r *http.Request, uid uuid.UUID, source string, mapped []*models.Role, wanted func(*models.Role) bool) ([]*models.Audit_Event, error) {
+	userRole := models.User_Role{}
+	grants, err := userRole.FindUserRolesByUserID(tx, uid)
+	if err != nil {
+		return nil, err
+	}
+	audits := []*models.Audit_Event{}
+	for _, role := range mapped {
+		granted, heldOtherwise := false, false
+		for _, grant := range grants {
+			if grant.RoleID == role.ID && grant.Source == source {
+				granted = true
+			} else if grant.RoleID == role.ID {
+				heldOtherwise = true
+			}
+		}
+		grant := models.User_Role{UserID: uid, RoleID: role.ID, Source: source}
+		event := &models.Audit_Event{TargetType: "role", TargetID: fmt.Sprintf("%d", role.ID)}
+		switch want := wanted(role); {
+		case want && !granted && !heldOtherwise:
+			event.Action = "role.sync_add_user"
+			err = grant.SaveUserToRole(tx)
+			if err == nil {
+				err = event.SetAfter(grant)
+			}
+			if err == nil {
+				err = models.PublishUserEvent(tx, models.EventUserRoleAssigned, uid, models.RoleEventData(uid, role.ID))
+			}
+		case !want && granted:
+			event.Action = "role.sync_remove_user"
+			_, err = userRole.DeleteUserRoleBySource(tx, role.ID, uid, source)
+			if err == nil {
+				err = event.SetBefore(grant)
+			}
+			if err == nil && !heldOtherwise {
+				err = models.PublishUserEvent(tx, models.EventUserRoleRemoved, uid, models.RoleEventData(uid, role.ID))
+			}
+		default:
+			continue
+		}
+		if err == nil {
+			err = event.Prepare(nil, r.Header.Get("X-Request-ID"), utils.ClientIP(r))
+		}
+		if err == nil {
+			err = event.SaveAuditEvent(tx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		audits = append(audits, event)
+	}
+	return audits, nil
+}
@@ -0,0 +1,644 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// CreateGroup godoc
+// @Summary Create a group of users
+// @Description Create a group to give its members roles together. With a parent_id the group is inside the parent group: its members also get the roles of the parent and of the groups above it. In order to access this API, someone must have "MANAGE_GROUPS" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param group body models.Group_Payload true "Group"
+// @Success 201 {object} models.Group
+// @Security ApiKeyAuth
+// @Router /groups [post]
+func (server *Server) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_GROUPS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Group_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	group := models.Group{}
+	group.Apply(payload)
+	group.Prepare(tokenID)
+	err = group.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	err = group.ValidateParent(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	event := models.Audit_Event{Action: "group.create", TargetType: "group", TargetID: group.ID.String()}
+	err = event.SetAfter(group)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := group.SaveGroup(tx)
+		return err
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%s", r.Host, r.RequestURI, group.ID))
+	responses.JSON(w, http.StatusCreated, group)
+}
+
+// GetGroups godoc
+// @Summary Get all groups
+// @Description Get all groups with the roles given to them. In order to access this API, someone must have "USERS_VIEW" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.Group
+// @Security ApiKeyAuth
+// @Router /groups [get]
+func (server *Server) GetGroups(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	group := models.Group{}
+	groups, err := group.FindAllGroups(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, groups)
+}
+
+// GetGroup godoc
+// @Summary Get a group by id
+// @Description Get a group by id with the roles given to it. In order to access this API, someone must have "USERS_VIEW" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the group"
+// @Success 200 {object} models.Group
+// @Security ApiKeyAuth
+// @Router /groups/{id} [get]
+func (server *Server) GetGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	gid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	group := models.Group{}
+	groupGotten, err := group.FindGroupByID(server.DB, gid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, groupGotten)
+}
+
+// UpdateGroup godoc
+// @Summary Update a group by id
+// @Description Replace the name, description and parent of a group. A group cannot be moved inside itself or inside the groups within it. In order to access this API, someone must have "MANAGE_GROUPS" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the group"
+// @Param group body models.Group_Payload true "Group"
+// @Success 200 {object} models.Group
+// @Security ApiKeyAuth
+// @Router /groups/{id} [put]
+func (server *Server) UpdateGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_GROUPS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	gid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Group_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	fetchGroup := models.Group{}
+	group, err := fetchGroup.FindGroupByID(server.DB, gid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "group.update", TargetType: "group", TargetID: gid.String()}
+	err = event.SetBefore(group)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	group.Apply(payload)
+	err = group.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	err = group.ValidateParent(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		// Moving the group changes the roles its members get from above.
+		uids, err := group.FindMemberIDsWithDescendants(tx, gid)
+		if err != nil {
+			return err
+		}
+		err = models.TrackRoleChanges(tx, uids, func() error {
+			_, err := group.UpdateAGroup(tx, tokenID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(group)
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusOK, group)
+}
+
+// DeleteGroup godoc
+// @Summary Delete a group by id
+// @Description Delete a group. Its members lose the roles they got through it, the groups inside it move to its parent. In order to access this API, someone must have "MANAGE_GROUPS" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the group"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /groups/{id} [delete]
+func (server *Server) DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_GROUPS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	gid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	group := models.Group{}
+	deleteGroup, err := group.FindGroupByID(server.DB, gid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "group.delete", TargetType: "group", TargetID: gid.String()}
+	err = event.SetBefore(deleteGroup)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		uids, err := group.FindMemberIDsWithDescendants(tx, gid)
+		if err != nil {
+			return err
+		}
+		return models.TrackRoleChanges(tx, uids, func() error {
+			_, err := group.DeleteAGroup(tx, gid)
+			return err
+		})
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Entity", gid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// GetGroupMembers godoc
+// @Summary Get the members of a group
+// @Description Get the users that are direct members of a group, without the members of the groups inside it. In order to access this API, someone must have "USERS_VIEW" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the group"
+// @Success 200 {object} models.UserResponse
+// @Security ApiKeyAuth
+// @Router /groups/{id}/users [get]
+func (server *Server) GetGroupMembers(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	gid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	group := models.Group{}
+	_, err = group.FindGroupByID(server.DB, gid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	member := models.Group_Member{}
+	users, err := member.FindGroupMembers(server.DB, gid)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, models.PrepareResponses(users))
+}
+
+// AddUsersToGroup godoc
+// @Summary Add users to a group
+// @Description Add users to a group, giving them the roles of the group. In order to access this API, someone must have "MANAGE_GROUPS" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the group"
+// @Param users body models.Group_Member_Payload true "Group Member Payload"
+// @Success 201
+// @Security ApiKeyAuth
+// @Router /groups/{id}/users [post]
+func (server *Server) AddUsersToGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_GROUPS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	gid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Group_Member_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	group := models.Group{}
+	_, err = group.FindGroupByID(server.DB, gid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+
+	members := []models.Group_Member{}
+	for i := range payload.Users {
+		member := models.Group_Member{GroupID: gid, UserID: payload.Users[i]}
+		err = member.Validate()
+		if err != nil {
+			responses.ERROR(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		members = append(members, member)
+	}
+	event := models.Audit_Event{Action: "group.add_users", TargetType: "group", TargetID: gid.String()}
+	err = event.SetAfter(map[string]interface{}{"users": payload.Users})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		return models.TrackRoleChanges(tx, payload.Users, func() error {
+			for i := range members {
+				err := members[i].SaveGroupMember(tx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s%s/", r.Host, r.RequestURI))
+	responses.JSON(w, http.StatusCreated, "")
+}
+
+// DeleteUserFromGroup godoc
+// @Summary Remove a user from a group
+// @Description Remove a user from a group. The user loses the roles it had through the group. In order to access this API, someone must have "MANAGE_GROUPS" Permission tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id1 path string true "ID of the group"
+// @Param id2 path string true "ID of the user"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /groups/{id1}/users/{id2} [delete]
+func (server *Server) DeleteUserFromGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_GROUPS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	gid, err := uuid.Parse(vars["id1"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	uid, err := uuid.Parse(vars["id2"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	member := models.Group_Member{}
+	event := models.Audit_Event{Action: "group.remove_user", TargetType: "group", TargetID: gid.String()}
+	err = event.SetBefore(map[string]interface{}{"user": uid})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		return models.TrackRoleChanges(tx, []uuid.UUID{uid}, func() error {
+			_, err := member.DeleteGroupMember(tx, gid, uid)
+			return err
+		})
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Entity", uid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// AddRolesToGroup godoc
+// @Summary Give roles to a group
+// @Description Give roles to a group. The members of the group and of the groups inside it get the roles and their permissions. In order to access this API, someone must have "MANAGE_GROUPS" and "USERS_ASSIGN_TO_ROLE" Permissions tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the group"
+// @Param roles body models.Group_Role_Payload true "Group Role Payload"
+// @Success 201
+// @Security ApiKeyAuth
+// @Router /groups/{id}/roles [post]
+func (server *Server) AddRolesToGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_GROUPS", "USERS_ASSIGN_TO_ROLE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	gid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Group_Role_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	group := models.Group{}
+	_, err = group.FindGroupByID(server.DB, gid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	role := models.Role{}
+	_, err = role.FindRolesByIDs(server.DB, payload.Roles)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	groupRoles := []models.Group_Role{}
+	for i := range payload.Roles {
+		groupRole := models.Group_Role{GroupID: gid, RoleID: payload.Roles[i]}
+		err = groupRole.Validate()
+		if err != nil {
+			responses.ERROR(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		groupRoles = append(groupRoles, groupRole)
+	}
+	event := models.Audit_Event{Action: "group.add_roles", TargetType: "group", TargetID: gid.String()}
+	err = event.SetAfter(map[string]interface{}{"roles": payload.Roles})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		uids, err := group.FindMemberIDsWithDescendants(tx, gid)
+		if err != nil {
+			return err
+		}
+		return models.TrackRoleChanges(tx, uids, func() error {
+			for i := range groupRoles {
+				err := groupRoles[i].SaveGroupRole(tx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s%s/", r.Host, r.RequestURI))
+	responses.JSON(w, http.StatusCreated, "")
+}
+
+// DeleteRoleFromGroup godoc
+// @Summary Take a role away from a group
+// @Description Take a role away from a group. Members keep the role if they hold it directly or through another group. In order to access this API, someone must have "MANAGE_GROUPS" and "USERS_ASSIGN_TO_ROLE" Permissions tagged to its role.
+// @Tags Group
+// @Accept  json
+// @Produce  json
+// @Param id1 path string true "ID of the group"
+// @Param id2 path int true "ID of the role"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /groups/{id1}/roles/{id2} [delete]
+func (server *Server) DeleteRoleFromGroup(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_GROUPS", "USERS_ASSIGN_TO_ROLE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	gid, err := uuid.Parse(vars["id1"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	rid, err := strconv.ParseUint(vars["id2"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	groupRole := models.Group_Role{}
+	event := models.Audit_Event{Action: "group.remove_role", TargetType: "group", TargetID: gid.String()}
+	err = event.SetBefore(map[string]interface{}{"role": rid})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		group := models.Group{}
+		uids, err := group.FindMemberIDsWithDescendants(tx, gid)
+		if err != nil {
+			return err
+		}
+		return models.TrackRoleChanges(tx, uids, func() error {
+			_, err := groupRole.DeleteGroupRole(tx, gid, uint32(rid))
+			return err
+		})
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Entity", fmt.Sprintf("%d", rid))
+	responses.JSON(w, http.StatusNoContent, "")
+}
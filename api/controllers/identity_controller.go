@@ -0,0 +1,354 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/goth"
+)
+
+// identityLinkCookie ties a link request to the browser of the user who
+// started it. Without it anyone could send the link URL to a victim and get
+// the victim's account at the provider linked to their own user.
+const identityLinkCookie = "identity_link"
+
+var errIdentityLinkBrowser = errors.New("The link has to be completed in the browser that started it")
+
+// IdentityLinkResponse holds the URL the browser of the user has to open
+// to link an account at the provider.
+type IdentityLinkResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetMyIdentities godoc
+// @Summary Get the linked accounts of the logged in user
+// @Description Get the accounts at OAuth and OpenID Connect providers the logged in user can log in with. The tokens of the providers are not returned.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.External_Identity
+// @Security ApiKeyAuth
+// @Router /user/me/identities [get]
+func (server *Server) GetMyIdentities(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	identity := models.External_Identity{}
+	identities, err := identity.FindExternalIdentitiesByUserID(server.DB, tokenID)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, identities)
+}
+
+// LinkMyIdentity godoc
+// @Summary Link an account at a provider to the logged in user
+// @Description Start linking an account at an OAuth or OpenID Connect provider. Call it from the browser of the user, with credentials, as it sets the identity_link cookie the link is bound to. Open the returned URL in that browser before it expires; after logging in at the provider the account is linked and the user can log in with it, whatever email the provider reports. An account can only be linked to one user. With a redirect_uri of OAUTH_REDIRECT_URIS the browser is sent there with linked={provider} or an error and error_description, without one the linked account is returned as JSON.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param provider path string true "OAuth provider"
+// @Param redirect_uri query string false "Frontend page to return to"
+// @Success 201 {object} IdentityLinkResponse
+// @Security ApiKeyAuth
+// @Router /user/me/identities/{provider} [post]
+func (server *Server) LinkMyIdentity(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	provider := mux.Vars(r)["provider"]
+	_, providers := sso.ProviderNames()
+	if _, ok := providers[provider]; !ok {
+		responses.ERROR(w, http.StatusNotFound, errors.New("Provider Not Found"))
+		return
+	}
+
+	redirectURI := r.URL.Query().Get("redirect_uri")
+	if redirectURI != "" {
+		redirectURI, err = models.OauthRedirectURI(redirectURI)
+		if err != nil {
+			responses.ERROR(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+	}
+	browser, browserHash, err := utils.SecureToken()
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	state, request, err := server.startOauthRequest(provider, redirectURI, "", &tokenID, browserHash)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     identityLinkCookie,
+		Value:    browser,
+		Path:     "/auth",
+		MaxAge:   int(models.OauthRequestExpiry().Seconds()),
+		HttpOnly: true,
+		Secure:   os.Getenv("APP_PROTOCOL") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	responses.JSON(w, http.StatusCreated, IdentityLinkResponse{
+		URL:       serviceURL("/auth/" + provider + "?state=" + state),
+		ExpiresAt: request.ExpiresAt,
+	})
+}
+
+// identityLinkBrowser reports whether the request comes from the browser
+// that started the link request.
+func identityLinkBrowser(r *http.Request, request *models.Oauth_Request) bool {
+	cookie, err := r.Cookie(identityLinkCookie)
+	if err != nil || cookie.Value == "" || request.BrowserHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(utils.HashToken(cookie.Value)), []byte(request.BrowserHash)) == 1
+}
+
+func clearIdentityLinkCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     identityLinkCookie,
+		Path:     "/auth",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   os.Getenv("APP_PROTOCOL") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// UnlinkMyIdentity godoc
+// @Summary Unlink an account at a provider from the logged in user
+// @Description Unlink an account at a provider. The last account of the provider the user signed up with cannot be unlinked before a password is set, as the user could not log in anymore.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the linked account"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /user/me/identities/{id} [delete]
+func (server *Server) UnlinkMyIdentity(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	iid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		user := models.User{}
+		fetchUser, err := user.FindUserByID(tx, tokenID)
+		if err != nil {
+			return err
+		}
+		identity := models.External_Identity{}
+		identities, err := identity.FindExternalIdentitiesByUserID(tx, tokenID)
+		if err != nil {
+			return err
+		}
+		var unlink *models.External_Identity
+		remaining := 0
+		for i := range *identities {
+			if (*identities)[i].ID == iid {
+				unlink = &(*identities)[i]
+			} else if (*identities)[i].Provider == fetchUser.Provider {
+				remaining++
+			}
+		}
+		if unlink == nil {
+			return errors.New("Identity Not Found")
+		}
+		if unlink.Provider == fetchUser.Provider && remaining == 0 && fetchUser.Password == "" {
+			return &externalLoginError{"Set a password before unlinking the account you signed up with"}
+		}
+		_, err = identity.DeleteAnExternalIdentity(tx, iid, tokenID)
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(*externalLoginError); ok {
+			responses.ERROR(w, http.StatusConflict, err)
+			return
+		}
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Entity", iid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// oauthUser returns the user the account at the provider is linked to. An
+// account not linked yet is matched by email only when the provider verified
+// it and the user signed up with the same provider; anyone could otherwise
+// take over an account by entering its email at a provider that does not
+// check it. Such users have to link the account themselves. Without a match
+// the user is created, again only from a verified email: an account created
+// from someone else's address would stay linked to the provider account
+// after its owner took it over through a password reset.
+func oauthUser(tx *gorm.DB, provider string, gothUser goth.User) (*models.User, error) {
+	if gothUser.UserID == "" {
+		return nil, &externalLoginError{"The provider did not identify the account"}
+	}
+	identity := oauthIdentity(gothUser)
+	fetchIdentity := models.External_Identity{}
+	linked, err := fetchIdentity.FindExternalIdentity(tx, provider, gothUser.UserID)
+	if err == nil {
+		user := models.User{}
+		linkedUser, err := user.FindUserByID(tx, linked.UserID)
+		if err != nil {
+			return nil, err
+		}
+		identity.ID = linked.ID
+		_, err = identity.UpdateExternalIdentity(tx)
+		if err != nil {
+			return nil, err
+		}
+		return linkedUser, nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	if gothUser.Email == "" {
+		return nil, &externalLoginError{"The provider did not share an email"}
+	}
+	user := models.User{}
+	existing, err := user.FindUserByEmail(tx, html.EscapeString(strings.TrimSpace(gothUser.Email)))
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if err == nil && (existing.Provider != provider || !oauthEmailVerified(provider, gothUser)) {
+		return nil, &externalLoginError{"An account with this email already exists, log in and link " + provider + " under /user/me/identities"}
+	}
+	if !oauthEmailVerified(provider, gothUser) {
+		return nil, &externalLoginError{"The provider has not verified the email"}
+	}
+	oauthUser, err := provisionExternalUser(tx, provider, oauthProfile(gothUser), true)
+	if err != nil {
+		return nil, err
+	}
+	identity.Prepare(oauthUser.ID, provider, gothUser.UserID)
+	_, err = identity.SaveExternalIdentity(tx)
+	if err != nil {
+		return nil, err
+	}
+	return oauthUser, nil
+}
+
+// linkOauthIdentity links the account at the provider to the user of the
+// link request.
+func linkOauthIdentity(tx *gorm.DB, provider string, uid uuid.UUID, gothUser goth.User) (*models.External_Identity, error) {
+	if gothUser.UserID == "" {
+		return nil, &externalLoginError{"The provider did not identify the account"}
+	}
+	identity := oauthIdentity(gothUser)
+	identity.Prepare(uid, provider, gothUser.UserID)
+	linked, err := identity.SaveExternalIdentity(tx)
+	if err == models.ErrIdentityLinked {
+		return nil, &externalLoginError{err.Error()}
+	}
+	return linked, err
+}
+
+func oauthIdentity(gothUser goth.User) models.External_Identity {
+	now := time.Now()
+	identity := models.External_Identity{
+		Email:        gothUser.Email,
+		AccessToken:  gothUser.AccessToken,
+		RefreshToken: gothUser.RefreshToken,
+		LastLoginAt:  &now,
+	}
+	if !gothUser.ExpiresAt.IsZero() {
+		identity.ExpiresAt = &gothUser.ExpiresAt
+	}
+	return identity
+}
+
+// oauthProfile takes the names from the profile at the provider, splitting
+// the full name when the provider has no first and last name.
+func oauthProfile(gothUser goth.User) models.User {
+	profile := models.User{
+		Email:     gothUser.Email,
+		FirstName: gothUser.FirstName,
+		LastName:  gothUser.LastName,
+	}
+	names := strings.Fields(gothUser.Name)
+	if profile.FirstName == "" && len(names) > 0 {
+		profile.FirstName = names[0]
+		names = names[1:]
+	}
+	if profile.LastName == "" && len(names) > 0 {
+		profile.LastName = strings.Join(names, " ")
+	}
+	return profile
+}
+
+// oauthEmailVerified tells whether the provider vouches for the email.
+// OpenID Connect providers say so in the email_verified claim, Google in
+// verified_email. GitHub only hands out verified emails.
+func oauthEmailVerified(provider string, gothUser goth.User) bool {
+	if provider == "github" {
+		return true
+	}
+	for _, claim := range []string{"email_verified", "verified_email"} {
+		switch verified := gothUser.RawData[claim].(type) {
+		case bool:
+			return verified
+		case string:
+			return verified == "true"
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/markbates/goth"
+)
+
+func TestIdentityLinkBrowser(t *testing.T) {
+	browser, browserHash, err := utils.SecureToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &models.Oauth_Request{BrowserHash: browserHash}
+
+	callback := func(cookie string) *http.Request {
+		r := httptest.NewRequest("GET", "/auth/github/callback?state=s", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: identityLinkCookie, Value: cookie})
+		}
+		return r
+	}
+	if !identityLinkBrowser(callback(browser), request) {
+		t.Error("The browser that started the link is refused")
+	}
+	// A victim opening a link URL sent by someone else has no cookie, or
+	// one of their own link.
+	other, _, _ := utils.SecureToken()
+	for _, cookie := range []string{"", other} {
+		if identityLinkBrowser(callback(cookie), request) {
+			t.Errorf("The cookie %q completes the link", cookie)
+		}
+	}
+	// Requests stored before links were bound to a browser are refused.
+	if identityLinkBrowser(callback(browser), &models.Oauth_Request{}) {
+		t.Error("A link request without a browser is accepted")
+	}
+}
+
+func TestOauthUserRefusesUnverifiedEmail(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// Nobody has the address yet, an account created from it would let
+	// whoever entered it at the provider into the account of its owner.
+	mock.ExpectQuery(`SELECT \* FROM "external_identities" WHERE \(provider = \$1 AND subject = \$2\)`).
+		WithArgs("corp", "subject-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT \* FROM "users" WHERE \(email = \$1\)`).
+		WithArgs("victim@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+
+	gothUser := goth.User{UserID: "subject-1", Email: "victim@example.com", RawData: map[string]interface{}{"email_verified": false}}
+	if _, err := oauthUser(db, "corp", gothUser); err == nil || err.Error() != "The provider has not verified the email" {
+		t.Errorf("oauthUser with an unverified email = %v", err)
+	}
+}
+
+func TestOauthEmailVerified(t *testing.T) {
+	tests := []struct {
+		provider string
+		rawData  map[string]interface{}
+		want     bool
+	}{
+		{"github", nil, true},
+		{"corp", map[string]interface{}{"email_verified": true}, true},
+		{"corp", map[string]interface{}{"email_verified": "true"}, true},
+		{"google", map[string]interface{}{"verified_email": true}, true},
+		{"corp", map[string]interface{}{"email_verified": false}, false},
+		{"corp", map[string]interface{}{"email_verified": "false"}, false},
+		{"corp", map[string]interface{}{}, false},
+	}
+	for _, tt := range tests {
+		if got := oauthEmailVerified(tt.provider, goth.User{RawData: tt.rawData}); got != tt.want {
+			t.Errorf("oauthEmailVerified(%s, %v) = %v, want %v", tt.provider, tt.rawData, got, tt.want)
+		}
+	}
+}
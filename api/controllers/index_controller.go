@@ -3,9 +3,11 @@ package controllers
 import (
 	"html/template"
 	"net/http"
-	"sort"
+	"net/url"
 
 	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
+	"github.com/google/uuid"
 )
 
 type ProviderIndex struct {
@@ -25,23 +27,34 @@ func (server *Server) Heartbeat(w http.ResponseWriter, r *http.Request) {
 	responses.JSON(w, http.StatusOK, "Welcome To This Awesome User Manegement API. I am live!!")
 }
 
+// IndexPage lists login links for the OAuth providers. The device_id and
+// redirect_uri of its query are passed on to /auth/{provider}; without a
+// device_id the login is for a new device, whose ID comes back from
+// /auth/token.
 func (server *Server) IndexPage(w http.ResponseWriter, r *http.Request) {
-	m := make(map[string]string)
-	m["github"] = "Github"
-	m["google"] = "Google"
+	keys, m := sso.ProviderNames()
+	providerIndex := &ProviderIndex{Providers: keys, ProvidersMap: m}
 
-	var keys []string
-	for k := range m {
-		keys = append(keys, k)
+	query := url.Values{}
+	query.Set("device_id", r.URL.Query().Get("device_id"))
+	if query.Get("device_id") == "" {
+		query.Set("device_id", uuid.New().String())
+	}
+	if redirectURI := r.URL.Query().Get("redirect_uri"); redirectURI != "" {
+		query.Set("redirect_uri", redirectURI)
+	}
+	links := map[string]string{}
+	for _, provider := range keys {
+		links[provider] = "/auth/" + url.PathEscape(provider) + "?" + query.Encode()
 	}
-	sort.Strings(keys)
-
-	providerIndex := &ProviderIndex{Providers: keys, ProvidersMap: m}
 
 	var indexTemplate = `{{range $key,$value:=.Providers}}
-    	<p><a href="/auth/{{$value}}">Log in with {{index $.ProvidersMap $value}}</a></p>
+    	<p><a href="{{index $.Links $value}}">Log in with {{index $.ProvidersMap $value}}</a></p>
 		{{end}}`
 
 	t, _ := template.New("foo").Parse(indexTemplate)
-	t.Execute(w, providerIndex)
+	t.Execute(w, struct {
+		*ProviderIndex
+		Links map[string]string
+	}{providerIndex, links})
 }
@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/github"
+)
+
+func TestIndexPageLinks(t *testing.T) {
+	goth.UseProviders(github.New("key", "secret", "https://id.example.com/auth/github/callback"))
+	defer goth.ClearProviders()
+	server := &Server{}
+
+	w := httptest.NewRecorder()
+	server.IndexPage(w, httptest.NewRequest("GET", "/?device_id=d-1&redirect_uri=https://app.example.com/login", nil))
+	want := `href="/auth/github?device_id=d-1&amp;redirect_uri=https%3A%2F%2Fapp.example.com%2Flogin"`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Index page %s, want a link %s", w.Body.String(), want)
+	}
+
+	// Without one the login is for a new device.
+	w = httptest.NewRecorder()
+	server.IndexPage(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), `href="/auth/github?device_id=`) || strings.Contains(w.Body.String(), "device_id=&amp;") {
+		t.Errorf("Index page %s links without a device_id", w.Body.String())
+	}
+}
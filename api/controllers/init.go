@@ -5,15 +5,22 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/breach"
+	"bitbucket.org/staydigital/truvest-identity-management/api/broker"
+	"bitbucket.org/staydigital/truvest-identity-management/api/directory"
+	"bitbucket.org/staydigital/truvest-identity-management/api/events"
+	"bitbucket.org/staydigital/truvest-identity-management/api/geoip"
+	"bitbucket.org/staydigital/truvest-identity-management/api/middleware"
 	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
 	"github.com/ReneKroon/ttlcache/v2"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres" //postgres database driver
-	"github.com/markbates/goth"
-	"github.com/markbates/goth/providers/github"
-	"github.com/markbates/goth/providers/google"
 	"github.com/rs/cors"
 )
 
@@ -40,21 +47,109 @@ func (server *Server) Initialize(Dbdriver, DbUser, DbPassword, DbPort, DbHost, D
 
 	server.TTLCache = ttlcache.NewCache()
 
-	goth.UseProviders(
-		google.New(os.Getenv("GOOGLE_KEY"), os.Getenv("GOOGLE_SECRET"), appProtocol + "://" + appHost + ":" + appPort + "/auth/google/callback"),
-		github.New(os.Getenv("GITHUB_KEY"), os.Getenv("GITHUB_SECRET"), appProtocol + "://" + appHost + ":" + appPort + "/auth/github/callback"),
-	)
+	if indexPath := os.Getenv("BREACHED_PASSWORD_INDEX"); indexPath != "" {
+		err = breach.Load(indexPath, os.Getenv("BREACHED_PASSWORD_INDEX_IN_MEMORY") == "true")
+		if err != nil {
+			log.Fatal("Cannot load the breached password index:", err)
+		}
+		fmt.Println("Breached password index loaded from " + indexPath)
+	}
+	if mode := breach.ParseMode(os.Getenv("BREACHED_PASSWORD_CHECK")); mode != breach.Off && !breach.Loaded() {
+		log.Fatalf("BREACHED_PASSWORD_CHECK=%s needs a BREACHED_PASSWORD_INDEX", mode)
+	}
+	if (models.MagicLinkEnabled() || models.LoginStepUpEnabled()) && models.MagicLinkURL() == "" {
+		log.Fatal("MAGIC_LINK_ENABLED and SUSPICIOUS_LOGIN_STEP_UP need a MAGIC_LINK_URL")
+	}
+
+	if geoipPath := os.Getenv("GEOIP_DATABASE"); geoipPath != "" {
+		err = geoip.Load(geoipPath)
+		if err != nil {
+			log.Fatal("Cannot load the GeoIP database:", err)
+		}
+		fmt.Println("GeoIP database loaded from " + geoipPath)
+	}
 
-	server.DB.Debug().AutoMigrate(&models.User{}, &models.Role{}, &models.User_Role{}, &models.Permission{}, &models.Role_Permission{}, models.User_Device{}, models.Refresh_Token{}) //database migration
+	sinks, err := events.SinksFromEnv()
+	if err != nil {
+		log.Fatal("Cannot configure the event sinks:", err)
+	}
+	events.Start(sinks, events.BufferFromEnv())
+
+	outboxBroker, err := broker.FromEnv()
+	if err != nil {
+		log.Fatal("Cannot connect to the outbox broker:", err)
+	}
+
+	directoryConfig, err := directory.ConfigFromEnv()
+	if err != nil {
+		log.Fatal("Cannot configure the LDAP directory:", err)
+	}
+	directory.Configure(directoryConfig)
+
+	if samlCert := os.Getenv("SAML_SP_CERT"); samlCert != "" {
+		err = sso.LoadSAMLKeyPair(samlCert, os.Getenv("SAML_SP_KEY"))
+		if err != nil {
+			log.Fatal("Cannot load the SAML key pair:", err)
+		}
+	}
+
+	server.DB.Debug().AutoMigrate(&models.User{}, &models.Role{}, &models.User_Role{}, &models.Permission{}, &models.Role_Permission{}, models.User_Device{}, models.Refresh_Token{}, &models.Invitation{}, &models.Magic_Link{}, &models.Password_Reset{}, &models.Password_History{}, &models.Login_Throttle{}, &models.Rate_Limit_Bucket{}, &models.Login_Event{}, &models.Login_Alert{}, &models.Audit_Event{}, &models.Ledger_Entry{}, &models.Ledger_Checkpoint{}, &models.Webhook_Subscription{}, &models.Webhook_Delivery{}, &models.Outbox_Message{}, &models.Scim_Token{}, &models.Saml_Provider{}, &models.Saml_Request{}, &models.Oidc_Provider{}, &models.Oauth_Request{}, &models.External_Identity{}, &models.Oauth_Code{}, &models.Role_Mapping_Rule{}, &models.Group{}, &models.Group_Member{}, &models.Group_Role{}, &models.Role_Assignment{}) //database migration
+
+	err = models.MigratePasswordColumn(server.DB)
+	if err != nil {
+		log.Fatal("Cannot widen the password column:", err)
+	}
+	err = models.EnforceAuditAppendOnly(server.DB)
+	if err != nil {
+		log.Fatal("Cannot protect the audit log:", err)
+	}
+	err = models.EnforceLedger(server.DB)
+	if err != nil {
+		log.Fatal("Cannot install the audit ledger:", err)
+	}
+	err = models.MigratePermissionNamespace(server.DB)
+	if err != nil {
+		log.Fatal("Cannot move the permissions into their namespace:", err)
+	}
+
+	err = configureOAuthSessions()
+	if err != nil {
+		log.Fatal("Cannot configure the OAuth sessions:", err)
+	}
+	_, err = server.loadOAuthProviders()
+	if err != nil {
+		log.Fatal("Cannot load the OAuth providers:", err)
+	}
+
+	auth.SetSessionRevocationLookup(func(uid uuid.UUID) (*time.Time, error) {
+		return models.SessionsRevokedSince(server.DB, uid)
+	})
+
+	if os.Getenv("RATE_LIMIT_STORE") == "database" {
+		middleware.SetRateLimitStore(newDatabaseRateLimitStore(server.DB))
+	}
+
+	go server.pruneLoginHistory()
+	go server.checkpointLedger()
+	go server.deliverWebhooks()
+	if outboxBroker != nil {
+		go server.relayOutbox(outboxBroker)
+	}
 
 	server.Router = mux.NewRouter()
 
 	server.initializeRoutes()
 }
 
+// serviceURL builds an absolute link to this service from the APP_* settings.
+func serviceURL(path string) string {
+	return os.Getenv("APP_PROTOCOL") + "://" + os.Getenv("APP_HOST") + ":" + os.Getenv("APP_PORT") + path
+}
+
 func (server *Server) Run(addr string, allowedOrigins []string) {
 	c := cors.New(cors.Options{
 		AllowedOrigins: allowedOrigins,
+		ExposedHeaders: []string{"Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 	})
 
 	fmt.Println("Listening to port "+addr)
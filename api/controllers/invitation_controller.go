@@ -0,0 +1,317 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// CreateInvitation godoc
+// @Summary Invite a user to the system
+// @Description Invite a user to the system. An email with a single-use link is sent to the invitee, who sets their own password on the accept page. The roles passed are assigned once the invitation is accepted. In order to access this API, someone must have "USERS_CREATE" Permission tagged to its role.
+// @Tags Invitation
+// @Accept  json
+// @Produce  json
+// @Param invitation body models.CreateInvitation true "Create Invitation"
+// @Success 201 {object} models.Invitation
+// @Security ApiKeyAuth
+// @Router /invitations [post]
+func (server *Server) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_CREATE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.CreateInvitation{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	role := models.Role{}
+	roles, err := role.FindRolesByIDs(server.DB, payload.Roles)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	token, tokenHash, err := utils.SecureToken()
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	invitation := models.Invitation{
+		Email:     payload.Email,
+		UserName:  payload.UserName,
+		FirstName: payload.FirstName,
+		LastName:  payload.LastName,
+		Roles:     roles,
+	}
+	invitation.Prepare(tokenID, tokenHash)
+	err = invitation.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user := models.User{}
+	if existing, _ := user.FindUserByEmail(server.DB, invitation.Email); len(existing.Email) > 0 {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Email Already Taken"))
+		return
+	}
+	invitationCreated, err := invitation.SaveInvitation(server.DB)
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	err = sendInvitationEmail(invitationCreated, token)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%s", r.Host, r.RequestURI, invitationCreated.ID))
+	responses.JSON(w, http.StatusCreated, invitationCreated)
+}
+
+// GetInvitations godoc
+// @Summary Get all pending invitations in the system
+// @Description Get all invitations that are neither accepted, revoked nor expired. In order to access this API, someone must have "USERS_VIEW" Permission tagged to its role.
+// @Tags Invitation
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.Invitation
+// @Security ApiKeyAuth
+// @Router /invitations [get]
+func (server *Server) GetInvitations(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	invitation := models.Invitation{}
+	invitations, err := invitation.FindPendingInvitations(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, invitations)
+}
+
+// ResendInvitation godoc
+// @Summary Resend a pending invitation
+// @Description Resend a pending invitation by ID. A fresh link is emailed and the previous link stops working. In order to access this API, someone must have "USERS_CREATE" Permission tagged to its role.
+// @Tags Invitation
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the invitation"
+// @Success 200 {object} models.Invitation
+// @Security ApiKeyAuth
+// @Router /invitations/{id}/resend [post]
+func (server *Server) ResendInvitation(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_CREATE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	iid, err := uuid.Parse(vars["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	fetchInvitation := models.Invitation{}
+	invitation, err := fetchInvitation.FindInvitationByID(server.DB, iid)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	token, tokenHash, err := utils.SecureToken()
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	renewed, err := invitation.RenewInvitation(server.DB, tokenHash, tokenID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	err = sendInvitationEmail(renewed, token)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, renewed)
+}
+
+// RevokeInvitation godoc
+// @Summary Revoke a pending invitation
+// @Description Revoke a pending invitation by ID so that its link can no longer be used. In order to access this API, someone must have "USERS_CREATE" Permission tagged to its role.
+// @Tags Invitation
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the invitation"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /invitations/{id} [delete]
+func (server *Server) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_CREATE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	iid, err := uuid.Parse(vars["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	invitation := models.Invitation{}
+	err = invitation.RevokeInvitation(server.DB, iid, tokenID)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Entity", iid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// AcceptInvitationPage renders the page on which an invitee chooses a
+// password. The token is only checked when the form is submitted.
+func (server *Server) AcceptInvitationPage(w http.ResponseWriter, r *http.Request) {
+	t, err := template.ParseFiles("./html/invitation_accept.html")
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		Token string
+	}{
+		Token: r.URL.Query().Get("token"),
+	})
+}
+
+// AcceptInvitation godoc
+// @Summary Accept an invitation and set the password
+// @Description Accept an invitation using the token from the invitation email. The user account is created with the given password and the roles chosen by the inviter. The token can only be used once.
+// @Tags Invitation
+// @Accept  json
+// @Produce  json
+// @Param invitation body models.Accept_Invitation_Payload true "Accept Invitation"
+// @Success 201 {object} models.UserResponse
+// @Router /invitations/accept [post]
+func (server *Server) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	accept := models.Accept_Invitation_Payload{}
+	err = json.Unmarshal(body, &accept)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	fetchInvitation := models.Invitation{}
+	invitation, err := fetchInvitation.FindInvitationByToken(server.DB, utils.HashToken(accept.Token))
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	userCreated, err := invitation.AcceptInvitation(server.DB, accept.Password)
+	if _, ok := err.(*models.PasswordPolicyError); ok {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, models.PrepareResponse(userCreated))
+}
+
+func sendInvitationEmail(invitation *models.Invitation, token string) error {
+	sm := models.SendMail{}
+	sm.Email = invitation.Email
+	link := serviceURL("/invitations/accept?token=" + url.QueryEscape(token))
+	return sm.SendLinkEmail(
+		"You have been invited",
+		"Welcome "+invitation.FirstName,
+		"You have been invited to create an account. Follow the link below to choose your password. The link can be used once and expires on "+invitation.ExpiresAt.Format("02 Jan 2006 15:04 MST")+".",
+		link,
+		"Accept Invitation",
+	)
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"html"
+	"log"
+	"net/http"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/directory"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"github.com/jinzhu/gorm"
+)
+
+// directorySignIn checks the password against the LDAP directory and returns
+// the email of the account to sign in. The account is created on the first
+// login and its profile and directory mapped roles follow the directory on
+// every login.
+func (server *Server) directorySignIn(r *http.Request, login string, password string) (string, error) {
+	entry, roleNames, err := directory.Login(login, password)
+	if err == directory.ErrInvalidCredentials {
+		server.recordDirectoryFailure(login)
+		return "", models.ErrPasswordMismatch
+	}
+	if err != nil {
+		log.Printf("LDAP login of %s failed: %v", login, err)
+		return "", &externalLoginError{"The directory is not available"}
+	}
+	if entry.Email == "" {
+		return "", &externalLoginError{"The directory entry has no email"}
+	}
+
+	var user *models.User
+	var audits []*models.Audit_Event
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		profile := models.User{
+			UserName:  entry.UserName,
+			FirstName: entry.FirstName,
+			LastName:  entry.LastName,
+			Email:     entry.Email,
+		}
+		var err error
+		user, err = provisionExternalUser(tx, "ldap", profile, directory.CreatesUsers())
+		if err != nil {
+			return err
+		}
+		audits, err = syncDirectoryRoles(tx, r, user, roleNames)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, event := range audits {
+		publishAuditEvent(event, "")
+	}
+	return user.Email, nil
+}
+
+// syncDirectoryRoles gives the user the mapped roles of its directory groups
+// and takes away the mapped roles it lost. Roles no group maps to and roles
+// granted otherwise are left alone, they are managed through /roles.
+func syncDirectoryRoles(tx *gorm.DB, r *http.Request, user *models.User, roleNames []string) ([]*models.Audit_Event, error) {
+	mapped := []string{}
+	for _, name := range directory.MappedRoles() {
+		mapped = append(mapped, html.EscapeString(name))
+	}
+	role := models.Role{}
+	roles, err := role.FindRolesByNames(tx, mapped)
+	if err != nil {
+		return nil, err
+	}
+	return syncMappedRoles(tx, r, user.ID, models.RoleSourceDirectory, roles, func(role *models.Role) bool {
+		for _, name := range roleNames {
+			if html.EscapeString(name) == role.Name {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// recordDirectoryFailure counts a wrong directory password against the
+// account, so that the lockout applies to directory logins as well.
+func (server *Server) recordDirectoryFailure(login string) {
+	user := models.User{}
+	err := server.DB.Debug().Model(models.User{}).Where("provider = ? AND (email = ? OR user_name = ?)", "ldap", login, login).Take(&user).Error
+	if err != nil {
+		return
+	}
+	locked, err := user.RecordFailedLogin(server.DB)
+	if err != nil {
+		log.Printf("Cannot record failed login of user %s: %v", user.ID, err)
+	}
+	if locked {
+		sendLockoutEmail(&user)
+	}
+}
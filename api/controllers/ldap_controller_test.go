@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/directory"
+	"bitbucket.org/staydigital/truvest-identity-management/api/directory/directorytest"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// newMockDB opens gorm on a mocked connection, the expected statements are
+// checked when the test ends.
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.LogMode(false)
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return db, mock
+}
+
+// setEnv sets an environment variable for the duration of the test.
+func setEnv(t *testing.T, key string, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// configureTestDirectory points the directory login at an in-process
+// directory where jane is in the admins and auditors groups, which map to
+// the Administrator and Auditor roles. The Other role is mapped too.
+func configureTestDirectory(t *testing.T) *directorytest.Server {
+	t.Helper()
+	server := directorytest.NewServer(
+		&directorytest.Entry{DN: "uid=jane,ou=people,dc=example,dc=com", Attributes: map[string][]string{
+			"objectClass":  {"person"},
+			"uid":          {"jane"},
+			"mail":         {"jane@example.com"},
+			"givenName":    {"Jane"},
+			"sn":           {"Doe"},
+			"memberOf":     {"cn=admins,ou=groups,dc=example,dc=com", "cn=auditors,ou=groups,dc=example,dc=com"},
+			"userPassword": {"s3cret"},
+		}},
+	)
+	t.Cleanup(server.Close)
+	directory.Configure(&directory.Config{
+		URL:                server.URL,
+		Timeout:            5 * time.Second,
+		UserBase:           "ou=people,dc=example,dc=com",
+		UserFilter:         "(&(objectClass=person)(uid={login}))",
+		UserNameAttribute:  "uid",
+		EmailAttribute:     "mail",
+		FirstNameAttribute: "givenName",
+		LastNameAttribute:  "sn",
+		GroupsAttribute:    "memberOf",
+		GroupRoles: map[string][]string{
+			"cn=admins,ou=groups,dc=example,dc=com":   {"Administrator"},
+			"cn=auditors,ou=groups,dc=example,dc=com": {"Auditor"},
+			"cn=others,ou=groups,dc=example,dc=com":   {"Other"},
+		},
+		CreateUsers: true,
+	})
+	t.Cleanup(func() { directory.Configure(nil) })
+	setEnv(t, "OUTBOX_BROKER", "")
+	return server
+}
+
+var userColumns = []string{"id", "user_name", "first_name", "last_name", "email", "enabled", "provider"}
+
+// expectEvent expects the webhook lookup of one published event, without
+// subscriptions.
+func expectEvent(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT \* FROM "webhook_subscriptions"`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+}
+
+// expectRoleSync expects the audit event of a role a login gave or took away.
+func expectRoleSync(mock sqlmock.Sqlmock, action string) {
+	mock.ExpectQuery(`INSERT INTO "audit_events"`).
+		WithArgs(sqlmock.AnyArg(), nil, action, "role", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+}
+
+// expectMappedRoles expects the lookup of the mapped roles.
+func expectMappedRoles(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT \* FROM "roles" WHERE \(name in \(\$1,\$2,\$3\)\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).
+			AddRow(1, "Administrator").
+			AddRow(2, "Auditor").
+			AddRow(3, "Other"))
+}
+
+func TestDirectorySignInCreatesUser(t *testing.T) {
+	configureTestDirectory(t)
+	db, mock := newMockDB(t)
+	server := &Server{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT \* FROM "users" WHERE \(email = \$1\)`).
+		WithArgs("jane@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectQuery(`INSERT INTO "users"`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+	mock.ExpectQuery(`SELECT "failed_login_count", "password_reset_required" FROM "users"`).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_login_count", "password_reset_required"}).AddRow(0, false))
+	expectEvent(mock)
+	expectMappedRoles(mock)
+	mock.ExpectQuery(`SELECT \* FROM "user_roles" WHERE \(user_id = \$1\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id", "source"}))
+	for _, rid := range []int64{1, 2} {
+		mock.ExpectExec(`INSERT INTO "user_roles" \("user_id","role_id","source"\)`).
+			WithArgs(sqlmock.AnyArg(), rid, models.RoleSourceDirectory).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectEvent(mock)
+		expectRoleSync(mock, "role.sync_add_user")
+	}
+	mock.ExpectCommit()
+
+	email, err := server.directorySignIn(httptest.NewRequest("POST", "/login", nil), "jane", "s3cret")
+	if err != nil || email != "jane@example.com" {
+		t.Fatalf("directorySignIn = %q, %v", email, err)
+	}
+}
+
+// expectJane expects the lookup of Jane's account with the roles she holds.
+func expectJane(mock sqlmock.Sqlmock, uid uuid.UUID, roles ...string) {
+	mock.ExpectQuery(`SELECT \* FROM "users" WHERE \(email = \$1\)`).
+		WithArgs("jane@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(uid, "jane", "Jane", "Doe", "jane@example.com", true, "ldap"))
+	rids := map[string]int{"Administrator": 1, "Auditor": 2, "Other": 3, "Support": 4}
+	rows := sqlmock.NewRows([]string{"id", "name", "user_id", "role_id"})
+	for _, name := range roles {
+		rows.AddRow(rids[name], name, uid, rids[name])
+	}
+	mock.ExpectQuery(`SELECT \* FROM "roles" INNER JOIN "user_roles" .* WHERE \("user_roles"."user_id" IN \(\$1\)\)`).
+		WithArgs(uid).
+		WillReturnRows(rows)
+	if len(roles) > 0 {
+		mock.ExpectQuery(`SELECT \* FROM "permissions" INNER JOIN "role_permissions"`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "role_id", "permission_id"}))
+	}
+}
+
+func TestDirectorySignInSyncsRoles(t *testing.T) {
+	configureTestDirectory(t)
+	db, mock := newMockDB(t)
+	server := &Server{DB: db}
+	uid := uuid.New()
+
+	// The directory granted Jane Administrator and Other, an admin granted
+	// her Support. She gets Auditor, loses Other and keeps Support.
+	mock.ExpectBegin()
+	expectJane(mock, uid, "Administrator", "Other", "Support")
+	expectMappedRoles(mock)
+	mock.ExpectQuery(`SELECT \* FROM "user_roles" WHERE \(user_id = \$1\)`).
+		WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id", "source"}).
+			AddRow(uid, 1, models.RoleSourceDirectory).
+			AddRow(uid, 3, models.RoleSourceDirectory).
+			AddRow(uid, 4, models.RoleSourceManual))
+	mock.ExpectExec(`INSERT INTO "user_roles" \("user_id","role_id","source"\)`).
+		WithArgs(uid, int64(2), models.RoleSourceDirectory).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock)
+	expectRoleSync(mock, "role.sync_add_user")
+	mock.ExpectExec(`DELETE FROM "user_roles" WHERE \(role_id = \$1 and user_id = \$2 and source = \$3\)`).
+		WithArgs(int64(3), uid, models.RoleSourceDirectory).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock)
+	expectRoleSync(mock, "role.sync_remove_user")
+	mock.ExpectCommit()
+
+	email, err := server.directorySignIn(httptest.NewRequest("POST", "/login", nil), "jane", "s3cret")
+	if err != nil || email != "jane@example.com" {
+		t.Fatalf("directorySignIn = %q, %v", email, err)
+	}
+}
+
+func TestDirectorySignInKeepsManualRoles(t *testing.T) {
+	configureTestDirectory(t)
+	db, mock := newMockDB(t)
+	server := &Server{DB: db}
+	uid := uuid.New()
+
+	// An admin granted Jane Auditor and Other. Her auditors group does not
+	// add Auditor a second time, and Other stays although no group of hers
+	// maps to it. Only Administrator changes.
+	mock.ExpectBegin()
+	expectJane(mock, uid, "Auditor", "Other")
+	expectMappedRoles(mock)
+	mock.ExpectQuery(`SELECT \* FROM "user_roles" WHERE \(user_id = \$1\)`).
+		WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id", "source"}).
+			AddRow(uid, 2, models.RoleSourceManual).
+			AddRow(uid, 3, models.RoleSourceManual))
+	mock.ExpectExec(`INSERT INTO "user_roles" \("user_id","role_id","source"\)`).
+		WithArgs(uid, int64(1), models.RoleSourceDirectory).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectEvent(mock)
+	expectRoleSync(mock, "role.sync_add_user")
+	mock.ExpectCommit()
+
+	email, err := server.directorySignIn(httptest.NewRequest("POST", "/login", nil), "jane", "s3cret")
+	if err != nil || email != "jane@example.com" {
+		t.Fatalf("directorySignIn = %q, %v", email, err)
+	}
+}
+
+func TestDirectorySignInWrongPassword(t *testing.T) {
+	configureTestDirectory(t)
+	db, mock := newMockDB(t)
+	server := &Server{DB: db}
+
+	// The failure counts against the local account, there is none here.
+	mock.ExpectQuery(`SELECT \* FROM "users" WHERE \(provider = \$1 AND \(email = \$2 OR user_name = \$3\)\)`).
+		WithArgs("ldap", "jane", "jane").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+
+	if _, err := server.directorySignIn(httptest.NewRequest("POST", "/login", nil), "jane", "wrong"); err != models.ErrPasswordMismatch {
+		t.Errorf("directorySignIn with a wrong password = %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+)
+
+// VerifyLedger godoc
+// @Summary Verify the audit ledger
+// @Description Walk the hash-chained ledger of changes to users, roles, permissions and their assignments, and report the first broken link. Checkpoint signatures are checked when LEDGER_VERIFY_KEY or LEDGER_SIGNING_KEY is configured. In order to access this API, someone must have "AUDIT_VIEW" Permission tagged to its role.
+// @Tags Audit
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.LedgerVerification
+// @Security ApiKeyAuth
+// @Router /audit-ledger/verify [get]
+func (server *Server) VerifyLedger(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"AUDIT_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	publicKey, err := models.LedgerVerifyKey()
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	verification, err := models.VerifyLedger(server.DB, publicKey)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, verification)
+}
+
+// checkpointLedger signs the head of the ledger every
+// LEDGER_CHECKPOINT_INTERVAL_MINUTES. It does nothing without a signing key.
+func (server *Server) checkpointLedger() {
+	signingKey, err := models.LedgerSigningKey()
+	if err != nil {
+		log.Printf("Ledger checkpoints are disabled: %v", err)
+		return
+	}
+	if signingKey == nil {
+		log.Print("Ledger checkpoints are disabled, LEDGER_SIGNING_KEY is not set")
+		return
+	}
+	for {
+		checkpoint := models.Ledger_Checkpoint{}
+		if _, err := checkpoint.SaveLedgerCheckpoint(server.DB, signingKey); err != nil {
+			log.Printf("Cannot checkpoint the ledger: %v", err)
+		}
+		time.Sleep(models.LedgerCheckpointInterval())
+	}
+}
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/geoip"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+)
+
+// DenyLoginPage renders the "this wasn't me" page linked from login alerts.
+// The token is only checked when the page is confirmed.
+func (server *Server) DenyLoginPage(w http.ResponseWriter, r *http.Request) {
+	t, err := template.ParseFiles("./html/login_alert_deny.html")
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		Token string
+	}{
+		Token: r.URL.Query().Get("token"),
+	})
+}
+
+// DenyLogin godoc
+// @Summary Report a login as not made by the account owner
+// @Description Answer a suspicious login alert with "this wasn't me" using the token from the alert email. Every session of the account is ended and the password has to be reset through the forgot password flow before it can be used to log in again. The token can only be used once.
+// @Tags Login
+// @Accept  json
+// @Produce  json
+// @Param deny body models.Deny_Login_Payload true "Deny Login"
+// @Success 200 {object} string
+// @Router /login-alerts/deny [post]
+func (server *Server) DenyLogin(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	deny := models.Deny_Login_Payload{}
+	err = json.Unmarshal(body, &deny)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if deny.Token == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Invalid or expired link"))
+		return
+	}
+	alert := models.Login_Alert{}
+	denied, err := alert.DenyLogin(server.DB, utils.HashToken(deny.Token))
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	user := models.User{}
+	fetchUser, err := user.FindUserByID(server.DB, denied.UserID)
+	if err == nil {
+		err = sendPasswordResetLink(server, fetchUser, "You told us a recent login to your account was not you. We ended all sessions and your password can no longer be used to log in. Follow the link below to choose a new one.")
+		if err != nil {
+			log.Printf("Cannot send password reset email to user %s: %v", fetchUser.ID, err)
+		}
+	}
+	responses.JSON(w, http.StatusOK, "All sessions have been ended. Please reset your password with the link we have emailed you.")
+}
+
+// checkLoginRisk looks for signs that a successful password login was not
+// made by the account owner. Risky logins need step-up verification when
+// SUSPICIOUS_LOGIN_STEP_UP is set, otherwise the user is alerted by email.
+// Magic links and OAuth logins already prove access to the mailbox or the
+// provider account and are not checked. Failing checks are logged and never
+// block the login, but a login needing step-up verification fails when the
+// link cannot be sent.
+func (server *Server) checkLoginRisk(r *http.Request, user *models.User, deviceID string) error {
+	if !models.SuspiciousLoginDetectionEnabled() {
+		return nil
+	}
+	ip := utils.ClientIP(r)
+	event := models.Login_Event{}
+	risk, err := event.AssessLoginRisk(server.DB, user.ID, ip, deviceID, time.Now())
+	if err != nil {
+		log.Printf("Cannot assess login risk of user %s: %v", user.ID, err)
+		return nil
+	}
+	if !risk.Risky() {
+		return nil
+	}
+
+	if models.LoginStepUpEnabled() {
+		err = sendStepUpLink(server, user, deviceID)
+		if err != nil {
+			log.Printf("Cannot send step-up link to user %s: %v", user.ID, err)
+			return err
+		}
+		server.recordLoginEvent(r, models.LoginEventMFAChallenge, user, user.Email, user.Provider, deviceID, nil)
+		return &models.StepUpRequiredError{Risk: risk}
+	}
+
+	token, tokenHash, err := utils.SecureToken()
+	if err != nil {
+		log.Printf("Cannot create login alert for user %s: %v", user.ID, err)
+		return nil
+	}
+	alert := models.Login_Alert{}
+	alert.Prepare(user.ID, deviceID, ip, risk, tokenHash)
+	err = alert.SaveLoginAlert(server.DB)
+	if err != nil {
+		log.Printf("Cannot save login alert for user %s: %v", user.ID, err)
+		return nil
+	}
+	err = sendLoginAlertEmail(user, &alert, r.UserAgent(), token)
+	if err != nil {
+		log.Printf("Cannot send login alert to user %s: %v", user.ID, err)
+	}
+	return nil
+}
+
+// sendStepUpLink emails a magic link bound to the device of the risky login.
+// Consuming it completes the login.
+func sendStepUpLink(server *Server, user *models.User, deviceID string) error {
+	token, tokenHash, err := utils.SecureToken()
+	if err != nil {
+		return err
+	}
+	magicLink := models.Magic_Link{}
+	magicLink.Prepare(user.ID, deviceID, tokenHash)
+	err = magicLink.SaveMagicLink(server.DB)
+	if err != nil {
+		return err
+	}
+	sm := models.SendMail{}
+	sm.Email = user.Email
+	return sm.SendLinkEmail(
+		"Verify your login",
+		"Hello "+user.FirstName,
+		"We noticed a login to your account that looks different from your usual ones. If it was you, follow the link below on the same device to finish logging in. The link expires on "+magicLink.ExpiresAt.Format("02 Jan 2006 15:04 MST")+". If it was not you, change your password.",
+		magicLinkURL(token),
+		"Verify Login",
+	)
+}
+
+func sendLoginAlertEmail(user *models.User, alert *models.Login_Alert, userAgent string, token string) error {
+	where := alert.IPAddress
+	if location, ok := geoipLocation(alert.IPAddress); ok {
+		where += " (" + location + ")"
+	}
+	sm := models.SendMail{}
+	sm.Email = user.Email
+	return sm.SendLinkEmail(
+		"New login to your account",
+		"Hello "+user.FirstName,
+		"Your account was just used to log in from "+where+" with "+userAgent+" on "+alert.CreatedAt.Format("02 Jan 2006 15:04 MST")+", which looks unusual ("+alert.Reasons+"). If this was you, there is nothing to do. If not, follow the link below to end all sessions and reset your password.",
+		serviceURL("/login-alerts/deny?token="+url.QueryEscape(token)),
+		"This Wasn't Me",
+	)
+}
+
+func geoipLocation(ip string) (string, bool) {
+	location, ok := geoip.Lookup(ip)
+	if !ok {
+		return "", false
+	}
+	parts := []string{}
+	if location.City != "" {
+		parts = append(parts, location.City)
+	}
+	if location.Country != "" {
+		parts = append(parts, location.Country)
+	}
+	return strings.Join(parts, ", "), len(parts) > 0
+}
@@ -5,24 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/directory"
 	"bitbucket.org/staydigital/truvest-identity-management/api/models"
 	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
 	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
 	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
 	"github.com/ReneKroon/ttlcache/v2"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/jinzhu/gorm"
 )
 
 type Login struct {
 	Email     	string    	`gorm:"size:100;not null;unique" json:"email"`
 	Password  	string    	`gorm:"size:100;not null;" json:"password,omitempty"`
 	DeviceID 	string 		`gorm:"size:255;not null;" json:"device_id"`
+	Provider	string		`json:"provider,omitempty"`
 }
 
 type Refresh struct {
@@ -35,7 +39,7 @@ type Logout struct {
 
 // SignUp godoc
 // @Summary Signup as a user in the system
-// @Description Signup as a user in the system. If Password is not passed while creating User, then it creates User with auto-generated password. The Password is then sent through Email.
+// @Description Signup as a user in the system. The Password chosen by the user is required.
 // @Tags SignUp
 // @Accept  json
 // @Produce  json
@@ -54,19 +58,25 @@ func (server *Server) SignUp(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	var password string
 	if user.Password == "" {
-		password = utils.RandSeq()
-		user.Password = password
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Password"))
+		return
 	}
-	fmt.Printf("New Auto-generated User Password: %s", password)
 	user.PrepareSignUp()
 	err = user.Validate("")
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	userCreated, err := user.SaveUser(server.DB)
+	var userCreated *models.User
+	err = server.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		userCreated, err = user.SaveUser(tx)
+		if err != nil {
+			return err
+		}
+		return models.PublishUserEvent(tx, models.EventUserCreated, userCreated.ID, models.UserEventData(userCreated))
+	})
 
 	if err != nil {
 		fmt.Println(err)
@@ -75,21 +85,13 @@ func (server *Server) SignUp(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
 		return
 	}
-	sm := models.SendMail{}
-	sm.Email = userCreated.Email
-	err = sm.SendEmail(password)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnprocessableEntity, err)
-		return
-	}
-
 	w.Header().Set("Location", fmt.Sprintf("%s%s/%d", r.Host, r.RequestURI, userCreated.ID))
 	responses.JSON(w, http.StatusCreated, models.PrepareResponse(userCreated))
 }
 
 // Login godoc
 // @Summary Login to the system
-// @Description Login to the system. It returns the accessToken, refreshToken, expiry and device_id in a JSON format. You need to pass email and password along with a unique device_id. You can use device fingerprint or browser fingerprint to generate a unique device_id. The access and refresh token will be mapped to this id so that whenever the user logs out, it can detect the device from which the user is logging out in case of multi-session login and can expire the JWT for that specific device.
+// @Description Login to the system. It returns the accessToken, refreshToken, expiry and device_id in a JSON format. You need to pass email and password along with a unique device_id. You can use device fingerprint or browser fingerprint to generate a unique device_id. The access and refresh token will be mapped to this id so that whenever the user logs out, it can detect the device from which the user is logging out in case of multi-session login and can expire the JWT for that specific device. Set provider to "ldap" to log in with the directory password, email then takes the directory login name.
 // @Tags Login
 // @Accept  json
 // @Produce  json
@@ -112,27 +114,85 @@ func (server *Server) Login(w http.ResponseWriter, r *http.Request) {
 	user.Email = login.Email
 	user.Password = login.Password
 
-	err = user.Validate("login")
+	provider := strings.ToLower(login.Provider)
+	switch provider {
+	case "", "local":
+		provider = "local"
+		err = user.Validate("login")
+	case "ldap":
+		if !directory.Enabled() {
+			err = errors.New("LDAP login is not enabled")
+		} else if user.Email == "" || user.Password == "" {
+			err = errors.New("Required Login and Password")
+		}
+	default:
+		err = errors.New("Unsupported provider " + login.Provider)
+	}
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	token, err := server.SignIn(user.Email, user.Password, login.DeviceID, "local")
+	throttle := models.Login_Throttle{}
+	throttleKey := "ip:" + utils.ClientIP(r)
+	err = throttle.CheckLoginThrottle(server.DB, throttleKey)
 	if err != nil {
-		formattedError := customErrorFormat.FormatError(err.Error())
-		responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
+		server.recordLoginEvent(r, models.LoginEventLogin, nil, user.Email, provider, login.DeviceID, err)
+		loginError(w, err)
+		return
+	}
+	token, err := server.SignIn(r, user.Email, user.Password, login.DeviceID, provider)
+	if err != nil {
+		if err == models.ErrPasswordMismatch || gorm.IsRecordNotFoundError(err) {
+			if recordErr := throttle.RecordLoginFailure(server.DB, throttleKey); recordErr != nil {
+				log.Printf("Cannot record failed login for %s: %v", throttleKey, recordErr)
+			}
+		}
+		loginError(w, err)
 		return
 	}
+	if err = throttle.ResetLoginThrottle(server.DB, throttleKey); err != nil {
+		log.Printf("Cannot reset login throttle for %s: %v", throttleKey, err)
+	}
 	responses.JSON(w, http.StatusOK, token)
 }
 
-func (server *Server) SignIn(email, password, deviceID string, provider string) (models.LoginResponse, error) {
+// loginError answers a failed login. Throttled callers and locked accounts
+// are told when to retry, everything else keeps the generic format.
+func loginError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *models.LoginThrottledError:
+		w.Header().Set("Retry-After", strconv.Itoa(models.RetryAfterSeconds(e.RetryAfter)))
+		responses.ERROR(w, http.StatusTooManyRequests, err)
+	case *models.StepUpRequiredError:
+		responses.ERROR(w, http.StatusForbidden, err)
+	case *externalLoginError:
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+	case *models.AccountLockedError:
+		w.Header().Set("Retry-After", strconv.Itoa(models.RetryAfterSeconds(time.Until(e.Until))))
+		responses.ERROR(w, http.StatusLocked, err)
+	default:
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
+	}
+}
+
+func (server *Server) SignIn(r *http.Request, email, password, deviceID string, provider string) (_ models.LoginResponse, err error) {
 
-	var err error
 	var role string
 
 	user := models.User{}
-
+	defer func() {
+		server.recordLoginEvent(r, models.LoginEventLogin, &user, email, provider, deviceID, err)
+	}()
+
+	if strings.EqualFold(provider, "ldap") {
+		// The directory checks the password, email is the login name until
+		// it resolves to the email of the account.
+		email, err = server.directorySignIn(r, email, password)
+		if err != nil {
+			return models.LoginResponse{}, err
+		}
+	}
 	err = server.DB.Debug().Model(models.User{}).Where("email = ?", email).Preload("Roles").Take(&user).Error
 	if err != nil {
 		return models.LoginResponse{}, err
@@ -140,12 +200,42 @@ func (server *Server) SignIn(email, password, deviceID string, provider string)
 	if !user.Enabled {
 		return models.LoginResponse{}, errors.New("Account is locked!!")
 	}
+	err = user.CheckLoginLock()
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
 	if strings.EqualFold(provider, "local") {
 		err = models.VerifyPassword(user.Password, password)
-		if err != nil && err == bcrypt.ErrMismatchedHashAndPassword {
+		if err != nil {
+			locked, recordErr := user.RecordFailedLogin(server.DB)
+			if recordErr != nil {
+				log.Printf("Cannot record failed login of user %s: %v", user.ID, recordErr)
+			}
+			if locked {
+				sendLockoutEmail(&user)
+			}
+			return models.LoginResponse{}, models.ErrPasswordMismatch
+		}
+		if models.PasswordNeedsRehash(user.Password) {
+			err = user.RehashPassword(server.DB, password)
+			if err != nil {
+				log.Printf("Cannot upgrade the password hash of user %s: %v", user.ID, err)
+			}
+		}
+	}
+	if strings.EqualFold(provider, "local") && user.PasswordResetRequired {
+		return models.LoginResponse{}, errors.New("Password reset required, please reset your password")
+	}
+	if strings.EqualFold(provider, "local") || strings.EqualFold(provider, "ldap") {
+		err = server.checkLoginRisk(r, &user, deviceID)
+		if err != nil {
 			return models.LoginResponse{}, err
 		}
 	}
+	err = user.ResetFailedLogins(server.DB)
+	if err != nil {
+		log.Printf("Cannot reset failed logins of user %s: %v", user.ID, err)
+	}
 	if len(user.Roles) > 0 {
 		role = user.Roles[0].Name
 	} else {
@@ -166,9 +256,14 @@ func (server *Server) SignIn(email, password, deviceID string, provider string)
 		return models.LoginResponse{}, err
 	}
 
+	permissions, err := models.UserEffectivePermissions(server.DB, &user)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
+
 	loginResponse := models.LoginResponse{}
 	refreshToken := models.Refresh_Token{}
-	loginResponse, refreshToken, err = auth.CreateToken(user.ID, user.UserName, user.Email, role, deviceID)
+	loginResponse, refreshToken, err = auth.CreateToken(user.ID, user.UserName, user.Email, role, models.PermissionNames(permissions), deviceID)
 	if err != nil {
 		return models.LoginResponse{}, err
 	}
@@ -181,6 +276,19 @@ func (server *Server) SignIn(email, password, deviceID string, provider string)
 	return loginResponse, nil
 }
 
+func sendLockoutEmail(user *models.User) {
+	sm := models.SendMail{}
+	sm.Email = user.Email
+	err := sm.SendNoticeEmail(
+		"Your account has been locked",
+		"Hello "+user.FirstName,
+		"Your account was temporarily locked after too many failed login attempts. You can log in again after "+user.LockedUntil.Format("02 Jan 2006 15:04 MST")+". If these attempts were not made by you, please reset your password and contact your administrator.",
+	)
+	if err != nil {
+		log.Printf("Cannot send lockout notice to user %s: %v", user.ID, err)
+	}
+}
+
 // Refresh godoc
 // @Summary Refresh JWT Token to Login to the system
 // @Description Refresh JWT token to Login to the system. It returns the accessToken, refreshToken and expiry in a JSON format. You need to pass the refresh token from the previous call.
@@ -229,7 +337,7 @@ func (server *Server) Refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := server.Recreate(userID, refreshToken)
+	token, err := server.Recreate(r, userID, refreshToken)
 	if err != nil {
 		formattedError := customErrorFormat.FormatError(err.Error())
 		responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
@@ -246,12 +354,15 @@ func (server *Server) Refresh(w http.ResponseWriter, r *http.Request) {
 	responses.JSON(w, http.StatusOK, token)
 }
 
-func (server *Server) Recreate(userID uuid.UUID, token uuid.UUID) (models.LoginResponse, error) {
+func (server *Server) Recreate(r *http.Request, userID uuid.UUID, token uuid.UUID) (_ models.LoginResponse, err error) {
 
-	var err error
 	var role string
+	var deviceID string
 
-	user := models.User{}
+	user := models.User{ID: userID}
+	defer func() {
+		server.recordLoginEvent(r, models.LoginEventRefresh, &user, user.Email, user.Provider, deviceID, err)
+	}()
 
 	err = server.DB.Debug().Model(models.User{}).Where("id = ?", userID).Preload("Roles").Take(&user).Error
 	if err != nil {
@@ -272,9 +383,14 @@ func (server *Server) Recreate(userID uuid.UUID, token uuid.UUID) (models.LoginR
 	if err != nil {
 		return models.LoginResponse{}, err
 	}
+	deviceID = device.DeviceID
+	permissions, err := models.UserEffectivePermissions(server.DB, &user)
+	if err != nil {
+		return models.LoginResponse{}, err
+	}
 
 	loginResponse := models.LoginResponse{}
-	loginResponse, _, err = auth.CreateToken(user.ID, user.UserName, user.Email, role, device.DeviceID)
+	loginResponse, _, err = auth.CreateToken(user.ID, user.UserName, user.Email, role, models.PermissionNames(permissions), device.DeviceID)
 	if err != nil {
 		return models.LoginResponse{}, err
 	}
@@ -340,7 +456,7 @@ func (server *Server) Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = server.Destroy(userID, logout.DeviceID, token, expiry)
+	err = server.Destroy(r, userID, logout.DeviceID, token, expiry)
 	if err != nil {
 		formattedError := customErrorFormat.FormatError(err.Error())
 		responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
@@ -349,11 +465,12 @@ func (server *Server) Logout(w http.ResponseWriter, r *http.Request) {
 	responses.JSON(w, http.StatusOK, "User Logged out successfully!")
 }
 
-func (server *Server) Destroy(userID uuid.UUID, deviceID string, token string, expiry int64) (error) {
-
-	var err error
+func (server *Server) Destroy(r *http.Request, userID uuid.UUID, deviceID string, token string, expiry int64) (err error) {
 
-	user := models.User{}
+	user := models.User{ID: userID}
+	defer func() {
+		server.recordLoginEvent(r, models.LoginEventLogout, &user, user.Email, user.Provider, deviceID, err)
+	}()
 	err = server.DB.Debug().Model(models.User{}).Where("id = ?", userID).Preload("Roles").Take(&user).Error
 	if err != nil {
 		return err
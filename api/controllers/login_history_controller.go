@@ -0,0 +1,166 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/events"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// GetMyLoginHistory godoc
+// @Summary Get the login history of the logged in user
+// @Description Get the logins, failed login attempts, token refreshes and logouts of the logged in user, newest first, with the IP address, user agent, device and provider used.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param page query int false "Page number, starting at 1"
+// @Param per_page query int false "Events per page, at most 100"
+// @Success 200 {object} models.Page
+// @Security ApiKeyAuth
+// @Router /user/me/login-history [get]
+func (server *Server) GetMyLoginHistory(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	page, perPage := pageParams(r)
+	event := models.Login_Event{}
+	history, err := event.FindLoginEventsByUserID(server.DB, tokenID, page, perPage)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, history)
+}
+
+// GetUserLoginHistory godoc
+// @Summary Get the login history of a user
+// @Description Get the logins, failed login attempts, token refreshes and logouts of a user by ID, newest first. In order to access this API, someone must have "USERS_VIEW" Permission tagged to its role.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the user"
+// @Param page query int false "Page number, starting at 1"
+// @Param per_page query int false "Events per page, at most 100"
+// @Success 200 {object} models.Page
+// @Security ApiKeyAuth
+// @Router /users/{id}/login-history [get]
+func (server *Server) GetUserLoginHistory(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	uid, err := uuid.Parse(vars["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	page, perPage := pageParams(r)
+	event := models.Login_Event{}
+	history, err := event.FindLoginEventsByUserID(server.DB, uid, page, perPage)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, history)
+}
+
+// pageParams reads the page and per_page query parameters, defaulting to the
+// first page of twenty items.
+func pageParams(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = 20
+	}
+	if perPage > 100 {
+		perPage = 100
+	}
+	return page, perPage
+}
+
+// recordLoginEvent stores an authentication event. Failing to store it is
+// logged but never fails the request it describes.
+func (server *Server) recordLoginEvent(r *http.Request, eventType string, user *models.User, email string, provider string, deviceID string, err error) {
+	event := models.Login_Event{
+		Email:     email,
+		Event:     eventType,
+		Provider:  provider,
+		Success:   err == nil,
+		IPAddress: utils.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		DeviceID:  deviceID,
+	}
+	if user != nil && user.ID != uuid.Nil {
+		uid := user.ID
+		event.UserID = &uid
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	event.Prepare()
+	if saveErr := event.SaveLoginEvent(server.DB); saveErr != nil {
+		log.Printf("Cannot record %s event for %s: %v", eventType, email, saveErr)
+	}
+
+	published := events.Event{
+		Time:      event.CreatedAt,
+		Category:  events.CategoryAuth,
+		Action:    eventType,
+		Success:   event.Success,
+		Email:     email,
+		Provider:  provider,
+		DeviceID:  deviceID,
+		Reason:    event.Reason,
+		SourceIP:  event.IPAddress,
+		UserAgent: event.UserAgent,
+		RequestID: r.Header.Get("X-Request-ID"),
+	}
+	if event.UserID != nil {
+		published.UserID = event.UserID.String()
+	}
+	events.Publish(published)
+}
+
+// pruneLoginHistory removes login events past LOGIN_HISTORY_RETENTION_DAYS
+// once a day.
+func (server *Server) pruneLoginHistory() {
+	event := models.Login_Event{}
+	for {
+		if err := event.PruneLoginEvents(server.DB); err != nil {
+			log.Printf("Cannot prune login history: %v", err)
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/badoux/checkmail"
+)
+
+// RequestMagicLink godoc
+// @Summary Request a passwordless login link
+// @Description Request a short-lived, single-use login link by email. The link can only be consumed from the device_id passed here. The link points to the frontend page of MAGIC_LINK_URL with the token, which the page posts with its device_id to /login/magic-link/consume. The response is the same whether or not the email belongs to an account. This API is only available when MAGIC_LINK_ENABLED is set.
+// @Tags Login
+// @Accept  json
+// @Produce  json
+// @Param login body models.Magic_Link_Request true "Magic Link Request"
+// @Success 202 {object} string
+// @Router /login/magic-link [post]
+func (server *Server) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	if !models.MagicLinkEnabled() {
+		responses.ERROR(w, http.StatusNotFound, errors.New("Magic link login is disabled"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	request := models.Magic_Link_Request{}
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if request.Email == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Email"))
+		return
+	}
+	if err := checkmail.ValidateFormat(request.Email); err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Invalid Email"))
+		return
+	}
+	if request.DeviceID == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required DeviceID"))
+		return
+	}
+
+	accepted := "If the account exists, a login link has been sent"
+	user := models.User{}
+	fetchUser, err := user.FindUserByEmail(server.DB, request.Email)
+	if err != nil || !fetchUser.Enabled {
+		responses.JSON(w, http.StatusAccepted, accepted)
+		return
+	}
+	token, tokenHash, err := utils.SecureToken()
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	magicLink := models.Magic_Link{}
+	magicLink.Prepare(fetchUser.ID, request.DeviceID, tokenHash)
+	err = magicLink.SaveMagicLink(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	sm := models.SendMail{}
+	sm.Email = fetchUser.Email
+	err = sm.SendLinkEmail(
+		"Your login link",
+		"Log in to your account",
+		"Follow the link below to log in. It can be used once, only on the device you requested it from, and expires on "+magicLink.ExpiresAt.Format("02 Jan 2006 15:04 MST")+".",
+		magicLinkURL(token),
+		"Log In",
+	)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	responses.JSON(w, http.StatusAccepted, accepted)
+}
+
+// ConsumeMagicLink godoc
+// @Summary Login to the system with a magic link
+// @Description Exchange the token from a magic link email for a login. The device_id must be the one the link was requested for. It returns the accessToken, refreshToken, expiry and device_id in a JSON format. This API is only available when MAGIC_LINK_ENABLED or SUSPICIOUS_LOGIN_STEP_UP is set, the latter to complete logins that needed verification.
+// @Tags Login
+// @Accept  json
+// @Produce  json
+// @Param login body models.Magic_Link_Consume true "Magic Link Consume"
+// @Success 200 {object} models.LoginResponse
+// @Router /login/magic-link/consume [post]
+func (server *Server) ConsumeMagicLink(w http.ResponseWriter, r *http.Request) {
+	if !models.MagicLinkEnabled() && !models.LoginStepUpEnabled() {
+		responses.ERROR(w, http.StatusNotFound, errors.New("Magic link login is disabled"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	consume := models.Magic_Link_Consume{}
+	err = json.Unmarshal(body, &consume)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if consume.Token == "" || consume.DeviceID == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Invalid or expired link"))
+		return
+	}
+
+	magicLink := models.Magic_Link{}
+	consumed, err := magicLink.ConsumeMagicLink(server.DB, utils.HashToken(consume.Token), consume.DeviceID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	user := models.User{}
+	fetchUser, err := user.FindUserByID(server.DB, consumed.UserID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Invalid or expired link"))
+		return
+	}
+	token, err := server.SignIn(r, fetchUser.Email, "", consumed.DeviceID, "magic-link")
+	if err != nil {
+		loginError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, token)
+}
+
+// magicLinkURL is the link to the frontend page of MAGIC_LINK_URL carrying
+// the token. The page posts it with the device_id of the browser, which the
+// link cannot carry without giving the device binding away.
+func magicLinkURL(token string) string {
+	return models.MagicLinkURL() + "?token=" + url.QueryEscape(token)
+}
@@ -1,129 +1,313 @@
 package controllers
 
 import (
+	"encoding/json"
 	"errors"
-	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
-	"strings"
-	"time"
+	"net/url"
 
 	"bitbucket.org/staydigital/truvest-identity-management/api/models"
 	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
-	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth/providers/openidConnect"
 )
 
+// OauthSignIn godoc
+// @Summary Log in with an OAuth provider
+// @Description Send the browser here to log in at an OAuth or OpenID Connect provider. The redirect_uri has to be one of OAUTH_REDIRECT_URIS and defaults to the first. After the login the browser is sent there with a one-time code, to be exchanged at /auth/token within OAUTH_CODE_EXPIRY_IN_SECONDS, or with an error and error_description. The device_id is the one the tokens are issued for. Link requests of /user/me/identities come here with their state instead.
+// @Tags OAuth
+// @Produce  json
+// @Param provider path string true "OAuth provider"
+// @Param device_id query string true "Device ID"
+// @Param redirect_uri query string false "Frontend page receiving the code"
+// @Success 302
+// @Router /auth/{provider} [get]
 func (server *Server) OauthSignIn(w http.ResponseWriter, r *http.Request) {
-	
-	if gothUser, err := gothic.CompleteUserAuth(w, r); err == nil {
-		user := models.User{}
-		fetchUser, _ := user.FindUserByEmail(server.DB, gothUser.Email)
-		if len(fetchUser.Email) > 0 {
-			token, err := server.SignIn(user.Email, user.Password, gothUser.AccessToken, "other")
-			if err != nil {
-				formattedError := customErrorFormat.FormatError(err.Error())
-				responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
-				return
-			}
-			responses.JSON(w, http.StatusOK, token)			
-		} else {
-			fetchUser.Email = gothUser.Email
-			if len(gothUser.FirstName) > 0 {
-				fetchUser.FirstName = gothUser.FirstName
-			} else {
-				fetchUser.FirstName = strings.Fields(gothUser.Name)[0]
-			}
-			if len(gothUser.LastName) > 0 {
-				fetchUser.LastName = gothUser.LastName
-			} else {
-				fetchUser.LastName = strings.Fields(gothUser.Name)[1]
-			}
-			fetchUser.UserName = gothUser.Email
-			userID := uuid.New()
-			fetchUser.ID = userID
-			fetchUser.CreatedBy = userID
-			fetchUser.CreatedAt = time.Now()
-			fetchUser.UpdatedBy = userID
-			fetchUser.UpdatedAt = time.Now()
-			userCreated, err := fetchUser.SaveUser(server.DB)
-			if err != nil {
-				fmt.Println(err)
-				formattedError := customErrorFormat.FormatError(err.Error())		
-				responses.ERROR(w, http.StatusInternalServerError, formattedError)
-				return
-			}
-			token, err := server.SignIn(userCreated.Email, userCreated.Password, gothUser.AccessToken, "other")
-			if err != nil {
-				formattedError := customErrorFormat.FormatError(err.Error())
-				responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
-				return
-			}
-			responses.JSON(w, http.StatusOK, token)
+	provider := mux.Vars(r)["provider"]
+	if _, err := goth.GetProvider(provider); err != nil {
+		responses.ERROR(w, http.StatusNotFound, errors.New("Provider Not Found"))
+		return
+	}
+
+	query := r.URL.Query()
+	state := query.Get("state")
+	var request *models.Oauth_Request
+	var err error
+	if state != "" {
+		fetchRequest := models.Oauth_Request{}
+		request, err = fetchRequest.FindOauthRequest(server.DB, utils.HashToken(state), provider)
+		if err != nil || request.UserID == nil {
+			responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Unknown or expired OAuth request"))
+			return
+		}
+		if !identityLinkBrowser(r, request) {
+			responses.ERROR(w, http.StatusForbidden, errIdentityLinkBrowser)
+			return
 		}
 	} else {
-		gothic.BeginAuthHandler(w, r)
+		deviceID := query.Get("device_id")
+		if deviceID == "" {
+			responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required DeviceID"))
+			return
+		}
+		redirectURI, err := models.OauthRedirectURI(query.Get("redirect_uri"))
+		if err != nil {
+			responses.ERROR(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		state, request, err = server.startOauthRequest(provider, redirectURI, deviceID, nil, "")
+		if err != nil {
+			responses.ERROR(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	// gothic takes the state from the query, and stores the auth URL with it
+	// in its session cookie, which binds the callback to this browser.
+	query.Set("state", state)
+	authRequest := r.WithContext(r.Context())
+	authURL := *r.URL
+	authURL.RawQuery = query.Encode()
+	authRequest.URL = &authURL
+	redirect, err := gothic.GetAuthURL(w, authRequest)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
 	}
+	if oauthUsesNonce(provider) {
+		u, err := url.Parse(redirect)
+		if err != nil {
+			responses.ERROR(w, http.StatusInternalServerError, err)
+			return
+		}
+		params := u.Query()
+		params.Set("nonce", request.Nonce)
+		u.RawQuery = params.Encode()
+		redirect = u.String()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, redirect, http.StatusFound)
 }
 
-func (server *Server) OauthSuccessCallback(w http.ResponseWriter, r *http.Request) {	
-	
-	if gothUser, err := gothic.CompleteUserAuth(w, r); err == nil {
-		user := models.User{}
-		fetchUser, _ := user.FindUserByEmail(server.DB, gothUser.Email)
-		if len(fetchUser.Email) > 0 {
-			token, err := server.SignIn(user.Email, user.Password, gothUser.AccessToken, "other")
-			if err != nil {
-				formattedError := customErrorFormat.FormatError(err.Error())
-				responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
-				return
-			}
-			responses.JSON(w, http.StatusOK, token)			
-		} else {
-			vars := mux.Vars(r)
-    		provider, ok := vars["provider"]
-    		if !ok {
-        		fmt.Println("provider is missing in parameters")
-				responses.ERROR(w, http.StatusInternalServerError, errors.New("provider is missing in parameters"))
-				return
-    		}
-			fetchUser.Email = gothUser.Email
-			if len(gothUser.FirstName) > 0 {
-				fetchUser.FirstName = gothUser.FirstName
-			} else {
-				fetchUser.FirstName = strings.Fields(gothUser.Name)[0]
-			}
-			if len(gothUser.LastName) > 0 {
-				fetchUser.LastName = gothUser.LastName
-			} else {
-				fetchUser.LastName = strings.Fields(gothUser.Name)[1]
-			}
-			fetchUser.UserName = gothUser.Email
-			userID := uuid.New()
-			fetchUser.ID = userID
-			fetchUser.CreatedBy = userID
-			fetchUser.CreatedAt = time.Now()
-			fetchUser.UpdatedBy = userID
-			fetchUser.UpdatedAt = time.Now()
-			fetchUser.Enabled = true
-			fetchUser.Provider = provider
-			userCreated, err := fetchUser.SaveUser(server.DB)
+// OauthSuccessCallback godoc
+// @Summary Receive the login of an OAuth provider
+// @Description The redirect URI to register at the provider. The state has to answer a pending request of /auth/{provider} from the same browser, and for OpenID Connect the ID token carry its nonce. A link request of /user/me/identities also needs the identity_link cookie it set. The browser is then sent to the redirect_uri of the request with a one-time code, or with an error and error_description.
+// @Tags OAuth
+// @Param provider path string true "OAuth provider"
+// @Param state query string true "State"
+// @Param code query string true "Authorization code of the provider"
+// @Success 302
+// @Router /auth/{provider}/callback [get]
+func (server *Server) OauthSuccessCallback(w http.ResponseWriter, r *http.Request) {
+	provider := mux.Vars(r)["provider"]
+	request := models.Oauth_Request{}
+	pending, err := request.ConsumeOauthRequest(server.DB, utils.HashToken(gothic.GetState(r)), provider)
+	if err != nil {
+		server.recordLoginEvent(r, models.LoginEventLogin, nil, "", provider, "", err)
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	gothUser, err := gothic.CompleteUserAuth(w, r)
+	if err == nil && oauthUsesNonce(provider) && gothUser.RawData["nonce"] != pending.Nonce {
+		err = errors.New("The nonce of the ID token does not match")
+	}
+	if err != nil {
+		log.Printf("OAuth login with %s failed: %v", provider, err)
+		server.recordLoginEvent(r, models.LoginEventLogin, nil, "", provider, pending.DeviceID, err)
+		oauthRedirect(w, r, pending, url.Values{"error": {"access_denied"}, "error_description": {"The login at the provider failed"}})
+		return
+	}
+
+	if pending.UserID != nil {
+		clearIdentityLinkCookie(w)
+		if !identityLinkBrowser(r, pending) {
+			log.Printf("Link of a %s account to user %s refused: %v", provider, pending.UserID, errIdentityLinkBrowser)
+			oauthRedirect(w, r, pending, url.Values{"error": {"link_failed"}, "error_description": {errIdentityLinkBrowser.Error()}})
+			return
+		}
+		var identity *models.External_Identity
+		err = server.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			identity, err = linkOauthIdentity(tx, provider, *pending.UserID, gothUser)
+			return err
+		})
+		if err != nil {
+			oauthRedirect(w, r, pending, url.Values{"error": {"link_failed"}, "error_description": {oauthErrorDescription(err)}})
+			return
+		}
+		if pending.RedirectURI == "" {
+			responses.JSON(w, http.StatusOK, identity)
+			return
+		}
+		oauthRedirect(w, r, pending, url.Values{"linked": {provider}})
+		return
+	}
+
+	// A failing GitHub API leaves the roles as they are rather than taking
+	// away the mapped ones.
+	rule := models.Role_Mapping_Rule{}
+	rules, err := rule.FindRoleMappingRulesForProvider(server.DB, provider)
+	var claims map[string][]string
+	if err == nil {
+		claims, err = oauthClaims(provider, gothUser, rules)
+		if err != nil {
+			log.Printf("Cannot read the claims of the %s login, its roles are not synced: %v", provider, err)
+			rules, err = nil, nil
+		}
+	}
+
+	var user *models.User
+	var audits []*models.Audit_Event
+	var code, codeHash string
+	if err == nil {
+		code, codeHash, err = utils.SecureToken()
+	}
+	if err == nil {
+		err = server.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			user, err = oauthUser(tx, provider, gothUser)
 			if err != nil {
-				fmt.Println(err)
-				formattedError := customErrorFormat.FormatError(err.Error())		
-				responses.ERROR(w, http.StatusInternalServerError, formattedError)
-				return
+				return err
 			}
-			token, err := server.SignIn(userCreated.Email, userCreated.Password, gothUser.AccessToken, provider)
+			audits, err = syncRoleMappings(tx, r, user.ID, rules, claims)
 			if err != nil {
-				formattedError := customErrorFormat.FormatError(err.Error())
-				responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
-				return
+				return err
 			}
-			responses.JSON(w, http.StatusOK, token)
-		}
+			oauthCode := models.Oauth_Code{}
+			oauthCode.Prepare(codeHash, user.ID, pending)
+			return oauthCode.SaveOauthCode(tx)
+		})
+	}
+	if err != nil {
+		server.recordLoginEvent(r, models.LoginEventLogin, nil, gothUser.Email, provider, pending.DeviceID, err)
+		oauthRedirect(w, r, pending, url.Values{"error": {"login_failed"}, "error_description": {oauthErrorDescription(err)}})
+		return
 	}
+	for _, event := range audits {
+		publishAuditEvent(event, "")
+	}
+	oauthRedirect(w, r, pending, url.Values{"code": {code}})
+}
+
+// ExchangeOauthCode godoc
+// @Summary Exchange the code of an OAuth login for tokens
+// @Description Exchange the one-time code the frontend received at its redirect_uri after an OAuth login. The redirect_uri must be the one the code was sent to. It returns the accessToken, refreshToken, expiry and device_id like /login, for the device_id the login was started with.
+// @Tags OAuth
+// @Accept  json
+// @Produce  json
+// @Param exchange body models.Oauth_Code_Exchange true "Code Exchange"
+// @Success 200 {object} models.LoginResponse
+// @Router /auth/token [post]
+func (server *Server) ExchangeOauthCode(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	exchange := models.Oauth_Code_Exchange{}
+	err = json.Unmarshal(body, &exchange)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if exchange.Code == "" || exchange.RedirectURI == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Invalid or expired code"))
+		return
+	}
+
+	oauthCode := models.Oauth_Code{}
+	consumed, err := oauthCode.ConsumeOauthCode(server.DB, utils.HashToken(exchange.Code), exchange.RedirectURI)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	user := models.User{}
+	fetchUser, err := user.FindUserByID(server.DB, consumed.UserID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Invalid or expired code"))
+		return
+	}
+	token, err := server.SignIn(r, fetchUser.Email, "", consumed.DeviceID, consumed.Provider)
+	if err != nil {
+		loginError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, token)
+}
+
+// startOauthRequest stores a pending login at the provider, or a link to
+// the user uid from the browser holding the cookie hashed to browserHash,
+// and returns its state.
+func (server *Server) startOauthRequest(provider, redirectURI, deviceID string, uid *uuid.UUID, browserHash string) (string, *models.Oauth_Request, error) {
+	state, stateHash, err := utils.SecureToken()
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, _, err := utils.SecureToken()
+	if err != nil {
+		return "", nil, err
+	}
+	request := models.Oauth_Request{}
+	request.Prepare(stateHash, provider, redirectURI, deviceID, nonce)
+	request.UserID = uid
+	request.BrowserHash = browserHash
+	err = request.SaveOauthRequest(server.DB)
+	if err != nil {
+		return "", nil, err
+	}
+	return state, &request, nil
+}
+
+// oauthUsesNonce tells whether the provider speaks OpenID Connect, whose
+// ID token carries the nonce of the request.
+func oauthUsesNonce(provider string) bool {
+	gothProvider, err := goth.GetProvider(provider)
+	if err != nil {
+		return false
+	}
+	_, ok := gothProvider.(*openidConnect.Provider)
+	return ok
+}
+
+// oauthRedirect sends the browser back to the frontend of the request with
+// params. Requests without a redirect_uri get the error as JSON.
+func oauthRedirect(w http.ResponseWriter, r *http.Request, request *models.Oauth_Request, params url.Values) {
+	if request.RedirectURI == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New(params.Get("error_description")))
+		return
+	}
+	u, err := url.Parse(request.RedirectURI)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// oauthErrorDescription tells the frontend why a login failed without
+// leaking internal errors.
+func oauthErrorDescription(err error) string {
+	if external, ok := err.(*externalLoginError); ok {
+		return external.message
+	}
+	if gorm.IsRecordNotFoundError(err) {
+		return "User Not Found"
+	}
+	return "Login failed"
 }
 
 // OAuthLogout godoc
@@ -137,8 +321,8 @@ func (server *Server) OauthSuccessCallback(w http.ResponseWriter, r *http.Reques
 // @Success 200 {object} string
 // @Security ApiKeyAuth
 // @Router /logout/{provider} [post]
-func (server *Server) OauthLogout(w http.ResponseWriter, r *http.Request) {	
-	
+func (server *Server) OauthLogout(w http.ResponseWriter, r *http.Request) {
+
 	gothic.Logout(w, r)
 	server.Logout(w, r)
-}
\ No newline at end of file
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
+	"github.com/gorilla/sessions"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"github.com/markbates/goth/providers/github"
+	"github.com/markbates/goth/providers/google"
+)
+
+// OAuthProvidersResponse tells which providers users can log in with after
+// a reload, and why the others failed.
+type OAuthProvidersResponse struct {
+	Providers []string          `json:"providers"`
+	Failed    map[string]string `json:"failed"`
+}
+
+// reloadMu keeps reloads from interleaving, a slow discovery would
+// otherwise let an older configuration win.
+var reloadMu sync.Mutex
+
+// loadOAuthProviders registers Google and GitHub when their keys are set,
+// the providers of the OIDC_PROVIDERS_FILE and the enabled providers of the
+// database, which win over the file. A provider whose discovery fails is
+// left out rather than keeping the others from loading.
+func (server *Server) loadOAuthProviders() (OAuthProvidersResponse, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	result := OAuthProvidersResponse{Providers: []string{}, Failed: map[string]string{}}
+	providers := []goth.Provider{}
+	displayNames := map[string]string{}
+	if key := os.Getenv("GOOGLE_KEY"); key != "" {
+		providers = append(providers, google.New(key, os.Getenv("GOOGLE_SECRET"), oauthCallbackURL("google")))
+		displayNames["google"] = "Google"
+	}
+	if key := os.Getenv("GITHUB_KEY"); key != "" {
+		scopes := []string{}
+		for _, scope := range strings.Split(os.Getenv("GITHUB_SCOPES"), ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+		providers = append(providers, github.New(key, os.Getenv("GITHUB_SECRET"), oauthCallbackURL("github"), scopes...))
+		displayNames["github"] = "Github"
+	}
+
+	configured := map[string]sso.OIDCProvider{}
+	if path := os.Getenv("OIDC_PROVIDERS_FILE"); path != "" {
+		fileProviders, err := sso.LoadOIDCFile(path)
+		if err != nil {
+			return result, err
+		}
+		for _, p := range fileProviders {
+			configured[p.Name] = p
+		}
+	}
+	provider := models.Oidc_Provider{}
+	dbProviders, err := provider.FindEnabledOidcProviders(server.DB)
+	if err != nil {
+		return result, err
+	}
+	for i := range *dbProviders {
+		p := (*dbProviders)[i].OIDCProvider()
+		configured[p.Name] = p
+	}
+
+	for name, p := range configured {
+		if _, ok := displayNames[name]; ok {
+			result.Failed[name] = "Name " + name + " is reserved"
+			continue
+		}
+		gothProvider, err := p.GothProvider(oauthCallbackURL(name))
+		if err != nil {
+			log.Printf("Cannot load the OpenID Connect provider %s: %v", name, err)
+			result.Failed[name] = err.Error()
+			continue
+		}
+		providers = append(providers, gothProvider)
+		displayNames[name] = p.DisplayName
+	}
+
+	sso.UseProviders(providers, displayNames)
+	for name := range displayNames {
+		result.Providers = append(result.Providers, name)
+	}
+	sort.Strings(result.Providers)
+	return result, nil
+}
+
+// reloadOAuthProviders reloads the providers after a change of the
+// database, logging rather than failing the change.
+func (server *Server) reloadOAuthProviders() {
+	_, err := server.loadOAuthProviders()
+	if err != nil {
+		log.Println("Cannot reload the OAuth providers:", err)
+	}
+}
+
+// configureOAuthSessions sets up the cookie gothic keeps the pending login
+// in. gothic reads SESSION_SECRET before the .env file is loaded, so it is
+// read again here. Without one a random key is used, which only works as
+// long as the browser comes back to the same instance.
+func configureOAuthSessions() error {
+	key := []byte(os.Getenv("SESSION_SECRET"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		log.Println("SESSION_SECRET is not set, OAuth logins have to come back to this instance")
+	}
+	store := sessions.NewCookieStore(key)
+	store.Options = &sessions.Options{
+		Path:     "/auth",
+		MaxAge:   int(models.OauthRequestExpiry().Seconds()),
+		HttpOnly: true,
+		Secure:   os.Getenv("APP_PROTOCOL") == "https",
+	}
+	gothic.Store = store
+	return nil
+}
+
+func oauthCallbackURL(name string) string {
+	return serviceURL("/auth/" + name + "/callback")
+}
+
+// withOAuthProviders keeps the providers from being replaced while gothic
+// uses them.
+func withOAuthProviders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sso.ReadProviders(func() {
+			next(w, r)
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// CreateOidcProvider godoc
+// @Summary Add an OpenID Connect provider
+// @Description Add an upstream OpenID Connect provider, such as Azure AD, Okta, Keycloak or Auth0, users can log in with at /auth/{name}. The discovery_url is the .well-known/openid-configuration of the issuer, the redirect URI to register there is /auth/{name}/callback. Scopes are separated by commas or spaces and default to openid, email and profile. The claims default to sub, email, preferred_username, given_name, family_name and name. The providers are reloaded, a provider whose discovery fails is not offered until the next reload. The client secret is never returned. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags OIDC
+// @Accept  json
+// @Produce  json
+// @Param provider body models.Oidc_Provider_Payload true "OIDC Provider"
+// @Success 201 {object} models.Oidc_Provider
+// @Security ApiKeyAuth
+// @Router /oidc-providers [post]
+func (server *Server) CreateOidcProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Oidc_Provider_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	provider := models.Oidc_Provider{Enabled: true}
+	provider.Apply(payload)
+	provider.Prepare(tokenID)
+	err = provider.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	event := models.Audit_Event{Action: "oidc_provider.create", TargetType: "oidc_provider", TargetID: provider.ID.String()}
+	err = event.SetAfter(provider)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := provider.SaveOidcProvider(tx)
+		return err
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	server.reloadOAuthProviders()
+	responses.JSON(w, http.StatusCreated, &provider)
+}
+
+// GetOidcProviders godoc
+// @Summary Get all OpenID Connect providers
+// @Description Get all OpenID Connect providers stored in the database, those of the OIDC_PROVIDERS_FILE are not listed. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags OIDC
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.Oidc_Provider
+// @Security ApiKeyAuth
+// @Router /oidc-providers [get]
+func (server *Server) GetOidcProviders(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	provider := models.Oidc_Provider{}
+	providers, err := provider.FindAllOidcProviders(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, providers)
+}
+
+// GetOidcProvider godoc
+// @Summary Get an OpenID Connect provider by id
+// @Description Get an OpenID Connect provider by id. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags OIDC
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the OIDC provider"
+// @Success 200 {object} models.Oidc_Provider
+// @Security ApiKeyAuth
+// @Router /oidc-providers/{id} [get]
+func (server *Server) GetOidcProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	pid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	provider := models.Oidc_Provider{}
+	providerGotten, err := provider.FindOidcProviderByID(server.DB, pid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, providerGotten)
+}
+
+// UpdateOidcProvider godoc
+// @Summary Update an OpenID Connect provider by id
+// @Description Replace the settings of an OpenID Connect provider, an empty client_secret keeps the current one. Renaming it changes its redirect URI, which then has to be updated at the provider. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags OIDC
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the OIDC provider"
+// @Param provider body models.Oidc_Provider_Payload true "OIDC Provider"
+// @Success 200 {object} models.Oidc_Provider
+// @Security ApiKeyAuth
+// @Router /oidc-providers/{id} [put]
+func (server *Server) UpdateOidcProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	pid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Oidc_Provider_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	fetchProvider := models.Oidc_Provider{}
+	provider, err := fetchProvider.FindOidcProviderByID(server.DB, pid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "oidc_provider.update", TargetType: "oidc_provider", TargetID: pid.String()}
+	err = event.SetBefore(provider)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	provider.Apply(payload)
+	err = provider.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := provider.UpdateAnOidcProvider(tx, tokenID)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(provider)
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	server.reloadOAuthProviders()
+	responses.JSON(w, http.StatusOK, provider)
+}
+
+// DeleteOidcProvider godoc
+// @Summary Delete an OpenID Connect provider by id
+// @Description Delete an OpenID Connect provider. The accounts created through it stay, but cannot log in with it anymore. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags OIDC
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the OIDC provider"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /oidc-providers/{id} [delete]
+func (server *Server) DeleteOidcProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	pid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	provider := models.Oidc_Provider{}
+	deleteProvider, err := provider.FindOidcProviderByID(server.DB, pid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "oidc_provider.delete", TargetType: "oidc_provider", TargetID: pid.String()}
+	err = event.SetBefore(deleteProvider)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := provider.DeleteAnOidcProvider(tx, pid)
+		return err
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	server.reloadOAuthProviders()
+	w.Header().Set("Entity", pid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// ReloadOAuthProviders godoc
+// @Summary Reload the OAuth and OpenID Connect providers
+// @Description Reload the providers of the OIDC_PROVIDERS_FILE and the database without a restart, for example after editing the file or rotating a client secret. It returns the providers users can log in with and why the others failed. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags OIDC
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} OAuthProvidersResponse
+// @Security ApiKeyAuth
+// @Router /oidc-providers/reload [post]
+func (server *Server) ReloadOAuthProviders(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	result, err := server.loadOAuthProviders()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,33 @@
+package controllers
+
+import (
+	"log"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/broker"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+)
+
+// relayOutbox publishes the outbox to the broker. It polls every
+// OUTBOX_POLL_INTERVAL_SECONDS while idle or while the broker fails, and
+// prunes published messages once an hour.
+func (server *Server) relayOutbox(b broker.Broker) {
+	interval := models.OutboxPollInterval()
+	batch := 100
+	pruned := time.Time{}
+	for {
+		published, err := models.RelayOutbox(server.DB, b, batch, 30*time.Second)
+		if err != nil {
+			log.Printf("Cannot relay the outbox to %s: %v", b.Name(), err)
+		}
+		if time.Since(pruned) > time.Hour {
+			if err := models.PruneOutboxMessages(server.DB); err != nil {
+				log.Printf("Cannot prune the outbox: %v", err)
+			}
+			pruned = time.Now()
+		}
+		if err != nil || published < batch {
+			time.Sleep(interval)
+		}
+	}
+}
@@ -17,11 +17,12 @@ import (
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
 )
 
 // CreatePermission godoc
 // @Summary Create a permission in the system
-// @Description Create a permission in the system.User must have "MANAGE_PERMISSION" permission tagged to its role in order to access this API
+// @Description Create a permission in the system. Names are segments of letters, digits, _, . and - separated by colons, like portfolio:orders:read, and a name without a namespace is put into identity:. A * as the last segment grants every permission below the segments before it, portfolio:* grants portfolio:orders:read, and * alone grants all permissions. User must have "MANAGE_PERMISSION" permission tagged to its role in order to access this API
 // @Tags Permission
 // @Accept  json
 // @Produce  json
@@ -67,7 +68,17 @@ func (server *Server) CreatePermission(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	permissionCreated, err := permission.SavePermission(server.DB)
+	var permissionCreated *models.Permission
+	event := models.Audit_Event{Action: "permission.create", TargetType: "permission"}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		permissionCreated, err = permission.SavePermission(tx)
+		if err != nil {
+			return err
+		}
+		event.TargetID = fmt.Sprintf("%d", permissionCreated.ID)
+		return event.SetAfter(permissionCreated)
+	})
 
 	if err != nil {
 
@@ -198,6 +209,12 @@ func (server *Server) UpdatePermission(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
+	event := models.Audit_Event{Action: "permission.update", TargetType: "permission", TargetID: fmt.Sprintf("%d", pid)}
+	err = event.SetBefore(updatePermission)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
 	err = json.Unmarshal(body, &updatePermission)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
@@ -209,7 +226,15 @@ func (server *Server) UpdatePermission(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	updatedPermission, err := updatePermission.UpdateAPermission(server.DB, uint32(pid), tokenID)
+	var updatedPermission *models.Permission
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		updatedPermission, err = updatePermission.UpdateAPermission(tx, uint32(pid), tokenID)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(updatedPermission)
+	})
 	if err != nil {
 		formattedError := customErrorFormat.FormatError(err.Error())
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
@@ -249,7 +274,21 @@ func (server *Server) DeletePermission(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	_, err = permission.DeleteAPermission(server.DB, uint32(pid))
+	deletePermission, err := permission.FindPermissionByID(server.DB, uint32(pid))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	event := models.Audit_Event{Action: "permission.delete", TargetType: "permission", TargetID: fmt.Sprintf("%d", pid)}
+	err = event.SetBefore(deletePermission)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := permission.DeleteAPermission(tx, uint32(pid))
+		return err
+	})
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
@@ -260,6 +299,13 @@ func (server *Server) DeletePermission(w http.ResponseWriter, r *http.Request) {
 
 // Permission Checks
 func (server *Server) HasPermission(r *http.Request, p []string) (bool, error) {
+	return server.HasPermissionOn(r, p, "", "")
+}
+
+// HasPermissionOn checks the permissions like HasPermission, also counting
+// the roles assigned to the user on the resource or on all resources of its
+// type.
+func (server *Server) HasPermissionOn(r *http.Request, p []string, resourceType string, resourceID string) (bool, error) {
 	tokenString := auth.ExtractToken(r)
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -280,14 +326,89 @@ func (server *Server) HasPermission(r *http.Request, p []string) (bool, error) {
 		user := models.User{}
 
 		userGotten, err := user.FindUserByID(server.DB, uid)
-		for i := range userGotten.Roles {
-			for j := range userGotten.Roles[i].Permissions {
-				permissions = append(permissions, userGotten.Roles[i].Permissions[j].Name)
-			}
+		if err != nil {
+			return false, err
 		}
+		permissions, err = models.UserPermissionsOn(server.DB, userGotten, resourceType, resourceID)
 		if err != nil {
 			return false, err
 		}
 	}
 	return utils.Contains(p, permissions), nil
 }
+
+// CheckPermission godoc
+// @Summary Check a permission of a user on a resource
+// @Description Check whether a user has a permission on a resource, e.g. {"permission": "PORTFOLIO_EDIT", "resource_type": "portfolio", "resource_id": "42"}. Roles without a scope count for every resource, roles assigned on the resource or with the resource_id * on all resources of its type only for those. Without a resource only the roles without a scope count. Without a user_id the logged in user is checked; checking other users requires the "USERS_VIEW" Permission tagged to its role.
+// @Tags Permission
+// @Accept  json
+// @Produce  json
+// @Param check body models.Permission_Check true "Permission Check"
+// @Success 200 {object} models.Permission_Check_Result
+// @Security ApiKeyAuth
+// @Router /permissions/check [post]
+func (server *Server) CheckPermission(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	permissionCheck := models.Permission_Check{}
+	err = json.Unmarshal(body, &permissionCheck)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if permissionCheck.Permission == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Permission"))
+		return
+	}
+	err = models.ValidateResource(permissionCheck.ResourceType, permissionCheck.ResourceID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	uid := tokenID
+	if permissionCheck.UserID != nil && *permissionCheck.UserID != tokenID {
+		check, err := server.HasPermission(r, []string{"USERS_VIEW"})
+		if !check || err != nil {
+			responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+			return
+		}
+		uid = *permissionCheck.UserID
+	}
+
+	user := models.User{}
+	userGotten, err := user.FindUserByID(server.DB, uid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, errors.New("User Not Found"))
+		return
+	}
+	permissions, err := models.UserPermissionsOn(server.DB, userGotten, permissionCheck.ResourceType, permissionCheck.ResourceID)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, models.Permission_Check_Result{
+		Allowed:      userGotten.Enabled && utils.Contains([]string{permissionCheck.Permission}, permissions),
+		UserID:       uid,
+		Permission:   permissionCheck.Permission,
+		ResourceType: permissionCheck.ResourceType,
+		ResourceID:   permissionCheck.ResourceID,
+	})
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/middleware"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"github.com/jinzhu/gorm"
+)
+
+// defaultRateLimits holds the limits of the public endpoints per key. Each can
+// be overridden through RATE_LIMIT_<ROUTE>_<KEY>, e.g. RATE_LIMIT_LOGIN_IP.
+var defaultRateLimits = map[string]map[string]string{
+	"signup":          {"IP": "5/1h", "EMAIL": "3/1h", "CLIENT": "off"},
+	"login":           {"IP": "30/1m", "EMAIL": "10/1m", "CLIENT": "off"},
+	"magic_link":      {"IP": "10/1h", "EMAIL": "3/15m", "CLIENT": "off"},
+	"forgot_password": {"IP": "10/1h", "EMAIL": "3/1h", "CLIENT": "off"},
+	"password_reset":  {"IP": "10/1h", "EMAIL": "3/1h", "CLIENT": "off"},
+	"send_mail":       {"IP": "10/1h", "EMAIL": "3/1h", "CLIENT": "off"},
+	"oauth_token":     {"IP": "30/1m", "EMAIL": "off", "CLIENT": "off"},
+}
+
+// rateLimited wraps a public handler with the limits configured for route.
+func rateLimited(route string, next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	keys := []struct {
+		name string
+		key  middleware.KeyFunc
+	}{
+		{"IP", middleware.ByIP},
+		{"EMAIL", middleware.ByEmail},
+		{"CLIENT", middleware.ByClientID},
+	}
+	limits := []middleware.RateLimit{}
+	for _, k := range keys {
+		env := "RATE_LIMIT_" + strings.ToUpper(route) + "_" + k.name
+		if limit, ok := middleware.RateLimitFromEnv(route, env, defaultRateLimits[route][k.name], k.key); ok {
+			limits = append(limits, limit)
+		}
+	}
+	return middleware.SetMiddlewareRateLimit(next, limits...)
+}
+
+// databaseRateLimitStore keeps buckets in the database so that every
+// instance of the service shares the same limits.
+type databaseRateLimitStore struct {
+	DB        *gorm.DB
+	mu        sync.Mutex
+	takes     int
+	retention time.Duration
+}
+
+func newDatabaseRateLimitStore(db *gorm.DB) *databaseRateLimitStore {
+	return &databaseRateLimitStore{DB: db, retention: 24 * time.Hour}
+}
+
+func (s *databaseRateLimitStore) Peek(key string, limit middleware.RateLimit, now time.Time) (middleware.RateLimitResult, error) {
+	bucket := models.Rate_Limit_Bucket{Tokens: float64(limit.Burst), UpdatedAt: now}
+	err := bucket.FindRateLimitBucket(s.DB, key)
+	if err != nil {
+		return middleware.RateLimitResult{}, err
+	}
+	_, result := middleware.Refill(bucket.Tokens, bucket.UpdatedAt, limit, now)
+	return result, nil
+}
+
+func (s *databaseRateLimitStore) Take(key string, limit middleware.RateLimit, now time.Time) (middleware.RateLimitResult, error) {
+	s.mu.Lock()
+	s.takes++
+	prune := s.takes%1000 == 0
+	if limit.Period > s.retention {
+		s.retention = limit.Period
+	}
+	retention := s.retention
+	s.mu.Unlock()
+
+	bucket := models.Rate_Limit_Bucket{}
+	if prune {
+		err := bucket.PruneRateLimitBuckets(s.DB, now.Add(-retention))
+		if err != nil {
+			log.Printf("Cannot prune rate limit buckets: %v", err)
+		}
+	}
+	var result middleware.RateLimitResult
+	err := bucket.UpdateRateLimitBucket(s.DB, key, float64(limit.Burst), now, func(tokens float64, updatedAt time.Time) float64 {
+		tokens, result = middleware.Refill(tokens, updatedAt, limit, now)
+		return tokens
+	})
+	return result, err
+}
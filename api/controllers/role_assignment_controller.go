@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// CreateRoleAssignment godoc
+// @Summary Give a user a role on a resource
+// @Description Give a user the role, and the permissions it has and inherits, on one resource only, e.g. {"user_id": "...", "resource_type": "portfolio", "resource_id": "42"}. With the resource_id * the role applies to all resources of the type. Scoped roles count in permission checks on the resource, see /permissions/check. In order to access this API, someone must have "USERS_ASSIGN_TO_ROLE" Permission tagged to its role.
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param id path int true "id of the Role"
+// @Param assignment body models.Role_Assignment_Payload true "Role Assignment"
+// @Success 201 {object} models.Role_Assignment
+// @Security ApiKeyAuth
+// @Router /roles/{id}/assignments [post]
+func (server *Server) CreateRoleAssignment(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_ASSIGN_TO_ROLE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	rid, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Role_Assignment_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	role := models.Role{}
+	_, err = role.FindRoleByID(server.DB, uint32(rid))
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, errors.New("Role not found"))
+		return
+	}
+	assignment := models.Role_Assignment{}
+	assignment.Apply(payload)
+	assignment.Prepare(uint32(rid), tokenID)
+	err = assignment.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user := models.User{}
+	_, err = user.FindUserByID(server.DB, assignment.UserID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("User Not Found"))
+		return
+	}
+
+	event := models.Audit_Event{Action: "role.assign", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	err = event.SetAfter(assignment)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := assignment.SaveRoleAssignment(tx)
+		return err
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, assignment)
+}
+
+// GetRoleAssignments godoc
+// @Summary Get the scoped assignments of a role
+// @Description Get the users the role is given to on resources. In order to access this API, someone must have "ROLES_VIEW" Permission tagged to its role.
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param id path int true "id of the Role"
+// @Success 200 {object} models.Role_Assignment
+// @Security ApiKeyAuth
+// @Router /roles/{id}/assignments [get]
+func (server *Server) GetRoleAssignments(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"ROLES_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	rid, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	assignment := models.Role_Assignment{}
+	assignments, err := assignment.FindRoleAssignmentsByRoleID(server.DB, uint32(rid))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, assignments)
+}
+
+// DeleteRoleAssignment godoc
+// @Summary Take a role on a resource away from a user
+// @Description Delete a scoped assignment of the role. In order to access this API, someone must have "USERS_ASSIGN_TO_ROLE" Permission tagged to its role.
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param id1 path int true "id of the Role"
+// @Param id2 path string true "id of the assignment"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /roles/{id1}/assignments/{id2} [delete]
+func (server *Server) DeleteRoleAssignment(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_ASSIGN_TO_ROLE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	rid, err := strconv.ParseUint(vars["id1"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	aid, err := uuid.Parse(vars["id2"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	assignment := models.Role_Assignment{}
+	deleteAssignment, err := assignment.FindRoleAssignmentByID(server.DB, aid)
+	if err != nil || deleteAssignment.RoleID != uint32(rid) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("Role Assignment Not Found"))
+		return
+	}
+	event := models.Audit_Event{Action: "role.unassign", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	err = event.SetBefore(deleteAssignment)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := assignment.DeleteARoleAssignment(tx, uint32(rid), aid)
+		return err
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Entity", aid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
@@ -14,11 +14,12 @@ import (
 	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
 )
 
 // CreateRole godoc
 // @Summary Create a role in the system
-// @Description Create a role in the system. User must have "MANAGE_ROLES" permission tagged to its role in order to use this API.
+// @Description Create a role in the system. With a parent_id the role inherits the permissions of the parent role and of the roles the parent inherits from. User must have "MANAGE_ROLES" permission tagged to its role in order to use this API.
 // @Tags Role
 // @Accept  json
 // @Produce  json
@@ -64,7 +65,22 @@ func (server *Server) CreateRole(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	roleCreated, err := role.SaveRole(server.DB)
+	err = role.ValidateParent(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	var roleCreated *models.Role
+	event := models.Audit_Event{Action: "role.create", TargetType: "role"}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		roleCreated, err = role.SaveRole(tx)
+		if err != nil {
+			return err
+		}
+		event.TargetID = fmt.Sprintf("%d", roleCreated.ID)
+		return event.SetAfter(roleCreated)
+	})
 
 	if err != nil {
 
@@ -145,9 +161,51 @@ func (server *Server) GetRole(w http.ResponseWriter, r *http.Request) {
 	responses.JSON(w, http.StatusOK, roleGotten)
 }
 
+// GetRoleEffectivePermissions godoc
+// @Summary Get the effective permissions of a role
+// @Description Get the permissions of a role together with those it inherits from its parent roles. Each permission lists the roles it comes from, with a depth of 0 for the role itself, 1 for its parent and so on. In order to access this API, someone must have "ROLES_VIEW" Permission tagged to its role.
+// @Tags Role
+// @Accept  json
+// @Produce  json
+// @Param id path int true "ID of the role"
+// @Success 200 {object} models.Effective_Permission
+// @Security ApiKeyAuth
+// @Router /roles/{id}/effective-permissions [get]
+func (server *Server) GetRoleEffectivePermissions(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"ROLES_VIEW"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	rid, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	role := models.Role{}
+	_, err = role.FindRoleByID(server.DB, uint32(rid))
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	permissions, err := models.EffectivePermissions(server.DB, []uint32{uint32(rid)})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, permissions)
+}
+
 // UpdateRole godoc
 // @Summary Update a role by id in the system
-// @Description Update a role by id in the system. In order to access this API, someone must have "MANAGE_ROLES" Permission tagged to its role.
+// @Description Update a role by id in the system. A parent_id of null stops the role inheriting permissions, a role cannot inherit from itself or from the roles inheriting from it. In order to access this API, someone must have "MANAGE_ROLES" Permission tagged to its role.
 // @Tags Role
 // @Accept  json
 // @Produce  json
@@ -195,6 +253,12 @@ func (server *Server) UpdateRole(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
+	event := models.Audit_Event{Action: "role.update", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	err = event.SetBefore(updateRole)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
 	err = json.Unmarshal(body, &updateRole)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
@@ -205,7 +269,21 @@ func (server *Server) UpdateRole(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	updatedRole, err := updateRole.UpdateARole(server.DB, uint32(rid), tokenID)
+	updateRole.ID = uint32(rid)
+	err = updateRole.ValidateParent(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	var updatedRole *models.Role
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		updatedRole, err = updateRole.UpdateARole(tx, uint32(rid), tokenID)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(updatedRole)
+	})
 	if err != nil {
 		formattedError := customErrorFormat.FormatError(err.Error())
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
@@ -216,7 +294,7 @@ func (server *Server) UpdateRole(w http.ResponseWriter, r *http.Request) {
 
 // DeleteRole godoc
 // @Summary Delete a role by id in the system
-// @Description Delete a role by id in the system. In order to access this API, someone must have "MANAGE_ROLES" Permission tagged to its role.
+// @Description Delete a role by id in the system. The roles inheriting from it inherit from its parent instead. In order to access this API, someone must have "MANAGE_ROLES" Permission tagged to its role.
 // @Tags Role
 // @Accept  json
 // @Produce  json
@@ -245,7 +323,27 @@ func (server *Server) DeleteRole(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	_, err = role.DeleteARole(server.DB, uint32(rid))
+	deleteRole, err := role.FindRoleByID(server.DB, uint32(rid))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	event := models.Audit_Event{Action: "role.delete", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	err = event.SetBefore(deleteRole)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		uids, err := models.FindRoleHolderIDs(tx, uint32(rid))
+		if err != nil {
+			return err
+		}
+		return models.TrackRoleChanges(tx, uids, func() error {
+			_, err := role.DeleteARole(tx, uint32(rid))
+			return err
+		})
+	})
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
@@ -294,6 +392,7 @@ func (server *Server) AddUsersToRole(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userRoles := []models.User_Role{}
 	for i := range uids.Users {
 		ur := models.User_Role{}
 		ur.UserID = uids.Users[i]
@@ -305,14 +404,41 @@ func (server *Server) AddUsersToRole(w http.ResponseWriter, r *http.Request) {
 			responses.ERROR(w, http.StatusUnprocessableEntity, err)
 			return
 		}
-		err := ur.SaveUserToRole(server.DB)
+		userRoles = append(userRoles, ur)
+	}
+	event := models.Audit_Event{Action: "role.add_users", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	members := models.User_Role{}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		before, err := members.FindUserIDsByRoleID(tx, uint32(rid))
 		if err != nil {
-
-			formattedError := customErrorFormat.FormatError(err.Error())
-	
-			responses.ERROR(w, http.StatusInternalServerError, formattedError)
-			return
+			return err
+		}
+		err = event.SetBefore(map[string]interface{}{"users": before})
+		if err != nil {
+			return err
+		}
+		for i := range userRoles {
+			err := userRoles[i].SaveUserToRole(tx)
+			if err != nil {
+				return err
+			}
+			err = models.PublishUserEvent(tx, models.EventUserRoleAssigned, userRoles[i].UserID, models.RoleEventData(userRoles[i].UserID, userRoles[i].RoleID))
+			if err != nil {
+				return err
+			}
+		}
+		after, err := members.FindUserIDsByRoleID(tx, uint32(rid))
+		if err != nil {
+			return err
 		}
+		return event.SetAfter(map[string]interface{}{"users": after})
+	})
+	if err != nil {
+
+		formattedError := customErrorFormat.FormatError(err.Error())
+
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
 	}
 	w.Header().Set("Location", fmt.Sprintf("%s%s/", r.Host, r.RequestURI))
 	responses.JSON(w, http.StatusCreated, "")
@@ -354,7 +480,30 @@ func (server *Server) DeleteUsersFromRole(w http.ResponseWriter, r *http.Request
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	_, err = roleUsers.DeleteUsersFromRole(server.DB, uint32(rid), uid)
+	event := models.Audit_Event{Action: "role.remove_user", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		before, err := roleUsers.FindUserIDsByRoleID(tx, uint32(rid))
+		if err != nil {
+			return err
+		}
+		err = event.SetBefore(map[string]interface{}{"users": before})
+		if err != nil {
+			return err
+		}
+		_, err = roleUsers.DeleteUsersFromRole(tx, uint32(rid), uid)
+		if err != nil {
+			return err
+		}
+		err = models.PublishUserEvent(tx, models.EventUserRoleRemoved, uid, models.RoleEventData(uid, uint32(rid)))
+		if err != nil {
+			return err
+		}
+		after, err := roleUsers.FindUserIDsByRoleID(tx, uint32(rid))
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(map[string]interface{}{"users": after})
+	})
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
@@ -403,6 +552,7 @@ func (server *Server) AddPermissionsToRole(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	rolePermissions := []models.Role_Permission{}
 	for i := range pids.Permissions {
 		rp := models.Role_Permission{}
 		rp.PermissionID = uint32(pids.Permissions[i])
@@ -414,14 +564,37 @@ func (server *Server) AddPermissionsToRole(w http.ResponseWriter, r *http.Reques
 			responses.ERROR(w, http.StatusUnprocessableEntity, err)
 			return
 		}
-		err := rp.SavePermissionToRole(server.DB)
+		rolePermissions = append(rolePermissions, rp)
+	}
+	event := models.Audit_Event{Action: "role.add_permissions", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	granted := models.Role_Permission{}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		before, err := granted.FindPermissionIDsByRoleID(tx, uint32(rid))
 		if err != nil {
-
-			formattedError := customErrorFormat.FormatError(err.Error())
-	
-			responses.ERROR(w, http.StatusInternalServerError, formattedError)
-			return
+			return err
 		}
+		err = event.SetBefore(map[string]interface{}{"permissions": before})
+		if err != nil {
+			return err
+		}
+		for i := range rolePermissions {
+			err := rolePermissions[i].SavePermissionToRole(tx)
+			if err != nil {
+				return err
+			}
+		}
+		after, err := granted.FindPermissionIDsByRoleID(tx, uint32(rid))
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(map[string]interface{}{"permissions": after})
+	})
+	if err != nil {
+
+		formattedError := customErrorFormat.FormatError(err.Error())
+
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
 	}
 	w.Header().Set("Location", fmt.Sprintf("%s%s/", r.Host, r.RequestURI))
 	responses.JSON(w, http.StatusCreated, "")
@@ -462,7 +635,26 @@ func (server *Server) DeletePermissionsFromRole(w http.ResponseWriter, r *http.R
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	_, err = rolePermission.DeleteRoleFromPermission(server.DB, uint32(rid), uint32(pid))
+	event := models.Audit_Event{Action: "role.remove_permission", TargetType: "role", TargetID: fmt.Sprintf("%d", rid)}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		before, err := rolePermission.FindPermissionIDsByRoleID(tx, uint32(rid))
+		if err != nil {
+			return err
+		}
+		err = event.SetBefore(map[string]interface{}{"permissions": before})
+		if err != nil {
+			return err
+		}
+		_, err = rolePermission.DeleteRoleFromPermission(tx, uint32(rid), uint32(pid))
+		if err != nil {
+			return err
+		}
+		after, err := rolePermission.FindPermissionIDsByRoleID(tx, uint32(rid))
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(map[string]interface{}{"permissions": after})
+	})
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
@@ -0,0 +1,446 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/markbates/goth"
+)
+
+// CreateRoleMappingRule godoc
+// @Summary Add a role mapping rule
+// @Description Give users logging in through an OAuth or OpenID Connect provider a role when one of their claims has the value, compared case-insensitively; a value of * matches any value. Rules without a provider apply to all providers. Besides the claims of the provider, like groups, the rules can look at email_domain (only for verified emails), google_domain (the Google Workspace domain), github_org and github_team (as org/team). The rules are evaluated on every login: the user gets the roles of the matching rules and loses the roles of the rules that no longer match, roles no rule gives are left alone. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" and "USERS_ASSIGN_TO_ROLE" Permissions tagged to its role.
+// @Tags Role Mapping
+// @Accept  json
+// @Produce  json
+// @Param rule body models.Role_Mapping_Rule_Payload true "Role Mapping Rule"
+// @Success 201 {object} models.Role_Mapping_Rule
+// @Security ApiKeyAuth
+// @Router /role-mappings [post]
+func (server *Server) CreateRoleMappingRule(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS", "USERS_ASSIGN_TO_ROLE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Role_Mapping_Rule_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	rule := models.Role_Mapping_Rule{Enabled: true}
+	rule.Apply(payload)
+	rule.Prepare(tokenID)
+	err = rule.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	role := models.Role{}
+	_, err = role.FindRoleByID(server.DB, rule.RoleID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Role Not Found"))
+		return
+	}
+
+	event := models.Audit_Event{Action: "role_mapping.create", TargetType: "role_mapping", TargetID: rule.ID.String()}
+	err = event.SetAfter(rule)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := rule.SaveRoleMappingRule(tx)
+		return err
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, rule)
+}
+
+// GetRoleMappingRules godoc
+// @Summary Get all role mapping rules
+// @Description Get all role mapping rules. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags Role Mapping
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.Role_Mapping_Rule
+// @Security ApiKeyAuth
+// @Router /role-mappings [get]
+func (server *Server) GetRoleMappingRules(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	rule := models.Role_Mapping_Rule{}
+	rules, err := rule.FindAllRoleMappingRules(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, rules)
+}
+
+// GetRoleMappingRule godoc
+// @Summary Get a role mapping rule by id
+// @Description Get a role mapping rule by id. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags Role Mapping
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the rule"
+// @Success 200 {object} models.Role_Mapping_Rule
+// @Security ApiKeyAuth
+// @Router /role-mappings/{id} [get]
+func (server *Server) GetRoleMappingRule(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	rid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	rule := models.Role_Mapping_Rule{}
+	ruleGotten, err := rule.FindRoleMappingRuleByID(server.DB, rid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, ruleGotten)
+}
+
+// UpdateRoleMappingRule godoc
+// @Summary Update a role mapping rule by id
+// @Description Replace a role mapping rule. Users keep the roles the old rule gave them until their next login. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" and "USERS_ASSIGN_TO_ROLE" Permissions tagged to its role.
+// @Tags Role Mapping
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the rule"
+// @Param rule body models.Role_Mapping_Rule_Payload true "Role Mapping Rule"
+// @Success 200 {object} models.Role_Mapping_Rule
+// @Security ApiKeyAuth
+// @Router /role-mappings/{id} [put]
+func (server *Server) UpdateRoleMappingRule(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS", "USERS_ASSIGN_TO_ROLE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	rid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Role_Mapping_Rule_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	fetchRule := models.Role_Mapping_Rule{}
+	rule, err := fetchRule.FindRoleMappingRuleByID(server.DB, rid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "role_mapping.update", TargetType: "role_mapping", TargetID: rid.String()}
+	err = event.SetBefore(rule)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	rule.Apply(payload)
+	err = rule.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	role := models.Role{}
+	_, err = role.FindRoleByID(server.DB, rule.RoleID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Role Not Found"))
+		return
+	}
+
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := rule.UpdateARoleMappingRule(tx, tokenID)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(rule)
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusOK, rule)
+}
+
+// DeleteRoleMappingRule godoc
+// @Summary Delete a role mapping rule by id
+// @Description Delete a role mapping rule. Users keep the roles it gave them, which are then managed like any other role assignment. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" and "USERS_ASSIGN_TO_ROLE" Permissions tagged to its role.
+// @Tags Role Mapping
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the rule"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /role-mappings/{id} [delete]
+func (server *Server) DeleteRoleMappingRule(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS", "USERS_ASSIGN_TO_ROLE"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	rid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	rule := models.Role_Mapping_Rule{}
+	deleteRule, err := rule.FindRoleMappingRuleByID(server.DB, rid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "role_mapping.delete", TargetType: "role_mapping", TargetID: rid.String()}
+	err = event.SetBefore(deleteRule)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := rule.DeleteARoleMappingRule(tx, rid)
+		return err
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Entity", rid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// DryRunRoleMappings godoc
+// @Summary Try the role mapping rules on a set of claims
+// @Description Show which enabled rules a login at the provider with the claims would match, the roles the user would get and the mapped roles the user would lose. Claims are lists of values, e.g. {"provider": "azure", "claims": {"groups": ["engineering"], "email_domain": ["example.com"]}}. Nothing is changed. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags Role Mapping
+// @Accept  json
+// @Produce  json
+// @Param login body models.Role_Mapping_Dry_Run true "Claims of a login"
+// @Success 200 {object} models.Role_Mapping_Result
+// @Security ApiKeyAuth
+// @Router /role-mappings/dry-run [post]
+func (server *Server) DryRunRoleMappings(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	dryRun := models.Role_Mapping_Dry_Run{}
+	err = json.Unmarshal(body, &dryRun)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	rule := models.Role_Mapping_Rule{}
+	rules, err := rule.FindRoleMappingRulesForProvider(server.DB, strings.ToLower(strings.TrimSpace(dryRun.Provider)))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	result, _, err := evaluateRoleMappings(server.DB, rules, dryRun.Claims)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, result)
+}
+
+// evaluateRoleMappings returns the rules the claims match with the roles
+// they give and take away, and all roles the rules can give.
+func evaluateRoleMappings(db *gorm.DB, rules []models.Role_Mapping_Rule, claims map[string][]string) (models.Role_Mapping_Result, []*models.Role, error) {
+	result := models.Role_Mapping_Result{Rules: []models.Role_Mapping_Rule{}, Roles: []*models.Role{}, Removed: []*models.Role{}}
+	if len(rules) == 0 {
+		return result, []*models.Role{}, nil
+	}
+	rids := []uint32{}
+	mappedIDs := map[uint32]bool{}
+	wanted := map[uint32]bool{}
+	for i := range rules {
+		if !mappedIDs[rules[i].RoleID] {
+			mappedIDs[rules[i].RoleID] = true
+			rids = append(rids, rules[i].RoleID)
+		}
+		if rules[i].Matches(claims) {
+			result.Rules = append(result.Rules, rules[i])
+			wanted[rules[i].RoleID] = true
+		}
+	}
+	role := models.Role{}
+	mapped, err := role.FindRolesByIDs(db, rids)
+	if err != nil {
+		return result, nil, err
+	}
+	for _, role := range mapped {
+		if wanted[role.ID] {
+			result.Roles = append(result.Roles, role)
+		} else {
+			result.Removed = append(result.Removed, role)
+		}
+	}
+	return result, mapped, nil
+}
+
+// syncRoleMappings gives the user the roles of the rules the claims match,
+// and takes away those of the rules that no longer match if a rule granted
+// them. It returns the audit events of the changes.
+func syncRoleMappings(tx *gorm.DB, r *http.Request, uid uuid.UUID, rules []models.Role_Mapping_Rule, claims map[string][]string) ([]*models.Audit_Event, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	result, mapped, err := evaluateRoleMappings(tx, rules, claims)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[uint32]bool{}
+	for _, role := range result.Roles {
+		wanted[role.ID] = true
+	}
+	return syncMappedRoles(tx, r, uid, models.RoleSourceMapping, mapped, func(role *models.Role) bool {
+		return wanted[role.ID]
+	})
+}
+
+// oauthClaims collects the claims of a login at the provider the rules look
+// at. The GitHub memberships take extra API calls and are only fetched when a
+// rule needs them.
+func oauthClaims(provider string, gothUser goth.User, rules []models.Role_Mapping_Rule) (map[string][]string, error) {
+	claims := map[string][]string{}
+	for name, value := range gothUser.RawData {
+		switch v := value.(type) {
+		case string:
+			claims[name] = []string{v}
+		case bool:
+			claims[name] = []string{strconv.FormatBool(v)}
+		case float64:
+			claims[name] = []string{strconv.FormatFloat(v, 'f', -1, 64)}
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					claims[name] = append(claims[name], s)
+				}
+			}
+		}
+	}
+	// The derived claims cannot be set by the provider.
+	for _, name := range []string{models.ClaimEmailDomain, models.ClaimGoogleDomain, models.ClaimGitHubOrg, models.ClaimGitHubTeam} {
+		delete(claims, name)
+	}
+	if at := strings.LastIndex(gothUser.Email, "@"); at >= 0 && oauthEmailVerified(provider, gothUser) {
+		claims[models.ClaimEmailDomain] = []string{strings.ToLower(gothUser.Email[at+1:])}
+	}
+	if hd, ok := gothUser.RawData["hd"].(string); ok && provider == "google" && hd != "" {
+		claims[models.ClaimGoogleDomain] = []string{hd}
+	}
+	if provider == "github" && (models.UsesClaim(rules, models.ClaimGitHubOrg) || models.UsesClaim(rules, models.ClaimGitHubTeam)) {
+		orgs, teams, err := sso.GitHubMemberships(gothUser.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		claims[models.ClaimGitHubOrg] = orgs
+		claims[models.ClaimGitHubTeam] = teams
+	}
+	return claims, nil
+}
@@ -9,6 +9,8 @@ import (
 
 func (s *Server) initializeRoutes() {
 
+	s.Router.Use(middleware.SetMiddlewareRequestID)
+
 	// Index Page route. Sample page to demo OAuth2
 	s.Router.HandleFunc("/", s.IndexPage).Methods("GET")
 
@@ -16,33 +18,57 @@ func (s *Server) initializeRoutes() {
 	s.Router.HandleFunc("/heartbeat", middleware.SetMiddlewareJSON(s.Heartbeat)).Methods("GET")
 	
 	// SignUp Route
-	s.Router.HandleFunc("/signup", middleware.SetMiddlewareJSON(s.SignUp)).Methods("POST")
+	s.Router.HandleFunc("/signup", middleware.SetMiddlewareJSON(rateLimited("signup", s.SignUp))).Methods("POST")
 
 	// Login Route
-	s.Router.HandleFunc("/login", middleware.SetMiddlewareJSON(s.Login)).Methods("POST")
+	s.Router.HandleFunc("/login", middleware.SetMiddlewareJSON(rateLimited("login", s.Login))).Methods("POST")
+	s.Router.HandleFunc("/login/magic-link", middleware.SetMiddlewareJSON(rateLimited("magic_link", s.RequestMagicLink))).Methods("POST")
+	s.Router.HandleFunc("/login/magic-link/consume", middleware.SetMiddlewareJSON(s.ConsumeMagicLink)).Methods("POST")
+	s.Router.HandleFunc("/login-alerts/deny", s.DenyLoginPage).Methods("GET")
+	s.Router.HandleFunc("/login-alerts/deny", middleware.SetMiddlewareJSON(s.DenyLogin)).Methods("POST")
 	s.Router.HandleFunc("/refresh", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.Refresh))).Methods("POST")
 	s.Router.HandleFunc("/logout", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.Logout))).Methods("POST")
 
 	// OAuth Route
-	s.Router.HandleFunc("/auth/{provider}", middleware.SetMiddlewareJSON(s.OauthSignIn)).Methods("GET")
-	s.Router.HandleFunc("/auth/{provider}/callback", middleware.SetMiddlewareJSON(s.OauthSuccessCallback)).Methods("GET")
+	s.Router.HandleFunc("/auth/{provider}", withOAuthProviders(s.OauthSignIn)).Methods("GET")
+	s.Router.HandleFunc("/auth/{provider}/callback", withOAuthProviders(s.OauthSuccessCallback)).Methods("GET")
+	s.Router.HandleFunc("/auth/token", middleware.SetMiddlewareJSON(rateLimited("oauth_token", s.ExchangeOauthCode))).Methods("POST")
 	s.Router.HandleFunc("/logout/{provider}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.OauthLogout))).Methods("POST")
 
 	// Users routes
 	s.Router.HandleFunc("/user/me", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetLoggedInUser))).Methods("GET")
+	s.Router.HandleFunc("/user/me/login-history", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetMyLoginHistory))).Methods("GET")
+	s.Router.HandleFunc("/user/me/identities", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetMyIdentities))).Methods("GET")
+	s.Router.HandleFunc("/user/me/identities/{provider}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.LinkMyIdentity))).Methods("POST")
+	s.Router.HandleFunc("/user/me/identities/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UnlinkMyIdentity))).Methods("DELETE")
 	s.Router.HandleFunc("/users", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateUser))).Methods("POST")
 	s.Router.HandleFunc("/users", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetUsers))).Methods("GET")
+	// Registered before /users/{id}, which would match it too.
+	s.Router.HandleFunc("/users/forgotPassword", s.ForgotPasswordPage).Methods("GET")
 	s.Router.HandleFunc("/users/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetUser))).Methods("GET")
 	s.Router.HandleFunc("/users/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdateUser))).Methods("PUT")
 	s.Router.HandleFunc("/users/{id}", middleware.SetMiddlewareAuthentication(s.DeleteUser)).Methods("DELETE")
 	s.Router.HandleFunc("/users/{id}/setPassword", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.SetPassword))).Methods("POST")
-	s.Router.HandleFunc("/users/forgotPassword", middleware.SetMiddlewareJSON(s.ForgotPassword)).Methods("POST")
-	s.Router.HandleFunc("/users/sendMail", middleware.SetMiddlewareJSON(s.SendMail)).Methods("POST")
+	s.Router.HandleFunc("/users/forgotPassword", middleware.SetMiddlewareJSON(rateLimited("forgot_password", s.ForgotPassword))).Methods("POST")
+	s.Router.HandleFunc("/users/forgotPassword/request", middleware.SetMiddlewareJSON(rateLimited("password_reset", s.RequestPasswordReset))).Methods("POST")
+	s.Router.HandleFunc("/password-policy", middleware.SetMiddlewareJSON(s.GetPasswordPolicy)).Methods("GET")
+	s.Router.HandleFunc("/users/sendMail", middleware.SetMiddlewareJSON(rateLimited("send_mail", s.SendMail))).Methods("POST")
 	s.Router.HandleFunc("/users/{id}/enableUser", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.EnableUser))).Methods("PUT")
+	s.Router.HandleFunc("/users/{id}/unlock", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UnlockUser))).Methods("POST")
+	s.Router.HandleFunc("/users/{id}/login-history", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetUserLoginHistory))).Methods("GET")
+
+	// Invitation routes
+	s.Router.HandleFunc("/invitations", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateInvitation))).Methods("POST")
+	s.Router.HandleFunc("/invitations", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetInvitations))).Methods("GET")
+	s.Router.HandleFunc("/invitations/accept", s.AcceptInvitationPage).Methods("GET")
+	s.Router.HandleFunc("/invitations/accept", middleware.SetMiddlewareJSON(s.AcceptInvitation)).Methods("POST")
+	s.Router.HandleFunc("/invitations/{id}/resend", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.ResendInvitation))).Methods("POST")
+	s.Router.HandleFunc("/invitations/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.RevokeInvitation))).Methods("DELETE")
 
 	// Permission routes
 	s.Router.HandleFunc("/permissions", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreatePermission))).Methods("POST")
 	s.Router.HandleFunc("/permissions", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetPermissions))).Methods("GET")
+	s.Router.HandleFunc("/permissions/check", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CheckPermission))).Methods("POST")
 	s.Router.HandleFunc("/permissions/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetPermission))).Methods("GET")
 	s.Router.HandleFunc("/permissions/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdatePermission))).Methods("PUT")
 	s.Router.HandleFunc("/permissions/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeletePermission))).Methods("DELETE")
@@ -53,15 +79,94 @@ func (s *Server) initializeRoutes() {
 	s.Router.HandleFunc("/roles/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetRole))).Methods("GET")
 	s.Router.HandleFunc("/roles/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdateRole))).Methods("PUT")
 	s.Router.HandleFunc("/roles/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteRole))).Methods("DELETE")
+	s.Router.HandleFunc("/roles/{id}/effective-permissions", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetRoleEffectivePermissions))).Methods("GET")
 
 	// Map Users to Roles routes
 	s.Router.HandleFunc("/roles/{id}/users", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.AddUsersToRole))).Methods("POST")
 	s.Router.HandleFunc("/roles/{id1}/users/{id2}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteUsersFromRole))).Methods("DELETE")
 
+	// Scoped role assignment routes
+	s.Router.HandleFunc("/roles/{id}/assignments", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateRoleAssignment))).Methods("POST")
+	s.Router.HandleFunc("/roles/{id}/assignments", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetRoleAssignments))).Methods("GET")
+	s.Router.HandleFunc("/roles/{id1}/assignments/{id2}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteRoleAssignment))).Methods("DELETE")
+
 	// Map Permissions to Roles routes
 	s.Router.HandleFunc("/roles/{id}/permissions", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.AddPermissionsToRole))).Methods("POST")
 	s.Router.HandleFunc("/roles/{id1}/permissions/{id2}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeletePermissionsFromRole))).Methods("DELETE")
 
+	// Group routes
+	s.Router.HandleFunc("/groups", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateGroup))).Methods("POST")
+	s.Router.HandleFunc("/groups", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetGroups))).Methods("GET")
+	s.Router.HandleFunc("/groups/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetGroup))).Methods("GET")
+	s.Router.HandleFunc("/groups/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdateGroup))).Methods("PUT")
+	s.Router.HandleFunc("/groups/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteGroup))).Methods("DELETE")
+	s.Router.HandleFunc("/groups/{id}/users", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetGroupMembers))).Methods("GET")
+	s.Router.HandleFunc("/groups/{id}/users", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.AddUsersToGroup))).Methods("POST")
+	s.Router.HandleFunc("/groups/{id1}/users/{id2}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteUserFromGroup))).Methods("DELETE")
+	s.Router.HandleFunc("/groups/{id}/roles", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.AddRolesToGroup))).Methods("POST")
+	s.Router.HandleFunc("/groups/{id1}/roles/{id2}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteRoleFromGroup))).Methods("DELETE")
+
+	// Audit log routes
+	s.Router.HandleFunc("/audit-events", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetAuditEvents))).Methods("GET")
+	s.Router.HandleFunc("/audit-ledger/verify", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.VerifyLedger))).Methods("GET")
+
+	// Webhook routes
+	s.Router.HandleFunc("/webhooks", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateWebhook))).Methods("POST")
+	s.Router.HandleFunc("/webhooks", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetWebhooks))).Methods("GET")
+	s.Router.HandleFunc("/webhooks/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetWebhook))).Methods("GET")
+	s.Router.HandleFunc("/webhooks/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdateWebhook))).Methods("PUT")
+	s.Router.HandleFunc("/webhooks/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteWebhook))).Methods("DELETE")
+	s.Router.HandleFunc("/webhook-deliveries", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetWebhookDeliveries))).Methods("GET")
+	s.Router.HandleFunc("/webhook-deliveries/{id}/redeliver", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.RedeliverWebhook))).Methods("POST")
+
+	// SCIM 2.0 provisioning routes
+	s.Router.HandleFunc("/scim-tokens", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateScimToken))).Methods("POST")
+	s.Router.HandleFunc("/scim-tokens", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetScimTokens))).Methods("GET")
+	s.Router.HandleFunc("/scim-tokens/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.RevokeScimToken))).Methods("DELETE")
+	s.Router.HandleFunc("/scim/v2/ServiceProviderConfig", s.GetScimServiceProviderConfig).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/Schemas", s.GetScimSchemas).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/Schemas/{id}", s.GetScimSchemas).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/ResourceTypes", s.GetScimResourceTypes).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/ResourceTypes/{id}", s.GetScimResourceTypes).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/Users", s.scimAuthenticated(s.GetScimUsers)).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/Users", s.scimAuthenticated(s.CreateScimUser)).Methods("POST")
+	s.Router.HandleFunc("/scim/v2/Users/{id}", s.scimAuthenticated(s.GetScimUser)).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/Users/{id}", s.scimAuthenticated(s.ReplaceScimUser)).Methods("PUT")
+	s.Router.HandleFunc("/scim/v2/Users/{id}", s.scimAuthenticated(s.PatchScimUser)).Methods("PATCH")
+	s.Router.HandleFunc("/scim/v2/Users/{id}", s.scimAuthenticated(s.DeleteScimUser)).Methods("DELETE")
+	s.Router.HandleFunc("/scim/v2/Groups", s.scimAuthenticated(s.GetScimGroups)).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/Groups", s.scimAuthenticated(s.CreateScimGroup)).Methods("POST")
+	s.Router.HandleFunc("/scim/v2/Groups/{id}", s.scimAuthenticated(s.GetScimGroup)).Methods("GET")
+	s.Router.HandleFunc("/scim/v2/Groups/{id}", s.scimAuthenticated(s.ReplaceScimGroup)).Methods("PUT")
+	s.Router.HandleFunc("/scim/v2/Groups/{id}", s.scimAuthenticated(s.PatchScimGroup)).Methods("PATCH")
+	s.Router.HandleFunc("/scim/v2/Groups/{id}", s.scimAuthenticated(s.DeleteScimGroup)).Methods("DELETE")
+
+	// SAML 2.0 service provider routes
+	s.Router.HandleFunc("/saml-providers", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateSamlProvider))).Methods("POST")
+	s.Router.HandleFunc("/saml-providers", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetSamlProviders))).Methods("GET")
+	s.Router.HandleFunc("/saml-providers/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetSamlProvider))).Methods("GET")
+	s.Router.HandleFunc("/saml-providers/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdateSamlProvider))).Methods("PUT")
+	s.Router.HandleFunc("/saml-providers/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteSamlProvider))).Methods("DELETE")
+	s.Router.HandleFunc("/saml/{name}/metadata", s.GetSamlMetadata).Methods("GET")
+	s.Router.HandleFunc("/saml/{name}/login", s.SamlLogin).Methods("GET")
+	s.Router.HandleFunc("/saml/{name}/acs", middleware.SetMiddlewareJSON(s.SamlACS)).Methods("POST")
+
+	// OpenID Connect provider routes
+	s.Router.HandleFunc("/oidc-providers", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateOidcProvider))).Methods("POST")
+	s.Router.HandleFunc("/oidc-providers", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetOidcProviders))).Methods("GET")
+	s.Router.HandleFunc("/oidc-providers/reload", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.ReloadOAuthProviders))).Methods("POST")
+	s.Router.HandleFunc("/oidc-providers/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetOidcProvider))).Methods("GET")
+	s.Router.HandleFunc("/oidc-providers/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdateOidcProvider))).Methods("PUT")
+	s.Router.HandleFunc("/oidc-providers/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteOidcProvider))).Methods("DELETE")
+
+	// Role mapping routes
+	s.Router.HandleFunc("/role-mappings", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.CreateRoleMappingRule))).Methods("POST")
+	s.Router.HandleFunc("/role-mappings", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetRoleMappingRules))).Methods("GET")
+	s.Router.HandleFunc("/role-mappings/dry-run", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DryRunRoleMappings))).Methods("POST")
+	s.Router.HandleFunc("/role-mappings/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.GetRoleMappingRule))).Methods("GET")
+	s.Router.HandleFunc("/role-mappings/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.UpdateRoleMappingRule))).Methods("PUT")
+	s.Router.HandleFunc("/role-mappings/{id}", middleware.SetMiddlewareJSON(middleware.SetMiddlewareAuthentication(s.DeleteRoleMappingRule))).Methods("DELETE")
+
 	// Swagger
     s.Router.PathPrefix("/swagger").Handler(httpSwagger.WrapHandler)
 }
\ No newline at end of file
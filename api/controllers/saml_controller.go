@@ -0,0 +1,211 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/crewjam/saml"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// samlServiceProvider builds the service provider of the enabled SAML
+// provider named in the path.
+func (server *Server) samlServiceProvider(r *http.Request) (*models.Saml_Provider, *saml.ServiceProvider, error) {
+	provider := models.Saml_Provider{}
+	fetchProvider, err := provider.FindSamlProviderByName(server.DB, mux.Vars(r)["name"])
+	if err != nil {
+		return nil, nil, err
+	}
+	sp, err := sso.NewServiceProvider(fetchProvider.SAMLProvider(), samlMetadataURL(fetchProvider.Name), samlACSURL(fetchProvider.Name))
+	if err != nil {
+		return nil, nil, err
+	}
+	return fetchProvider, sp, nil
+}
+
+func samlMetadataURL(name string) string {
+	return serviceURL("/saml/" + name + "/metadata")
+}
+
+func samlACSURL(name string) string {
+	return serviceURL("/saml/" + name + "/acs")
+}
+
+// GetSamlMetadata godoc
+// @Summary Get the SAML service provider metadata
+// @Description Get the metadata to register the service at a SAML identity provider. Its entity ID is the URL of the metadata, its assertion consumer service /saml/{name}/acs with the HTTP-POST binding.
+// @Tags SAML
+// @Produce  xml
+// @Param name path string true "Name of the SAML provider"
+// @Success 200 {string} string
+// @Router /saml/{name}/metadata [get]
+func (server *Server) GetSamlMetadata(w http.ResponseWriter, r *http.Request) {
+	_, sp, err := server.samlServiceProvider(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	metadata, err := sso.Metadata(sp)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(metadata)
+}
+
+// SamlLogin godoc
+// @Summary Log in with a SAML identity provider
+// @Description Send the browser here to log in at the SAML identity provider. It is redirected, or for the post binding sent a form posting, the AuthnRequest to the identity provider, which answers at /saml/{name}/acs. The redirect_uri has to be one of OAUTH_REDIRECT_URIS and defaults to the first; the browser is sent there after the login like for /auth/{provider}. The device_id is the one the tokens are issued for.
+// @Tags SAML
+// @Produce  html
+// @Param name path string true "Name of the SAML provider"
+// @Param device_id query string true "Device ID"
+// @Param redirect_uri query string false "Frontend page receiving the code"
+// @Success 302
+// @Router /saml/{name}/login [get]
+func (server *Server) SamlLogin(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required DeviceID"))
+		return
+	}
+	redirectURI, err := models.OauthRedirectURI(r.URL.Query().Get("redirect_uri"))
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	provider, sp, err := server.samlServiceProvider(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	requestID, redirect, form, err := sso.AuthnRequest(sp)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	request := models.Saml_Request{}
+	request.Prepare(requestID, provider.ID, redirectURI, deviceID)
+	err = request.SaveSamlRequest(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	if redirect != nil {
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("<!DOCTYPE html><html><body>"))
+	w.Write(form)
+	w.Write([]byte("</body></html>"))
+}
+
+// SamlACS godoc
+// @Summary Receive the SAML response of an identity provider
+// @Description The assertion consumer service. The identity provider posts the SAMLResponse and RelayState here. The response or its assertion has to be signed with a certificate of the provider and answer a pending request of /saml/{name}/login. The user is looked up by the mapped email attribute, or the NameID without one, and created when the provider allows it. The browser is then sent to the redirect_uri of the request with a one-time code, to be exchanged at /auth/token, or with an error and error_description.
+// @Tags SAML
+// @Accept  x-www-form-urlencoded
+// @Produce  json
+// @Param name path string true "Name of the SAML provider"
+// @Param SAMLResponse formData string true "SAML response"
+// @Param RelayState formData string true "Relay state"
+// @Success 302
+// @Router /saml/{name}/acs [post]
+func (server *Server) SamlACS(w http.ResponseWriter, r *http.Request) {
+	provider, sp, err := server.samlServiceProvider(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	providerName := "saml:" + provider.Name
+	err = r.ParseForm()
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	if r.PostForm.Get("SAMLart") != "" {
+		responses.ERROR(w, http.StatusBadRequest, errors.New("The artifact binding is not supported"))
+		return
+	}
+	request := models.Saml_Request{}
+	pending, err := request.ConsumeSamlRequest(server.DB, r.PostForm.Get("RelayState"), provider.ID)
+	if err != nil {
+		server.recordLoginEvent(r, models.LoginEventLogin, nil, "", providerName, "", err)
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	handoff := pending.OauthRequest(providerName)
+	assertion, err := sp.ParseResponse(r, []string{pending.ID})
+	if err != nil {
+		if invalid, ok := err.(*saml.InvalidResponseError); ok {
+			log.Printf("Invalid SAML response from %s: %v", provider.Name, invalid.PrivateErr)
+		}
+		err = errors.New("Invalid SAML response")
+		server.recordLoginEvent(r, models.LoginEventLogin, nil, "", providerName, pending.DeviceID, err)
+		oauthRedirect(w, r, handoff, url.Values{"error": {"access_denied"}, "error_description": {err.Error()}})
+		return
+	}
+
+	profile := models.User{
+		Email:     sso.NameID(assertion),
+		UserName:  sso.AssertionValue(assertion, provider.UserNameAttribute),
+		FirstName: sso.AssertionValue(assertion, provider.FirstNameAttribute),
+		LastName:  sso.AssertionValue(assertion, provider.LastNameAttribute),
+	}
+	if provider.EmailAttribute != "" {
+		profile.Email = sso.AssertionValue(assertion, provider.EmailAttribute)
+	}
+	if provider.UserNameAttribute == "" {
+		profile.UserName = profile.Email
+	}
+	code, codeHash, err := utils.SecureToken()
+	if err == nil && profile.Email == "" {
+		err = &externalLoginError{"The SAML assertion has no email"}
+	}
+	if err == nil {
+		err = server.DB.Transaction(func(tx *gorm.DB) error {
+			user, err := provisionExternalUser(tx, providerName, profile, provider.CreateUsers)
+			if err != nil {
+				return err
+			}
+			oauthCode := models.Oauth_Code{}
+			oauthCode.Prepare(codeHash, user.ID, handoff)
+			return oauthCode.SaveOauthCode(tx)
+		})
+	}
+	if err != nil {
+		server.recordLoginEvent(r, models.LoginEventLogin, nil, profile.Email, providerName, pending.DeviceID, err)
+		oauthRedirect(w, r, handoff, url.Values{"error": {"login_failed"}, "error_description": {oauthErrorDescription(err)}})
+		return
+	}
+	oauthRedirect(w, r, handoff, url.Values{"code": {code}})
+}
+
+func samlProviderResponse(provider *models.Saml_Provider) models.Saml_Provider_Response {
+	return models.Saml_Provider_Response{
+		Saml_Provider: *provider,
+		MetadataURL:   samlMetadataURL(provider.Name),
+		ACSURL:        samlACSURL(provider.Name),
+		LoginURL:      serviceURL("/saml/" + provider.Name + "/login"),
+	}
+}
+
+func samlProviderResponses(providers *[]models.Saml_Provider) []models.Saml_Provider_Response {
+	result := []models.Saml_Provider_Response{}
+	for i := range *providers {
+		result = append(result, samlProviderResponse(&(*providers)[i]))
+	}
+	return result
+}
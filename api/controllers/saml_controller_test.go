@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+)
+
+func TestSamlLoginRejectsUnlistedRedirectURI(t *testing.T) {
+	db, _ := newMockDB(t)
+	server := &Server{DB: db}
+	setEnv(t, "OAUTH_REDIRECT_URIS", "https://app.example.com/login")
+
+	// The code must not be sent anywhere else, and nothing is stored.
+	w := httptest.NewRecorder()
+	server.SamlLogin(w, httptest.NewRequest("GET", "/saml/corp/login?device_id=d&redirect_uri=https://evil.example.com/", nil))
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusUnprocessableEntity || body.Error != models.ErrRedirectURINotAllowed.Error() {
+		t.Errorf("SamlLogin = %d %q", w.Code, body.Error)
+	}
+}
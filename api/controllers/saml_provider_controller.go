@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// CreateSamlProvider godoc
+// @Summary Add a SAML identity provider
+// @Description Add a SAML 2.0 identity provider users can log in with at /saml/{name}/login. The certificate is the PEM encoded signing certificate of the identity provider, several can be concatenated during a rollover. The binding is redirect (default) or post. Attributes are matched by Name or FriendlyName, without an email attribute the NameID is the email. With create_users the account is created on the first login. The response holds the metadata, ACS and login URLs to configure at the identity provider. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags SAML
+// @Accept  json
+// @Produce  json
+// @Param provider body models.Saml_Provider_Payload true "SAML Provider"
+// @Success 201 {object} models.Saml_Provider_Response
+// @Security ApiKeyAuth
+// @Router /saml-providers [post]
+func (server *Server) CreateSamlProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Saml_Provider_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	provider := models.Saml_Provider{Enabled: true}
+	provider.Apply(payload)
+	provider.Prepare(tokenID)
+	err = provider.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	event := models.Audit_Event{Action: "saml_provider.create", TargetType: "saml_provider", TargetID: provider.ID.String()}
+	err = event.SetAfter(provider)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := provider.SaveSamlProvider(tx)
+		return err
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, samlProviderResponse(&provider))
+}
+
+// GetSamlProviders godoc
+// @Summary Get all SAML identity providers
+// @Description Get all SAML identity providers. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags SAML
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.Saml_Provider_Response
+// @Security ApiKeyAuth
+// @Router /saml-providers [get]
+func (server *Server) GetSamlProviders(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	provider := models.Saml_Provider{}
+	providers, err := provider.FindAllSamlProviders(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, samlProviderResponses(providers))
+}
+
+// GetSamlProvider godoc
+// @Summary Get a SAML identity provider by id
+// @Description Get a SAML identity provider by id. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags SAML
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the SAML provider"
+// @Success 200 {object} models.Saml_Provider_Response
+// @Security ApiKeyAuth
+// @Router /saml-providers/{id} [get]
+func (server *Server) GetSamlProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	pid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	provider := models.Saml_Provider{}
+	providerGotten, err := provider.FindSamlProviderByID(server.DB, pid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, samlProviderResponse(providerGotten))
+}
+
+// UpdateSamlProvider godoc
+// @Summary Update a SAML identity provider by id
+// @Description Replace the settings of a SAML identity provider. Renaming it changes its URLs, which then have to be updated at the identity provider. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags SAML
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the SAML provider"
+// @Param provider body models.Saml_Provider_Payload true "SAML Provider"
+// @Success 200 {object} models.Saml_Provider_Response
+// @Security ApiKeyAuth
+// @Router /saml-providers/{id} [put]
+func (server *Server) UpdateSamlProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	pid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Saml_Provider_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	fetchProvider := models.Saml_Provider{}
+	provider, err := fetchProvider.FindSamlProviderByID(server.DB, pid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "saml_provider.update", TargetType: "saml_provider", TargetID: pid.String()}
+	err = event.SetBefore(provider)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	provider.Apply(payload)
+	err = provider.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := provider.UpdateASamlProvider(tx, tokenID)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(provider)
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusOK, samlProviderResponse(provider))
+}
+
+// DeleteSamlProvider godoc
+// @Summary Delete a SAML identity provider by id
+// @Description Delete a SAML identity provider. The accounts created through it stay, but cannot log in with it anymore. In order to access this API, someone must have "MANAGE_IDENTITY_PROVIDERS" Permission tagged to its role.
+// @Tags SAML
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the SAML provider"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /saml-providers/{id} [delete]
+func (server *Server) DeleteSamlProvider(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_IDENTITY_PROVIDERS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	pid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	provider := models.Saml_Provider{}
+	deleteProvider, err := provider.FindSamlProviderByID(server.DB, pid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "saml_provider.delete", TargetType: "saml_provider", TargetID: pid.String()}
+	err = event.SetBefore(deleteProvider)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := provider.DeleteASamlProvider(tx, pid)
+		return err
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Entity", pid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
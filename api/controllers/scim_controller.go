@@ -0,0 +1,986 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/scim"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+type scimClientKey struct{}
+
+// scimAuthenticated lets a request through with the bearer token of an
+// unrevoked SCIM client, see /scim-tokens.
+func (server *Server) scimAuthenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			scim.ERROR(w, &scim.Error{Status: http.StatusUnauthorized, Detail: "Unauthorized"})
+			return
+		}
+		token := models.Scim_Token{}
+		client, err := token.FindActiveScimToken(server.DB, utils.HashToken(strings.TrimSpace(header[7:])))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim", error="invalid_token"`)
+			scim.ERROR(w, &scim.Error{Status: http.StatusUnauthorized, Detail: "Unauthorized"})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), scimClientKey{}, client)))
+	}
+}
+
+// scimClient returns the SCIM client that authenticated the request, nil
+// outside of the SCIM API.
+func scimClient(r *http.Request) *models.Scim_Token {
+	client, _ := r.Context().Value(scimClientKey{}).(*models.Scim_Token)
+	return client
+}
+
+var scimUserColumns = map[string]scim.Column{
+	"id":                {Name: "CAST(id AS text)", Type: scim.TypeString, CaseExact: true},
+	"username":          {Name: "user_name", Type: scim.TypeString},
+	"name.givenname":    {Name: "first_name", Type: scim.TypeString},
+	"name.familyname":   {Name: "last_name", Type: scim.TypeString},
+	"emails":            {Name: "email", Type: scim.TypeString},
+	"emails.value":      {Name: "email", Type: scim.TypeString},
+	"active":            {Name: "enabled", Type: scim.TypeBoolean},
+	"meta.created":      {Name: "created_at", Type: scim.TypeDateTime},
+	"meta.lastmodified": {Name: "updated_at", Type: scim.TypeDateTime},
+}
+
+var scimGroupColumns = map[string]scim.Column{
+	"id":                {Name: "CAST(id AS text)", Type: scim.TypeString, CaseExact: true},
+	"displayname":       {Name: "name", Type: scim.TypeString},
+	"meta.created":      {Name: "created_at", Type: scim.TypeDateTime},
+	"meta.lastmodified": {Name: "updated_at", Type: scim.TypeDateTime},
+}
+
+func scimBaseURL() string {
+	return serviceURL("/scim/v2")
+}
+
+// scimListParams reads the filter, startIndex and count of a list request
+// into a WHERE clause, an offset and a limit.
+func scimListParams(r *http.Request, columns map[string]scim.Column) (string, []interface{}, int, int, error) {
+	query := r.URL.Query()
+	where := ""
+	args := []interface{}{}
+	if filter := query.Get("filter"); filter != "" {
+		f, err := scim.ParseFilter(filter)
+		if err != nil {
+			return "", nil, 0, 0, err
+		}
+		where, args, err = scim.SQL(f, columns)
+		if err != nil {
+			return "", nil, 0, 0, err
+		}
+	}
+	startIndex, err := strconv.Atoi(query.Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(query.Get("count"))
+	if err != nil || count > scim.MaxResults {
+		count = scim.MaxResults
+	}
+	if count < 0 {
+		count = 0
+	}
+	return where, args, startIndex, count, nil
+}
+
+// scimStoreError answers errors of a change, a taken userName, email or
+// displayName is a uniqueness conflict.
+func scimStoreError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*scim.Error); ok {
+		scim.ERROR(w, err)
+		return
+	}
+	if strings.Contains(err.Error(), "duplicate key") {
+		scim.ERROR(w, scim.Conflict(customErrorFormat.FormatError(err.Error()).Error()))
+		return
+	}
+	if err.Error() == "User Not Found" || gorm.IsRecordNotFoundError(err) {
+		scim.ERROR(w, scim.NotFound("Resource not found"))
+		return
+	}
+	scim.ERROR(w, err)
+}
+
+func scimUser(u *models.User) scim.User {
+	active := u.Enabled
+	id := u.ID.String()
+	firstName := html.UnescapeString(u.FirstName)
+	lastName := html.UnescapeString(u.LastName)
+	su := scim.User{
+		Schemas:  []string{scim.SchemaUser},
+		ID:       id,
+		UserName: html.UnescapeString(u.UserName),
+		Name: &scim.Name{
+			Formatted:  strings.TrimSpace(firstName + " " + lastName),
+			GivenName:  firstName,
+			FamilyName: lastName,
+		},
+		DisplayName: strings.TrimSpace(firstName + " " + lastName),
+		Emails:      []scim.MultiValue{{Value: html.UnescapeString(u.Email), Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			LastModified: u.UpdatedAt,
+			Location:     scimBaseURL() + "/Users/" + id,
+		},
+	}
+	for _, role := range u.Roles {
+		rid := strconv.FormatUint(uint64(role.ID), 10)
+		su.Groups = append(su.Groups, scim.MultiValue{Value: rid, Display: html.UnescapeString(role.Name), Ref: scimBaseURL() + "/Groups/" + rid})
+	}
+	return su
+}
+
+// applyScimUser copies a User resource onto the user. Without a given name
+// the display name or else the userName stands in, the first name is
+// required. Without an email a userName that is an email address is used.
+func applyScimUser(u *models.User, su *scim.User) {
+	u.UserName = html.EscapeString(strings.TrimSpace(su.UserName))
+	firstName := ""
+	lastName := ""
+	if su.Name != nil {
+		firstName = strings.TrimSpace(su.Name.GivenName)
+		lastName = strings.TrimSpace(su.Name.FamilyName)
+	}
+	if firstName == "" {
+		firstName = strings.TrimSpace(su.DisplayName)
+	}
+	if firstName == "" {
+		firstName = strings.TrimSpace(su.UserName)
+	}
+	u.FirstName = html.EscapeString(firstName)
+	u.LastName = html.EscapeString(lastName)
+	email := strings.TrimSpace(su.PrimaryEmail())
+	if email == "" && strings.Contains(su.UserName, "@") {
+		email = strings.TrimSpace(su.UserName)
+	}
+	u.Email = html.EscapeString(email)
+	if su.Active != nil {
+		u.Enabled = *su.Active
+	}
+}
+
+func scimGroup(role *models.Role, members *[]models.User) scim.Group {
+	id := strconv.FormatUint(uint64(role.ID), 10)
+	group := scim.Group{
+		Schemas:     []string{scim.SchemaGroup},
+		ID:          id,
+		DisplayName: html.UnescapeString(role.Name),
+		Members:     []scim.MultiValue{},
+		Meta: &scim.Meta{
+			ResourceType: "Group",
+			Created:      role.CreatedAt,
+			LastModified: role.UpdatedAt,
+			Location:     scimBaseURL() + "/Groups/" + id,
+		},
+	}
+	if members != nil {
+		for _, member := range *members {
+			uid := member.ID.String()
+			group.Members = append(group.Members, scim.MultiValue{Value: uid, Display: html.UnescapeString(member.UserName), Ref: scimBaseURL() + "/Users/" + uid})
+		}
+	}
+	return group
+}
+
+// GetScimServiceProviderConfig godoc
+// @Summary SCIM service provider configuration
+// @Description The SCIM 2.0 features this server supports, RFC 7643 section 5.
+// @Tags SCIM
+// @Produce  json
+// @Success 200
+// @Router /scim/v2/ServiceProviderConfig [get]
+func (server *Server) GetScimServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	scim.JSON(w, http.StatusOK, scim.ServiceProviderConfig(scimBaseURL()))
+}
+
+// GetScimSchemas godoc
+// @Summary SCIM schemas
+// @Description The User and Group schemas, RFC 7643 section 7.
+// @Tags SCIM
+// @Produce  json
+// @Success 200 {object} scim.ListResponse
+// @Router /scim/v2/Schemas [get]
+func (server *Server) GetScimSchemas(w http.ResponseWriter, r *http.Request) {
+	schemas := scim.Schemas(scimBaseURL())
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		scim.JSON(w, http.StatusOK, scim.NewListResponse(schemas, len(schemas), 1))
+		return
+	}
+	for _, schema := range schemas {
+		if schema.(map[string]interface{})["id"] == id {
+			scim.JSON(w, http.StatusOK, schema)
+			return
+		}
+	}
+	scim.ERROR(w, scim.NotFound("Schema "+id+" not found"))
+}
+
+// GetScimResourceTypes godoc
+// @Summary SCIM resource types
+// @Description The User and Group resource types, RFC 7643 section 6.
+// @Tags SCIM
+// @Produce  json
+// @Success 200 {object} scim.ListResponse
+// @Router /scim/v2/ResourceTypes [get]
+func (server *Server) GetScimResourceTypes(w http.ResponseWriter, r *http.Request) {
+	resourceTypes := scim.ResourceTypes(scimBaseURL())
+	id := mux.Vars(r)["id"]
+	if id == "" {
+		scim.JSON(w, http.StatusOK, scim.NewListResponse(resourceTypes, len(resourceTypes), 1))
+		return
+	}
+	for _, resourceType := range resourceTypes {
+		if resourceType.(map[string]interface{})["id"] == id {
+			scim.JSON(w, http.StatusOK, resourceType)
+			return
+		}
+	}
+	scim.ERROR(w, scim.NotFound("Resource type "+id+" not found"))
+}
+
+// GetScimUsers godoc
+// @Summary List users over SCIM
+// @Description List users, filtered on userName, name.givenName, name.familyName, emails, active, id, meta.created and meta.lastModified with eq, ne, co, sw, ew, gt, ge, lt, le and pr, combined with and, or, not. Paged through startIndex and count, at most 200 per page. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Produce  json
+// @Param filter query string false "Filter, e.g. userName eq \"jane@example.com\""
+// @Param startIndex query int false "Index of the first result, starting at 1"
+// @Param count query int false "Results per page"
+// @Success 200 {object} scim.ListResponse
+// @Security ScimBearer
+// @Router /scim/v2/Users [get]
+func (server *Server) GetScimUsers(w http.ResponseWriter, r *http.Request) {
+	where, args, startIndex, count, err := scimListParams(r, scimUserColumns)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	user := models.User{}
+	users, total, err := user.FindUsersWhere(server.DB, where, args, startIndex-1, count)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	resources := []interface{}{}
+	for i := range *users {
+		resources = append(resources, scimUser(&(*users)[i]))
+	}
+	scim.JSON(w, http.StatusOK, scim.NewListResponse(resources, total, startIndex))
+}
+
+// GetScimUser godoc
+// @Summary Get a user over SCIM
+// @Description Get a user by id. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Produce  json
+// @Param id path string true "ID of the user"
+// @Success 200 {object} scim.User
+// @Security ScimBearer
+// @Router /scim/v2/Users/{id} [get]
+func (server *Server) GetScimUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		scim.ERROR(w, scim.NotFound("User not found"))
+		return
+	}
+	user := models.User{}
+	userGotten, err := user.FindUserByID(server.DB, uid)
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	scim.JSON(w, http.StatusOK, scimUser(userGotten))
+}
+
+// CreateScimUser godoc
+// @Summary Provision a user over SCIM
+// @Description Create a user. Without a password the user can only log in through an external provider, a magic link or after a password reset. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param user body scim.User true "User"
+// @Success 201 {object} scim.User
+// @Security ScimBearer
+// @Router /scim/v2/Users [post]
+func (server *Server) CreateScimUser(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	su, err := scim.DecodeUser(body)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	client := scimClient(r)
+	user := models.User{Password: su.Password}
+	user.Prepare(client.ID)
+	user.Provider = "scim"
+	applyScimUser(&user, su)
+	err = user.Validate("")
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidValue", err.Error()))
+		return
+	}
+
+	var userCreated *models.User
+	event := models.Audit_Event{Action: "user.create", TargetType: "user", TargetID: user.ID.String()}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		userCreated, err = user.SaveUser(tx)
+		if err != nil {
+			return err
+		}
+		err = models.PublishUserEvent(tx, models.EventUserCreated, userCreated.ID, models.UserEventData(userCreated))
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(models.PrepareResponse(userCreated))
+	})
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	created := scimUser(userCreated)
+	w.Header().Set("Location", created.Meta.Location)
+	scim.JSON(w, http.StatusCreated, created)
+}
+
+// ReplaceScimUser godoc
+// @Summary Replace a user over SCIM
+// @Description Replace the userName, name, email and active flag of a user. active=false disables the user, like enableUser. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the user"
+// @Param user body scim.User true "User"
+// @Success 200 {object} scim.User
+// @Security ScimBearer
+// @Router /scim/v2/Users/{id} [put]
+func (server *Server) ReplaceScimUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		scim.ERROR(w, scim.NotFound("User not found"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	su, err := scim.DecodeUser(body)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	fetchUser := models.User{}
+	user, err := fetchUser.FindUserByID(server.DB, uid)
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	server.provisionScimUser(w, r, user, su)
+}
+
+// PatchScimUser godoc
+// @Summary Patch a user over SCIM
+// @Description Apply add, replace and remove operations to userName, name, displayName, emails, active and password. Operations on other attributes are ignored. active=false disables the user, like enableUser. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the user"
+// @Param operations body scim.PatchRequest true "Operations"
+// @Success 200 {object} scim.User
+// @Security ScimBearer
+// @Router /scim/v2/Users/{id} [patch]
+func (server *Server) PatchScimUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		scim.ERROR(w, scim.NotFound("User not found"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	patch := scim.PatchRequest{}
+	err = json.Unmarshal(body, &patch)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	err = patch.Validate()
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	fetchUser := models.User{}
+	user, err := fetchUser.FindUserByID(server.DB, uid)
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	su := scimUser(user)
+	for _, op := range patch.Operations {
+		err = su.Patch(op)
+		if err != nil {
+			scim.ERROR(w, err)
+			return
+		}
+	}
+	server.provisionScimUser(w, r, user, &su)
+}
+
+// provisionScimUser stores the user as described by su. A change of the
+// active flag is audited as user.enable or user.disable and published next
+// to user.updated when the profile changed as well.
+func (server *Server) provisionScimUser(w http.ResponseWriter, r *http.Request, user *models.User, su *scim.User) {
+	before := *user
+	updateUser := *user
+	updateUser.Password = ""
+	applyScimUser(&updateUser, su)
+	password := su.Password
+	err := updateUser.Validate("")
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidValue", err.Error()))
+		return
+	}
+	if password != "" {
+		err = models.CurrentPasswordPolicy().Validate(server.DB, password, &before)
+		if err != nil {
+			scim.ERROR(w, scim.BadRequest("invalidValue", err.Error()))
+			return
+		}
+	}
+
+	profileChanged := updateUser.UserName != before.UserName || updateUser.FirstName != before.FirstName ||
+		updateUser.LastName != before.LastName || updateUser.Email != before.Email || password != ""
+	event := models.Audit_Event{Action: "user.update", TargetType: "user", TargetID: user.ID.String()}
+	err = event.SetBefore(models.PrepareResponse(&before))
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	userEvents := []string{}
+	if profileChanged {
+		userEvents = append(userEvents, models.EventUserUpdated)
+	}
+	if updateUser.Enabled != before.Enabled {
+		event.Action = "user.enable"
+		userEvents = append(userEvents, models.EventUserEnabled)
+		if !updateUser.Enabled {
+			event.Action = "user.disable"
+			userEvents[len(userEvents)-1] = models.EventUserDisabled
+		}
+	}
+	if len(userEvents) == 0 {
+		scim.JSON(w, http.StatusOK, scimUser(&before))
+		return
+	}
+
+	client := scimClient(r)
+	var updatedUser *models.User
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		updatedUser, err = updateUser.ProvisionUser(tx, user.ID, client.ID)
+		if err != nil {
+			return err
+		}
+		if password != "" {
+			payload := models.Set_User_Password_Payload{Password: password}
+			err = payload.ResetPassword(tx, user.ID, client.ID)
+			if err != nil {
+				return err
+			}
+		}
+		for _, userEvent := range userEvents {
+			err = models.PublishUserEvent(tx, userEvent, user.ID, models.UserEventData(updatedUser))
+			if err != nil {
+				return err
+			}
+		}
+		return event.SetAfter(models.PrepareResponse(updatedUser))
+	})
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	scim.JSON(w, http.StatusOK, scimUser(updatedUser))
+}
+
+// DeleteScimUser godoc
+// @Summary Deprovision a user over SCIM
+// @Description Delete a user. To keep the user but stop it from logging in, set active to false instead. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Param id path string true "ID of the user"
+// @Success 204
+// @Security ScimBearer
+// @Router /scim/v2/Users/{id} [delete]
+func (server *Server) DeleteScimUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		scim.ERROR(w, scim.NotFound("User not found"))
+		return
+	}
+	user := models.User{}
+	deleteUser, err := user.FindUserByID(server.DB, uid)
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	event := models.Audit_Event{Action: "user.delete", TargetType: "user", TargetID: uid.String()}
+	err = event.SetBefore(models.PrepareResponse(deleteUser))
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := user.DeleteAUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		return models.PublishUserEvent(tx, models.EventUserDeleted, uid, models.UserEventData(deleteUser))
+	})
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetScimGroups godoc
+// @Summary List groups over SCIM
+// @Description List roles as groups, filtered on displayName, id, meta.created and meta.lastModified. excludedAttributes=members leaves out the members. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Produce  json
+// @Param filter query string false "Filter, e.g. displayName eq \"Finance\""
+// @Param startIndex query int false "Index of the first result, starting at 1"
+// @Param count query int false "Results per page"
+// @Param excludedAttributes query string false "members to leave out the members"
+// @Success 200 {object} scim.ListResponse
+// @Security ScimBearer
+// @Router /scim/v2/Groups [get]
+func (server *Server) GetScimGroups(w http.ResponseWriter, r *http.Request) {
+	where, args, startIndex, count, err := scimListParams(r, scimGroupColumns)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	role := models.Role{}
+	roles, total, err := role.FindRolesWhere(server.DB, where, args, startIndex-1, count)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	withMembers := !strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members")
+	resources := []interface{}{}
+	for i := range *roles {
+		var members *[]models.User
+		if withMembers {
+			userRole := models.User_Role{}
+			members, err = userRole.FindUsersByRoleID(server.DB, (*roles)[i].ID)
+			if err != nil {
+				scim.ERROR(w, err)
+				return
+			}
+		}
+		resources = append(resources, scimGroup(&(*roles)[i], members))
+	}
+	scim.JSON(w, http.StatusOK, scim.NewListResponse(resources, total, startIndex))
+}
+
+// scimGroupID reads the id of a group, the ID of a role.
+func scimGroupID(r *http.Request) (uint32, error) {
+	rid, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		return 0, scim.NotFound("Group not found")
+	}
+	return uint32(rid), nil
+}
+
+// GetScimGroup godoc
+// @Summary Get a group over SCIM
+// @Description Get a role as a group by id, with its members. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Produce  json
+// @Param id path int true "ID of the role"
+// @Success 200 {object} scim.Group
+// @Security ScimBearer
+// @Router /scim/v2/Groups/{id} [get]
+func (server *Server) GetScimGroup(w http.ResponseWriter, r *http.Request) {
+	rid, err := scimGroupID(r)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	role := models.Role{}
+	roleGotten, err := role.FindRoleByID(server.DB, rid)
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	userRole := models.User_Role{}
+	members, err := userRole.FindUsersByRoleID(server.DB, rid)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	scim.JSON(w, http.StatusOK, scimGroup(roleGotten, members))
+}
+
+// CreateScimGroup godoc
+// @Summary Provision a group over SCIM
+// @Description Create a role from a group, with its members. The role has no permissions until they are added through /roles. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param group body scim.Group true "Group"
+// @Success 201 {object} scim.Group
+// @Security ScimBearer
+// @Router /scim/v2/Groups [post]
+func (server *Server) CreateScimGroup(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	group, err := scim.DecodeGroup(body)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	memberIDs, err := scimMemberIDs(group.Members)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	client := scimClient(r)
+	role := models.Role{Name: group.DisplayName, Description: group.DisplayName}
+	role.Prepare(client.ID)
+	err = role.Validate()
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidValue", err.Error()))
+		return
+	}
+
+	var roleCreated *models.Role
+	event := models.Audit_Event{Action: "role.create", TargetType: "role"}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		roleCreated, err = role.SaveRole(tx)
+		if err != nil {
+			return err
+		}
+		event.TargetID = strconv.FormatUint(uint64(roleCreated.ID), 10)
+		err = assignScimMembers(tx, roleCreated.ID, memberIDs, nil)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(roleCreated)
+	})
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	server.writeScimGroup(w, http.StatusCreated, roleCreated)
+}
+
+// ReplaceScimGroup godoc
+// @Summary Replace a group over SCIM
+// @Description Rename a role and replace its members. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param id path int true "ID of the role"
+// @Param group body scim.Group true "Group"
+// @Success 200 {object} scim.Group
+// @Security ScimBearer
+// @Router /scim/v2/Groups/{id} [put]
+func (server *Server) ReplaceScimGroup(w http.ResponseWriter, r *http.Request) {
+	rid, err := scimGroupID(r)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	group, err := scim.DecodeGroup(body)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	server.provisionScimGroup(w, r, rid, func(current *scim.Group) error {
+		current.DisplayName = group.DisplayName
+		current.Members = group.Members
+		return nil
+	})
+}
+
+// PatchScimGroup godoc
+// @Summary Patch a group over SCIM
+// @Description Apply add, replace and remove operations to displayName and members, e.g. remove with path members[value eq "<user id>"]. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param id path int true "ID of the role"
+// @Param operations body scim.PatchRequest true "Operations"
+// @Success 200 {object} scim.Group
+// @Security ScimBearer
+// @Router /scim/v2/Groups/{id} [patch]
+func (server *Server) PatchScimGroup(w http.ResponseWriter, r *http.Request) {
+	rid, err := scimGroupID(r)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	patch := scim.PatchRequest{}
+	err = json.Unmarshal(body, &patch)
+	if err != nil {
+		scim.ERROR(w, scim.BadRequest("invalidSyntax", err.Error()))
+		return
+	}
+	err = patch.Validate()
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	server.provisionScimGroup(w, r, rid, func(current *scim.Group) error {
+		for _, op := range patch.Operations {
+			if err := current.Patch(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// provisionScimGroup applies change to the group of the role and stores the
+// new name and the difference in members.
+func (server *Server) provisionScimGroup(w http.ResponseWriter, r *http.Request, rid uint32, change func(current *scim.Group) error) {
+	role := models.Role{}
+	updateRole, err := role.FindRoleByID(server.DB, rid)
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	userRole := models.User_Role{}
+	members, err := userRole.FindUsersByRoleID(server.DB, rid)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	current := scimGroup(updateRole, members)
+	err = change(&current)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	if current.DisplayName == "" {
+		scim.ERROR(w, scim.BadRequest("invalidValue", "Required displayName"))
+		return
+	}
+	memberIDs, err := scimMemberIDs(current.Members)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	existing := map[uuid.UUID]bool{}
+	for _, member := range *members {
+		existing[member.ID] = true
+	}
+	removed := []uuid.UUID{}
+	for uid := range existing {
+		if !containsUUID(memberIDs, uid) {
+			removed = append(removed, uid)
+		}
+	}
+	renamed := html.EscapeString(current.DisplayName) != updateRole.Name
+
+	client := scimClient(r)
+	event := models.Audit_Event{Action: "role.update", TargetType: "role", TargetID: strconv.FormatUint(uint64(rid), 10)}
+	err = event.SetBefore(scimGroup(updateRole, members))
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		if renamed {
+			updateRole.Name = html.EscapeString(current.DisplayName)
+			_, err := updateRole.UpdateARole(tx, rid, client.ID)
+			if err != nil {
+				return err
+			}
+		}
+		err := assignScimMembers(tx, rid, memberIDs, existing)
+		if err != nil {
+			return err
+		}
+		for _, uid := range removed {
+			ur := models.User_Role{}
+			_, err := ur.DeleteUsersFromRole(tx, rid, uid)
+			if err != nil {
+				return err
+			}
+			err = models.PublishUserEvent(tx, models.EventUserRoleRemoved, uid, models.RoleEventData(uid, rid))
+			if err != nil {
+				return err
+			}
+		}
+		return event.SetAfter(current)
+	})
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	server.writeScimGroup(w, http.StatusOK, updateRole)
+}
+
+// DeleteScimGroup godoc
+// @Summary Deprovision a group over SCIM
+// @Description Delete a role, after removing its members. Requires the bearer token of a SCIM client.
+// @Tags SCIM
+// @Param id path int true "ID of the role"
+// @Success 204
+// @Security ScimBearer
+// @Router /scim/v2/Groups/{id} [delete]
+func (server *Server) DeleteScimGroup(w http.ResponseWriter, r *http.Request) {
+	rid, err := scimGroupID(r)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	role := models.Role{}
+	deleteRole, err := role.FindRoleByID(server.DB, rid)
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	userRole := models.User_Role{}
+	members, err := userRole.FindUsersByRoleID(server.DB, rid)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	event := models.Audit_Event{Action: "role.delete", TargetType: "role", TargetID: strconv.FormatUint(uint64(rid), 10)}
+	err = event.SetBefore(scimGroup(deleteRole, members))
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		for _, member := range *members {
+			ur := models.User_Role{}
+			_, err := ur.DeleteUsersFromRole(tx, rid, member.ID)
+			if err != nil {
+				return err
+			}
+			err = models.PublishUserEvent(tx, models.EventUserRoleRemoved, member.ID, models.RoleEventData(member.ID, rid))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := role.DeleteARole(tx, rid)
+		return err
+	})
+	if err != nil {
+		scimStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) writeScimGroup(w http.ResponseWriter, statusCode int, role *models.Role) {
+	userRole := models.User_Role{}
+	members, err := userRole.FindUsersByRoleID(server.DB, role.ID)
+	if err != nil {
+		scim.ERROR(w, err)
+		return
+	}
+	group := scimGroup(role, members)
+	if statusCode == http.StatusCreated {
+		w.Header().Set("Location", group.Meta.Location)
+	}
+	scim.JSON(w, statusCode, group)
+}
+
+func scimMemberIDs(members []scim.MultiValue) ([]uuid.UUID, error) {
+	uids := []uuid.UUID{}
+	for _, member := range members {
+		uid, err := uuid.Parse(member.Value)
+		if err != nil {
+			return nil, scim.BadRequest("invalidValue", "Unknown member "+member.Value)
+		}
+		if !containsUUID(uids, uid) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+func containsUUID(uids []uuid.UUID, uid uuid.UUID) bool {
+	for _, other := range uids {
+		if other == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// assignScimMembers adds the users not in existing to the role. An unknown
+// user is an invalidValue error.
+func assignScimMembers(tx *gorm.DB, rid uint32, uids []uuid.UUID, existing map[uuid.UUID]bool) error {
+	for _, uid := range uids {
+		if existing[uid] {
+			continue
+		}
+		user := models.User{}
+		_, err := user.FindUserByID(tx, uid)
+		if err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return scim.BadRequest("invalidValue", "Unknown member "+uid.String())
+			}
+			return err
+		}
+		userRole := models.User_Role{UserID: uid, RoleID: rid}
+		err = userRole.SaveUserToRole(tx)
+		if err != nil {
+			return err
+		}
+		err = models.PublishUserEvent(tx, models.EventUserRoleAssigned, uid, models.RoleEventData(uid, rid))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// CreateScimToken godoc
+// @Summary Issue a token for a SCIM provisioning client
+// @Description Issue the bearer token an HR system or identity provider uses on /scim/v2. The token is only returned by this API. In order to access this API, someone must have "MANAGE_SCIM" Permission tagged to its role.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param token body models.Scim_Token_Payload true "Client"
+// @Success 201 {object} models.Scim_Token_Created
+// @Security ApiKeyAuth
+// @Router /scim-tokens [post]
+func (server *Server) CreateScimToken(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_SCIM"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Scim_Token_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	token, tokenHash, err := utils.SecureToken()
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	scimToken := models.Scim_Token{Name: payload.Name}
+	scimToken.Prepare(tokenID, tokenHash)
+	err = scimToken.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	event := models.Audit_Event{Action: "scim_token.create", TargetType: "scim_token", TargetID: scimToken.ID.String()}
+	err = event.SetAfter(scimToken)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := scimToken.SaveScimToken(tx)
+		return err
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, models.Scim_Token_Created{Scim_Token: scimToken, Token: token})
+}
+
+// GetScimTokens godoc
+// @Summary Get the SCIM provisioning clients
+// @Description Get the tokens issued to SCIM clients, without the tokens themselves, with when they were last used. In order to access this API, someone must have "MANAGE_SCIM" Permission tagged to its role.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.Scim_Token
+// @Security ApiKeyAuth
+// @Router /scim-tokens [get]
+func (server *Server) GetScimTokens(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_SCIM"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	scimToken := models.Scim_Token{}
+	tokens, err := scimToken.FindAllScimTokens(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, tokens)
+}
+
+// RevokeScimToken godoc
+// @Summary Revoke the token of a SCIM provisioning client
+// @Description Revoke a SCIM client token, its requests are refused from now on. In order to access this API, someone must have "MANAGE_SCIM" Permission tagged to its role.
+// @Tags SCIM
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the token"
+// @Success 200 {object} models.Scim_Token
+// @Security ApiKeyAuth
+// @Router /scim-tokens/{id} [delete]
+func (server *Server) RevokeScimToken(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_SCIM"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	tid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	var revoked *models.Scim_Token
+	scimToken := models.Scim_Token{}
+	event := models.Audit_Event{Action: "scim_token.revoke", TargetType: "scim_token", TargetID: tid.String()}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		revoked, err = scimToken.RevokeScimToken(tx, tid)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(revoked)
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, revoked)
+}
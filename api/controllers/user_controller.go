@@ -4,21 +4,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
 
 	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
 	"bitbucket.org/staydigital/truvest-identity-management/api/models"
 	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
 	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
 	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/badoux/checkmail"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
 )
 
 // CreateUser godoc
 // @Summary Create a user in the system
-// @Description Create a user by ID in the system. In order to access this API, someone must have "USERS_CREATE" Permission tagged to its role. If Password is not passed while creating User, then it creates User with auto-generated password and sends it through Email.
+// @Description Create a user by ID in the system. In order to access this API, someone must have "USERS_CREATE" Permission tagged to its role. The Password is required. To let a user choose their own password, send an invitation through /invitations instead.
 // @Tags User
 // @Accept  json
 // @Produce  json
@@ -48,12 +53,10 @@ func (server *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	var password string
 	if user.Password == "" {
-		password = utils.RandSeq()
-		user.Password = password
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Password"))
+		return
 	}
-	fmt.Printf("New Auto-generated User Password: %s", password)
 	authID, err := auth.ExtractTokenID(r)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
@@ -70,7 +73,21 @@ func (server *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	userCreated, err := user.SaveUser(server.DB)
+	var userCreated *models.User
+	event := models.Audit_Event{Action: "user.create", TargetType: "user"}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		userCreated, err = user.SaveUser(tx)
+		if err != nil {
+			return err
+		}
+		event.TargetID = userCreated.ID.String()
+		err = models.PublishUserEvent(tx, models.EventUserCreated, userCreated.ID, models.UserEventData(userCreated))
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(models.PrepareResponse(userCreated))
+	})
 
 	if err != nil {
 		fmt.Println(err)
@@ -79,14 +96,6 @@ func (server *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
 		return
 	}
-	sm := models.SendMail{}
-	sm.Email = userCreated.Email
-	err = sm.SendEmail(password)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnprocessableEntity, err)
-		return
-	}
-
 	w.Header().Set("Location", fmt.Sprintf("%s%s/%d", r.Host, r.RequestURI, userCreated.ID))
 	responses.JSON(w, http.StatusCreated, models.PrepareResponse(userCreated))
 }
@@ -199,6 +208,12 @@ func (server *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
+	event := models.Audit_Event{TargetType: "user", TargetID: uid.String()}
+	err = event.SetBefore(models.PrepareResponse(updateUser))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
 	err = json.Unmarshal(body, &updateUser)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
@@ -214,7 +229,20 @@ func (server *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
 		return
 	}
-	updatedUser, err := updateUser.UpdateAUser(server.DB, uid, tokenID)
+	var updatedUser *models.User
+	event.Action = "user.update"
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		updatedUser, err = updateUser.UpdateAUser(tx, uid, tokenID)
+		if err != nil {
+			return err
+		}
+		err = models.PublishUserEvent(tx, models.EventUserUpdated, uid, models.UserEventData(updatedUser))
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(models.PrepareResponse(updatedUser))
+	})
 	if err != nil {
 		formattedError := customErrorFormat.FormatError(err.Error())
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
@@ -254,7 +282,24 @@ func (server *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	_, err = user.DeleteAUser(server.DB, uid)
+	deleteUser, err := user.FindUserByID(server.DB, uid)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	event := models.Audit_Event{Action: "user.delete", TargetType: "user", TargetID: uid.String()}
+	err = event.SetBefore(models.PrepareResponse(deleteUser))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := user.DeleteAUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		return models.PublishUserEvent(tx, models.EventUserDeleted, uid, models.UserEventData(deleteUser))
+	})
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
@@ -265,7 +310,7 @@ func (server *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
 
 // GetLoggedInUser godoc
 // @Summary Get the Logged in User details
-// @Description Get the logged in user details by Authorization header being passed. This is useful by other microservices to check for authorization based upon the roles and permissions listed.
+// @Description Get the logged in user details by Authorization header being passed. This is useful by other microservices to check for authorization based upon the roles and permissions listed. The roles are those given to the user directly, the groups those the user is a member of, and the permissions the effective ones of all its roles, including those of its groups and inherited from parent roles. Roles given on resources are listed under assignments and not counted in the permissions, check them with /permissions/check.
 // @Tags User
 // @Accept  json
 // @Produce  json
@@ -294,7 +339,28 @@ func (server *Server) GetLoggedInUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	responses.JSON(w, http.StatusOK, models.PrepareResponse(userGotten))
+	group := models.Group{}
+	groups, err := group.FindGroupsByUserID(server.DB, tokenID)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	permissions, err := models.UserEffectivePermissions(server.DB, userGotten)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	assignment := models.Role_Assignment{}
+	assignments, err := assignment.FindRoleAssignmentsByUserID(server.DB, tokenID)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := models.PrepareResponse(userGotten)
+	response.Groups = groups
+	response.Assignments = assignments
+	response.Permissions = models.PermissionNames(permissions)
+	responses.JSON(w, http.StatusOK, response)
 }
 
 // SetPassword godoc
@@ -347,6 +413,10 @@ func (server *Server) SetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	err = setPassword.ResetPassword(server.DB, uid, tokenID)
+	if _, ok := err.(*models.PasswordPolicyError); ok {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
@@ -355,60 +425,122 @@ func (server *Server) SetPassword(w http.ResponseWriter, r *http.Request) {
 	responses.JSON(w, http.StatusNoContent, "")
 }
 
-// ForgotPassword godoc
-// @Summary Set the Password of the user if he has forgotten
-// @Description Set the Password of the user if he has forgotten.
+// RequestPasswordReset godoc
+// @Summary Request a link to reset a forgotten Password
+// @Description Email a single-use link to reset the Password. The token of the link is needed by /users/forgotPassword. The response is the same whether or not the email belongs to an account.
 // @Tags User
 // @Accept  json
 // @Produce  json
-// @Param user body models.Forgot_User_Password_Payload true "Forgot Password"
-// @Success 200 
-// @Router /users/forgotPassword [post]
-func (server *Server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
-
+// @Param user body models.Password_Reset_Request true "Password Reset Request"
+// @Success 202 {object} string
+// @Router /users/forgotPassword/request [post]
+func (server *Server) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	forgotPassword := models.Forgot_User_Password_Payload{}
-	err = json.Unmarshal(body, &forgotPassword)
+	request := models.Password_Reset_Request{}
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if request.Email == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Email"))
+		return
+	}
+	if err := checkmail.ValidateFormat(request.Email); err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Invalid Email"))
+		return
+	}
+
+	accepted := "If the account exists, a password reset link has been sent"
+	user := models.User{}
+	fetchUser, err := user.FindUserByEmail(server.DB, request.Email)
+	if err != nil || !fetchUser.Enabled {
+		responses.JSON(w, http.StatusAccepted, accepted)
+		return
+	}
+	err = sendPasswordResetLink(server, fetchUser, "Follow the link below to choose a new password. If you did not ask for it, you can ignore this email.")
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	err = forgotPassword.ForgetPassword(server.DB)
+	responses.JSON(w, http.StatusAccepted, accepted)
+}
+
+// sendPasswordResetLink emails a single-use link to /users/forgotPassword,
+// or to the frontend page in PASSWORD_RESET_URL, after the message.
+func sendPasswordResetLink(server *Server, user *models.User, message string) error {
+	token, tokenHash, err := utils.SecureToken()
+	if err != nil {
+		return err
+	}
+	reset := models.Password_Reset{}
+	reset.Prepare(user.ID, tokenHash)
+	err = reset.SavePasswordReset(server.DB)
+	if err != nil {
+		return err
+	}
+	link := os.Getenv("PASSWORD_RESET_URL")
+	if link == "" {
+		link = serviceURL("/users/forgotPassword")
+	}
+	sm := models.SendMail{}
+	sm.Email = user.Email
+	return sm.SendLinkEmail(
+		"Reset your password",
+		"Hello "+user.FirstName,
+		message+" The link can be used once and expires on "+reset.ExpiresAt.Format("02 Jan 2006 15:04 MST")+".",
+		link+"?token="+url.QueryEscape(token),
+		"Reset Password",
+	)
+}
+
+// ForgotPasswordPage renders the page the password reset link opens, on
+// which the user chooses a new password.
+func (server *Server) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	t, err := template.ParseFiles("./html/password_reset.html")
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	responses.JSON(w, http.StatusNoContent, "")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t.Execute(w, struct {
+		Token string
+	}{
+		Token: r.URL.Query().Get("token"),
+	})
 }
 
-// SendMail godoc
-// @Summary Send a mail with a link for the user to reset password
-// @Description Send a mail with a link for the user to reset password. This can be used in combination with Forget Password API to make sure a legitimate user is trying to reset his password.
+// ForgotPassword godoc
+// @Summary Set the Password of the user if he has forgotten
+// @Description Set the Password of the user if he has forgotten, with the token of the link from /users/forgotPassword/request. The link can be used once, and every session of the user is ended.
 // @Tags User
 // @Accept  json
 // @Produce  json
-// @Param user body models.SendMail true "Send Email"
+// @Param user body models.Forgot_User_Password_Payload true "Forgot Password"
 // @Success 200 
-// @Router /users/sendMail [post]
-func (server *Server) SendMail(w http.ResponseWriter, r *http.Request) {
+// @Router /users/forgotPassword [post]
+func (server *Server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	sendMail := models.SendMail{}
-	err = json.Unmarshal(body, &sendMail)
+	forgotPassword := models.Forgot_User_Password_Payload{}
+	err = json.Unmarshal(body, &forgotPassword)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	// err = sm.SendGridMail()
-	err = sendMail.SendEmail("")
+	if forgotPassword.Token == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Invalid or expired link"))
+		return
+	}
+	err = forgotPassword.ForgetPassword(server.DB, utils.HashToken(forgotPassword.Token))
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
@@ -416,6 +548,31 @@ func (server *Server) SendMail(w http.ResponseWriter, r *http.Request) {
 	responses.JSON(w, http.StatusNoContent, "")
 }
 
+// GetPasswordPolicy godoc
+// @Summary Get the password policy
+// @Description Get the rules every password has to satisfy, so that frontends can render hints before submitting. Violations are returned by the password APIs in the "details" field of the error, listing each failed rule.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.PasswordPolicy
+// @Router /password-policy [get]
+func (server *Server) GetPasswordPolicy(w http.ResponseWriter, r *http.Request) {
+	responses.JSON(w, http.StatusOK, models.CurrentPasswordPolicy())
+}
+
+// SendMail godoc
+// @Summary Send a mail with a link for the user to reset password
+// @Description Deprecated, use /users/forgotPassword/request. Email a single-use link to reset the Password like /users/forgotPassword/request. Nothing is sent unless the email belongs to an enabled account, and the response is the same either way.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param user body models.Password_Reset_Request true "Password Reset Request"
+// @Success 202 {object} string
+// @Router /users/sendMail [post]
+func (server *Server) SendMail(w http.ResponseWriter, r *http.Request) {
+	server.RequestPasswordReset(w, r)
+}
+
 // EnableUser godoc
 // @Summary Enable/Disable a user in the system
 // @Description Enable/Disable a user by ID in the system. In order to access this API, someone must have "USERS_CREATE" Permission tagged to its role. Set Enabled field in payload to true to enable a user/Set Enabled field in payload to false to disable a user 
@@ -456,6 +613,12 @@ func (server *Server) EnableUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
+	event := models.Audit_Event{TargetType: "user", TargetID: uid.String()}
+	err = event.SetBefore(models.PrepareResponse(updateUser))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
 	err = json.Unmarshal(body, &updateUser)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
@@ -471,7 +634,25 @@ func (server *Server) EnableUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
 		return
 	}
-	updatedUser, err := updateUser.EnableDisableUser(server.DB, uid, tokenID)
+	var updatedUser *models.User
+	event.Action = "user.enable"
+	userEvent := models.EventUserEnabled
+	if !updateUser.Enabled {
+		event.Action = "user.disable"
+		userEvent = models.EventUserDisabled
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		updatedUser, err = updateUser.EnableDisableUser(tx, uid, tokenID)
+		if err != nil {
+			return err
+		}
+		err = models.PublishUserEvent(tx, userEvent, uid, models.UserEventData(updatedUser))
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(models.PrepareResponse(updatedUser))
+	})
 	if err != nil {
 		formattedError := customErrorFormat.FormatError(err.Error())
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
@@ -479,3 +660,69 @@ func (server *Server) EnableUser(w http.ResponseWriter, r *http.Request) {
 	}
 	responses.JSON(w, http.StatusOK, models.PrepareResponse(updatedUser))
 }
+
+// UnlockUser godoc
+// @Summary Unlock a user locked after failed logins
+// @Description Unlock a user by ID that was temporarily locked after too many failed login attempts and clear its failed login counter. Disabled users stay disabled, use enableUser for those. In order to access this API, someone must have "USERS_UNLOCK" Permission tagged to its role.
+// @Tags User
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the user to be unlocked"
+// @Success 200 {object} models.UserResponse
+// @Security ApiKeyAuth
+// @Router /users/{id}/unlock [post]
+func (server *Server) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"USERS_UNLOCK"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	uid, err := uuid.Parse(vars["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	user := models.User{}
+	lockedUser, err := user.FindUserByID(server.DB, uid)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	var unlockedUser *models.User
+	event := models.Audit_Event{Action: "user.unlock", TargetType: "user", TargetID: uid.String()}
+	err = event.SetBefore(models.PrepareResponse(lockedUser))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		var err error
+		unlockedUser, err = user.UnlockUser(tx, uid, tokenID)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(models.PrepareResponse(unlockedUser))
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, models.PrepareResponse(unlockedUser))
+}
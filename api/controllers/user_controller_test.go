@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+func TestSendMailOnlyToEnabledAccounts(t *testing.T) {
+	db, mock := newMockDB(t)
+	server := &Server{DB: db}
+
+	// Neither an unknown address nor a disabled account gets a mail, and the
+	// caller cannot tell them from an account that does.
+	mock.ExpectQuery(`SELECT \* FROM "users" WHERE \(email = \$1\)`).
+		WithArgs("nobody@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns))
+	uid := uuid.New()
+	mock.ExpectQuery(`SELECT \* FROM "users" WHERE \(email = \$1\)`).
+		WithArgs("jane@example.com").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow(uid, "jane", "Jane", "Doe", "jane@example.com", false, "local"))
+	mock.ExpectQuery(`SELECT \* FROM "roles" INNER JOIN "user_roles"`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "user_id", "role_id"}))
+
+	for _, email := range []string{"nobody@example.com", "jane@example.com"} {
+		w := httptest.NewRecorder()
+		server.SendMail(w, httptest.NewRequest("POST", "/users/sendMail", strings.NewReader(`{"email":"`+email+`"}`)))
+		if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), "If the account exists") {
+			t.Errorf("SendMail to %s = %d %s", email, w.Code, w.Body.String())
+		}
+	}
+}
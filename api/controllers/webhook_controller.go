@@ -0,0 +1,424 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils/customErrorFormat"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// CreateWebhook godoc
+// @Summary Subscribe a URL to identity lifecycle events
+// @Description Create a webhook subscription. Events are user.created, user.updated, user.enabled, user.disabled, user.deleted, user.role_assigned and user.role_removed, or "*" for all of them. Every delivery is signed in the X-Webhook-Signature header as "v1=" followed by the hex HMAC-SHA256 of "<X-Webhook-Timestamp>.<body>" with the secret. A secret is generated when none is given, it is only returned by this API. In order to access this API, someone must have "MANAGE_WEBHOOKS" Permission tagged to its role.
+// @Tags Webhooks
+// @Accept  json
+// @Produce  json
+// @Param webhook body models.Webhook_Subscription_Payload true "Webhook"
+// @Success 201 {object} models.Webhook_Subscription_Created
+// @Security ApiKeyAuth
+// @Router /webhooks [post]
+func (server *Server) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_WEBHOOKS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Webhook_Subscription_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	subscription := models.Webhook_Subscription{Enabled: true}
+	err = subscription.Apply(payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	subscription.Prepare(tokenID)
+	err = subscription.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	event := models.Audit_Event{Action: "webhook.create", TargetType: "webhook", TargetID: subscription.ID.String()}
+	err = event.SetAfter(subscription)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := subscription.SaveWebhookSubscription(tx)
+		return err
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, models.Webhook_Subscription_Created{Webhook_Subscription: subscription, Secret: subscription.Secret})
+}
+
+// GetWebhooks godoc
+// @Summary Get all webhook subscriptions
+// @Description Get all webhook subscriptions, without their secrets. In order to access this API, someone must have "MANAGE_WEBHOOKS" Permission tagged to its role.
+// @Tags Webhooks
+// @Accept  json
+// @Produce  json
+// @Success 200 {object} models.Webhook_Subscription
+// @Security ApiKeyAuth
+// @Router /webhooks [get]
+func (server *Server) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_WEBHOOKS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	subscription := models.Webhook_Subscription{}
+	subscriptions, err := subscription.FindAllWebhookSubscriptions(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, subscriptions)
+}
+
+// GetWebhook godoc
+// @Summary Get a webhook subscription by id
+// @Description Get a webhook subscription by id, without its secret. In order to access this API, someone must have "MANAGE_WEBHOOKS" Permission tagged to its role.
+// @Tags Webhooks
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the webhook"
+// @Success 200 {object} models.Webhook_Subscription
+// @Security ApiKeyAuth
+// @Router /webhooks/{id} [get]
+func (server *Server) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_WEBHOOKS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	wid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	subscription := models.Webhook_Subscription{}
+	subscriptionGotten, err := subscription.FindWebhookSubscriptionByID(server.DB, wid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, subscriptionGotten)
+}
+
+// UpdateWebhook godoc
+// @Summary Update a webhook subscription by id
+// @Description Update the URL, events, secret or enabled flag of a webhook subscription. Leaving out the secret keeps the current one. In order to access this API, someone must have "MANAGE_WEBHOOKS" Permission tagged to its role.
+// @Tags Webhooks
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the webhook"
+// @Param webhook body models.Webhook_Subscription_Payload true "Webhook"
+// @Success 200 {object} models.Webhook_Subscription
+// @Security ApiKeyAuth
+// @Router /webhooks/{id} [put]
+func (server *Server) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_WEBHOOKS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	wid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	authID, err := auth.ExtractTokenID(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	tokenID, err := uuid.Parse(authID)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	payload := models.Webhook_Subscription_Payload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	fetchSubscription := models.Webhook_Subscription{}
+	subscription, err := fetchSubscription.FindWebhookSubscriptionByID(server.DB, wid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "webhook.update", TargetType: "webhook", TargetID: wid.String()}
+	err = event.SetBefore(subscription)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = subscription.Apply(payload)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	err = subscription.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := subscription.UpdateAWebhookSubscription(tx, tokenID)
+		if err != nil {
+			return err
+		}
+		return event.SetAfter(subscription)
+	})
+	if err != nil {
+		formattedError := customErrorFormat.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	responses.JSON(w, http.StatusOK, subscription)
+}
+
+// DeleteWebhook godoc
+// @Summary Delete a webhook subscription by id
+// @Description Delete a webhook subscription together with its deliveries. In order to access this API, someone must have "MANAGE_WEBHOOKS" Permission tagged to its role.
+// @Tags Webhooks
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the webhook"
+// @Success 204
+// @Security ApiKeyAuth
+// @Router /webhooks/{id} [delete]
+func (server *Server) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_WEBHOOKS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	wid, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	subscription := models.Webhook_Subscription{}
+	deleteSubscription, err := subscription.FindWebhookSubscriptionByID(server.DB, wid)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	event := models.Audit_Event{Action: "webhook.delete", TargetType: "webhook", TargetID: wid.String()}
+	err = event.SetBefore(deleteSubscription)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = server.withAudit(r, &event, func(tx *gorm.DB) error {
+		_, err := subscription.DeleteAWebhookSubscription(tx, wid)
+		return err
+	})
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Entity", wid.String())
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// GetWebhookDeliveries godoc
+// @Summary Get webhook deliveries
+// @Description Get webhook deliveries, newest first. Filter on status=dead for the deliveries that ran out of attempts. In order to access this API, someone must have "MANAGE_WEBHOOKS" Permission tagged to its role.
+// @Tags Webhooks
+// @Accept  json
+// @Produce  json
+// @Param subscription_id query string false "ID of the webhook"
+// @Param status query string false "pending, delivered or dead"
+// @Param page query int false "Page number, starting at 1"
+// @Param per_page query int false "Deliveries per page, at most 100"
+// @Success 200 {object} models.Page
+// @Security ApiKeyAuth
+// @Router /webhook-deliveries [get]
+func (server *Server) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_WEBHOOKS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	query := r.URL.Query()
+	var subscriptionID *uuid.UUID
+	if raw := query.Get("subscription_id"); raw != "" {
+		wid, err := uuid.Parse(raw)
+		if err != nil {
+			responses.ERROR(w, http.StatusBadRequest, errors.New("Invalid subscription_id"))
+			return
+		}
+		subscriptionID = &wid
+	}
+	status := query.Get("status")
+	if status != "" && status != models.WebhookPending && status != models.WebhookDelivered && status != models.WebhookDead {
+		responses.ERROR(w, http.StatusBadRequest, errors.New("Invalid status"))
+		return
+	}
+	page, perPage := pageParams(r)
+	delivery := models.Webhook_Delivery{}
+	deliveries, err := delivery.FindWebhookDeliveries(server.DB, subscriptionID, status, page, perPage)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, deliveries)
+}
+
+// RedeliverWebhook godoc
+// @Summary Redeliver a webhook delivery
+// @Description Queue a delivery again right away with a fresh set of attempts, typically one from the dead letters. The receiver gets the same X-Webhook-ID and event id again. In order to access this API, someone must have "MANAGE_WEBHOOKS" Permission tagged to its role.
+// @Tags Webhooks
+// @Accept  json
+// @Produce  json
+// @Param id path string true "ID of the delivery"
+// @Success 200 {object} models.Webhook_Delivery
+// @Security ApiKeyAuth
+// @Router /webhook-deliveries/{id}/redeliver [post]
+func (server *Server) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	err := auth.CheckBlacklistedJWT(server.TTLCache, r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	check, err := server.HasPermission(r, []string{"MANAGE_WEBHOOKS"})
+	if !check || err != nil {
+		responses.ERROR(w, http.StatusForbidden, errors.New("Forbidden"))
+		return
+	}
+
+	did, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	delivery := models.Webhook_Delivery{}
+	redelivered, err := delivery.Redeliver(server.DB, did)
+	if err != nil {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, redelivered)
+}
+
+// deliverWebhooks sends due webhook deliveries every
+// WEBHOOK_POLL_INTERVAL_SECONDS, right away again while there is a backlog.
+func (server *Server) deliverWebhooks() {
+	client := &http.Client{
+		Timeout: models.WebhookTimeout(),
+		// A redirect is answered like any other non 2xx status, the
+		// signed request is never replayed to another URL.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	interval := models.WebhookPollInterval()
+	batch := 50
+	for {
+		deliveries, err := models.ClaimWebhookDeliveries(server.DB, batch, 2*client.Timeout+time.Minute)
+		if err != nil {
+			log.Printf("Cannot claim webhook deliveries: %v", err)
+		}
+		subscriptions := map[uuid.UUID]*models.Webhook_Subscription{}
+		for i := range deliveries {
+			delivery := &deliveries[i]
+			subscription, ok := subscriptions[delivery.SubscriptionID]
+			if !ok {
+				fetchSubscription := models.Webhook_Subscription{}
+				subscription, err = fetchSubscription.FindWebhookSubscriptionByID(server.DB, delivery.SubscriptionID)
+				if err != nil {
+					log.Printf("Cannot load webhook %s: %v", delivery.SubscriptionID, err)
+					continue
+				}
+				subscriptions[delivery.SubscriptionID] = subscription
+			}
+			statusCode, deliveryErr := delivery.Deliver(client, subscription)
+			if err := delivery.RecordWebhookAttempt(server.DB, statusCode, deliveryErr); err != nil {
+				log.Printf("Cannot record webhook delivery %s: %v", delivery.ID, err)
+			}
+		}
+		if len(deliveries) < batch {
+			time.Sleep(interval)
+		}
+	}
+}
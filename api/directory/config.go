@@ -0,0 +1,58 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ConfigFromEnv reads the LDAP_* settings. It returns nil when LDAP_URL is
+// not set. The defaults fit OpenLDAP, see the README for Active Directory.
+func ConfigFromEnv() (*Config, error) {
+	url := os.Getenv("LDAP_URL")
+	if url == "" {
+		return nil, nil
+	}
+	cfg := &Config{
+		URL:                url,
+		StartTLS:           os.Getenv("LDAP_START_TLS") == "true",
+		InsecureSkipVerify: os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true",
+		CACertFile:         os.Getenv("LDAP_CA_CERT"),
+		Timeout:            10 * time.Second,
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		UserBase:           os.Getenv("LDAP_USER_BASE"),
+		UserFilter:         envOr("LDAP_USER_FILTER", "(&(objectClass=person)(|(uid={login})(mail={login})))"),
+		UserNameAttribute:  envOr("LDAP_ATTRIBUTE_USERNAME", "uid"),
+		EmailAttribute:     envOr("LDAP_ATTRIBUTE_EMAIL", "mail"),
+		FirstNameAttribute: envOr("LDAP_ATTRIBUTE_FIRSTNAME", "givenName"),
+		LastNameAttribute:  envOr("LDAP_ATTRIBUTE_LASTNAME", "sn"),
+		GroupsAttribute:    envOr("LDAP_ATTRIBUTE_GROUPS", "memberOf"),
+		GroupBase:          os.Getenv("LDAP_GROUP_BASE"),
+		GroupFilter:        envOr("LDAP_GROUP_FILTER", "(|(member={dn})(uniqueMember={dn}))"),
+		GroupRoles:         map[string][]string{},
+		CreateUsers:        os.Getenv("LDAP_CREATE_USERS") != "false",
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("LDAP_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		cfg.Timeout = time.Duration(seconds) * time.Second
+	}
+	if cfg.UserBase == "" {
+		return nil, errors.New("LDAP_USER_BASE is required with LDAP_URL")
+	}
+	if mapping := os.Getenv("LDAP_GROUP_ROLES"); mapping != "" {
+		err := json.Unmarshal([]byte(mapping), &cfg.GroupRoles)
+		if err != nil {
+			return nil, errors.New("LDAP_GROUP_ROLES must map group DNs to lists of role names: " + err.Error())
+		}
+	}
+	return cfg, nil
+}
+
+func envOr(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,288 @@
+// Package directory authenticates users against an LDAP directory or Active
+// Directory. A service account searches the user by login name, the user's
+// own password is then checked with a bind as the entry found.
+package directory
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrInvalidCredentials is returned for an unknown login or a wrong password,
+// which are not told apart.
+var ErrInvalidCredentials = errors.New("Invalid directory credentials")
+
+// Config describes the directory. UserFilter and GroupFilter contain the
+// placeholders {login} and {dn}, replaced by the escaped login name and the
+// DN of the user.
+type Config struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	CACertFile         string
+	Timeout            time.Duration
+
+	BindDN       string
+	BindPassword string
+
+	UserBase   string
+	UserFilter string
+
+	UserNameAttribute  string
+	EmailAttribute     string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	GroupsAttribute    string
+
+	GroupBase   string
+	GroupFilter string
+
+	// GroupRoles maps group DNs, compared case insensitively, to the names
+	// of the roles their members get.
+	GroupRoles map[string][]string
+
+	// CreateUsers creates the account of a directory user on its first
+	// login. Without it only existing accounts can log in.
+	CreateUsers bool
+}
+
+// Entry is the user as found in the directory.
+type Entry struct {
+	DN        string
+	UserName  string
+	Email     string
+	FirstName string
+	LastName  string
+	Groups    []string
+}
+
+var (
+	mu     sync.RWMutex
+	config *Config
+)
+
+// Configure makes cfg the directory used by Login, nil switches LDAP login
+// off.
+func Configure(cfg *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	config = cfg
+}
+
+// Enabled reports whether a directory is configured.
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config != nil
+}
+
+func current() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config
+}
+
+// Login checks the password of the user with the login name and returns its
+// entry, together with the roles its groups map to.
+func Login(login string, password string) (*Entry, []string, error) {
+	cfg := current()
+	if cfg == nil {
+		return nil, nil, errors.New("LDAP login is not configured")
+	}
+	entry, err := cfg.Login(login, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, cfg.Roles(entry), nil
+}
+
+// CreatesUsers reports whether accounts are created on their first login.
+func CreatesUsers() bool {
+	cfg := current()
+	return cfg != nil && cfg.CreateUsers
+}
+
+// MappedRoles returns every role name GroupRoles can grant. Those are the
+// roles a login through the directory adds, and removes when the directory
+// granted them.
+func MappedRoles() []string {
+	cfg := current()
+	if cfg == nil {
+		return nil
+	}
+	roles := []string{}
+	for _, names := range cfg.GroupRoles {
+		for _, name := range names {
+			if !containsFold(roles, name) {
+				roles = append(roles, name)
+			}
+		}
+	}
+	return roles
+}
+
+func (c *Config) Login(login string, password string) (*Entry, error) {
+	login = strings.TrimSpace(login)
+	// An empty password would make an unauthenticated bind, which most
+	// directories accept for any DN.
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if c.BindDN != "" {
+		err = conn.Bind(c.BindDN, c.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("cannot bind as %s: %v", c.BindDN, err)
+		}
+	}
+	attributes := []string{c.UserNameAttribute, c.EmailAttribute, c.FirstNameAttribute, c.LastNameAttribute}
+	if c.GroupsAttribute != "" {
+		attributes = append(attributes, c.GroupsAttribute)
+	}
+	filter := strings.Replace(c.UserFilter, "{login}", ldap.EscapeFilter(login), -1)
+	result, err := conn.Search(ldap.NewSearchRequest(
+		c.UserBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(c.Timeout/time.Second), false,
+		filter, attributes, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("cannot search the user: %v", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	found := result.Entries[0]
+
+	err = conn.Bind(found.DN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("cannot bind as %s: %v", found.DN, err)
+	}
+
+	entry := &Entry{
+		DN:        found.DN,
+		UserName:  found.GetAttributeValue(c.UserNameAttribute),
+		Email:     found.GetAttributeValue(c.EmailAttribute),
+		FirstName: found.GetAttributeValue(c.FirstNameAttribute),
+		LastName:  found.GetAttributeValue(c.LastNameAttribute),
+	}
+	if c.GroupsAttribute != "" {
+		entry.Groups = found.GetAttributeValues(c.GroupsAttribute)
+	}
+	if c.GroupBase != "" && c.GroupFilter != "" {
+		// Search the groups as the service account, the user may not be
+		// allowed to read them.
+		if c.BindDN != "" {
+			err = conn.Bind(c.BindDN, c.BindPassword)
+			if err != nil {
+				return nil, fmt.Errorf("cannot bind as %s: %v", c.BindDN, err)
+			}
+		}
+		filter := strings.Replace(c.GroupFilter, "{dn}", ldap.EscapeFilter(found.DN), -1)
+		filter = strings.Replace(filter, "{login}", ldap.EscapeFilter(login), -1)
+		groups, err := conn.Search(ldap.NewSearchRequest(
+			c.GroupBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(c.Timeout/time.Second), false,
+			filter, []string{"dn"}, nil,
+		))
+		if err != nil {
+			return nil, fmt.Errorf("cannot search the groups: %v", err)
+		}
+		for _, group := range groups.Entries {
+			if !containsFold(entry.Groups, group.DN) {
+				entry.Groups = append(entry.Groups, group.DN)
+			}
+		}
+	}
+	if entry.UserName == "" {
+		entry.UserName = login
+	}
+	return entry, nil
+}
+
+// Roles returns the names of the roles the groups of the entry map to.
+func (c *Config) Roles(entry *Entry) []string {
+	roles := []string{}
+	for _, group := range entry.Groups {
+		for dn, names := range c.GroupRoles {
+			if !strings.EqualFold(normalizeDN(dn), normalizeDN(group)) {
+				continue
+			}
+			for _, name := range names {
+				if !containsFold(roles, name) {
+					roles = append(roles, name)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+func (c *Config) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + c.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if host, _, err := net.SplitHostPort(strings.TrimPrefix(strings.TrimPrefix(c.URL, "ldaps://"), "ldap://")); err == nil {
+		tlsConfig.ServerName = host
+	}
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	conn, err := ldap.DialURL(c.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %v", c.URL, err)
+	}
+	conn.SetTimeout(c.Timeout)
+	if c.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot start TLS with %s: %v", c.URL, err)
+		}
+	}
+	return conn, nil
+}
+
+// normalizeDN drops the spaces around the separators of a DN, directories
+// differ in how they format them.
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i := range parts {
+		kv := strings.SplitN(parts[i], "=", 2)
+		for j := range kv {
+			kv[j] = strings.TrimSpace(kv[j])
+		}
+		parts[i] = strings.Join(kv, "=")
+	}
+	return strings.Join(parts, ",")
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
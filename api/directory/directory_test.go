@@ -0,0 +1,154 @@
+package directory
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/directory/directorytest"
+)
+
+// newTestDirectory starts a directory holding jane, a member of admins
+// through memberOf and of auditors through the group entry, and returns a
+// config pointing at it.
+func newTestDirectory(t *testing.T) (*Config, *directorytest.Server) {
+	t.Helper()
+	server := directorytest.NewServer(
+		&directorytest.Entry{DN: "cn=service,dc=example,dc=com", Attributes: map[string][]string{
+			"userPassword": {"service-secret"},
+		}},
+		&directorytest.Entry{DN: "uid=jane,ou=people,dc=example,dc=com", Attributes: map[string][]string{
+			"objectClass":  {"person"},
+			"uid":          {"jane"},
+			"mail":         {"jane@example.com"},
+			"givenName":    {"Jane"},
+			"sn":           {"Doe"},
+			"memberOf":     {"cn=admins,ou=groups,dc=example,dc=com"},
+			"userPassword": {"s3cret"},
+		}},
+		&directorytest.Entry{DN: "uid=john,ou=people,dc=example,dc=com", Attributes: map[string][]string{
+			"objectClass":  {"person"},
+			"uid":          {"john"},
+			"mail":         {"john@example.com"},
+			"userPassword": {"hunter2"},
+		}},
+		&directorytest.Entry{DN: "cn=auditors,ou=groups,dc=example,dc=com", Attributes: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"member":      {"uid=jane,ou=people,dc=example,dc=com"},
+		}},
+	)
+	t.Cleanup(server.Close)
+	cfg := &Config{
+		URL:                server.URL,
+		Timeout:            5 * time.Second,
+		BindDN:             "cn=service,dc=example,dc=com",
+		BindPassword:       "service-secret",
+		UserBase:           "ou=people,dc=example,dc=com",
+		UserFilter:         "(&(objectClass=person)(|(uid={login})(mail={login})))",
+		UserNameAttribute:  "uid",
+		EmailAttribute:     "mail",
+		FirstNameAttribute: "givenName",
+		LastNameAttribute:  "sn",
+		GroupsAttribute:    "memberOf",
+		GroupBase:          "ou=groups,dc=example,dc=com",
+		GroupFilter:        "(|(member={dn})(uniqueMember={dn}))",
+		GroupRoles: map[string][]string{
+			"CN=Admins,OU=groups,DC=example,DC=com":      {"Administrator"},
+			"cn=auditors , ou=groups, dc=example,dc=com": {"Auditor", "administrator"},
+			"cn=other,ou=groups,dc=example,dc=com":       {"Other"},
+		},
+	}
+	return cfg, server
+}
+
+func TestLogin(t *testing.T) {
+	cfg, server := newTestDirectory(t)
+	Configure(cfg)
+	defer Configure(nil)
+
+	entry, roles, err := Login(" jane@example.com ", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Entry{
+		DN:        "uid=jane,ou=people,dc=example,dc=com",
+		UserName:  "jane",
+		Email:     "jane@example.com",
+		FirstName: "Jane",
+		LastName:  "Doe",
+		Groups:    []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=auditors,ou=groups,dc=example,dc=com"},
+	}
+	if !reflect.DeepEqual(entry, want) {
+		t.Errorf("Login returned %+v, want %+v", entry, want)
+	}
+	if !reflect.DeepEqual(roles, []string{"Administrator", "Auditor"}) {
+		t.Errorf("Groups map to roles %v", roles)
+	}
+
+	// The service account searches, the user binds with its password, and
+	// the service account searches the groups.
+	binds := []directorytest.Bind{
+		{DN: "cn=service,dc=example,dc=com", Password: "service-secret"},
+		{DN: "uid=jane,ou=people,dc=example,dc=com", Password: "s3cret"},
+		{DN: "cn=service,dc=example,dc=com", Password: "service-secret"},
+	}
+	if !reflect.DeepEqual(server.Binds(), binds) {
+		t.Errorf("Binds %+v, want %+v", server.Binds(), binds)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	cfg, _ := newTestDirectory(t)
+	if _, err := cfg.Login("jane", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("Login with a wrong password = %v", err)
+	}
+	if _, err := cfg.Login("nobody", "s3cret"); err != ErrInvalidCredentials {
+		t.Errorf("Login of an unknown user = %v", err)
+	}
+	if _, err := cfg.Login("john", "s3cret"); err != ErrInvalidCredentials {
+		t.Errorf("Login with the password of another user = %v", err)
+	}
+}
+
+func TestLoginRefusesEmptyPassword(t *testing.T) {
+	cfg, server := newTestDirectory(t)
+	// The directory accepts an empty password as an unauthenticated bind,
+	// so it must never be asked.
+	if _, err := cfg.Login("jane", ""); err != ErrInvalidCredentials {
+		t.Errorf("Login with an empty password = %v", err)
+	}
+	if _, err := cfg.Login("  ", "s3cret"); err != ErrInvalidCredentials {
+		t.Errorf("Login with an empty login = %v", err)
+	}
+	if server.Connections() != 0 {
+		t.Errorf("Login connected %d times", server.Connections())
+	}
+}
+
+func TestLoginEscapesFilter(t *testing.T) {
+	cfg, server := newTestDirectory(t)
+	// Unescaped, both logins would match every person.
+	for _, login := range []string{"*", "jane)(uid=*"} {
+		if _, err := cfg.Login(login, "s3cret"); err != ErrInvalidCredentials {
+			t.Errorf("Login(%q) = %v", login, err)
+		}
+	}
+	filters := []string{
+		`(&(objectClass=person)(|(uid=\2a)(mail=\2a)))`,
+		`(&(objectClass=person)(|(uid=jane\29\28uid=\2a)(mail=jane\29\28uid=\2a)))`,
+	}
+	if !reflect.DeepEqual(server.Filters(), filters) {
+		t.Errorf("Searched %q, want %q", server.Filters(), filters)
+	}
+}
+
+func TestMappedRoles(t *testing.T) {
+	cfg, _ := newTestDirectory(t)
+	Configure(cfg)
+	defer Configure(nil)
+
+	roles := MappedRoles()
+	if len(roles) != 3 || !containsFold(roles, "Administrator") || !containsFold(roles, "Auditor") || !containsFold(roles, "Other") {
+		t.Errorf("MappedRoles = %v", roles)
+	}
+}
@@ -0,0 +1,257 @@
+// Package directorytest runs an in-process LDAP server for tests. It answers
+// simple binds and searches over a fixed set of entries, which is all the
+// directory package asks of a directory.
+package directorytest
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Entry is an object of the directory. Attribute names compare case
+// insensitively, the userPassword attribute is the password binds check.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+func (e *Entry) values(attribute string) []string {
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Bind is a bind the server received.
+type Bind struct {
+	DN       string
+	Password string
+}
+
+type Server struct {
+	URL string
+
+	listener net.Listener
+	entries  []*Entry
+	wg       sync.WaitGroup
+
+	mu          sync.Mutex
+	connections int
+	binds       []Bind
+	filters     []string
+}
+
+// NewServer starts a server on a local port holding the entries. Stop it
+// with Close.
+func NewServer(entries ...*Entry) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("directorytest: cannot listen: " + err.Error())
+	}
+	s := &Server{URL: "ldap://" + listener.Addr().String(), listener: listener, entries: entries}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// Connections returns the number of connections accepted so far.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// Binds returns the binds received so far, in order.
+func (s *Server) Binds() []Bind {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Bind(nil), s.binds...)
+}
+
+// Filters returns the filters of the searches received so far, in order.
+func (s *Server) Filters() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.filters...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connections++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		id, _ := request.Children[0].Value.(int64)
+		op := request.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{s.bind(id, op)}
+		case ldap.ApplicationSearchRequest:
+			responses = s.search(id, op)
+		default:
+			return
+		}
+		for _, response := range responses {
+			if _, err := conn.Write(response.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind accepts the password of the entry, and like most directories any
+// DN with an empty password as an unauthenticated bind.
+func (s *Server) bind(id int64, op *ber.Packet) *ber.Packet {
+	dn, _ := op.Children[1].Value.(string)
+	password := op.Children[2].Data.String()
+	s.mu.Lock()
+	s.binds = append(s.binds, Bind{DN: dn, Password: password})
+	s.mu.Unlock()
+	if password == "" {
+		return result(id, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) {
+			for _, value := range entry.values("userPassword") {
+				if value == password {
+					return result(id, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+				}
+			}
+		}
+	}
+	return result(id, ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+}
+
+func (s *Server) search(id int64, op *ber.Packet) []*ber.Packet {
+	base, _ := op.Children[0].Value.(string)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	decompiled, err := ldap.DecompileFilter(filter)
+	if err != nil {
+		return []*ber.Packet{result(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+	s.mu.Lock()
+	s.filters = append(s.filters, decompiled)
+	s.mu.Unlock()
+	attributes := []string{}
+	for _, attribute := range op.Children[7].Children {
+		if name, ok := attribute.Value.(string); ok {
+			attributes = append(attributes, name)
+		}
+	}
+
+	responses := []*ber.Packet{}
+	for _, entry := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(entry.DN), strings.ToLower(base)) || !matches(entry, filter) {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, result(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+		responses = append(responses, searchEntry(id, entry, attributes))
+	}
+	return append(responses, result(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+// matches evaluates the and, or, not, equality and presence filters,
+// comparing case insensitively. Other filters match nothing.
+func matches(entry *Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matches(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matches(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !matches(entry, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		attribute, _ := filter.Children[0].Value.(string)
+		value, _ := filter.Children[1].Value.(string)
+		for _, v := range entry.values(attribute) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return len(entry.values(filter.Data.String())) > 0
+	}
+	return false
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	return packet
+}
+
+func result(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, ldap.ApplicationMap[uint8(tag)])
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return message(id, op)
+}
+
+func searchEntry(id int64, entry *Entry, attributes []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "Object Name"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, name := range attributes {
+		values := entry.values(name)
+		if len(values) == 0 || strings.EqualFold(name, "userPassword") {
+			continue
+		}
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+		list.AppendChild(attribute)
+	}
+	op.AppendChild(list)
+	return message(id, op)
+}
@@ -0,0 +1,75 @@
+package events
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	cefVendor  = "Truvest"
+	cefProduct = "Identity Management"
+	cefVersion = "1.0"
+)
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// FormatCEF renders the event as an ArcSight Common Event Format record.
+func FormatCEF(e Event) string {
+	severity := 3
+	if e.Category == CategoryAdmin {
+		severity = 5
+	}
+	if !e.Success {
+		severity = 6
+	}
+	name := e.Action + " " + e.Outcome()
+
+	var b strings.Builder
+	b.WriteString("CEF:0|")
+	for _, field := range []string{cefVendor, cefProduct, cefVersion, e.Action, name, strconv.Itoa(severity)} {
+		b.WriteString(cefHeaderEscaper.Replace(field) + "|")
+	}
+
+	extensions := [][2]string{
+		{"rt", strconv.FormatInt(e.Time.UnixNano()/1000000, 10)},
+		{"cat", e.Category},
+		{"act", e.Action},
+		{"outcome", e.Outcome()},
+		{"suid", e.ActorID},
+		{"duid", e.UserID},
+		{"duser", e.Email},
+		{"src", e.SourceIP},
+		{"reason", e.Reason},
+		{"requestClientApplication", e.UserAgent},
+	}
+	custom := [][2]string{
+		{"requestId", e.RequestID},
+		{"targetType", e.TargetType},
+		{"targetId", e.TargetID},
+		{"provider", e.Provider},
+		{"deviceId", e.DeviceID},
+	}
+	for i, field := range custom {
+		if field[1] == "" {
+			continue
+		}
+		key := "cs" + strconv.Itoa(i+1)
+		extensions = append(extensions, [2]string{key + "Label", field[0]}, [2]string{key, field[1]})
+	}
+
+	first := true
+	for _, extension := range extensions {
+		if extension[1] == "" {
+			continue
+		}
+		if !first {
+			b.WriteString(" ")
+		}
+		first = false
+		b.WriteString(extension[0] + "=" + cefExtensionEscaper.Replace(extension[1]))
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SinksFromEnv builds the sinks listed in EVENT_SINKS, a comma separated
+// list of URLs:
+//
+//	syslog+udp://host:514             RFC 5424 with a JSON body
+//	syslog+tcp://host:601
+//	syslog+tls://host:6514?ca=/etc/ssl/siem-ca.pem
+//	cef+udp://host:514                RFC 5424 with an ArcSight CEF body
+//	file:///var/log/truvest/events.jsonl?max_size_mb=100&max_backups=5
+//
+// Syslog sinks also take facility (default 10, authpriv) and app_name.
+func SinksFromEnv() ([]Sink, error) {
+	sinks := []Sink{}
+	for _, raw := range strings.Split(os.Getenv("EVENT_SINKS"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		sink, err := ParseSink(raw)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// BufferFromEnv is how many events each sink may fall behind before events
+// are dropped, configured by EVENT_SINK_BUFFER.
+func BufferFromEnv() int {
+	buffer, err := strconv.Atoi(os.Getenv("EVENT_SINK_BUFFER"))
+	if err != nil || buffer < 1 {
+		return 1000
+	}
+	return buffer
+}
+
+func ParseSink(raw string) (Sink, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("Invalid event sink " + raw)
+	}
+	query := u.Query()
+
+	if u.Scheme == "file" {
+		if u.Path == "" {
+			return nil, errors.New("Event sink " + raw + " needs a path")
+		}
+		maxSize, err := queryInt(query, "max_size_mb", 100)
+		if err != nil {
+			return nil, err
+		}
+		maxBackups, err := queryInt(query, "max_backups", 5)
+		if err != nil {
+			return nil, err
+		}
+		return &FileSink{Path: u.Path, MaxSize: int64(maxSize) << 20, MaxBackups: maxBackups}, nil
+	}
+
+	parts := strings.SplitN(u.Scheme, "+", 2)
+	if len(parts) != 2 || (parts[0] != "syslog" && parts[0] != "cef") {
+		return nil, errors.New("Unsupported event sink " + raw)
+	}
+	if u.Host == "" {
+		return nil, errors.New("Event sink " + raw + " needs a host and port")
+	}
+	facility, err := queryInt(query, "facility", FacilityAuthPriv)
+	if err != nil {
+		return nil, err
+	}
+	appName := query.Get("app_name")
+	if appName == "" {
+		appName = "truvest-identity"
+	}
+	sink := &SyslogSink{
+		Network:  parts[1],
+		Address:  u.Host,
+		Facility: facility,
+		AppName:  appName,
+		CEF:      parts[0] == "cef",
+	}
+	switch sink.Network {
+	case "udp", "tcp":
+	case "tls":
+		sink.TLSConfig = &tls.Config{ServerName: u.Hostname()}
+		if ca := query.Get("ca"); ca != "" {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("No certificates found in " + ca)
+			}
+			sink.TLSConfig.RootCAs = pool
+		}
+	default:
+		return nil, errors.New("Unsupported event sink transport " + sink.Network)
+	}
+	return sink, nil
+}
+
+func queryInt(query url.Values, key string, fallback int) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid " + key + " " + value)
+	}
+	return n, nil
+}
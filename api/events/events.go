@@ -0,0 +1,151 @@
+// Package events streams authentication and admin events to external sinks,
+// such as a SIEM listening for syslog or a file shipped by a log agent.
+// Publishing never blocks: every sink has its own bounded queue, and events
+// are dropped, and counted, when a sink cannot keep up.
+package events
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CategoryAuth  = "auth"
+	CategoryAdmin = "admin"
+)
+
+// Event is one authentication or admin event as sent to the sinks.
+type Event struct {
+	Time       time.Time       `json:"time"`
+	Category   string          `json:"category"`
+	Action     string          `json:"action"`
+	Success    bool            `json:"success"`
+	ActorID    string          `json:"actor_id,omitempty"`
+	UserID     string          `json:"user_id,omitempty"`
+	Email      string          `json:"email,omitempty"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	Provider   string          `json:"provider,omitempty"`
+	DeviceID   string          `json:"device_id,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	SourceIP   string          `json:"source_ip,omitempty"`
+	UserAgent  string          `json:"user_agent,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Changes    json.RawMessage `json:"changes,omitempty"`
+}
+
+func (e Event) Outcome() string {
+	if e.Success {
+		return "success"
+	}
+	return "failure"
+}
+
+// Sink delivers events to one destination. Write is only ever called from a
+// single goroutine per sink.
+type Sink interface {
+	Name() string
+	Write(e Event) error
+	Close() error
+}
+
+// queue feeds one sink from its own goroutine.
+type queue struct {
+	sink    Sink
+	events  chan Event
+	dropped uint64
+	done    chan struct{}
+}
+
+var (
+	mu     sync.RWMutex
+	queues []*queue
+)
+
+// Retries is how often a failed write is retried before the event is
+// dropped. The sinks reconnect between attempts.
+const Retries = 3
+
+// Start replaces the sinks events are published to. Each sink buffers up to
+// buffer events. The sinks it replaces are drained and closed.
+func Start(sinks []Sink, buffer int) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	started := make([]*queue, 0, len(sinks))
+	for _, sink := range sinks {
+		q := &queue{sink: sink, events: make(chan Event, buffer), done: make(chan struct{})}
+		go q.run()
+		started = append(started, q)
+	}
+	mu.Lock()
+	previous := queues
+	queues = started
+	mu.Unlock()
+	for _, q := range previous {
+		close(q.events)
+		<-q.done
+	}
+}
+
+// Stop drains and closes every sink.
+func Stop() {
+	Start(nil, 1)
+}
+
+// Publish hands the event to every sink without waiting for any of them.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, q := range queues {
+		select {
+		case q.events <- e:
+		default:
+			if atomic.AddUint64(&q.dropped, 1) == 1 {
+				log.Printf("Event sink %s is falling behind, dropping events", q.sink.Name())
+			}
+		}
+	}
+}
+
+// Dropped returns how many events each sink dropped since it was started.
+func Dropped() map[string]uint64 {
+	mu.RLock()
+	defer mu.RUnlock()
+	dropped := map[string]uint64{}
+	for _, q := range queues {
+		dropped[q.sink.Name()] = atomic.LoadUint64(&q.dropped)
+	}
+	return dropped
+}
+
+func (q *queue) run() {
+	defer close(q.done)
+	defer q.sink.Close()
+	reported := uint64(0)
+	for e := range q.events {
+		var err error
+		for attempt := 0; attempt <= Retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			}
+			if err = q.sink.Write(e); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			atomic.AddUint64(&q.dropped, 1)
+			log.Printf("Cannot write %s event to sink %s: %v", e.Action, q.sink.Name(), err)
+		}
+		if dropped := atomic.LoadUint64(&q.dropped); dropped != reported && len(q.events) == 0 {
+			log.Printf("Event sink %s caught up, %d events dropped so far", q.sink.Name(), dropped)
+			reported = dropped
+		}
+	}
+}
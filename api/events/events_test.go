@@ -0,0 +1,127 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingSink holds every write until it is released.
+type blockingSink struct {
+	writing chan Event
+	release chan struct{}
+
+	mu      sync.Mutex
+	written []Event
+	closed  bool
+}
+
+func newBlockingSink() *blockingSink {
+	return &blockingSink{writing: make(chan Event, 100), release: make(chan struct{})}
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+
+func (s *blockingSink) Write(e Event) error {
+	s.writing <- e
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written = append(s.written, e)
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestPublishDropsWhenSinkIsFull(t *testing.T) {
+	sink := newBlockingSink()
+	Start([]Sink{sink}, 2)
+	defer Stop()
+
+	Publish(testEvent("first"))
+	select {
+	case <-sink.writing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The sink never received the first event")
+	}
+
+	// The sink is stuck writing the first event, two fit in the queue and
+	// the rest are dropped without blocking the caller.
+	published := make(chan struct{})
+	go func() {
+		for _, action := range []string{"second", "third", "fourth", "fifth", "sixth"} {
+			Publish(testEvent(action))
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a full sink")
+	}
+	if dropped := Dropped()["blocking"]; dropped != 3 {
+		t.Errorf("Dropped %d events, want 3", dropped)
+	}
+
+	close(sink.release)
+	Stop()
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	actions := []string{}
+	for _, e := range sink.written {
+		actions = append(actions, e.Action)
+	}
+	if len(actions) != 3 || actions[0] != "first" || actions[1] != "second" || actions[2] != "third" {
+		t.Errorf("Sink wrote %v, want [first second third]", actions)
+	}
+	if !sink.closed {
+		t.Error("Stop did not close the sink")
+	}
+}
+
+// failingSink fails the first failures writes.
+type failingSink struct {
+	failures int
+	attempts int
+	written  []Event
+}
+
+func (s *failingSink) Name() string { return "failing" }
+
+func (s *failingSink) Write(e Event) error {
+	s.attempts++
+	if s.attempts <= s.failures {
+		return errors.New("connection refused")
+	}
+	s.written = append(s.written, e)
+	return nil
+}
+
+func (s *failingSink) Close() error { return nil }
+
+func TestPublishRetriesFailedWrites(t *testing.T) {
+	sink := &failingSink{failures: Retries}
+	Start([]Sink{sink}, 10)
+	Publish(testEvent("login"))
+	Stop()
+	if len(sink.written) != 1 || sink.attempts != Retries+1 {
+		t.Errorf("Wrote %d events in %d attempts", len(sink.written), sink.attempts)
+	}
+}
+
+func TestPublishSetsTheTime(t *testing.T) {
+	sink := &failingSink{}
+	Start([]Sink{sink}, 10)
+	before := time.Now()
+	Publish(Event{Category: CategoryAuth, Action: "login", Success: true})
+	Stop()
+	if len(sink.written) != 1 || sink.written[0].Time.Before(before) {
+		t.Errorf("Published events %+v", sink.written)
+	}
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// FileSink appends events as JSON lines to a file. Once the file reaches
+// MaxSize bytes it is rotated to path.1, path.1 to path.2 and so on, keeping
+// at most MaxBackups old files.
+type FileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	file *os.File
+	size int64
+}
+
+func (s *FileSink) Name() string {
+	return "file://" + s.Path
+}
+
+func (s *FileSink) Write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if s.MaxBackups < 1 {
+		if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.Path, s.MaxBackups))
+	for i := s.MaxBackups - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", s.Path, i), fmt.Sprintf("%s.%d", s.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.Path, s.Path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.open()
+}
@@ -0,0 +1,243 @@
+package events
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEvent(action string) Event {
+	return Event{
+		Time:     time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Category: CategoryAuth,
+		Action:   action,
+		Success:  true,
+		UserID:   "5b0e2f36-4f8e-4a51-9f3c-3d0c7a1c2e11",
+		Email:    "jane@example.com",
+		SourceIP: "203.0.113.7",
+	}
+}
+
+// readFrame reads one octet counted frame, "<length> <message>".
+func readFrame(r *bufio.Reader) (string, error) {
+	prefix, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	length, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+	if err != nil {
+		return "", fmt.Errorf("invalid frame length %q", prefix)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+// checkMessage checks the header and JSON body of an RFC 5424 message.
+func checkMessage(t *testing.T, message string, action string) {
+	t.Helper()
+	header := "<86>1 2024-03-01T12:30:00.000000Z test truvest-identity "
+	if !strings.HasPrefix(message, header) {
+		t.Fatalf("Message %q does not start with %q", message, header)
+	}
+	if !strings.Contains(message, " "+action+" [truvest@32473 category=\"auth\" action=\""+action+"\"") {
+		t.Errorf("Message %q lacks the structured data of %s", message, action)
+	}
+	body := message[strings.Index(message, "] ")+2:]
+	e := Event{}
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatalf("Body %q is not JSON: %v", body, err)
+	}
+	if e.Action != action || e.Email != "jane@example.com" {
+		t.Errorf("Body decoded to %+v", e)
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink := &SyslogSink{Network: "udp", Address: conn.LocalAddr().String(), Facility: FacilityAuthPriv, AppName: "truvest-identity", Hostname: "test"}
+	defer sink.Close()
+
+	for _, action := range []string{"login", "logout"} {
+		if err := sink.Write(testEvent(action)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 65536)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One datagram per message, without octet counting.
+		checkMessage(t, string(buf[:n]), action)
+	}
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sink := &SyslogSink{Network: "tcp", Address: listener.Addr().String(), Facility: FacilityAuthPriv, AppName: "truvest-identity", Hostname: "test"}
+	testStream(t, listener, sink)
+}
+
+func TestSyslogSinkTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sink := &SyslogSink{
+		Network:   "tls",
+		Address:   listener.Addr().String(),
+		TLSConfig: &tls.Config{ServerName: "localhost", RootCAs: pool},
+		Facility:  FacilityAuthPriv,
+		AppName:   "truvest-identity",
+		Hostname:  "test",
+	}
+	testStream(t, listener, sink)
+}
+
+func TestSyslogSinkTLSUntrusted(t *testing.T) {
+	cert, _ := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	sink := &SyslogSink{Network: "tls", Address: listener.Addr().String(), TLSConfig: &tls.Config{ServerName: "localhost", RootCAs: x509.NewCertPool()}}
+	if err := sink.Write(testEvent("login")); err == nil {
+		t.Fatal("Write succeeded against an untrusted certificate")
+	}
+}
+
+// testStream writes two messages over a stream sink and checks that each
+// arrives in its own octet counted frame.
+func testStream(t *testing.T, listener net.Listener, sink *SyslogSink) {
+	t.Helper()
+	received := make(chan []string, 1)
+	failed := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			failed <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		messages := []string{}
+		for len(messages) < 2 {
+			message, err := readFrame(r)
+			if err != nil {
+				failed <- err
+				return
+			}
+			messages = append(messages, message)
+		}
+		received <- messages
+	}()
+
+	for _, action := range []string{"login", "logout"} {
+		if err := sink.Write(testEvent(action)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var messages []string
+	select {
+	case messages = <-received:
+	case err := <-failed:
+		t.Fatalf("Cannot read the messages: %v", err)
+	}
+	sink.Close()
+	checkMessage(t, messages[0], "login")
+	checkMessage(t, messages[1], "logout")
+}
+
+func TestSyslogFormat(t *testing.T) {
+	sink := &SyslogSink{Facility: FacilityAuthPriv, AppName: "truvest identity", Hostname: "host name"}
+
+	admin := testEvent("role.update")
+	admin.Category = CategoryAdmin
+	admin.TargetID = `a"b]c\d`
+	message := string(sink.Format(admin))
+	if !strings.HasPrefix(message, "<85>1 ") {
+		t.Errorf("Admin event %q is not a notice", message)
+	}
+	if !strings.Contains(message, " hostname truvestidentity ") {
+		t.Errorf("Header fields of %q keep their spaces", message)
+	}
+	if !strings.Contains(message, `targetId="a\"b\]c\\d"`) {
+		t.Errorf("Structured data of %q is not escaped", message)
+	}
+
+	failed := testEvent("login")
+	failed.Success = false
+	sink.CEF = true
+	message = string(sink.Format(failed))
+	if !strings.HasPrefix(message, "<84>1 ") {
+		t.Errorf("Failed event %q is not a warning", message)
+	}
+	if !strings.Contains(message, "] CEF:0|Truvest|Identity Management|1.0|login|login failure|6|") {
+		t.Errorf("CEF body missing in %q", message)
+	}
+}
+
+// testCertificate creates a self-signed certificate for localhost and a pool
+// trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
@@ -0,0 +1,85 @@
+// Package geoip resolves client addresses to an approximate location using a
+// local MaxMind City database (GeoLite2-City.mmdb or compatible). Without a
+// database every lookup misses, so features built on it degrade gracefully.
+package geoip
+
+import (
+	"math"
+	"net"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Location is where an address was placed by the database.
+type Location struct {
+	Country        string
+	City           string
+	Latitude       float64
+	Longitude      float64
+	AccuracyRadius uint16
+}
+
+var (
+	mu     sync.RWMutex
+	reader *geoip2.Reader
+)
+
+// Load opens the database at path and makes it the one used by Lookup,
+// closing the database it replaces.
+func Load(path string) error {
+	r, err := geoip2.Open(path)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	previous := reader
+	reader = r
+	mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// Loaded reports whether a database is available to Lookup.
+func Loaded() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return reader != nil
+}
+
+// Lookup returns the location of ip. It reports false when no database is
+// loaded or the address has no coordinates, such as private addresses.
+func Lookup(ip string) (Location, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Location{}, false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if reader == nil {
+		return Location{}, false
+	}
+	city, err := reader.City(parsed)
+	if err != nil || (city.Location.Latitude == 0 && city.Location.Longitude == 0) {
+		return Location{}, false
+	}
+	return Location{
+		Country:        city.Country.IsoCode,
+		City:           city.City.Names["en"],
+		Latitude:       city.Location.Latitude,
+		Longitude:      city.Location.Longitude,
+		AccuracyRadius: city.Location.AccuracyRadius,
+	}, true
+}
+
+// DistanceKm is the great-circle distance between two locations.
+func DistanceKm(a Location, b Location) float64 {
+	const earthRadiusKm = 6371.0
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
@@ -6,6 +6,7 @@ import (
 
 	"bitbucket.org/staydigital/truvest-identity-management/api/auth"
 	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"github.com/google/uuid"
 )
 
 func SetMiddlewareJSON(next http.HandlerFunc) http.HandlerFunc {
@@ -25,3 +26,17 @@ func SetMiddlewareAuthentication(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// SetMiddlewareRequestID tags every request with an X-Request-ID, keeping the
+// one set by a proxy in front, and echoes it in the response.
+func SetMiddlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 64 {
+			requestID = uuid.New().String()
+			r.Header.Set("X-Request-ID", requestID)
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,273 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/responses"
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
+)
+
+// RateLimit is a token bucket holding up to Burst requests that refills
+// completely once per Period. Each limit keeps one bucket per route and key.
+type RateLimit struct {
+	Route  string
+	Burst  int
+	Period time.Duration
+	Key    KeyFunc
+}
+
+// KeyFunc extracts what a limit is counted by from the request. An empty key
+// means the limit does not apply to the request.
+type KeyFunc struct {
+	Name    string
+	Extract func(r *http.Request) string
+}
+
+// RateLimitStore takes one token from the bucket identified by key. Peek
+// tells what Take would return without spending the token.
+type RateLimitStore interface {
+	Peek(key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+	Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+var (
+	// ByIP counts requests per client address, see utils.ClientIP.
+	ByIP = KeyFunc{Name: "ip", Extract: utils.ClientIP}
+	// ByEmail counts requests per "email" field of the JSON body.
+	ByEmail = KeyFunc{Name: "email", Extract: emailFromBody}
+	// ByClientID counts requests per X-Client-ID header.
+	ByClientID = KeyFunc{Name: "client", Extract: func(r *http.Request) string {
+		return strings.TrimSpace(r.Header.Get("X-Client-ID"))
+	}}
+)
+
+var rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+// SetRateLimitStore replaces the in-process store, for example with one
+// shared through the database when the service runs on several instances.
+func SetRateLimitStore(store RateLimitStore) {
+	rateLimitStore = store
+}
+
+// RateLimitFromEnv reads a limit such as "10/1m" from the environment. The
+// value "off" disables the limit, an unset variable falls back to fallback.
+func RateLimitFromEnv(route string, env string, fallback string, key KeyFunc) (RateLimit, bool) {
+	value := strings.TrimSpace(os.Getenv(env))
+	if value == "" {
+		value = fallback
+	}
+	if strings.EqualFold(value, "off") {
+		return RateLimit{}, false
+	}
+	limit, err := ParseRateLimit(value)
+	if err != nil {
+		log.Fatalf("Invalid rate limit %s=%q: %v", env, value, err)
+	}
+	limit.Route = route
+	limit.Key = key
+	return limit, true
+}
+
+// ParseRateLimit parses "<burst>/<period>", the period being a Go duration
+// such as 1m or 1h.
+func ParseRateLimit(value string) (RateLimit, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, errors.New("expected <requests>/<period>")
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || burst <= 0 {
+		return RateLimit{}, errors.New("requests must be a positive number")
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period <= 0 {
+		return RateLimit{}, errors.New("period must be a positive duration")
+	}
+	return RateLimit{Burst: burst, Period: period}, nil
+}
+
+// SetMiddlewareRateLimit rejects requests exceeding any of the limits with
+// 429 and Retry-After. The RateLimit-* headers describe the most exhausted
+// limit. Tokens are only spent when every limit allows the request, so that
+// requests rejected by one limit, say per IP, do not drain the buckets of the
+// others, say per email. Limits are skipped when RATE_LIMIT_ENABLED is
+// "false", and requests are let through when the store fails.
+func SetMiddlewareRateLimit(next http.HandlerFunc, limits ...RateLimit) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("RATE_LIMIT_ENABLED") == "false" {
+			next(w, r)
+			return
+		}
+		now := time.Now()
+		keys := make([]string, len(limits))
+		for i, limit := range limits {
+			if key := limit.Key.Extract(r); key != "" {
+				keys[i] = limit.Route + ":" + limit.Key.Name + ":" + key
+			}
+		}
+		if limit, result := applyRateLimits(rateLimitStore.Peek, limits, keys, now); limit != nil && !result.Allowed {
+			rejectRateLimited(w, limit, result)
+			return
+		}
+		limit, result := applyRateLimits(rateLimitStore.Take, limits, keys, now)
+		if limit != nil {
+			if !result.Allowed {
+				rejectRateLimited(w, limit, result)
+				return
+			}
+			setRateLimitHeaders(w, limit, result)
+		}
+		next(w, r)
+	}
+}
+
+// applyRateLimits runs apply on the bucket of each limit with a key and
+// returns the most exhausted limit, a rejecting one first.
+func applyRateLimits(apply func(string, RateLimit, time.Time) (RateLimitResult, error), limits []RateLimit, keys []string, now time.Time) (*RateLimit, RateLimitResult) {
+	var tightest *RateLimit
+	var tightestResult RateLimitResult
+	for i := range limits {
+		if keys[i] == "" {
+			continue
+		}
+		result, err := apply(keys[i], limits[i], now)
+		if err != nil {
+			log.Printf("Rate limit store failed for %s: %v", limits[i].Route, err)
+			continue
+		}
+		if tightest == nil || (tightestResult.Allowed && (!result.Allowed || result.Remaining < tightestResult.Remaining)) {
+			tightest = &limits[i]
+			tightestResult = result
+		}
+	}
+	return tightest, tightestResult
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, limit *RateLimit, result RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+}
+
+func rejectRateLimited(w http.ResponseWriter, limit *RateLimit, result RateLimitResult) {
+	setRateLimitHeaders(w, limit, result)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+	responses.ERROR(w, http.StatusTooManyRequests, fmt.Errorf("Too many requests, retry in %d seconds", seconds(result.RetryAfter)))
+}
+
+// Refill spends one token of a bucket last updated at updatedAt, refilling
+// it for the time passed since. It returns the tokens left and the result.
+// Stores peek by discarding the tokens left.
+func Refill(tokens float64, updatedAt time.Time, limit RateLimit, now time.Time) (float64, RateLimitResult) {
+	burst := float64(limit.Burst)
+	rate := burst / limit.Period.Seconds()
+	if elapsed := now.Sub(updatedAt).Seconds(); elapsed > 0 {
+		tokens = math.Min(burst, tokens+elapsed*rate)
+	}
+	result := RateLimitResult{}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(math.Floor(tokens))
+	result.Reset = time.Duration((burst - tokens) / rate * float64(time.Second))
+	return tokens, result
+}
+
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	period    time.Duration
+}
+
+// MemoryRateLimitStore keeps buckets in process memory. Each instance of the
+// service enforces its own limits.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	takes   int
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *MemoryRateLimitStore) Peek(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		_, result := Refill(float64(limit.Burst), now, limit, now)
+		return result, nil
+	}
+	_, result := Refill(bucket.tokens, bucket.updatedAt, limit, now)
+	return result, nil
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.takes++
+	if s.takes%1000 == 0 {
+		for k, b := range s.buckets {
+			if now.Sub(b.updatedAt) > b.period {
+				delete(s.buckets, k)
+			}
+		}
+	}
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Burst), updatedAt: now, period: limit.Period}
+		s.buckets[key] = bucket
+	}
+	var result RateLimitResult
+	bucket.tokens, result = Refill(bucket.tokens, bucket.updatedAt, limit, now)
+	bucket.updatedAt = now
+	return result, nil
+}
+
+// emailFromBody reads the "email" field of a JSON body and puts the body
+// back for the handler.
+func emailFromBody(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	payload := struct {
+		Email string `json:"email"`
+	}{}
+	if json.Unmarshal(body, &payload) != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(payload.Email))
+}
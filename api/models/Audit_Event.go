@@ -0,0 +1,193 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Audit_Event records one administrative change. Events are only ever
+// inserted, the table refuses updates and deletes, see EnforceAuditAppendOnly.
+type Audit_Event struct {
+	ID         uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	ActorID    *uuid.UUID `gorm:"type:uuid;index" json:"actor_id,omitempty"`
+	Action     string     `gorm:"size:64;not null;index" json:"action"`
+	TargetType string     `gorm:"size:64;not null" json:"target_type"`
+	TargetID   string     `gorm:"size:255;index" json:"target_id"`
+	Before     JSONB      `gorm:"type:jsonb" json:"before,omitempty"`
+	After      JSONB      `gorm:"type:jsonb" json:"after,omitempty"`
+	Changes    JSONB      `gorm:"type:jsonb" json:"changes,omitempty"`
+	RequestID  string     `gorm:"size:64" json:"request_id"`
+	SourceIP   string     `gorm:"size:64" json:"source_ip"`
+	CreatedAt  time.Time  `gorm:"default:CURRENT_TIMESTAMP;index" json:"created_at"`
+}
+
+type Audit_Event_Filter struct {
+	ActorID    *uuid.UUID
+	Action     string
+	TargetType string
+	TargetID   string
+	From       *time.Time
+	To         *time.Time
+}
+
+// JSONB stores raw JSON in a jsonb column and embeds it as is in responses.
+type JSONB json.RawMessage
+
+func (j JSONB) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+func (j *JSONB) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		*j = append((*j)[:0], v...)
+	case string:
+		*j = JSONB(v)
+	case nil:
+		*j = nil
+	default:
+		return errors.New("Unsupported type for JSONB")
+	}
+	return nil
+}
+
+func (j JSONB) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+// AuditChange is the value of one field before and after a change.
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// SetBefore snapshots the target as it was before the change.
+func (ae *Audit_Event) SetBefore(v interface{}) error {
+	before, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ae.Before = before
+	return nil
+}
+
+// SetAfter snapshots the target as it is after the change.
+func (ae *Audit_Event) SetAfter(v interface{}) error {
+	after, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ae.After = after
+	return nil
+}
+
+func (ae *Audit_Event) Prepare(actorID *uuid.UUID, requestID string, sourceIP string) error {
+	ae.ID = uuid.New()
+	ae.ActorID = actorID
+	ae.RequestID = requestID
+	ae.SourceIP = sourceIP
+	ae.CreatedAt = time.Now()
+	changes, err := auditDiff(ae.Before, ae.After)
+	if err != nil {
+		return err
+	}
+	ae.Changes = changes
+	return nil
+}
+
+// auditDiff lists the top-level fields that differ between two snapshots.
+// Fields that only exist on one side are reported with null on the other.
+func auditDiff(before JSONB, after JSONB) (JSONB, error) {
+	from := map[string]interface{}{}
+	to := map[string]interface{}{}
+	if len(before) > 0 && json.Unmarshal(before, &from) != nil {
+		return nil, nil
+	}
+	if len(after) > 0 && json.Unmarshal(after, &to) != nil {
+		return nil, nil
+	}
+	changes := map[string]AuditChange{}
+	for field, value := range from {
+		if !reflect.DeepEqual(value, to[field]) {
+			changes[field] = AuditChange{From: value, To: to[field]}
+		}
+	}
+	for field, value := range to {
+		if _, ok := from[field]; !ok && value != nil {
+			changes[field] = AuditChange{From: nil, To: value}
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	diff, err := json.Marshal(changes)
+	return diff, err
+}
+
+func (ae *Audit_Event) SaveAuditEvent(db *gorm.DB) error {
+	return db.Debug().Create(&ae).Error
+}
+
+// FindAuditEvents returns a page of events matching the filter, newest first.
+func (ae *Audit_Event) FindAuditEvents(db *gorm.DB, filter Audit_Event_Filter, page int, perPage int) (*Page, error) {
+	query := db.Debug().Model(&Audit_Event{})
+	if filter.ActorID != nil {
+		query = query.Where("actor_id = ?", *filter.ActorID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		query = query.Where("target_id = ?", filter.TargetID)
+	}
+	if filter.From != nil {
+		query = query.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("created_at < ?", *filter.To)
+	}
+	total := 0
+	err := query.Count(&total).Error
+	if err != nil {
+		return &Page{}, err
+	}
+	events := []Audit_Event{}
+	err = query.Order("created_at desc").Offset((page - 1) * perPage).Limit(perPage).Find(&events).Error
+	if err != nil {
+		return &Page{}, err
+	}
+	return &Page{Items: events, Page: page, PerPage: perPage, Total: total}, nil
+}
+
+// EnforceAuditAppendOnly installs a trigger that rejects every update and
+// delete on the audit table, so that not even the service can rewrite it.
+func EnforceAuditAppendOnly(db *gorm.DB) error {
+	err := db.Debug().Exec(`CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql`).Error
+	if err != nil {
+		return err
+	}
+	err = db.Debug().Exec("DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events").Error
+	if err != nil {
+		return err
+	}
+	return db.Debug().Exec("CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events FOR EACH ROW EXECUTE PROCEDURE audit_events_append_only()").Error
+}
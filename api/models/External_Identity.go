@@ -0,0 +1,111 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// External_Identity is an account at an OAuth or OpenID Connect provider
+// linked to a user. It is matched by the subject the provider identifies the
+// account with, which unlike the email cannot be changed by its owner.
+type External_Identity struct {
+	ID           uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	UserID       uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	Provider     string     `gorm:"size:100;not null;unique_index:idx_external_identity_subject" json:"provider"`
+	Subject      string     `gorm:"size:255;not null;unique_index:idx_external_identity_subject" json:"subject"`
+	Email        string     `gorm:"size:100" json:"email"`
+	AccessToken  string     `gorm:"type:text" json:"-"`
+	RefreshToken string     `gorm:"type:text" json:"-"`
+	ExpiresAt    *time.Time `json:"-"`
+	LastLoginAt  *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt    time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// ErrIdentityLinked is returned when the account at the provider already
+// belongs to another user.
+var ErrIdentityLinked = errors.New("This account is already linked to another user")
+
+func (ei *External_Identity) Prepare(uid uuid.UUID, provider, subject string) {
+	ei.ID = uuid.New()
+	ei.UserID = uid
+	ei.Provider = provider
+	ei.Subject = subject
+	ei.CreatedAt = time.Now()
+	ei.UpdatedAt = time.Now()
+}
+
+// SaveExternalIdentity links the identity. It fails with ErrIdentityLinked
+// when the identity belongs to another user, and updates it when it already
+// belongs to the same one.
+func (ei *External_Identity) SaveExternalIdentity(db *gorm.DB) (*External_Identity, error) {
+	existing := External_Identity{}
+	err := db.Debug().Model(&External_Identity{}).Where("provider = ? AND subject = ?", ei.Provider, ei.Subject).Take(&existing).Error
+	if err == nil {
+		if existing.UserID != ei.UserID {
+			return &External_Identity{}, ErrIdentityLinked
+		}
+		ei.ID = existing.ID
+		ei.CreatedAt = existing.CreatedAt
+		return ei.UpdateExternalIdentity(db)
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return &External_Identity{}, err
+	}
+	err = db.Debug().Model(&External_Identity{}).Create(&ei).Error
+	if err != nil {
+		return &External_Identity{}, err
+	}
+	return ei, nil
+}
+
+// UpdateExternalIdentity stores the email and tokens of the latest login.
+func (ei *External_Identity) UpdateExternalIdentity(db *gorm.DB) (*External_Identity, error) {
+	ei.UpdatedAt = time.Now()
+	err := db.Debug().Model(&External_Identity{}).Where("id = ?", ei.ID).UpdateColumns(
+		map[string]interface{}{
+			"email":         ei.Email,
+			"access_token":  ei.AccessToken,
+			"refresh_token": ei.RefreshToken,
+			"expires_at":    ei.ExpiresAt,
+			"last_login_at": ei.LastLoginAt,
+			"updated_at":    ei.UpdatedAt,
+		},
+	).Error
+	if err != nil {
+		return &External_Identity{}, err
+	}
+	return ei, nil
+}
+
+func (ei *External_Identity) FindExternalIdentity(db *gorm.DB, provider, subject string) (*External_Identity, error) {
+	err := db.Debug().Model(&External_Identity{}).Where("provider = ? AND subject = ?", provider, subject).Take(&ei).Error
+	if err != nil {
+		return &External_Identity{}, err
+	}
+	return ei, nil
+}
+
+func (ei *External_Identity) FindExternalIdentitiesByUserID(db *gorm.DB, uid uuid.UUID) (*[]External_Identity, error) {
+	identities := []External_Identity{}
+	err := db.Debug().Model(&External_Identity{}).Where("user_id = ?", uid).Order("provider, created_at").Find(&identities).Error
+	if err != nil {
+		return &[]External_Identity{}, err
+	}
+	return &identities, nil
+}
+
+// DeleteAnExternalIdentity unlinks an identity of the user.
+func (ei *External_Identity) DeleteAnExternalIdentity(db *gorm.DB, id, uid uuid.UUID) (int64, error) {
+	result := db.Debug().Where("id = ? AND user_id = ?", id, uid).Delete(&External_Identity{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("Identity Not Found")
+	}
+	return result.RowsAffected, nil
+}
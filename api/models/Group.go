@@ -0,0 +1,470 @@
+package models
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Group gathers users to give them roles together. The members of a group
+// are also members of the groups above it, so they get the roles of its
+// parent and so on up.
+type Group struct {
+	ID          uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	Name        string     `gorm:"size:255;not null;unique" json:"name"`
+	Description string     `gorm:"size:255" json:"description"`
+	ParentID    *uuid.UUID `gorm:"type:uuid;index" json:"parent_id"`
+	CreatedAt   time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy   uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	UpdatedAt   time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+	UpdatedBy   uuid.UUID  `gorm:"type:uuid;not null" json:"updated_by"`
+	Roles       []*Role    `gorm:"many2many:group_roles" json:"roles"`
+}
+
+type Group_Payload struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	ParentID    *uuid.UUID `json:"parent_id"`
+}
+
+type Group_Member struct {
+	GroupID uuid.UUID `gorm:"type:uuid;primary_key" json:"groupid"`
+	UserID  uuid.UUID `gorm:"type:uuid;primary_key" json:"userid"`
+}
+
+type Group_Member_Payload struct {
+	Users []uuid.UUID `json:"users"`
+}
+
+type Group_Role struct {
+	GroupID uuid.UUID `gorm:"type:uuid;primary_key" json:"groupid"`
+	RoleID  uint32    `gorm:"primary_key;auto_increment:false" json:"roleid"`
+}
+
+type Group_Role_Payload struct {
+	Roles []uint32 `json:"roles"`
+}
+
+var ErrGroupCycle = errors.New("A group cannot be inside itself")
+
+func (g *Group) Apply(payload Group_Payload) {
+	g.Name = html.EscapeString(strings.TrimSpace(payload.Name))
+	g.Description = html.EscapeString(strings.TrimSpace(payload.Description))
+	g.ParentID = payload.ParentID
+}
+
+func (g *Group) Prepare(tuid uuid.UUID) {
+	g.ID = uuid.New()
+	g.CreatedAt = time.Now()
+	g.CreatedBy = tuid
+	g.UpdatedAt = time.Now()
+	g.UpdatedBy = tuid
+}
+
+func (g *Group) Validate() error {
+	if g.Name == "" {
+		return errors.New("Required Name")
+	}
+	return nil
+}
+
+// ValidateParent checks that the parent exists and that the group is not
+// among the groups above it.
+func (g *Group) ValidateParent(db *gorm.DB) error {
+	seen := map[uuid.UUID]bool{}
+	pid := g.ParentID
+	for pid != nil {
+		if *pid == g.ID || seen[*pid] {
+			return ErrGroupCycle
+		}
+		seen[*pid] = true
+		parent := Group{}
+		err := db.Debug().Model(&Group{}).Where("id = ?", *pid).Take(&parent).Error
+		if err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return errors.New("Parent group not found")
+			}
+			return err
+		}
+		pid = parent.ParentID
+	}
+	return nil
+}
+
+func (g *Group) SaveGroup(db *gorm.DB) (*Group, error) {
+	err := db.Debug().Model(&Group{}).Create(&g).Error
+	if err != nil {
+		return &Group{}, err
+	}
+	return g, nil
+}
+
+func (g *Group) FindAllGroups(db *gorm.DB) (*[]Group, error) {
+	groups := []Group{}
+	err := db.Debug().Model(&Group{}).Preload("Roles").Order("name").Find(&groups).Error
+	if err != nil {
+		return &[]Group{}, err
+	}
+	return &groups, nil
+}
+
+func (g *Group) FindGroupByID(db *gorm.DB, gid uuid.UUID) (*Group, error) {
+	err := db.Debug().Model(&Group{}).Where("id = ?", gid).Preload("Roles").Take(&g).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Group{}, errors.New("Group Not Found")
+		}
+		return &Group{}, err
+	}
+	return g, nil
+}
+
+// FindGroupsByUserID returns the groups the user is a direct member of.
+func (g *Group) FindGroupsByUserID(db *gorm.DB, uid uuid.UUID) ([]*Group, error) {
+	groups := []*Group{}
+	err := db.Debug().Model(&Group{}).Joins("JOIN group_members ON group_members.group_id = groups.id").
+		Where("group_members.user_id = ?", uid).Order("groups.name").Find(&groups).Error
+	if err != nil {
+		return []*Group{}, err
+	}
+	return groups, nil
+}
+
+func (g *Group) UpdateAGroup(db *gorm.DB, tuid uuid.UUID) (*Group, error) {
+	g.UpdatedAt = time.Now()
+	g.UpdatedBy = tuid
+	err := db.Debug().Model(&Group{}).Where("id = ?", g.ID).UpdateColumns(
+		map[string]interface{}{
+			"name":        g.Name,
+			"description": g.Description,
+			"parent_id":   g.ParentID,
+			"updated_at":  g.UpdatedAt,
+			"updated_by":  g.UpdatedBy,
+		},
+	).Error
+	if err != nil {
+		return &Group{}, err
+	}
+	return g, nil
+}
+
+// DeleteAGroup deletes the group with its memberships and roles. The groups
+// inside it move to its parent.
+func (g *Group) DeleteAGroup(db *gorm.DB, gid uuid.UUID) (int64, error) {
+	deleted := Group{}
+	err := db.Debug().Model(&Group{}).Where("id = ?", gid).Take(&deleted).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return 0, errors.New("Group Not Found")
+		}
+		return 0, err
+	}
+	err = db.Debug().Model(&Group{}).Where("parent_id = ?", gid).UpdateColumn("parent_id", deleted.ParentID).Error
+	if err != nil {
+		return 0, err
+	}
+	err = db.Debug().Where("group_id = ?", gid).Delete(&Group_Member{}).Error
+	if err != nil {
+		return 0, err
+	}
+	err = db.Debug().Where("group_id = ?", gid).Delete(&Group_Role{}).Error
+	if err != nil {
+		return 0, err
+	}
+	result := db.Debug().Where("id = ?", gid).Delete(&Group{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return result.RowsAffected, nil
+}
+
+// FindGroupsWithAncestors returns the groups and the groups above them, with
+// their roles, by ID.
+func (g *Group) FindGroupsWithAncestors(db *gorm.DB, gids []uuid.UUID) (map[uuid.UUID]*Group, error) {
+	groups := map[uuid.UUID]*Group{}
+	queued := map[uuid.UUID]bool{}
+	pending := []uuid.UUID{}
+	for _, gid := range gids {
+		if !queued[gid] {
+			queued[gid] = true
+			pending = append(pending, gid)
+		}
+	}
+	for len(pending) > 0 {
+		level := []*Group{}
+		err := db.Debug().Model(&Group{}).Where("id in (?)", pending).Preload("Roles").Find(&level).Error
+		if err != nil {
+			return map[uuid.UUID]*Group{}, err
+		}
+		pending = []uuid.UUID{}
+		for _, group := range level {
+			groups[group.ID] = group
+			if group.ParentID != nil && !queued[*group.ParentID] {
+				queued[*group.ParentID] = true
+				pending = append(pending, *group.ParentID)
+			}
+		}
+	}
+	return groups, nil
+}
+
+func (gm *Group_Member) Validate() error {
+	if gm.GroupID == uuid.Nil {
+		return errors.New("Required GroupID")
+	}
+	if gm.UserID == uuid.Nil {
+		return errors.New("Required UserID")
+	}
+	return nil
+}
+
+func (gm *Group_Member) SaveGroupMember(db *gorm.DB) error {
+	return db.Debug().Model(&Group_Member{}).Create(&gm).Error
+}
+
+func (gm *Group_Member) DeleteGroupMember(db *gorm.DB, gid uuid.UUID, uid uuid.UUID) (int64, error) {
+	result := db.Debug().Where("group_id = ? AND user_id = ?", gid, uid).Delete(&Group_Member{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("Group/User not found")
+	}
+	return result.RowsAffected, nil
+}
+
+// FindGroupMembers returns the direct members of the group, without their
+// roles.
+func (gm *Group_Member) FindGroupMembers(db *gorm.DB, gid uuid.UUID) (*[]User, error) {
+	users := []User{}
+	err := db.Debug().Model(&User{}).Joins("JOIN group_members ON group_members.user_id = users.id").
+		Where("group_members.group_id = ?", gid).Order("users.user_name").Find(&users).Error
+	if err != nil {
+		return &[]User{}, err
+	}
+	return &users, nil
+}
+
+func (gr *Group_Role) Validate() error {
+	if gr.GroupID == uuid.Nil {
+		return errors.New("Required GroupID")
+	}
+	if gr.RoleID == 0 {
+		return errors.New("Required RoleID")
+	}
+	return nil
+}
+
+func (gr *Group_Role) SaveGroupRole(db *gorm.DB) error {
+	return db.Debug().Model(&Group_Role{}).Create(&gr).Error
+}
+
+func (gr *Group_Role) DeleteGroupRole(db *gorm.DB, gid uuid.UUID, rid uint32) (int64, error) {
+	result := db.Debug().Where("group_id = ? AND role_id = ?", gid, rid).Delete(&Group_Role{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("Group/Role not found")
+	}
+	return result.RowsAffected, nil
+}
+
+// UserRoleIDs returns the IDs of the roles the user holds directly or
+// through its groups and the groups above them. The roles of the user have
+// to be loaded.
+func UserRoleIDs(db *gorm.DB, user *User) ([]uint32, error) {
+	rids := []uint32{}
+	seen := map[uint32]bool{}
+	add := func(rid uint32) {
+		if !seen[rid] {
+			seen[rid] = true
+			rids = append(rids, rid)
+		}
+	}
+	for _, role := range user.Roles {
+		add(role.ID)
+	}
+	members := []Group_Member{}
+	err := db.Debug().Model(&Group_Member{}).Where("user_id = ?", user.ID).Find(&members).Error
+	if err != nil {
+		return []uint32{}, err
+	}
+	if len(members) == 0 {
+		return rids, nil
+	}
+	gids := []uuid.UUID{}
+	for _, member := range members {
+		gids = append(gids, member.GroupID)
+	}
+	group := Group{}
+	groups, err := group.FindGroupsWithAncestors(db, gids)
+	if err != nil {
+		return []uint32{}, err
+	}
+	for _, group := range groups {
+		for _, role := range group.Roles {
+			add(role.ID)
+		}
+	}
+	return rids, nil
+}
+
+// FindMemberIDsWithDescendants returns the IDs of the members of the group
+// and of the groups inside it, who all get the roles of the group.
+func (g *Group) FindMemberIDsWithDescendants(db *gorm.DB, gid uuid.UUID) ([]uuid.UUID, error) {
+	gids := []uuid.UUID{gid}
+	queued := map[uuid.UUID]bool{gid: true}
+	pending := []uuid.UUID{gid}
+	for len(pending) > 0 {
+		children := []uuid.UUID{}
+		err := db.Debug().Model(&Group{}).Where("parent_id in (?)", pending).Pluck("id", &children).Error
+		if err != nil {
+			return []uuid.UUID{}, err
+		}
+		pending = []uuid.UUID{}
+		for _, child := range children {
+			if !queued[child] {
+				queued[child] = true
+				gids = append(gids, child)
+				pending = append(pending, child)
+			}
+		}
+	}
+	uids := []uuid.UUID{}
+	err := db.Debug().Model(&Group_Member{}).Where("group_id in (?)", gids).Order("user_id").Pluck("DISTINCT user_id", &uids).Error
+	if err != nil {
+		return []uuid.UUID{}, err
+	}
+	return uids, nil
+}
+
+// FindRoleHolderIDs returns the IDs of the users holding the role directly
+// or through a group.
+func FindRoleHolderIDs(db *gorm.DB, rid uint32) ([]uuid.UUID, error) {
+	userRole := User_Role{}
+	uids, err := userRole.FindUserIDsByRoleID(db, rid)
+	if err != nil {
+		return []uuid.UUID{}, err
+	}
+	gids := []uuid.UUID{}
+	err = db.Debug().Model(&Group_Role{}).Where("role_id = ?", rid).Pluck("group_id", &gids).Error
+	if err != nil {
+		return []uuid.UUID{}, err
+	}
+	group := Group{}
+	for _, gid := range gids {
+		members, err := group.FindMemberIDsWithDescendants(db, gid)
+		if err != nil {
+			return []uuid.UUID{}, err
+		}
+		uids = append(uids, members...)
+	}
+	return uniqueUUIDs(uids), nil
+}
+
+// UsersRoleIDs returns the IDs of the roles each user holds, see
+// UserRoleIDs. Unknown users hold none.
+func UsersRoleIDs(db *gorm.DB, uids []uuid.UUID) (map[uuid.UUID][]uint32, error) {
+	roles := map[uuid.UUID][]uint32{}
+	for _, uid := range uids {
+		user := User{}
+		err := db.Debug().Model(&User{}).Where("id = ?", uid).Preload("Roles").Take(&user).Error
+		if err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				continue
+			}
+			return map[uuid.UUID][]uint32{}, err
+		}
+		rids, err := UserRoleIDs(db, &user)
+		if err != nil {
+			return map[uuid.UUID][]uint32{}, err
+		}
+		roles[uid] = rids
+	}
+	return roles, nil
+}
+
+// PublishRoleChanges publishes user.role_assigned for the roles a user holds
+// after a change but not before, and user.role_removed for those the user
+// lost. before and after come from UsersRoleIDs.
+func PublishRoleChanges(db *gorm.DB, uids []uuid.UUID, before map[uuid.UUID][]uint32, after map[uuid.UUID][]uint32) error {
+	for _, uid := range uniqueUUIDs(uids) {
+		held := map[uint32]bool{}
+		for _, rid := range before[uid] {
+			held[rid] = true
+		}
+		holds := map[uint32]bool{}
+		for _, rid := range after[uid] {
+			holds[rid] = true
+			if !held[rid] {
+				err := PublishUserEvent(db, EventUserRoleAssigned, uid, RoleEventData(uid, rid))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, rid := range before[uid] {
+			if !holds[rid] {
+				err := PublishUserEvent(db, EventUserRoleRemoved, uid, RoleEventData(uid, rid))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// TrackRoleChanges makes a change to groups or roles and publishes the role
+// events of the users it affects, see PublishRoleChanges.
+func TrackRoleChanges(db *gorm.DB, uids []uuid.UUID, change func() error) error {
+	before, err := UsersRoleIDs(db, uids)
+	if err != nil {
+		return err
+	}
+	err = change()
+	if err != nil {
+		return err
+	}
+	after, err := UsersRoleIDs(db, uids)
+	if err != nil {
+		return err
+	}
+	return PublishRoleChanges(db, uids, before, after)
+}
+
+func uniqueUUIDs(uids []uuid.UUID) []uuid.UUID {
+	unique := []uuid.UUID{}
+	seen := map[uuid.UUID]bool{}
+	for _, uid := range uids {
+		if !seen[uid] {
+			seen[uid] = true
+			unique = append(unique, uid)
+		}
+	}
+	return unique
+}
+
+// UserEffectivePermissions returns the permissions of all roles of the user,
+// see UserRoleIDs, with those the roles inherit.
+func UserEffectivePermissions(db *gorm.DB, user *User) ([]Effective_Permission, error) {
+	rids, err := UserRoleIDs(db, user)
+	if err != nil {
+		return []Effective_Permission{}, err
+	}
+	return EffectivePermissions(db, rids)
+}
+
+// PermissionNames returns the names of the permissions.
+func PermissionNames(permissions []Effective_Permission) []string {
+	names := []string{}
+	for i := range permissions {
+		names = append(names, permissions[i].Name)
+	}
+	return names
+}
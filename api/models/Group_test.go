@@ -0,0 +1,55 @@
+package models
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+// payloadContains matches a JSON payload argument containing want.
+type payloadContains struct {
+	want string
+}
+
+func (p payloadContains) Match(v driver.Value) bool {
+	switch payload := v.(type) {
+	case []byte:
+		return strings.Contains(string(payload), p.want)
+	case string:
+		return strings.Contains(payload, p.want)
+	}
+	return false
+}
+
+func TestPublishRoleChanges(t *testing.T) {
+	setEnv(t, "OUTBOX_BROKER", "")
+	db, mock := newMockDB(t)
+	kept, changed := uuid.New(), uuid.New()
+	sid := uuid.New()
+
+	// id, subscription_id, event_id, event, payload, status, attempts,
+	// next_attempt_at, last_status_code, last_error, delivered_at,
+	// created_at, updated_at
+	expect := func(event string, rid string) {
+		mock.ExpectQuery(`SELECT \* FROM "webhook_subscriptions" WHERE \(enabled = \$1\)`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "events", "enabled"}).AddRow(sid, "user.role_assigned,user.role_removed", true))
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO "webhook_deliveries"`).
+			WithArgs(sqlmock.AnyArg(), sid, sqlmock.AnyArg(), event, payloadContains{`"role_id":` + rid + `,"user_id":"` + changed.String() + `"`},
+				WebhookPending, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(uuid.New()))
+		mock.ExpectCommit()
+	}
+	expect(EventUserRoleAssigned, "3")
+	expect(EventUserRoleRemoved, "1")
+
+	before := map[uuid.UUID][]uint32{kept: {1}, changed: {1, 2}}
+	after := map[uuid.UUID][]uint32{kept: {1}, changed: {2, 3}}
+	err := PublishRoleChanges(db, []uuid.UUID{kept, changed, changed}, before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
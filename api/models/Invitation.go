@@ -0,0 +1,240 @@
+package models
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/badoux/checkmail"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+type Invitation struct {
+	ID         uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	Email      string     `gorm:"size:100;not null" json:"email"`
+	UserName   string     `gorm:"size:255;not null" json:"username"`
+	FirstName  string     `gorm:"size:255;not null" json:"firstname"`
+	LastName   string     `gorm:"size:255;not null" json:"lastname"`
+	TokenHash  string     `gorm:"size:64;not null;unique" json:"-"`
+	ExpiresAt  time.Time  `gorm:"not null" json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	UserID     *uuid.UUID `gorm:"type:uuid" json:"user_id,omitempty"`
+	CreatedAt  time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy  uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	UpdatedAt  time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+	UpdatedBy  uuid.UUID  `gorm:"type:uuid;not null" json:"updated_by"`
+	Roles      []*Role    `gorm:"many2many:invitation_roles;association_autoupdate:false;association_autocreate:false" json:"roles,omitempty"`
+}
+
+type CreateInvitation struct {
+	Email     string   `json:"email"`
+	UserName  string   `json:"username"`
+	FirstName string   `json:"firstname"`
+	LastName  string   `json:"lastname"`
+	Roles     []uint32 `json:"roles"`
+}
+
+type Accept_Invitation_Payload struct {
+	Token    string `json:"token"`
+	Password string `json:"password,omitempty"`
+}
+
+// InvitationExpiry is the lifetime of an invitation link, configured through
+// INVITATION_EXPIRY_IN_HOURS and defaulting to three days.
+func InvitationExpiry() time.Duration {
+	hours := envInt("INVITATION_EXPIRY_IN_HOURS", 72)
+	if hours <= 0 {
+		hours = 72
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+func (i *Invitation) Prepare(tuid uuid.UUID, tokenHash string) {
+	i.ID = uuid.New()
+	i.Email = html.EscapeString(strings.TrimSpace(i.Email))
+	i.UserName = html.EscapeString(strings.TrimSpace(i.UserName))
+	i.FirstName = html.EscapeString(strings.TrimSpace(i.FirstName))
+	i.LastName = html.EscapeString(strings.TrimSpace(i.LastName))
+	i.TokenHash = tokenHash
+	i.ExpiresAt = time.Now().Add(InvitationExpiry())
+	i.CreatedAt = time.Now()
+	i.CreatedBy = tuid
+	i.UpdatedAt = time.Now()
+	i.UpdatedBy = tuid
+}
+
+func (i *Invitation) Validate() error {
+	if i.UserName == "" {
+		return errors.New("Required UserName")
+	}
+	if i.FirstName == "" {
+		return errors.New("Required FirstName")
+	}
+	if i.Email == "" {
+		return errors.New("Required Email")
+	}
+	if err := checkmail.ValidateFormat(i.Email); err != nil {
+		return errors.New("Invalid Email")
+	}
+	return nil
+}
+
+// IsPending reports whether the invitation can still be accepted.
+func (i *Invitation) IsPending() bool {
+	return i.AcceptedAt == nil && i.RevokedAt == nil && time.Now().Before(i.ExpiresAt)
+}
+
+func (i *Invitation) SaveInvitation(db *gorm.DB) (*Invitation, error) {
+	var err error
+	err = db.Debug().Create(&i).Error
+	if err != nil {
+		return &Invitation{}, err
+	}
+	return i, nil
+}
+
+func (i *Invitation) FindPendingInvitations(db *gorm.DB) (*[]Invitation, error) {
+	var err error
+	invitations := []Invitation{}
+	err = db.Debug().Model(&Invitation{}).Where("accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", time.Now()).Preload("Roles").Order("created_at desc").Find(&invitations).Error
+	if err != nil {
+		return &[]Invitation{}, err
+	}
+	return &invitations, nil
+}
+
+func (i *Invitation) FindInvitationByID(db *gorm.DB, iid uuid.UUID) (*Invitation, error) {
+	var err error
+	err = db.Debug().Model(&Invitation{}).Where("id = ?", iid).Preload("Roles").Take(&i).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Invitation{}, errors.New("Invitation Not Found")
+		}
+		return &Invitation{}, err
+	}
+	return i, nil
+}
+
+func (i *Invitation) FindInvitationByToken(db *gorm.DB, tokenHash string) (*Invitation, error) {
+	var err error
+	err = db.Debug().Model(&Invitation{}).Where("token_hash = ?", tokenHash).Preload("Roles").Take(&i).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Invitation{}, errors.New("Invalid or expired invitation")
+		}
+		return &Invitation{}, err
+	}
+	if !i.IsPending() {
+		return &Invitation{}, errors.New("Invalid or expired invitation")
+	}
+	return i, nil
+}
+
+// RenewInvitation swaps the token of a pending invitation and restarts its
+// expiry window, which invalidates any link sent before.
+func (i *Invitation) RenewInvitation(db *gorm.DB, tokenHash string, tuid uuid.UUID) (*Invitation, error) {
+	if i.AcceptedAt != nil || i.RevokedAt != nil {
+		return &Invitation{}, errors.New("Invitation is no longer pending")
+	}
+	i.TokenHash = tokenHash
+	i.ExpiresAt = time.Now().Add(InvitationExpiry())
+	i.UpdatedAt = time.Now()
+	i.UpdatedBy = tuid
+	err := db.Debug().Model(&Invitation{}).Where("id = ?", i.ID).UpdateColumns(
+		map[string]interface{}{
+			"token_hash": i.TokenHash,
+			"expires_at": i.ExpiresAt,
+			"updated_at": i.UpdatedAt,
+			"updated_by": i.UpdatedBy,
+		},
+	).Error
+	if err != nil {
+		return &Invitation{}, err
+	}
+	return i, nil
+}
+
+func (i *Invitation) RevokeInvitation(db *gorm.DB, iid uuid.UUID, tuid uuid.UUID) error {
+	now := time.Now()
+	db = db.Debug().Model(&Invitation{}).Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", iid).UpdateColumns(
+		map[string]interface{}{
+			"revoked_at": now,
+			"updated_at": now,
+			"updated_by": tuid,
+		},
+	)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return errors.New("Invitation Not Found")
+	}
+	return nil
+}
+
+// AcceptInvitation creates the invited user with the chosen password, assigns
+// the pre-selected roles and closes the invitation in a single transaction.
+func (i *Invitation) AcceptInvitation(db *gorm.DB, password string) (*User, error) {
+	if len(password) < 1 {
+		return &User{}, errors.New("Required Password")
+	}
+	user := User{}
+	user.UserName = i.UserName
+	user.FirstName = i.FirstName
+	user.LastName = i.LastName
+	user.Email = i.Email
+	user.Password = password
+	user.Prepare(i.CreatedBy)
+	err := user.Validate("")
+	if err != nil {
+		return &User{}, err
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return &User{}, tx.Error
+	}
+	if _, err = user.SaveUser(tx); err != nil {
+		tx.Rollback()
+		return &User{}, err
+	}
+	if err = PublishUserEvent(tx, EventUserCreated, user.ID, UserEventData(&user)); err != nil {
+		tx.Rollback()
+		return &User{}, err
+	}
+	for _, role := range i.Roles {
+		ur := User_Role{UserID: user.ID, RoleID: role.ID}
+		if err = ur.SaveUserToRole(tx); err != nil {
+			tx.Rollback()
+			return &User{}, err
+		}
+		if err = PublishUserEvent(tx, EventUserRoleAssigned, user.ID, RoleEventData(user.ID, role.ID)); err != nil {
+			tx.Rollback()
+			return &User{}, err
+		}
+	}
+	now := time.Now()
+	result := tx.Debug().Model(&Invitation{}).Where("id = ? AND accepted_at IS NULL AND revoked_at IS NULL", i.ID).UpdateColumns(
+		map[string]interface{}{
+			"accepted_at": now,
+			"user_id":     user.ID,
+			"updated_at":  now,
+		},
+	)
+	if result.Error != nil {
+		tx.Rollback()
+		return &User{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return &User{}, errors.New("Invalid or expired invitation")
+	}
+	if err = tx.Commit().Error; err != nil {
+		return &User{}, err
+	}
+	user.Password = ""
+	return &user, nil
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Ledger_Checkpoint is a signed statement of the ledger head at some point.
+// Anyone holding the public key can prove the ledger was not rewritten or
+// truncated up to that sequence since.
+type Ledger_Checkpoint struct {
+	ID        uint32    `gorm:"primary_key;auto_increment" json:"id"`
+	Sequence  int64     `gorm:"not null;index" json:"sequence"`
+	Hash      string    `gorm:"size:64;not null" json:"hash"`
+	Signature string    `gorm:"size:128;not null" json:"signature"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+}
+
+func LedgerCheckpointInterval() time.Duration {
+	return time.Duration(envInt("LEDGER_CHECKPOINT_INTERVAL_MINUTES", 60)) * time.Minute
+}
+
+// LedgerSigningKey reads the base64 Ed25519 seed in LEDGER_SIGNING_KEY. It
+// returns nil when no key is configured, checkpoints are then not written.
+func LedgerSigningKey() (ed25519.PrivateKey, error) {
+	encoded := os.Getenv("LEDGER_SIGNING_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("LEDGER_SIGNING_KEY must be a base64 encoded 32 byte Ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// LedgerVerifyKey reads the base64 public key in LEDGER_VERIFY_KEY, falling
+// back to the public half of LEDGER_SIGNING_KEY.
+func LedgerVerifyKey() (ed25519.PublicKey, error) {
+	encoded := os.Getenv("LEDGER_VERIFY_KEY")
+	if encoded == "" {
+		signingKey, err := LedgerSigningKey()
+		if signingKey == nil || err != nil {
+			return nil, err
+		}
+		return signingKey.Public().(ed25519.PublicKey), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("LEDGER_VERIFY_KEY must be a base64 encoded Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func (lc *Ledger_Checkpoint) signedMessage() []byte {
+	return []byte(strconv.FormatInt(lc.Sequence, 10) + "\n" + lc.Hash + "\n" + strconv.FormatInt(lc.CreatedAt.UnixNano()/int64(time.Microsecond), 10))
+}
+
+func (lc *Ledger_Checkpoint) VerifySignature(publicKey ed25519.PublicKey) bool {
+	signature, err := base64.StdEncoding.DecodeString(lc.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(publicKey, lc.signedMessage(), signature)
+}
+
+// SaveLedgerCheckpoint signs the current head of the ledger. Nothing is
+// written while the ledger is empty or the head is already checkpointed.
+func (lc *Ledger_Checkpoint) SaveLedgerCheckpoint(db *gorm.DB, signingKey ed25519.PrivateKey) (*Ledger_Checkpoint, error) {
+	head := Ledger_Entry{}
+	err := db.Debug().Model(&Ledger_Entry{}).Order("sequence desc").Limit(1).Take(&head).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	last := Ledger_Checkpoint{}
+	err = db.Debug().Model(&Ledger_Checkpoint{}).Order("sequence desc").Limit(1).Take(&last).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	if err == nil && last.Sequence == head.Sequence {
+		return nil, nil
+	}
+
+	lc.Sequence = head.Sequence
+	lc.Hash = head.Hash
+	lc.CreatedAt = time.Now().Truncate(time.Microsecond)
+	lc.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, lc.signedMessage()))
+	err = db.Debug().Create(&lc).Error
+	if err != nil {
+		return nil, err
+	}
+	return lc, nil
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LedgerTables are the tables whose every row change is written to the ledger.
+var LedgerTables = []string{"users", "roles", "permissions", "user_roles", "role_permissions", "groups", "group_members", "group_roles", "role_assignments"}
+
+// Ledger_Entry is one row change in the tamper-evident ledger. Entries are
+// written by a database trigger, so that no change can bypass the ledger, and
+// each one carries the hash of the entry before it. Changing or removing any
+// entry breaks every hash that follows.
+type Ledger_Entry struct {
+	Sequence  int64     `gorm:"primary_key;auto_increment:false" json:"sequence"`
+	Table     string    `gorm:"column:table_name;size:64;not null" json:"table_name"`
+	Operation string    `gorm:"size:16;not null" json:"operation"`
+	OldData   JSONB     `gorm:"type:jsonb" json:"old_data,omitempty"`
+	NewData   JSONB     `gorm:"type:jsonb" json:"new_data,omitempty"`
+	ActorID   string    `gorm:"size:64" json:"actor_id"`
+	RequestID string    `gorm:"size:64" json:"request_id"`
+	PrevHash  string    `gorm:"size:64;not null" json:"prev_hash"`
+	Hash      string    `gorm:"size:64;not null" json:"hash"`
+	CreatedAt time.Time `gorm:"not null" json:"created_at"`
+}
+
+// LedgerVerification is the outcome of walking the ledger. BrokenAt is the
+// sequence of the first entry or checkpoint that does not match.
+type LedgerVerification struct {
+	Valid             bool   `json:"valid"`
+	Entries           int64  `json:"entries"`
+	Checkpoints       int    `json:"checkpoints"`
+	SignaturesChecked bool   `json:"signatures_checked"`
+	BrokenAt          *int64 `json:"broken_at,omitempty"`
+	Reason            string `json:"reason,omitempty"`
+}
+
+func (lv *LedgerVerification) broken(sequence int64, reason string) *LedgerVerification {
+	lv.Valid = false
+	lv.BrokenAt = &sequence
+	lv.Reason = reason
+	return lv
+}
+
+// ComputeHash hashes the entry the same way the ledger trigger does. Payloads
+// are hashed in the text form Postgres gives jsonb, which is canonical.
+func (le *Ledger_Entry) ComputeHash() string {
+	payload := strings.Join([]string{
+		le.PrevHash,
+		strconv.FormatInt(le.Sequence, 10),
+		le.Table,
+		le.Operation,
+		string(le.OldData),
+		string(le.NewData),
+		le.ActorID,
+		le.RequestID,
+		strconv.FormatInt(le.CreatedAt.UnixNano()/int64(time.Microsecond), 10),
+	}, "\n")
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetLedgerContext names the actor and request for the ledger entries written
+// by the rest of the transaction.
+func SetLedgerContext(tx *gorm.DB, actorID string, requestID string) error {
+	return tx.Debug().Exec("SELECT set_config('ledger.actor_id', ?, true), set_config('ledger.request_id', ?, true)", actorID, requestID).Error
+}
+
+// EnforceLedger installs the triggers that write every change of the
+// LedgerTables to the ledger and keep the ledger itself append-only. An
+// advisory lock serializes writers, so the chain never forks.
+func EnforceLedger(db *gorm.DB) error {
+	err := db.Debug().Exec(`CREATE OR REPLACE FUNCTION ledger_record() RETURNS trigger AS $$
+DECLARE
+	last_entry RECORD;
+	entry_sequence bigint := 1;
+	entry_prev_hash text := '';
+	entry_old jsonb;
+	entry_new jsonb;
+	entry_actor text := coalesce(current_setting('ledger.actor_id', true), '');
+	entry_request text := coalesce(current_setting('ledger.request_id', true), '');
+	entry_at timestamptz := clock_timestamp();
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('ledger_entries'));
+	SELECT sequence, hash INTO last_entry FROM ledger_entries ORDER BY sequence DESC LIMIT 1;
+	IF FOUND THEN
+		entry_sequence := last_entry.sequence + 1;
+		entry_prev_hash := last_entry.hash;
+	END IF;
+	IF TG_OP <> 'INSERT' THEN
+		entry_old := to_jsonb(OLD) - 'password';
+	END IF;
+	IF TG_OP <> 'DELETE' THEN
+		entry_new := to_jsonb(NEW) - 'password';
+	END IF;
+	INSERT INTO ledger_entries (sequence, table_name, operation, old_data, new_data, actor_id, request_id, prev_hash, hash, created_at)
+	VALUES (entry_sequence, TG_TABLE_NAME, TG_OP, entry_old, entry_new, entry_actor, entry_request, entry_prev_hash,
+		encode(sha256(convert_to(concat_ws(E'\n', entry_prev_hash, entry_sequence, TG_TABLE_NAME, TG_OP,
+			coalesce(entry_old::text, ''), coalesce(entry_new::text, ''), entry_actor, entry_request,
+			round(extract(epoch FROM entry_at) * 1000000)::bigint), 'UTF8')), 'hex'),
+		entry_at);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`).Error
+	if err != nil {
+		return err
+	}
+	err = db.Debug().Exec(`CREATE OR REPLACE FUNCTION ledger_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql`).Error
+	if err != nil {
+		return err
+	}
+	for _, table := range LedgerTables {
+		err = db.Debug().Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS ledger_record ON %s", table)).Error
+		if err != nil {
+			return err
+		}
+		err = db.Debug().Exec(fmt.Sprintf("CREATE TRIGGER ledger_record AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE ledger_record()", table)).Error
+		if err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"ledger_entries", "ledger_checkpoints"} {
+		err = db.Debug().Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS ledger_append_only ON %s", table)).Error
+		if err != nil {
+			return err
+		}
+		err = db.Debug().Exec(fmt.Sprintf("CREATE TRIGGER ledger_append_only BEFORE UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE PROCEDURE ledger_append_only()", table)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyLedger walks the whole ledger in order, recomputing every hash and
+// checking every checkpoint against the entry it covers. Without a public
+// key the checkpoint signatures are not checked, only their hashes.
+func VerifyLedger(db *gorm.DB, publicKey ed25519.PublicKey) (*LedgerVerification, error) {
+	result := &LedgerVerification{Valid: true, SignaturesChecked: publicKey != nil}
+
+	checkpoints := []Ledger_Checkpoint{}
+	err := db.Debug().Model(&Ledger_Checkpoint{}).Order("sequence").Find(&checkpoints).Error
+	if err != nil {
+		return result, err
+	}
+	result.Checkpoints = len(checkpoints)
+	bySequence := map[int64][]Ledger_Checkpoint{}
+	for _, checkpoint := range checkpoints {
+		bySequence[checkpoint.Sequence] = append(bySequence[checkpoint.Sequence], checkpoint)
+	}
+
+	prevHash := ""
+	var sequence int64
+	for {
+		entries := []Ledger_Entry{}
+		err = db.Debug().Model(&Ledger_Entry{}).Where("sequence > ?", sequence).Order("sequence").Limit(1000).Find(&entries).Error
+		if err != nil {
+			return result, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for i := range entries {
+			entry := &entries[i]
+			if entry.Sequence != sequence+1 {
+				return result.broken(sequence+1, "entry is missing"), nil
+			}
+			if entry.PrevHash != prevHash {
+				return result.broken(entry.Sequence, "previous hash does not match"), nil
+			}
+			if entry.ComputeHash() != entry.Hash {
+				return result.broken(entry.Sequence, "entry hash does not match its content"), nil
+			}
+			for _, checkpoint := range bySequence[entry.Sequence] {
+				if checkpoint.Hash != entry.Hash {
+					return result.broken(entry.Sequence, "entry does not match its checkpoint"), nil
+				}
+				if publicKey != nil && !checkpoint.VerifySignature(publicKey) {
+					return result.broken(entry.Sequence, "checkpoint signature is invalid"), nil
+				}
+			}
+			sequence = entry.Sequence
+			prevHash = entry.Hash
+			result.Entries++
+		}
+	}
+
+	// Entries cut off the end of the chain leave no broken link behind, only
+	// the checkpoints still remember them.
+	if len(checkpoints) > 0 && checkpoints[len(checkpoints)-1].Sequence > sequence {
+		return result.broken(sequence+1, "entry is missing, a checkpoint covers a later sequence"), nil
+	}
+	return result, nil
+}
@@ -0,0 +1,234 @@
+package models
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/geoip"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Login_Alert is sent to a user after a suspicious login. Its token lets the
+// user deny the login, which ends every session of the account and requires
+// a password reset.
+type Login_Alert struct {
+	ID        uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	DeviceID  string     `gorm:"size:255" json:"device_id"`
+	IPAddress string     `gorm:"size:64" json:"ip_address"`
+	Reasons   string     `gorm:"size:255" json:"reasons"`
+	TokenHash string     `gorm:"size:64;not null;unique" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	DeniedAt  *time.Time `json:"denied_at,omitempty"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+type Deny_Login_Payload struct {
+	Token string `json:"token"`
+}
+
+// LoginRisk lists what made a login look unusual compared to the user's
+// earlier successful logins.
+type LoginRisk struct {
+	NewDevice        bool
+	NewNetwork       bool
+	ImpossibleTravel bool
+}
+
+func (lr LoginRisk) Risky() bool {
+	return lr.NewDevice || lr.NewNetwork || lr.ImpossibleTravel
+}
+
+func (lr LoginRisk) Reasons() []string {
+	reasons := []string{}
+	if lr.NewDevice {
+		reasons = append(reasons, "new device")
+	}
+	if lr.NewNetwork {
+		reasons = append(reasons, "new network")
+	}
+	if lr.ImpossibleTravel {
+		reasons = append(reasons, "impossible travel")
+	}
+	return reasons
+}
+
+// SuspiciousLoginDetectionEnabled is switched through SUSPICIOUS_LOGIN_DETECTION.
+func SuspiciousLoginDetectionEnabled() bool {
+	return envBool("SUSPICIOUS_LOGIN_DETECTION", true)
+}
+
+// LoginStepUpEnabled reports whether risky password logins have to be
+// confirmed through an emailed link, configured by SUSPICIOUS_LOGIN_STEP_UP.
+func LoginStepUpEnabled() bool {
+	return envBool("SUSPICIOUS_LOGIN_STEP_UP", false)
+}
+
+func LoginAlertExpiry() time.Duration {
+	return time.Duration(envInt("LOGIN_ALERT_EXPIRY_IN_HOURS", 72)) * time.Hour
+}
+
+// StepUpRequiredError is returned instead of tokens for a risky login that
+// has to be confirmed from the user's mailbox first.
+type StepUpRequiredError struct {
+	Risk LoginRisk
+}
+
+func (e *StepUpRequiredError) Error() string {
+	return "This login needs to be verified, a sign-in link has been sent to your email"
+}
+
+func (e *StepUpRequiredError) Details() interface{} {
+	return map[string]interface{}{
+		"step_up": "email",
+		"reasons": e.Risk.Reasons(),
+	}
+}
+
+// AssessLoginRisk compares a login with the earlier successful logins of the
+// user kept in the login history. The very first login is never risky, as
+// there is nothing to compare it with.
+func (le *Login_Event) AssessLoginRisk(db *gorm.DB, uid uuid.UUID, ip string, deviceID string, now time.Time) (LoginRisk, error) {
+	risk := LoginRisk{}
+	previous := []Login_Event{}
+	err := db.Debug().Model(&Login_Event{}).
+		Where("user_id = ? AND event = ? AND success = ?", uid, LoginEventLogin, true).
+		Order("created_at desc").Limit(envInt("SUSPICIOUS_LOGIN_HISTORY_SIZE", 50)).Find(&previous).Error
+	if err != nil {
+		return risk, err
+	}
+	if len(previous) == 0 {
+		return risk, nil
+	}
+
+	risk.NewDevice = true
+	risk.NewNetwork = true
+	network := networkOf(ip)
+	for _, event := range previous {
+		if event.DeviceID == deviceID {
+			risk.NewDevice = false
+		}
+		if network != "" && networkOf(event.IPAddress) == network {
+			risk.NewNetwork = false
+		}
+	}
+
+	last := previous[0]
+	from, ok := geoip.Lookup(last.IPAddress)
+	if !ok {
+		return risk, nil
+	}
+	to, ok := geoip.Lookup(ip)
+	if !ok {
+		return risk, nil
+	}
+	// Locations are only accurate to their radius, short hops are never
+	// reported as travel.
+	distance := geoip.DistanceKm(from, to) - float64(from.AccuracyRadius) - float64(to.AccuracyRadius)
+	if distance <= float64(envInt("SUSPICIOUS_LOGIN_MIN_DISTANCE_KM", 300)) {
+		return risk, nil
+	}
+	hours := now.Sub(last.CreatedAt).Hours()
+	if hours <= 0 || distance/hours > float64(envInt("SUSPICIOUS_LOGIN_MAX_SPEED_KMH", 1000)) {
+		risk.ImpossibleTravel = true
+	}
+	return risk, nil
+}
+
+// networkOf returns the /24 of an IPv4 or the /48 of an IPv6 address, the
+// range a user typically keeps while roaming within one network.
+func networkOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func (la *Login_Alert) Prepare(uid uuid.UUID, deviceID string, ip string, risk LoginRisk, tokenHash string) {
+	la.ID = uuid.New()
+	la.UserID = uid
+	la.DeviceID = deviceID
+	la.IPAddress = ip
+	la.Reasons = strings.Join(risk.Reasons(), ", ")
+	la.TokenHash = tokenHash
+	la.ExpiresAt = time.Now().Add(LoginAlertExpiry())
+	la.CreatedAt = time.Now()
+}
+
+func (la *Login_Alert) SaveLoginAlert(db *gorm.DB) error {
+	return db.Debug().Create(&la).Error
+}
+
+// DenyLogin handles a "this wasn't me" answer to an alert. In one transaction
+// it marks the alert, ends every session of the user and requires a password
+// reset before the password can be used again. The reset needs a link
+// emailed to the user, see Password_Reset.
+func (la *Login_Alert) DenyLogin(db *gorm.DB, tokenHash string) (*Login_Alert, error) {
+	err := db.Debug().Model(&Login_Alert{}).Where("token_hash = ?", tokenHash).Take(&la).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Login_Alert{}, errors.New("Invalid or expired link")
+		}
+		return &Login_Alert{}, err
+	}
+	if la.DeniedAt != nil || time.Now().After(la.ExpiresAt) {
+		return &Login_Alert{}, errors.New("Invalid or expired link")
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Debug().Model(&Login_Alert{}).Where("id = ? AND denied_at IS NULL", la.ID).UpdateColumns(
+			map[string]interface{}{
+				"denied_at": now,
+			},
+		)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("Invalid or expired link")
+		}
+		err := tx.Debug().Model(&User{}).Where("id = ?", la.UserID).UpdateColumns(
+			map[string]interface{}{
+				"password_reset_required": true,
+				"updated_at":              now,
+			},
+		).Error
+		if err != nil {
+			return err
+		}
+		return RevokeUserSessions(tx, la.UserID)
+	})
+	if err != nil {
+		return &Login_Alert{}, err
+	}
+	la.DeniedAt = &now
+	return la, nil
+}
+
+// RevokeUserSessions deletes the devices and refresh tokens of every session
+// of the user, so that none of them can be refreshed any more, and records
+// the time so that access tokens issued before are rejected, see
+// auth.CheckBlacklistedJWT.
+func RevokeUserSessions(db *gorm.DB, uid uuid.UUID) error {
+	err := db.Debug().Model(&User{}).Where("id = ?", uid).UpdateColumns(
+		map[string]interface{}{
+			"sessions_revoked_at": time.Now(),
+		},
+	).Error
+	if err != nil {
+		return err
+	}
+	err = db.Debug().Where("device_id IN (?)", db.Model(&User_Device{}).Select("device_id").Where("user_id = ?", uid).QueryExpr()).Delete(&Refresh_Token{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Debug().Where("user_id = ?", uid).Delete(&User_Device{}).Error
+}
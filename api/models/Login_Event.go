@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	LoginEventLogin        = "login"
+	LoginEventRefresh      = "refresh"
+	LoginEventLogout       = "logout"
+	LoginEventMFAChallenge = "mfa_challenge"
+)
+
+// Login_Event records one authentication attempt. UserID is empty when the
+// attempt named an account that does not exist.
+type Login_Event struct {
+	ID        uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	UserID    *uuid.UUID `gorm:"type:uuid;index" json:"user_id,omitempty"`
+	Email     string     `gorm:"size:100" json:"email"`
+	Event     string     `gorm:"size:32;not null" json:"event"`
+	Provider  string     `gorm:"size:255" json:"provider"`
+	Success   bool       `gorm:"not null" json:"success"`
+	Reason    string     `gorm:"size:255" json:"reason,omitempty"`
+	IPAddress string     `gorm:"size:64" json:"ip_address"`
+	UserAgent string     `gorm:"size:512" json:"user_agent"`
+	DeviceID  string     `gorm:"size:255" json:"device_id"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP;index" json:"created_at"`
+}
+
+// Page wraps one page of a listing together with the total number of items.
+type Page struct {
+	Items   interface{} `json:"items"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"`
+}
+
+// LoginHistoryRetention is how long login events are kept, configured through
+// LOGIN_HISTORY_RETENTION_DAYS. Zero keeps them forever.
+func LoginHistoryRetention() time.Duration {
+	return time.Duration(envInt("LOGIN_HISTORY_RETENTION_DAYS", 90)) * 24 * time.Hour
+}
+
+func (le *Login_Event) Prepare() {
+	le.ID = uuid.New()
+	le.CreatedAt = time.Now()
+	le.Reason = truncateRunes(le.Reason, 255)
+	le.UserAgent = truncateRunes(le.UserAgent, 512)
+}
+
+// truncateRunes cuts s to at most max characters, the unit of varchar
+// sizes, without splitting a multi-byte character.
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max])
+}
+
+func (le *Login_Event) SaveLoginEvent(db *gorm.DB) error {
+	return db.Debug().Create(&le).Error
+}
+
+// FindLoginEventsByUserID returns a page of the user's events, newest first.
+func (le *Login_Event) FindLoginEventsByUserID(db *gorm.DB, uid uuid.UUID, page int, perPage int) (*Page, error) {
+	events := []Login_Event{}
+	total := 0
+	err := db.Debug().Model(&Login_Event{}).Where("user_id = ?", uid).Count(&total).Error
+	if err != nil {
+		return &Page{}, err
+	}
+	err = db.Debug().Model(&Login_Event{}).Where("user_id = ?", uid).Order("created_at desc").
+		Offset((page - 1) * perPage).Limit(perPage).Find(&events).Error
+	if err != nil {
+		return &Page{}, err
+	}
+	return &Page{Items: events, Page: page, PerPage: perPage, Total: total}, nil
+}
+
+// PruneLoginEvents removes events older than the retention period.
+func (le *Login_Event) PruneLoginEvents(db *gorm.DB) error {
+	retention := LoginHistoryRetention()
+	if retention <= 0 {
+		return nil
+	}
+	return db.Debug().Where("created_at < ?", time.Now().Add(-retention)).Delete(&Login_Event{}).Error
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Login_Throttle counts failed logins per client IP. Failures per account are
+// counted on the user itself, next to its lock state.
+type Login_Throttle struct {
+	Key          string    `gorm:"column:throttle_key;primary_key;size:255" json:"key"`
+	FailedCount  int       `gorm:"default:0" json:"failed_count"`
+	LastFailedAt time.Time `json:"last_failed_at"`
+	UpdatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// LoginThrottledError is returned while a caller has to wait before the next
+// login attempt is evaluated.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return fmt.Sprintf("Too many failed login attempts, retry in %d seconds", RetryAfterSeconds(e.RetryAfter))
+}
+
+// AccountLockedError is returned for accounts that are temporarily locked
+// after too many failed logins. Disabled accounts are reported separately.
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return "Too many failed login attempts, the account is temporarily locked until " + e.Until.Format(time.RFC3339)
+}
+
+func RetryAfterSeconds(d time.Duration) int {
+	seconds := int(d / time.Second)
+	if d%time.Second != 0 {
+		seconds++
+	}
+	return seconds
+}
+
+// LoginBackoff is the wait imposed after the given number of consecutive
+// failures. The first LOGIN_BACKOFF_FREE_ATTEMPTS are free, afterwards the
+// wait doubles from LOGIN_BACKOFF_BASE_SECONDS up to LOGIN_BACKOFF_MAX_SECONDS.
+func LoginBackoff(failures int) time.Duration {
+	free := envInt("LOGIN_BACKOFF_FREE_ATTEMPTS", 3)
+	if failures <= free {
+		return 0
+	}
+	base := time.Duration(envInt("LOGIN_BACKOFF_BASE_SECONDS", 1)) * time.Second
+	max := time.Duration(envInt("LOGIN_BACKOFF_MAX_SECONDS", 300)) * time.Second
+	backoff := base
+	for i := free + 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// LoginFailureWindow is how long a failure is remembered. Counters restart
+// once no failure happened within the window.
+func LoginFailureWindow() time.Duration {
+	return time.Duration(envInt("LOGIN_FAILURE_WINDOW_MINUTES", 60)) * time.Minute
+}
+
+func LoginLockoutThreshold() int {
+	return envInt("LOGIN_LOCKOUT_THRESHOLD", 10)
+}
+
+func LoginLockoutDuration() time.Duration {
+	return time.Duration(envInt("LOGIN_LOCKOUT_DURATION_MINUTES", 30)) * time.Minute
+}
+
+// activeFailures returns the failure count that still applies at now.
+func activeFailures(count int, lastFailedAt time.Time, now time.Time) int {
+	if count == 0 || now.Sub(lastFailedAt) > LoginFailureWindow() {
+		return 0
+	}
+	return count
+}
+
+// CheckLoginThrottle returns a LoginThrottledError while the key is backing
+// off after failed attempts.
+func (lt *Login_Throttle) CheckLoginThrottle(db *gorm.DB, key string) error {
+	err := db.Debug().Model(&Login_Throttle{}).Where("throttle_key = ?", key).Take(&lt).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	now := time.Now()
+	failures := activeFailures(lt.FailedCount, lt.LastFailedAt, now)
+	if wait := lt.LastFailedAt.Add(LoginBackoff(failures)).Sub(now); failures > 0 && wait > 0 {
+		return &LoginThrottledError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// RecordLoginFailure counts a failure against key. The row is created if
+// needed and held under a row lock while it is counted, so that concurrent
+// failures are each counted once.
+func (lt *Login_Throttle) RecordLoginFailure(db *gorm.DB, key string) error {
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Debug().Exec("INSERT INTO login_throttles (throttle_key, failed_count, last_failed_at, updated_at) VALUES (?, 0, ?, ?) ON CONFLICT DO NOTHING", key, now, now).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Debug().Set("gorm:query_option", "FOR UPDATE").Model(&Login_Throttle{}).Where("throttle_key = ?", key).Take(&lt).Error
+		if err != nil {
+			return err
+		}
+		lt.FailedCount = activeFailures(lt.FailedCount, lt.LastFailedAt, now) + 1
+		lt.LastFailedAt = now
+		lt.UpdatedAt = now
+		return tx.Debug().Model(&Login_Throttle{}).Where("throttle_key = ?", key).UpdateColumns(
+			map[string]interface{}{
+				"failed_count":   lt.FailedCount,
+				"last_failed_at": now,
+				"updated_at":     now,
+			},
+		).Error
+	})
+}
+
+func (lt *Login_Throttle) ResetLoginThrottle(db *gorm.DB, key string) error {
+	return db.Debug().Where("throttle_key = ?", key).Delete(&Login_Throttle{}).Error
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+func TestRecordLoginFailureCountsLockedRow(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// The row is read under a lock, a concurrent failure already counted
+	// four.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO login_throttles .* ON CONFLICT DO NOTHING`).
+		WithArgs("ip:203.0.113.7", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT \* FROM "login_throttles" WHERE \(throttle_key = \$1\) LIMIT 1 FOR UPDATE`).
+		WithArgs("ip:203.0.113.7").
+		WillReturnRows(sqlmock.NewRows([]string{"throttle_key", "failed_count", "last_failed_at"}).
+			AddRow("ip:203.0.113.7", 4, time.Now().Add(-time.Second)))
+	mock.ExpectExec(`UPDATE "login_throttles" SET "failed_count" = \$1, "last_failed_at" = \$2, "updated_at" = \$3 WHERE \(throttle_key = \$4\)`).
+		WithArgs(int64(5), sqlmock.AnyArg(), sqlmock.AnyArg(), "ip:203.0.113.7").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	throttle := Login_Throttle{}
+	if err := throttle.RecordLoginFailure(db, "ip:203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+	if throttle.FailedCount != 5 {
+		t.Errorf("FailedCount = %d, want 5", throttle.FailedCount)
+	}
+}
+
+func TestRecordLoginFailureFirst(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// The first failure creates the row, or finds the one a concurrent
+	// failure created, and counts itself either way.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO login_throttles .* ON CONFLICT DO NOTHING`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT \* FROM "login_throttles" .* FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"throttle_key", "failed_count", "last_failed_at"}).
+			AddRow("ip:203.0.113.7", 0, time.Now()))
+	mock.ExpectExec(`UPDATE "login_throttles"`).
+		WithArgs(int64(1), sqlmock.AnyArg(), sqlmock.AnyArg(), "ip:203.0.113.7").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	throttle := Login_Throttle{}
+	if err := throttle.RecordLoginFailure(db, "ip:203.0.113.7"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordFailedLoginLocksFromStoredCount(t *testing.T) {
+	db, mock := newMockDB(t)
+	setEnv(t, "LOGIN_LOCKOUT_THRESHOLD", "10")
+	uid := uuid.New()
+
+	// The user was loaded before nine concurrent failures were counted, the
+	// tenth locks the account all the same.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT failed_login_count, last_failed_login_at, locked_until FROM "users" WHERE \(id = \$1\) LIMIT 1 FOR UPDATE`).
+		WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_login_count", "last_failed_login_at", "locked_until"}).
+			AddRow(9, time.Now().Add(-time.Second), nil))
+	mock.ExpectExec(`UPDATE "users" SET "failed_login_count" = \$1, "last_failed_login_at" = \$2, "locked_until" = \$3 WHERE \(id = \$4\)`).
+		WithArgs(int64(0), sqlmock.AnyArg(), sqlmock.AnyArg(), uid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	user := User{ID: uid}
+	locked, err := user.RecordFailedLogin(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked || user.LockedUntil == nil || user.FailedLoginCount != 0 {
+		t.Errorf("RecordFailedLogin = %v, locked until %v, %d failures", locked, user.LockedUntil, user.FailedLoginCount)
+	}
+}
+
+func TestRecordFailedLoginCountsStoredCount(t *testing.T) {
+	db, mock := newMockDB(t)
+	setEnv(t, "LOGIN_LOCKOUT_THRESHOLD", "10")
+	uid := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT failed_login_count, last_failed_login_at, locked_until FROM "users" .* FOR UPDATE`).
+		WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"failed_login_count", "last_failed_login_at", "locked_until"}).
+			AddRow(3, time.Now().Add(-time.Second), nil))
+	mock.ExpectExec(`UPDATE "users" SET "failed_login_count" = \$1, "last_failed_login_at" = \$2 WHERE \(id = \$3\)`).
+		WithArgs(int64(4), sqlmock.AnyArg(), uid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	user := User{ID: uid}
+	locked, err := user.RecordFailedLogin(db)
+	if err != nil || locked || user.FailedLoginCount != 4 {
+		t.Errorf("RecordFailedLogin = %v, %v with %d failures", locked, err, user.FailedLoginCount)
+	}
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+type Magic_Link struct {
+	ID        uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null" json:"user_id"`
+	DeviceID  string     `gorm:"size:255;not null" json:"device_id"`
+	TokenHash string     `gorm:"size:64;not null;unique" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+type Magic_Link_Request struct {
+	Email    string `json:"email"`
+	DeviceID string `json:"device_id"`
+}
+
+type Magic_Link_Consume struct {
+	Token    string `json:"token"`
+	DeviceID string `json:"device_id"`
+}
+
+// MagicLinkEnabled reports whether passwordless login is switched on for this
+// deployment through MAGIC_LINK_ENABLED.
+func MagicLinkEnabled() bool {
+	return envBool("MAGIC_LINK_ENABLED", false)
+}
+
+// MagicLinkURL is the frontend page the emailed links point to, configured
+// through MAGIC_LINK_URL. It reads the token from the query and posts it with
+// its device_id to /login/magic-link/consume.
+func MagicLinkURL() string {
+	return strings.TrimSpace(os.Getenv("MAGIC_LINK_URL"))
+}
+
+// MagicLinkExpiry is the lifetime of a login link, configured through
+// MAGIC_LINK_EXPIRY_IN_MINUTES and defaulting to fifteen minutes.
+func MagicLinkExpiry() time.Duration {
+	minutes := envInt("MAGIC_LINK_EXPIRY_IN_MINUTES", 15)
+	if minutes <= 0 {
+		minutes = 15
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (ml *Magic_Link) Prepare(uid uuid.UUID, deviceID string, tokenHash string) {
+	ml.ID = uuid.New()
+	ml.UserID = uid
+	ml.DeviceID = deviceID
+	ml.TokenHash = tokenHash
+	ml.ExpiresAt = time.Now().Add(MagicLinkExpiry())
+	ml.CreatedAt = time.Now()
+}
+
+func (ml *Magic_Link) SaveMagicLink(db *gorm.DB) error {
+	var err error
+	err = db.Debug().Create(&ml).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConsumeMagicLink marks the link matching the token as used and returns it.
+// A link only works once, before it expires and from the device it was
+// requested for.
+func (ml *Magic_Link) ConsumeMagicLink(db *gorm.DB, tokenHash string, deviceID string) (*Magic_Link, error) {
+	var err error
+	err = db.Debug().Model(&Magic_Link{}).Where("token_hash = ?", tokenHash).Take(&ml).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Magic_Link{}, errors.New("Invalid or expired link")
+		}
+		return &Magic_Link{}, err
+	}
+	if ml.UsedAt != nil || time.Now().After(ml.ExpiresAt) || ml.DeviceID != deviceID {
+		return &Magic_Link{}, errors.New("Invalid or expired link")
+	}
+
+	now := time.Now()
+	db = db.Debug().Model(&Magic_Link{}).Where("id = ? AND used_at IS NULL", ml.ID).UpdateColumns(
+		map[string]interface{}{
+			"used_at": now,
+		},
+	)
+	if db.Error != nil {
+		return &Magic_Link{}, db.Error
+	}
+	if db.RowsAffected == 0 {
+		return &Magic_Link{}, errors.New("Invalid or expired link")
+	}
+	ml.UsedAt = &now
+	return ml, nil
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Oauth_Code is the one-time code an OAuth login hands to the frontend
+// through its redirect_uri. The frontend exchanges it at /auth/token for the
+// tokens, which so never appear in a URL or the browser history.
+type Oauth_Code struct {
+	ID          string    `gorm:"primary_key;size:64" json:"-"`
+	UserID      uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
+	Provider    string    `gorm:"size:100;not null" json:"provider"`
+	DeviceID    string    `gorm:"size:255;not null" json:"device_id"`
+	RedirectURI string    `gorm:"size:2048;not null" json:"redirect_uri"`
+	ExpiresAt   time.Time `gorm:"not null" json:"expires_at"`
+	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+type Oauth_Code_Exchange struct {
+	Code        string `json:"code"`
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// OauthCodeExpiry is how long the frontend has to exchange the code,
+// configured through OAUTH_CODE_EXPIRY_IN_SECONDS and defaulting to a
+// minute.
+func OauthCodeExpiry() time.Duration {
+	seconds := envInt("OAUTH_CODE_EXPIRY_IN_SECONDS", 60)
+	if seconds <= 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (oc *Oauth_Code) Prepare(codeHash string, uid uuid.UUID, request *Oauth_Request) {
+	oc.ID = codeHash
+	oc.UserID = uid
+	oc.Provider = request.Provider
+	oc.DeviceID = request.DeviceID
+	oc.RedirectURI = request.RedirectURI
+	oc.ExpiresAt = time.Now().Add(OauthCodeExpiry())
+	oc.CreatedAt = time.Now()
+}
+
+// SaveOauthCode stores the code and drops the expired ones.
+func (oc *Oauth_Code) SaveOauthCode(db *gorm.DB) error {
+	err := db.Debug().Where("expires_at < ?", time.Now()).Delete(&Oauth_Code{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Debug().Create(&oc).Error
+}
+
+// ConsumeOauthCode takes the code out of the store. It can only be
+// exchanged once, before it expires and with the redirect_uri it was sent
+// to.
+func (oc *Oauth_Code) ConsumeOauthCode(db *gorm.DB, codeHash string, redirectURI string) (*Oauth_Code, error) {
+	err := db.Debug().Model(&Oauth_Code{}).Where("id = ?", codeHash).Take(&oc).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Oauth_Code{}, errors.New("Invalid or expired code")
+		}
+		return &Oauth_Code{}, err
+	}
+	db = db.Debug().Where("id = ?", codeHash).Delete(&Oauth_Code{})
+	if db.Error != nil {
+		return &Oauth_Code{}, db.Error
+	}
+	if db.RowsAffected == 0 || time.Now().After(oc.ExpiresAt) || oc.RedirectURI != redirectURI {
+		return &Oauth_Code{}, errors.New("Invalid or expired code")
+	}
+	return oc, nil
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Oauth_Request is an OAuth login started here and waiting for the callback
+// of the provider. Its ID is the hash of the state parameter, the nonce is
+// expected back in the ID token of OpenID Connect providers. A request with
+// a user links the identity to that user instead of logging in, and only
+// from the browser holding the cookie whose hash is BrowserHash.
+type Oauth_Request struct {
+	ID          string     `gorm:"primary_key;size:64" json:"-"`
+	Provider    string     `gorm:"size:100;not null" json:"provider"`
+	UserID      *uuid.UUID `gorm:"type:uuid" json:"user_id,omitempty"`
+	RedirectURI string     `gorm:"size:2048" json:"redirect_uri"`
+	DeviceID    string     `gorm:"size:255" json:"device_id"`
+	Nonce       string     `gorm:"size:255;not null" json:"-"`
+	BrowserHash string     `gorm:"size:64" json:"-"`
+	ExpiresAt   time.Time  `gorm:"not null" json:"expires_at"`
+	CreatedAt   time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// ErrRedirectURINotAllowed is returned for a redirect_uri missing from
+// OAUTH_REDIRECT_URIS.
+var ErrRedirectURINotAllowed = errors.New("The redirect_uri is not allowed")
+
+// OauthRequestExpiry is how long the user has to log in at the provider,
+// configured through OAUTH_REQUEST_EXPIRY_IN_MINUTES and defaulting to ten
+// minutes.
+func OauthRequestExpiry() time.Duration {
+	minutes := envInt("OAUTH_REQUEST_EXPIRY_IN_MINUTES", 10)
+	if minutes <= 0 {
+		minutes = 10
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// OauthRedirectURI checks the requested redirect_uri against the comma
+// separated OAUTH_REDIRECT_URIS of the frontends, which have to match
+// exactly. Without one the first of the list is used.
+func OauthRedirectURI(requested string) (string, error) {
+	allowed := []string{}
+	for _, uri := range strings.Split(os.Getenv("OAUTH_REDIRECT_URIS"), ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			allowed = append(allowed, uri)
+		}
+	}
+	if requested == "" {
+		if len(allowed) == 0 {
+			return "", errors.New("No OAUTH_REDIRECT_URIS configured")
+		}
+		return allowed[0], nil
+	}
+	for _, uri := range allowed {
+		if uri == requested {
+			return uri, nil
+		}
+	}
+	return "", ErrRedirectURINotAllowed
+}
+
+func (or *Oauth_Request) Prepare(stateHash string, provider string, redirectURI string, deviceID string, nonce string) {
+	or.ID = stateHash
+	or.Provider = provider
+	or.RedirectURI = redirectURI
+	or.DeviceID = deviceID
+	or.Nonce = nonce
+	or.ExpiresAt = time.Now().Add(OauthRequestExpiry())
+	or.CreatedAt = time.Now()
+}
+
+// SaveOauthRequest stores the request and drops the expired ones.
+func (or *Oauth_Request) SaveOauthRequest(db *gorm.DB) error {
+	err := db.Debug().Where("expires_at < ?", time.Now()).Delete(&Oauth_Request{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Debug().Create(&or).Error
+}
+
+// FindOauthRequest returns the pending request of the provider without
+// consuming it.
+func (or *Oauth_Request) FindOauthRequest(db *gorm.DB, stateHash string, provider string) (*Oauth_Request, error) {
+	err := db.Debug().Model(&Oauth_Request{}).Where("id = ? AND provider = ? AND expires_at > ?", stateHash, provider, time.Now()).Take(&or).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Oauth_Request{}, errors.New("Unknown or expired OAuth request")
+		}
+		return &Oauth_Request{}, err
+	}
+	return or, nil
+}
+
+// ConsumeOauthRequest takes the request of the provider out of the store. A
+// request can only be answered once and before it expires.
+func (or *Oauth_Request) ConsumeOauthRequest(db *gorm.DB, stateHash string, provider string) (*Oauth_Request, error) {
+	err := db.Debug().Model(&Oauth_Request{}).Where("id = ? AND provider = ?", stateHash, provider).Take(&or).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Oauth_Request{}, errors.New("Unknown or expired OAuth request")
+		}
+		return &Oauth_Request{}, err
+	}
+	db = db.Debug().Where("id = ?", stateHash).Delete(&Oauth_Request{})
+	if db.Error != nil {
+		return &Oauth_Request{}, db.Error
+	}
+	if db.RowsAffected == 0 || time.Now().After(or.ExpiresAt) {
+		return &Oauth_Request{}, errors.New("Unknown or expired OAuth request")
+	}
+	return or, nil
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Oidc_Provider is an upstream OpenID Connect provider users can log in
+// with at /auth/{name}. Providers of the OIDC_PROVIDERS_FILE with the same
+// name are replaced by it.
+type Oidc_Provider struct {
+	ID             uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	Name           string    `gorm:"size:100;not null;unique" json:"name"`
+	DisplayName    string    `gorm:"size:255" json:"display_name"`
+	DiscoveryURL   string    `gorm:"size:2048;not null" json:"discovery_url"`
+	ClientID       string    `gorm:"size:255;not null" json:"client_id"`
+	ClientSecret   string    `gorm:"size:1024" json:"-"`
+	Scopes         string    `gorm:"size:1024" json:"scopes"`
+	SubjectClaim   string    `gorm:"size:255" json:"subject_claim"`
+	EmailClaim     string    `gorm:"size:255" json:"email_claim"`
+	UserNameClaim  string    `gorm:"size:255" json:"user_name_claim"`
+	FirstNameClaim string    `gorm:"size:255" json:"first_name_claim"`
+	LastNameClaim  string    `gorm:"size:255" json:"last_name_claim"`
+	NameClaim      string    `gorm:"size:255" json:"name_claim"`
+	Enabled        bool      `json:"enabled"`
+	CreatedAt      time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy      uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	UpdatedAt      time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+	UpdatedBy      uuid.UUID `gorm:"type:uuid;not null" json:"updated_by"`
+}
+
+type Oidc_Provider_Payload struct {
+	Name           string `json:"name"`
+	DisplayName    string `json:"display_name"`
+	DiscoveryURL   string `json:"discovery_url"`
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+	Scopes         string `json:"scopes"`
+	SubjectClaim   string `json:"subject_claim"`
+	EmailClaim     string `json:"email_claim"`
+	UserNameClaim  string `json:"user_name_claim"`
+	FirstNameClaim string `json:"first_name_claim"`
+	LastNameClaim  string `json:"last_name_claim"`
+	NameClaim      string `json:"name_claim"`
+	Enabled        *bool  `json:"enabled,omitempty"`
+}
+
+// builtinOAuthProviders are configured through their own settings and
+// cannot be shadowed.
+var builtinOAuthProviders = []string{"google", "github"}
+
+// Apply copies the payload onto the provider. An empty client secret keeps
+// the current one, so that it does not have to be sent on every update.
+func (op *Oidc_Provider) Apply(payload Oidc_Provider_Payload) {
+	op.Name = strings.ToLower(strings.TrimSpace(payload.Name))
+	op.DisplayName = strings.TrimSpace(payload.DisplayName)
+	op.DiscoveryURL = strings.TrimSpace(payload.DiscoveryURL)
+	op.ClientID = strings.TrimSpace(payload.ClientID)
+	if payload.ClientSecret != "" {
+		op.ClientSecret = payload.ClientSecret
+	}
+	op.Scopes = strings.Join(strings.Fields(strings.Replace(payload.Scopes, ",", " ", -1)), ",")
+	op.SubjectClaim = strings.TrimSpace(payload.SubjectClaim)
+	op.EmailClaim = strings.TrimSpace(payload.EmailClaim)
+	op.UserNameClaim = strings.TrimSpace(payload.UserNameClaim)
+	op.FirstNameClaim = strings.TrimSpace(payload.FirstNameClaim)
+	op.LastNameClaim = strings.TrimSpace(payload.LastNameClaim)
+	op.NameClaim = strings.TrimSpace(payload.NameClaim)
+	if payload.Enabled != nil {
+		op.Enabled = *payload.Enabled
+	}
+}
+
+func (op *Oidc_Provider) Prepare(tuid uuid.UUID) {
+	op.ID = uuid.New()
+	op.CreatedAt = time.Now()
+	op.CreatedBy = tuid
+	op.UpdatedAt = time.Now()
+	op.UpdatedBy = tuid
+}
+
+func (op *Oidc_Provider) Validate() error {
+	for _, name := range builtinOAuthProviders {
+		if op.Name == name {
+			return errors.New("Name " + name + " is reserved")
+		}
+	}
+	return op.OIDCProvider().Validate()
+}
+
+// OIDCProvider returns the settings of the provider.
+func (op *Oidc_Provider) OIDCProvider() sso.OIDCProvider {
+	provider := sso.OIDCProvider{
+		Name:         op.Name,
+		DisplayName:  op.DisplayName,
+		DiscoveryURL: op.DiscoveryURL,
+		ClientID:     op.ClientID,
+		ClientSecret: op.ClientSecret,
+		Claims: sso.ClaimMapping{
+			Subject:   op.SubjectClaim,
+			Email:     op.EmailClaim,
+			UserName:  op.UserNameClaim,
+			FirstName: op.FirstNameClaim,
+			LastName:  op.LastNameClaim,
+			Name:      op.NameClaim,
+		},
+	}
+	if op.Scopes != "" {
+		provider.Scopes = strings.Split(op.Scopes, ",")
+	}
+	return provider
+}
+
+func (op *Oidc_Provider) SaveOidcProvider(db *gorm.DB) (*Oidc_Provider, error) {
+	err := db.Debug().Model(&Oidc_Provider{}).Create(&op).Error
+	if err != nil {
+		return &Oidc_Provider{}, err
+	}
+	return op, nil
+}
+
+func (op *Oidc_Provider) FindAllOidcProviders(db *gorm.DB) (*[]Oidc_Provider, error) {
+	providers := []Oidc_Provider{}
+	err := db.Debug().Model(&Oidc_Provider{}).Order("name").Find(&providers).Error
+	if err != nil {
+		return &[]Oidc_Provider{}, err
+	}
+	return &providers, nil
+}
+
+func (op *Oidc_Provider) FindEnabledOidcProviders(db *gorm.DB) (*[]Oidc_Provider, error) {
+	providers := []Oidc_Provider{}
+	err := db.Debug().Model(&Oidc_Provider{}).Where("enabled = ?", true).Order("name").Find(&providers).Error
+	if err != nil {
+		return &[]Oidc_Provider{}, err
+	}
+	return &providers, nil
+}
+
+func (op *Oidc_Provider) FindOidcProviderByID(db *gorm.DB, pid uuid.UUID) (*Oidc_Provider, error) {
+	err := db.Debug().Model(&Oidc_Provider{}).Where("id = ?", pid).Take(&op).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Oidc_Provider{}, errors.New("OIDC Provider Not Found")
+		}
+		return &Oidc_Provider{}, err
+	}
+	return op, nil
+}
+
+func (op *Oidc_Provider) UpdateAnOidcProvider(db *gorm.DB, tuid uuid.UUID) (*Oidc_Provider, error) {
+	op.UpdatedAt = time.Now()
+	op.UpdatedBy = tuid
+	err := db.Debug().Model(&Oidc_Provider{}).Where("id = ?", op.ID).UpdateColumns(
+		map[string]interface{}{
+			"name":             op.Name,
+			"display_name":     op.DisplayName,
+			"discovery_url":    op.DiscoveryURL,
+			"client_id":        op.ClientID,
+			"client_secret":    op.ClientSecret,
+			"scopes":           op.Scopes,
+			"subject_claim":    op.SubjectClaim,
+			"email_claim":      op.EmailClaim,
+			"user_name_claim":  op.UserNameClaim,
+			"first_name_claim": op.FirstNameClaim,
+			"last_name_claim":  op.LastNameClaim,
+			"name_claim":       op.NameClaim,
+			"enabled":          op.Enabled,
+			"updated_at":       op.UpdatedAt,
+			"updated_by":       op.UpdatedBy,
+		},
+	).Error
+	if err != nil {
+		return &Oidc_Provider{}, err
+	}
+	return op, nil
+}
+
+func (op *Oidc_Provider) DeleteAnOidcProvider(db *gorm.DB, pid uuid.UUID) (int64, error) {
+	result := db.Debug().Where("id = ?", pid).Delete(&Oidc_Provider{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("OIDC Provider Not Found")
+	}
+	return result.RowsAffected, nil
+}
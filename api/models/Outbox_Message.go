@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/broker"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// outboxLockKey is the advisory lock held by the one relay publishing at a
+// time, which keeps messages in order across instances.
+const outboxLockKey = 7302517046
+
+// Outbox_Message is an event waiting to be published to the broker. It is
+// written in the transaction of the change it reports, so an event exists if
+// and only if the change was committed, and is relayed in ID order.
+type Outbox_Message struct {
+	ID            uint64     `gorm:"primary_key;auto_increment" json:"id"`
+	AggregateType string     `gorm:"size:64;not null" json:"aggregate_type"`
+	AggregateID   string     `gorm:"size:64;not null;index" json:"aggregate_id"`
+	Event         string     `gorm:"size:64;not null" json:"event"`
+	Payload       JSONB      `gorm:"type:jsonb;not null" json:"payload"`
+	Attempts      int        `gorm:"not null" json:"attempts"`
+	LastError     string     `gorm:"size:512" json:"last_error,omitempty"`
+	PublishedAt   *time.Time `gorm:"index" json:"published_at,omitempty"`
+	CreatedAt     time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// OutboxEnabled reports whether an OUTBOX_BROKER is configured. Without one
+// no outbox messages are written.
+func OutboxEnabled() bool {
+	return os.Getenv("OUTBOX_BROKER") != ""
+}
+
+func OutboxPollInterval() time.Duration {
+	return time.Duration(envInt("OUTBOX_POLL_INTERVAL_SECONDS", 1)) * time.Second
+}
+
+func OutboxRetention() time.Duration {
+	return time.Duration(envInt("OUTBOX_RETENTION_HOURS", 24)) * time.Hour
+}
+
+// EnqueueOutboxMessage writes the event to the outbox. Call it with the
+// transaction of the change the event reports.
+func EnqueueOutboxMessage(db *gorm.DB, aggregateType string, aggregateID string, event string, data interface{}) error {
+	if !OutboxEnabled() {
+		return nil
+	}
+	now := time.Now()
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":             uuid.New(),
+		"event":          event,
+		"aggregate_type": aggregateType,
+		"aggregate_id":   aggregateID,
+		"created_at":     now,
+		"data":           data,
+	})
+	if err != nil {
+		return err
+	}
+	message := Outbox_Message{
+		AggregateType: aggregateType,
+		AggregateID:   aggregateID,
+		Event:         event,
+		Payload:       payload,
+		CreatedAt:     now,
+	}
+	return db.Debug().Create(&message).Error
+}
+
+// PublishUserEvent records a lifecycle event of a user in the outbox and
+// queues it for the webhooks, in the transaction of the change.
+func PublishUserEvent(db *gorm.DB, event string, uid uuid.UUID, data interface{}) error {
+	err := EnqueueOutboxMessage(db, "user", uid.String(), event, data)
+	if err != nil {
+		return err
+	}
+	return EnqueueWebhookEvent(db, event, data)
+}
+
+// RelayOutbox publishes up to limit unpublished messages, oldest first, and
+// marks them published once the broker acknowledged them. A crash in between
+// publishes them again, delivery is at least once. Only one relay runs at a
+// time, the others return 0 right away.
+func RelayOutbox(db *gorm.DB, b broker.Broker, limit int, timeout time.Duration) (int, error) {
+	published := 0
+	var publishErr error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		locked := false
+		err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", outboxLockKey).Row().Scan(&locked)
+		if err != nil || !locked {
+			return err
+		}
+		messages := []Outbox_Message{}
+		err = tx.Debug().Model(&Outbox_Message{}).Where("published_at IS NULL").Order("id").Limit(limit).Find(&messages).Error
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+
+		batch := make([]broker.Message, len(messages))
+		ids := make([]uint64, len(messages))
+		for i, message := range messages {
+			batch[i] = broker.Message{
+				ID:      strconv.FormatUint(message.ID, 10),
+				Key:     message.AggregateID,
+				Event:   message.Event,
+				Payload: message.Payload,
+			}
+			ids[i] = message.ID
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		publishErr = b.Publish(ctx, batch...)
+		if publishErr != nil {
+			lastError := publishErr.Error()
+			if len(lastError) > 512 {
+				lastError = lastError[:512]
+			}
+			err = tx.Debug().Model(&Outbox_Message{}).Where("id IN (?)", ids).UpdateColumns(
+				map[string]interface{}{
+					"attempts":   gorm.Expr("attempts + 1"),
+					"last_error": lastError,
+				},
+			).Error
+			return err
+		}
+		err = tx.Debug().Model(&Outbox_Message{}).Where("id IN (?)", ids).UpdateColumns(
+			map[string]interface{}{
+				"attempts":     gorm.Expr("attempts + 1"),
+				"last_error":   "",
+				"published_at": time.Now(),
+			},
+		).Error
+		if err != nil {
+			return err
+		}
+		published = len(messages)
+		return nil
+	})
+	if err == nil {
+		err = publishErr
+	}
+	return published, err
+}
+
+// PruneOutboxMessages removes published messages past OUTBOX_RETENTION_HOURS.
+func PruneOutboxMessages(db *gorm.DB) error {
+	return db.Debug().Where("published_at < ?", time.Now().Add(-OutboxRetention())).Delete(&Outbox_Message{}).Error
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/broker"
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectOutboxRound expects a relay taking the lock and reading the
+// messages, the ID, aggregate ID and event of each.
+func expectOutboxRound(mock sqlmock.Sqlmock, messages ...[3]interface{}) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).
+		WithArgs(outboxLockKey).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+	rows := sqlmock.NewRows([]string{"id", "aggregate_type", "aggregate_id", "event", "payload"})
+	for _, message := range messages {
+		rows.AddRow(message[0], "user", message[1], message[2], []byte(`{}`))
+	}
+	mock.ExpectQuery(`SELECT \* FROM "outbox_messages" WHERE \(published_at IS NULL\) ORDER BY "id" LIMIT 10`).
+		WillReturnRows(rows)
+}
+
+func TestRelayOutboxPublishesInOrder(t *testing.T) {
+	db, mock := newMockDB(t)
+	b := broker.NewMemory()
+	expectOutboxRound(mock,
+		[3]interface{}{1, "alice", EventUserCreated},
+		[3]interface{}{2, "bob", EventUserCreated},
+		[3]interface{}{3, "alice", EventUserUpdated},
+	)
+	mock.ExpectExec(`UPDATE "outbox_messages" SET "attempts" = attempts \+ 1, "last_error" = \$1, "published_at" = \$2 WHERE \(id IN \(\$3,\$4,\$5\)\)`).
+		WithArgs("", sqlmock.AnyArg(), 1, 2, 3).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	published, err := RelayOutbox(db, b, 10, time.Second)
+	if err != nil || published != 3 {
+		t.Fatalf("RelayOutbox = %d, %v", published, err)
+	}
+	messages := b.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("Published %+v", messages)
+	}
+	// Each aggregate keeps the order of its events.
+	alice := []string{}
+	for i, message := range messages {
+		if message.ID != []string{"1", "2", "3"}[i] {
+			t.Errorf("Message %d is %s", i, message.ID)
+		}
+		if message.Key == "alice" {
+			alice = append(alice, message.Event)
+		}
+	}
+	if len(alice) != 2 || alice[0] != EventUserCreated || alice[1] != EventUserUpdated {
+		t.Errorf("Events of alice arrived as %v", alice)
+	}
+}
+
+func TestRelayOutboxKeepsMessagesWhenPublishFails(t *testing.T) {
+	db, mock := newMockDB(t)
+	b := broker.NewMemory()
+	b.Fail = errors.New("broker unavailable")
+	expectOutboxRound(mock, [3]interface{}{1, "alice", EventUserCreated}, [3]interface{}{2, "bob", EventUserCreated})
+	// Only the attempt is recorded, published_at stays empty.
+	mock.ExpectExec(`UPDATE "outbox_messages" SET "attempts" = attempts \+ 1, "last_error" = \$1 WHERE \(id IN \(\$2,\$3\)\)`).
+		WithArgs("broker unavailable", 1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	published, err := RelayOutbox(db, b, 10, time.Second)
+	if err != b.Fail || published != 0 {
+		t.Fatalf("RelayOutbox = %d, %v", published, err)
+	}
+	if len(b.Messages()) != 0 {
+		t.Errorf("A failing broker stored %+v", b.Messages())
+	}
+}
+
+func TestRelayOutboxRedeliversUnmarkedMessages(t *testing.T) {
+	db, mock := newMockDB(t)
+	b := broker.NewMemory()
+
+	// The broker acknowledged the message but marking it published failed.
+	expectOutboxRound(mock, [3]interface{}{1, "alice", EventUserCreated})
+	mock.ExpectExec(`UPDATE "outbox_messages" SET`).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	if published, err := RelayOutbox(db, b, 10, time.Second); err == nil || published != 0 {
+		t.Fatalf("RelayOutbox = %d, %v", published, err)
+	}
+
+	// The next round finds it unpublished and publishes it again.
+	expectOutboxRound(mock, [3]interface{}{1, "alice", EventUserCreated})
+	mock.ExpectExec(`UPDATE "outbox_messages" SET`).
+		WithArgs("", sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if published, err := RelayOutbox(db, b, 10, time.Second); err != nil || published != 1 {
+		t.Fatalf("RelayOutbox = %d, %v", published, err)
+	}
+
+	messages := b.Messages()
+	if len(messages) != 2 || messages[0].ID != "1" || messages[1].ID != "1" {
+		t.Errorf("Published %+v, want message 1 twice", messages)
+	}
+}
+
+func TestRelayOutboxSkipsWhenLocked(t *testing.T) {
+	db, mock := newMockDB(t)
+	b := broker.NewMemory()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(false))
+	mock.ExpectCommit()
+
+	if published, err := RelayOutbox(db, b, 10, time.Second); err != nil || published != 0 {
+		t.Fatalf("RelayOutbox = %d, %v", published, err)
+	}
+}
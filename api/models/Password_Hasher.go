@@ -0,0 +1,182 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrPasswordMismatch keeps the wording of bcrypt so that existing callers
+// formatting "hashedPassword" errors keep working for every algorithm.
+var ErrPasswordMismatch = errors.New("hashedPassword is not the hash of the given password")
+
+// PasswordHasher produces and checks versioned password hashes. Every hash
+// carries its algorithm and parameters, so a hash made with older settings
+// can still be verified and recognised as outdated.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(hashedPassword, password string) error
+	NeedsRehash(hashedPassword string) bool
+}
+
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+// CurrentPasswordHasher returns the hasher new passwords are stored with, as
+// configured through PASSWORD_HASH_ALGORITHM and its ARGON2_* or BCRYPT_COST
+// parameters.
+func CurrentPasswordHasher() PasswordHasher {
+	if strings.EqualFold(os.Getenv("PASSWORD_HASH_ALGORITHM"), "bcrypt") {
+		return BcryptHasher{Cost: envInt("BCRYPT_COST", bcrypt.DefaultCost)}
+	}
+	return Argon2idHasher{
+		Memory:      uint32(envInt("ARGON2_MEMORY_KB", 64*1024)),
+		Iterations:  uint32(envInt("ARGON2_ITERATIONS", 3)),
+		Parallelism: argon2Parallelism(),
+		SaltLength:  uint32(envInt("ARGON2_SALT_LENGTH", 16)),
+		KeyLength:   uint32(envInt("ARGON2_KEY_LENGTH", 32)),
+	}
+}
+
+// argon2Parallelism reads ARGON2_PARALLELISM, which has to fit in a uint8
+// and cannot be 0.
+func argon2Parallelism() uint8 {
+	parallelism := envInt("ARGON2_PARALLELISM", 2)
+	if parallelism < 1 || parallelism > 255 {
+		log.Printf("ARGON2_PARALLELISM=%d is not between 1 and 255, using 2", parallelism)
+		return 2
+	}
+	return uint8(parallelism)
+}
+
+// hasherFor picks the hasher able to verify an existing hash.
+func hasherFor(hashedPassword string) (PasswordHasher, error) {
+	switch {
+	case strings.HasPrefix(hashedPassword, "$argon2id$"):
+		return Argon2idHasher{}, nil
+	case strings.HasPrefix(hashedPassword, "$2a$"), strings.HasPrefix(hashedPassword, "$2b$"), strings.HasPrefix(hashedPassword, "$2y$"):
+		return BcryptHasher{}, nil
+	}
+	return nil, errors.New("Unknown password hash format")
+}
+
+func Hash(password string) ([]byte, error) {
+	hashedPassword, err := CurrentPasswordHasher().Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hashedPassword), nil
+}
+
+func VerifyPassword(hashedPassword, password string) error {
+	hasher, err := hasherFor(hashedPassword)
+	if err != nil {
+		return err
+	}
+	return hasher.Verify(hashedPassword, password)
+}
+
+// PasswordNeedsRehash reports whether a hash was made with another algorithm
+// or weaker parameters than the ones currently configured.
+func PasswordNeedsRehash(hashedPassword string) bool {
+	return CurrentPasswordHasher().NeedsRehash(hashedPassword)
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Verify(hashedPassword, password string) error {
+	params, salt, key, err := decodeArgon2id(hashedPassword)
+	if err != nil {
+		return err
+	}
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(candidate, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h Argon2idHasher) NeedsRehash(hashedPassword string) bool {
+	params, salt, key, err := decodeArgon2id(hashedPassword)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.Memory || params.Iterations != h.Iterations || params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength || uint32(len(key)) != h.KeyLength
+}
+
+func decodeArgon2id(hashedPassword string) (Argon2idHasher, []byte, []byte, error) {
+	params := Argon2idHasher{}
+	parts := strings.Split(hashedPassword, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errors.New("Unknown password hash format")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("Unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	return params, salt, key, nil
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
+func (h BcryptHasher) Verify(hashedPassword, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrPasswordMismatch
+	}
+	return err
+}
+
+func (h BcryptHasher) NeedsRehash(hashedPassword string) bool {
+	if !strings.HasPrefix(hashedPassword, "$2") {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	return err != nil || cost < h.Cost
+}
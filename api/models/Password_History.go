@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+type Password_History struct {
+	ID           uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	UserID       uuid.UUID `gorm:"type:uuid;not null;index" json:"user_id"`
+	PasswordHash string    `gorm:"size:255;not null" json:"-"`
+	CreatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// RecordPasswordHistory stores an already hashed password and trims the
+// history of the user down to the most recent keep entries.
+func (ph *Password_History) RecordPasswordHistory(db *gorm.DB, uid uuid.UUID, passwordHash string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	ph.ID = uuid.New()
+	ph.UserID = uid
+	ph.PasswordHash = passwordHash
+	ph.CreatedAt = time.Now()
+	err := db.Debug().Create(&ph).Error
+	if err != nil {
+		return err
+	}
+
+	stale := []Password_History{}
+	err = db.Debug().Model(&Password_History{}).Where("user_id = ?", uid).Order("created_at desc").Offset(keep).Find(&stale).Error
+	if err != nil {
+		return err
+	}
+	for i := range stale {
+		err = db.Debug().Where("id = ?", stale[i].ID).Delete(&Password_History{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ph *Password_History) MatchesRecentPassword(db *gorm.DB, uid uuid.UUID, password string, count int) (bool, error) {
+	history := []Password_History{}
+	err := db.Debug().Model(&Password_History{}).Where("user_id = ?", uid).Order("created_at desc").Limit(count).Find(&history).Error
+	if err != nil {
+		return false, err
+	}
+	for i := range history {
+		if VerifyPassword(history[i].PasswordHash, password) == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/breach"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// PasswordPolicy holds the rules a password has to satisfy. It is read from
+// the PASSWORD_* environment variables and published to frontends as is.
+type PasswordPolicy struct {
+	MinLength        int    `json:"min_length"`
+	MaxLength        int    `json:"max_length"`
+	RequireUpper     bool   `json:"require_uppercase"`
+	RequireLower     bool   `json:"require_lowercase"`
+	RequireDigit     bool   `json:"require_digit"`
+	RequireSymbol    bool   `json:"require_symbol"`
+	DisallowUserInfo bool   `json:"disallow_user_info"`
+	HistoryCount     int    `json:"history_count"`
+	BreachedCheck    string `json:"breached_check"`
+}
+
+type PasswordPolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password failed, not just the first.
+type PasswordPolicyError struct {
+	Violations []PasswordPolicyViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return "Password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+func (e *PasswordPolicyError) Details() interface{} {
+	return e.Violations
+}
+
+func CurrentPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:        envInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:        envInt("PASSWORD_MAX_LENGTH", 72),
+		RequireUpper:     envBool("PASSWORD_REQUIRE_UPPERCASE", true),
+		RequireLower:     envBool("PASSWORD_REQUIRE_LOWERCASE", true),
+		RequireDigit:     envBool("PASSWORD_REQUIRE_DIGIT", true),
+		RequireSymbol:    envBool("PASSWORD_REQUIRE_SYMBOL", false),
+		DisallowUserInfo: envBool("PASSWORD_DISALLOW_USER_INFO", true),
+		HistoryCount:     envInt("PASSWORD_HISTORY_COUNT", 5),
+		BreachedCheck:    string(breach.ParseMode(os.Getenv("BREACHED_PASSWORD_CHECK"))),
+	}
+}
+
+// Validate checks the password against every rule of the policy. The user
+// supplies the name and email fragments to reject and, once it has an ID,
+// the password history to compare against.
+func (p PasswordPolicy) Validate(db *gorm.DB, password string, u *User) error {
+	violations := []PasswordPolicyViolation{}
+	add := func(rule string, format string, args ...interface{}) {
+		violations = append(violations, PasswordPolicyViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		add("min_length", "Password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add("max_length", "Password must be at most %d characters long", p.MaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add("uppercase", "Password must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		add("lowercase", "Password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add("digit", "Password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add("symbol", "Password must contain a symbol")
+	}
+
+	if p.DisallowUserInfo && u != nil {
+		lowered := strings.ToLower(password)
+		for _, fragment := range userInfoFragments(u) {
+			if strings.Contains(lowered, fragment) {
+				add("user_info", "Password must not contain your username, name or email")
+				break
+			}
+		}
+	}
+
+	if p.HistoryCount > 0 && db != nil && u != nil && u.ID != uuid.Nil {
+		history := Password_History{}
+		reused, err := history.MatchesRecentPassword(db, u.ID, password, p.HistoryCount)
+		if err != nil {
+			return err
+		}
+		if reused {
+			add("history", "Password must not be one of your last %d passwords", p.HistoryCount)
+		}
+	}
+
+	if mode := breach.Mode(p.BreachedCheck); mode != breach.Off {
+		breached, err := breach.Check(password)
+		if err != nil {
+			return err
+		}
+		if breached && mode == breach.Block {
+			add("breached", "Password appears in a known data breach")
+		} else if breached {
+			log.Printf("Password chosen for %s appears in a known data breach, allowed by BREACHED_PASSWORD_CHECK=warn", userLabel(u))
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func userLabel(u *User) string {
+	if u == nil {
+		return "unknown user"
+	}
+	if u.ID != uuid.Nil {
+		return u.ID.String()
+	}
+	return u.UserName
+}
+
+func userInfoFragments(u *User) []string {
+	candidates := []string{u.UserName, u.FirstName, u.LastName}
+	if at := strings.Index(u.Email, "@"); at > 0 {
+		candidates = append(candidates, u.Email[:at])
+	}
+	fragments := []string{}
+	for _, c := range candidates {
+		c = strings.ToLower(strings.TrimSpace(c))
+		// Very short fragments would reject far too many passwords
+		if utf8.RuneCountInString(c) >= 3 {
+			fragments = append(fragments, c)
+		}
+	}
+	return fragments
+}
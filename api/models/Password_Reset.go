@@ -0,0 +1,76 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Password_Reset is a single-use token emailed to a user to set a new
+// password through /users/forgotPassword.
+type Password_Reset struct {
+	ID        uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	UserID    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	TokenHash string     `gorm:"size:64;not null;unique" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+type Password_Reset_Request struct {
+	Email string `json:"email"`
+}
+
+// PasswordResetExpiry is the lifetime of a password reset link, configured
+// through PASSWORD_RESET_EXPIRY_IN_MINUTES and defaulting to one hour.
+func PasswordResetExpiry() time.Duration {
+	minutes := envInt("PASSWORD_RESET_EXPIRY_IN_MINUTES", 60)
+	if minutes <= 0 {
+		minutes = 60
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (pr *Password_Reset) Prepare(uid uuid.UUID, tokenHash string) {
+	pr.ID = uuid.New()
+	pr.UserID = uid
+	pr.TokenHash = tokenHash
+	pr.ExpiresAt = time.Now().Add(PasswordResetExpiry())
+	pr.CreatedAt = time.Now()
+}
+
+func (pr *Password_Reset) SavePasswordReset(db *gorm.DB) error {
+	return db.Debug().Create(&pr).Error
+}
+
+// ConsumePasswordReset marks the reset matching the token as used and
+// returns it. A reset only works once and before it expires.
+func (pr *Password_Reset) ConsumePasswordReset(db *gorm.DB, tokenHash string) (*Password_Reset, error) {
+	err := db.Debug().Model(&Password_Reset{}).Where("token_hash = ?", tokenHash).Take(&pr).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Password_Reset{}, errors.New("Invalid or expired link")
+		}
+		return &Password_Reset{}, err
+	}
+	if pr.UsedAt != nil || time.Now().After(pr.ExpiresAt) {
+		return &Password_Reset{}, errors.New("Invalid or expired link")
+	}
+
+	now := time.Now()
+	db = db.Debug().Model(&Password_Reset{}).Where("id = ? AND used_at IS NULL", pr.ID).UpdateColumns(
+		map[string]interface{}{
+			"used_at": now,
+		},
+	)
+	if db.Error != nil {
+		return &Password_Reset{}, db.Error
+	}
+	if db.RowsAffected == 0 {
+		return &Password_Reset{}, errors.New("Invalid or expired link")
+	}
+	pr.UsedAt = &now
+	return pr, nil
+}
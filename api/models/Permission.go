@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"bitbucket.org/staydigital/truvest-identity-management/api/utils"
 	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 )
@@ -25,7 +26,7 @@ type CreatePermission struct {
 
 func (p *Permission) Prepare(tuid uuid.UUID) {
 	p.ID = 0
-	p.Name = html.EscapeString(strings.TrimSpace(p.Name))
+	p.Name = utils.QualifyPermission(html.EscapeString(strings.TrimSpace(p.Name)))
 	p.CreatedAt = time.Now()
 	p.CreatedBy = tuid
 	p.UpdatedAt = time.Now()
@@ -33,10 +34,15 @@ func (p *Permission) Prepare(tuid uuid.UUID) {
 }
 
 func (p *Permission) Validate() error {
-	if p.Name == "" {
-		return errors.New("Required Name")
-	}
-	return nil
+	return utils.ValidatePermissionName(p.Name)
+}
+
+// MigratePermissionNamespace moves the permissions named before namespaces
+// were introduced into utils.PermissionNamespace. A name is left alone when
+// its namespaced version already exists.
+func MigratePermissionNamespace(db *gorm.DB) error {
+	return db.Debug().Exec("UPDATE permissions SET name = CAST(? AS text) || name WHERE position(':' in name) = 0 AND name <> ? AND NOT EXISTS (SELECT 1 FROM permissions AS p WHERE p.name = CAST(? AS text) || permissions.name)",
+		utils.PermissionNamespace+":", utils.PermissionWildcard, utils.PermissionNamespace+":").Error
 }
 
 func (p *Permission) SavePermission(db *gorm.DB) (*Permission, error) {
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Rate_Limit_Bucket holds the state of a token bucket shared by every
+// instance of the service.
+type Rate_Limit_Bucket struct {
+	Key       string    `gorm:"column:bucket_key;primary_key;size:255" json:"key"`
+	Tokens    float64   `gorm:"not null" json:"tokens"`
+	UpdatedAt time.Time `gorm:"not null" json:"updated_at"`
+}
+
+// UpdateRateLimitBucket locks the bucket for key, creating it with initial
+// tokens if it does not exist yet, and stores the token count returned by
+// update. The bucket is held under a row lock while update runs so that
+// concurrent instances never spend the same token twice.
+func (b *Rate_Limit_Bucket) UpdateRateLimitBucket(db *gorm.DB, key string, initial float64, now time.Time, update func(tokens float64, updatedAt time.Time) float64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Debug().Exec("INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", key, initial, now).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Debug().Set("gorm:query_option", "FOR UPDATE").Model(&Rate_Limit_Bucket{}).Where("bucket_key = ?", key).Take(&b).Error
+		if err != nil {
+			return err
+		}
+		b.Tokens = update(b.Tokens, b.UpdatedAt)
+		b.UpdatedAt = now
+		return tx.Debug().Model(&Rate_Limit_Bucket{}).Where("bucket_key = ?", key).UpdateColumns(
+			map[string]interface{}{
+				"tokens":     b.Tokens,
+				"updated_at": now,
+			},
+		).Error
+	})
+}
+
+// FindRateLimitBucket loads the bucket for key, leaving b as it is when the
+// bucket does not exist yet.
+func (b *Rate_Limit_Bucket) FindRateLimitBucket(db *gorm.DB, key string) error {
+	err := db.Debug().Model(&Rate_Limit_Bucket{}).Where("bucket_key = ?", key).Take(&b).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil
+	}
+	return err
+}
+
+// PruneRateLimitBuckets removes buckets untouched since before, which are
+// full again by then and would be recreated on demand.
+func (b *Rate_Limit_Bucket) PruneRateLimitBuckets(db *gorm.DB, before time.Time) error {
+	return db.Debug().Where("updated_at < ?", before).Delete(&Rate_Limit_Bucket{}).Error
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"errors"
 	"html"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,14 +19,34 @@ type Role struct {
 	CreatedBy	 	uuid.UUID				 	`gorm:"type:uuid;not null" json:"created_by"`
 	UpdatedAt 		time.Time		 			`gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
 	UpdatedBy	 	uuid.UUID				 	`gorm:"type:uuid;not null" json:"updated_by"`
+	ParentID		*uint32						`gorm:"index" json:"parent_id"`
 	Permissions		[]*Permission				`gorm:"many2many:role_permissions" json:"permissions"`
 }
 
 type CreateRole struct {
 	Name     		string    		`gorm:"size:255;not null;unique" json:"name"`
 	Description 	string    		`gorm:"size:255;not null;" json:"description"`
+	ParentID		*uint32			`json:"parent_id"`
 }
 
+// Permission_Source is a role a permission comes from, with Depth 0 for the
+// role itself, 1 for its parent and so on.
+type Permission_Source struct {
+	RoleID   uint32 `json:"role_id"`
+	RoleName string `json:"role_name"`
+	Depth    int    `json:"depth"`
+}
+
+// Effective_Permission is a permission a role has, directly or inherited
+// from the roles above it.
+type Effective_Permission struct {
+	ID      uint32              `json:"id"`
+	Name    string              `json:"name"`
+	Sources []Permission_Source `json:"sources"`
+}
+
+var ErrRoleCycle = errors.New("A role cannot inherit from itself")
+
 func (r *Role) Prepare(tuid uuid.UUID) {
 	r.ID = 0
 	r.Name = html.EscapeString(strings.TrimSpace(r.Name))
@@ -46,6 +67,29 @@ func (r *Role) Validate() error {
 	return nil
 }
 
+// ValidateParent checks that the parent exists and that the role is not
+// among the roles it inherits from.
+func (r *Role) ValidateParent(db *gorm.DB) error {
+	seen := map[uint32]bool{}
+	pid := r.ParentID
+	for pid != nil {
+		if *pid == r.ID || seen[*pid] {
+			return ErrRoleCycle
+		}
+		seen[*pid] = true
+		parent := Role{}
+		err := db.Debug().Model(&Role{}).Where("id = ?", *pid).Take(&parent).Error
+		if err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return errors.New("Parent role not found")
+			}
+			return err
+		}
+		pid = parent.ParentID
+	}
+	return nil
+}
+
 func (r *Role) SaveRole(db *gorm.DB) (*Role, error) {
 	var err error
 	err = db.Debug().Model(&Role{}).Create(&r).Error
@@ -87,11 +131,36 @@ func (r *Role) UpdateARole(db *gorm.DB, rid uint32, tuid uuid.UUID) (*Role, erro
 	if err != nil {
 		return &Role{}, err
 	}
+	err = db.Debug().Model(&Role{}).Where("id = ?", r.ID).UpdateColumn("parent_id", r.ParentID).Error
+	if err != nil {
+		return &Role{}, err
+	}
 	return r, nil
 }
 
 func (r *Role) DeleteARole(db *gorm.DB, rid uint32) (int64, error) {
 
+	err := db.Debug().Where("role_id = ?", rid).Delete(&Role_Mapping_Rule{}).Error
+	if err != nil {
+		return 0, err
+	}
+	err = db.Debug().Where("role_id = ?", rid).Delete(&Group_Role{}).Error
+	if err != nil {
+		return 0, err
+	}
+	err = db.Debug().Where("role_id = ?", rid).Delete(&Role_Assignment{}).Error
+	if err != nil {
+		return 0, err
+	}
+	// The roles inheriting from it inherit from its parent instead.
+	deleted := Role{}
+	err = db.Debug().Model(&Role{}).Where("id = ?", rid).Take(&deleted).Error
+	if err == nil {
+		err = db.Debug().Model(&Role{}).Where("parent_id = ?", rid).UpdateColumn("parent_id", deleted.ParentID).Error
+	}
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return 0, err
+	}
 	db = db.Debug().Model(&Role{}).Where("id = ?", rid).Take(&Role{}).Delete(&Role{})
 
 	if db.Error != nil {
@@ -101,4 +170,137 @@ func (r *Role) DeleteARole(db *gorm.DB, rid uint32) (int64, error) {
 		return 0, db.Error
 	}
 	return db.RowsAffected, nil
-}
\ No newline at end of file
+}
+func (r *Role) FindRolesByIDs(db *gorm.DB, rids []uint32) ([]*Role, error) {
+	var err error
+	roles := []*Role{}
+	if len(rids) == 0 {
+		return roles, nil
+	}
+	err = db.Debug().Model(&Role{}).Where("id in (?)", rids).Find(&roles).Error
+	if err != nil {
+		return []*Role{}, err
+	}
+	if len(roles) != len(rids) {
+		return []*Role{}, errors.New("Role not found")
+	}
+	return roles, nil
+}
+
+// FindRolesWhere returns a page of roles matching the condition, ordered by
+// ID, together with the number of all matching roles.
+func (r *Role) FindRolesWhere(db *gorm.DB, where string, args []interface{}, offset int, limit int) (*[]Role, int, error) {
+	roles := []Role{}
+	total := 0
+	query := db.Debug().Model(&Role{})
+	if where != "" {
+		query = query.Where(where, args...)
+	}
+	err := query.Count(&total).Error
+	if err != nil {
+		return &[]Role{}, 0, err
+	}
+	if limit == 0 {
+		return &roles, total, nil
+	}
+	err = query.Order("id").Offset(offset).Limit(limit).Find(&roles).Error
+	if err != nil {
+		return &[]Role{}, 0, err
+	}
+	return &roles, total, nil
+}
+
+// FindRolesByNames returns the roles with the names, skipping unknown names.
+func (r *Role) FindRolesByNames(db *gorm.DB, names []string) ([]*Role, error) {
+	roles := []*Role{}
+	if len(names) == 0 {
+		return roles, nil
+	}
+	err := db.Debug().Model(&Role{}).Where("name in (?)", names).Find(&roles).Error
+	if err != nil {
+		return []*Role{}, err
+	}
+	return roles, nil
+}
+
+// FindRolesWithAncestors returns the roles and the roles they inherit from,
+// with their permissions, by ID.
+func (r *Role) FindRolesWithAncestors(db *gorm.DB, rids []uint32) (map[uint32]*Role, error) {
+	roles := map[uint32]*Role{}
+	queued := map[uint32]bool{}
+	pending := []uint32{}
+	for _, rid := range rids {
+		if !queued[rid] {
+			queued[rid] = true
+			pending = append(pending, rid)
+		}
+	}
+	for len(pending) > 0 {
+		level := []*Role{}
+		err := db.Debug().Model(&Role{}).Where("id in (?)", pending).Preload("Permissions").Find(&level).Error
+		if err != nil {
+			return map[uint32]*Role{}, err
+		}
+		pending = []uint32{}
+		for _, role := range level {
+			roles[role.ID] = role
+			if role.ParentID != nil && !queued[*role.ParentID] {
+				queued[*role.ParentID] = true
+				pending = append(pending, *role.ParentID)
+			}
+		}
+	}
+	return roles, nil
+}
+
+// EffectivePermissions returns the permissions of the roles together with
+// those they inherit, each with the roles it comes from, ordered by name.
+func EffectivePermissions(db *gorm.DB, rids []uint32) ([]Effective_Permission, error) {
+	role := Role{}
+	roles, err := role.FindRolesWithAncestors(db, rids)
+	if err != nil {
+		return []Effective_Permission{}, err
+	}
+	byID := map[uint32]*Effective_Permission{}
+	for _, rid := range rids {
+		visited := map[uint32]bool{}
+		depth := 0
+		for role := roles[rid]; role != nil && !visited[role.ID]; depth++ {
+			visited[role.ID] = true
+			for _, permission := range role.Permissions {
+				effective := byID[permission.ID]
+				if effective == nil {
+					effective = &Effective_Permission{ID: permission.ID, Name: permission.Name, Sources: []Permission_Source{}}
+					byID[permission.ID] = effective
+				}
+				effective.addSource(Permission_Source{RoleID: role.ID, RoleName: role.Name, Depth: depth})
+			}
+			if role.ParentID == nil {
+				break
+			}
+			role = roles[*role.ParentID]
+		}
+	}
+	permissions := []Effective_Permission{}
+	for _, effective := range byID {
+		permissions = append(permissions, *effective)
+	}
+	sort.Slice(permissions, func(i, j int) bool {
+		return permissions[i].Name < permissions[j].Name
+	})
+	return permissions, nil
+}
+
+// addSource records the role, keeping the nearest depth when several of the
+// roles inherit from it.
+func (ep *Effective_Permission) addSource(source Permission_Source) {
+	for i := range ep.Sources {
+		if ep.Sources[i].RoleID == source.RoleID {
+			if source.Depth < ep.Sources[i].Depth {
+				ep.Sources[i].Depth = source.Depth
+			}
+			return
+		}
+	}
+	ep.Sources = append(ep.Sources, source)
+}
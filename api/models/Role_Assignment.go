@@ -0,0 +1,183 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// ResourceWildcard as the resource ID scopes an assignment to all resources
+// of the type.
+const ResourceWildcard = "*"
+
+// Role_Assignment gives a user a role on one resource, or on all resources
+// of a type, e.g. the role "Editor" on portfolio 42. Roles given through
+// /roles/{id}/users and groups are not scoped and apply everywhere.
+type Role_Assignment struct {
+	ID           uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	UserID       uuid.UUID `gorm:"type:uuid;not null;unique_index:idx_role_assignment_scope" json:"user_id"`
+	RoleID       uint32    `gorm:"not null;unique_index:idx_role_assignment_scope" json:"role_id"`
+	ResourceType string    `gorm:"size:100;not null;unique_index:idx_role_assignment_scope" json:"resource_type"`
+	ResourceID   string    `gorm:"size:255;not null;unique_index:idx_role_assignment_scope" json:"resource_id"`
+	CreatedAt    time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy    uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+}
+
+type Role_Assignment_Payload struct {
+	UserID       uuid.UUID `json:"user_id"`
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id"`
+}
+
+// Permission_Check asks whether a user has a permission on a resource.
+// Without a resource only unscoped roles count.
+type Permission_Check struct {
+	UserID       *uuid.UUID `json:"user_id,omitempty"`
+	Permission   string     `json:"permission"`
+	ResourceType string     `json:"resource_type"`
+	ResourceID   string     `json:"resource_id"`
+}
+
+type Permission_Check_Result struct {
+	Allowed      bool      `json:"allowed"`
+	UserID       uuid.UUID `json:"user_id"`
+	Permission   string    `json:"permission"`
+	ResourceType string    `json:"resource_type,omitempty"`
+	ResourceID   string    `json:"resource_id,omitempty"`
+}
+
+var resourceTypeName = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+
+// ValidateResource checks a resource type and ID. An empty type means no
+// resource, and then the ID has to be empty too.
+func ValidateResource(resourceType string, resourceID string) error {
+	if resourceType == "" {
+		if resourceID != "" {
+			return errors.New("Required ResourceType")
+		}
+		return nil
+	}
+	if len(resourceType) > 100 || !resourceTypeName.MatchString(resourceType) {
+		return errors.New("Invalid ResourceType")
+	}
+	if resourceID == "" {
+		return errors.New("Required ResourceID")
+	}
+	if len(resourceID) > 255 {
+		return errors.New("Invalid ResourceID")
+	}
+	return nil
+}
+
+func (ra *Role_Assignment) Apply(payload Role_Assignment_Payload) {
+	ra.UserID = payload.UserID
+	ra.ResourceType = strings.ToLower(strings.TrimSpace(payload.ResourceType))
+	ra.ResourceID = strings.TrimSpace(payload.ResourceID)
+}
+
+func (ra *Role_Assignment) Prepare(rid uint32, tuid uuid.UUID) {
+	ra.ID = uuid.New()
+	ra.RoleID = rid
+	ra.CreatedAt = time.Now()
+	ra.CreatedBy = tuid
+}
+
+func (ra *Role_Assignment) Validate() error {
+	if ra.UserID == uuid.Nil {
+		return errors.New("Required UserID")
+	}
+	if ra.RoleID == 0 {
+		return errors.New("Required RoleID")
+	}
+	if ra.ResourceType == "" {
+		return errors.New("Required ResourceType")
+	}
+	return ValidateResource(ra.ResourceType, ra.ResourceID)
+}
+
+func (ra *Role_Assignment) SaveRoleAssignment(db *gorm.DB) (*Role_Assignment, error) {
+	err := db.Debug().Model(&Role_Assignment{}).Create(&ra).Error
+	if err != nil {
+		return &Role_Assignment{}, err
+	}
+	return ra, nil
+}
+
+func (ra *Role_Assignment) FindRoleAssignmentsByRoleID(db *gorm.DB, rid uint32) (*[]Role_Assignment, error) {
+	assignments := []Role_Assignment{}
+	err := db.Debug().Model(&Role_Assignment{}).Where("role_id = ?", rid).Order("resource_type, resource_id, created_at").Find(&assignments).Error
+	if err != nil {
+		return &[]Role_Assignment{}, err
+	}
+	return &assignments, nil
+}
+
+func (ra *Role_Assignment) FindRoleAssignmentsByUserID(db *gorm.DB, uid uuid.UUID) ([]*Role_Assignment, error) {
+	assignments := []*Role_Assignment{}
+	err := db.Debug().Model(&Role_Assignment{}).Where("user_id = ?", uid).Order("resource_type, resource_id, role_id").Find(&assignments).Error
+	if err != nil {
+		return []*Role_Assignment{}, err
+	}
+	return assignments, nil
+}
+
+func (ra *Role_Assignment) FindRoleAssignmentByID(db *gorm.DB, aid uuid.UUID) (*Role_Assignment, error) {
+	err := db.Debug().Model(&Role_Assignment{}).Where("id = ?", aid).Take(&ra).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Role_Assignment{}, errors.New("Role Assignment Not Found")
+		}
+		return &Role_Assignment{}, err
+	}
+	return ra, nil
+}
+
+func (ra *Role_Assignment) DeleteARoleAssignment(db *gorm.DB, rid uint32, aid uuid.UUID) (int64, error) {
+	result := db.Debug().Where("id = ? AND role_id = ?", aid, rid).Delete(&Role_Assignment{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("Role Assignment Not Found")
+	}
+	return result.RowsAffected, nil
+}
+
+// ScopedRoleIDs returns the IDs of the roles the user has on the resource,
+// through assignments to it or to all resources of its type.
+func ScopedRoleIDs(db *gorm.DB, uid uuid.UUID, resourceType string, resourceID string) ([]uint32, error) {
+	rids := []uint32{}
+	err := db.Debug().Model(&Role_Assignment{}).Where("user_id = ? AND resource_type = ? AND resource_id in (?)", uid, resourceType, []string{resourceID, ResourceWildcard}).
+		Pluck("DISTINCT role_id", &rids).Error
+	if err != nil {
+		return []uint32{}, err
+	}
+	return rids, nil
+}
+
+// UserPermissionsOn returns the names of the permissions the user has on the
+// resource: those of its unscoped roles, see UserRoleIDs, and of the roles
+// assigned to it on the resource, with those the roles inherit. Without a
+// resource type only the unscoped roles count.
+func UserPermissionsOn(db *gorm.DB, user *User, resourceType string, resourceID string) ([]string, error) {
+	rids, err := UserRoleIDs(db, user)
+	if err != nil {
+		return []string{}, err
+	}
+	if resourceType != "" {
+		scoped, err := ScopedRoleIDs(db, user.ID, resourceType, resourceID)
+		if err != nil {
+			return []string{}, err
+		}
+		rids = append(rids, scoped...)
+	}
+	permissions, err := EffectivePermissions(db, rids)
+	if err != nil {
+		return []string{}, err
+	}
+	return PermissionNames(permissions), nil
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Role_Mapping_Rule gives users logging in through an OAuth or OpenID
+// Connect provider a role when one of their claims has the value. Rules
+// without a provider apply to all providers. A value of * matches any value
+// of the claim.
+//
+// Besides the claims of the provider, these are derived from the login:
+// email_domain (only for emails the provider verified), google_domain (the
+// Google Workspace domain), github_org and github_team (as org/team).
+type Role_Mapping_Rule struct {
+	ID          uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	Provider    string    `gorm:"size:100;index" json:"provider"`
+	Claim       string    `gorm:"size:255;not null" json:"claim"`
+	Value       string    `gorm:"size:1024;not null" json:"value"`
+	RoleID      uint32    `gorm:"not null;index" json:"role_id"`
+	Description string    `gorm:"size:255" json:"description"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy   uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	UpdatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+	UpdatedBy   uuid.UUID `gorm:"type:uuid;not null" json:"updated_by"`
+}
+
+type Role_Mapping_Rule_Payload struct {
+	Provider    string `json:"provider"`
+	Claim       string `json:"claim"`
+	Value       string `json:"value"`
+	RoleID      uint32 `json:"role_id"`
+	Description string `json:"description"`
+	Enabled     *bool  `json:"enabled,omitempty"`
+}
+
+// Role_Mapping_Dry_Run is a login to try the rules on.
+type Role_Mapping_Dry_Run struct {
+	Provider string              `json:"provider"`
+	Claims   map[string][]string `json:"claims"`
+}
+
+// Role_Mapping_Result tells which rules matched the claims, the roles they
+// give and the roles they would take away from a user a rule granted them.
+type Role_Mapping_Result struct {
+	Rules   []Role_Mapping_Rule `json:"rules"`
+	Roles   []*Role             `json:"roles"`
+	Removed []*Role             `json:"removed"`
+}
+
+const (
+	ClaimEmailDomain  = "email_domain"
+	ClaimGoogleDomain = "google_domain"
+	ClaimGitHubOrg    = "github_org"
+	ClaimGitHubTeam   = "github_team"
+)
+
+var mappingProviderName = regexp.MustCompile(`^[a-z0-9][a-z0-9_:-]*$`)
+
+func (rm *Role_Mapping_Rule) Apply(payload Role_Mapping_Rule_Payload) {
+	rm.Provider = strings.ToLower(strings.TrimSpace(payload.Provider))
+	rm.Claim = strings.TrimSpace(payload.Claim)
+	rm.Value = strings.TrimSpace(payload.Value)
+	rm.RoleID = payload.RoleID
+	rm.Description = strings.TrimSpace(payload.Description)
+	if payload.Enabled != nil {
+		rm.Enabled = *payload.Enabled
+	}
+}
+
+func (rm *Role_Mapping_Rule) Prepare(tuid uuid.UUID) {
+	rm.ID = uuid.New()
+	rm.CreatedAt = time.Now()
+	rm.CreatedBy = tuid
+	rm.UpdatedAt = time.Now()
+	rm.UpdatedBy = tuid
+}
+
+func (rm *Role_Mapping_Rule) Validate() error {
+	if rm.Provider != "" && !mappingProviderName.MatchString(rm.Provider) {
+		return errors.New("Invalid Provider")
+	}
+	if rm.Claim == "" {
+		return errors.New("Required Claim")
+	}
+	if rm.Value == "" {
+		return errors.New("Required Value")
+	}
+	if rm.RoleID == 0 {
+		return errors.New("Required RoleID")
+	}
+	return nil
+}
+
+// Matches tells whether the claims satisfy the rule. Values are compared
+// case-insensitively.
+func (rm *Role_Mapping_Rule) Matches(claims map[string][]string) bool {
+	for _, value := range claims[rm.Claim] {
+		if rm.Value == "*" || strings.EqualFold(value, rm.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesClaim tells whether any of the rules looks at the claim, so that
+// claims that are expensive to fetch are only fetched when needed.
+func UsesClaim(rules []Role_Mapping_Rule, claim string) bool {
+	for i := range rules {
+		if rules[i].Claim == claim {
+			return true
+		}
+	}
+	return false
+}
+
+func (rm *Role_Mapping_Rule) SaveRoleMappingRule(db *gorm.DB) (*Role_Mapping_Rule, error) {
+	err := db.Debug().Model(&Role_Mapping_Rule{}).Create(&rm).Error
+	if err != nil {
+		return &Role_Mapping_Rule{}, err
+	}
+	return rm, nil
+}
+
+func (rm *Role_Mapping_Rule) FindAllRoleMappingRules(db *gorm.DB) (*[]Role_Mapping_Rule, error) {
+	rules := []Role_Mapping_Rule{}
+	err := db.Debug().Model(&Role_Mapping_Rule{}).Order("provider, claim, value").Find(&rules).Error
+	if err != nil {
+		return &[]Role_Mapping_Rule{}, err
+	}
+	return &rules, nil
+}
+
+// FindRoleMappingRulesForProvider returns the enabled rules of the provider
+// and those of all providers.
+func (rm *Role_Mapping_Rule) FindRoleMappingRulesForProvider(db *gorm.DB, provider string) ([]Role_Mapping_Rule, error) {
+	rules := []Role_Mapping_Rule{}
+	err := db.Debug().Model(&Role_Mapping_Rule{}).Where("enabled = ? AND (provider = ? OR provider = ?)", true, provider, "").Order("claim, value").Find(&rules).Error
+	if err != nil {
+		return []Role_Mapping_Rule{}, err
+	}
+	return rules, nil
+}
+
+func (rm *Role_Mapping_Rule) FindRoleMappingRuleByID(db *gorm.DB, rid uuid.UUID) (*Role_Mapping_Rule, error) {
+	err := db.Debug().Model(&Role_Mapping_Rule{}).Where("id = ?", rid).Take(&rm).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Role_Mapping_Rule{}, errors.New("Role Mapping Rule Not Found")
+		}
+		return &Role_Mapping_Rule{}, err
+	}
+	return rm, nil
+}
+
+func (rm *Role_Mapping_Rule) UpdateARoleMappingRule(db *gorm.DB, tuid uuid.UUID) (*Role_Mapping_Rule, error) {
+	rm.UpdatedAt = time.Now()
+	rm.UpdatedBy = tuid
+	err := db.Debug().Model(&Role_Mapping_Rule{}).Where("id = ?", rm.ID).UpdateColumns(
+		map[string]interface{}{
+			"provider":    rm.Provider,
+			"claim":       rm.Claim,
+			"value":       rm.Value,
+			"role_id":     rm.RoleID,
+			"description": rm.Description,
+			"enabled":     rm.Enabled,
+			"updated_at":  rm.UpdatedAt,
+			"updated_by":  rm.UpdatedBy,
+		},
+	).Error
+	if err != nil {
+		return &Role_Mapping_Rule{}, err
+	}
+	return rm, nil
+}
+
+func (rm *Role_Mapping_Rule) DeleteARoleMappingRule(db *gorm.DB, rid uuid.UUID) (int64, error) {
+	result := db.Debug().Where("id = ?", rid).Delete(&Role_Mapping_Rule{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("Role Mapping Rule Not Found")
+	}
+	return result.RowsAffected, nil
+}
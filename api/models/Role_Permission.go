@@ -16,8 +16,6 @@ type Role_Permission_Payload struct {
 }
 
 func (rp *Role_Permission) Prepare() {
-	rp.PermissionID = rp.PermissionID
-	rp.RoleID = rp.RoleID
 }
 
 func (rp *Role_Permission) Validate() error {
@@ -50,4 +48,15 @@ func (rp *Role_Permission) DeleteRoleFromPermission(db *gorm.DB, rid uint32, pid
 		return 0, db.Error
 	}
 	return db.RowsAffected, nil
-}
\ No newline at end of file
+}
+
+// FindPermissionIDsByRoleID returns the IDs of the permissions given to the
+// role directly.
+func (rp *Role_Permission) FindPermissionIDsByRoleID(db *gorm.DB, rid uint32) ([]uint32, error) {
+	pids := []uint32{}
+	err := db.Debug().Model(&Role_Permission{}).Where("role_id = ?", rid).Order("permission_id").Pluck("permission_id", &pids).Error
+	if err != nil {
+		return []uint32{}, err
+	}
+	return pids, nil
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func rolePointer(id uint32) *uint32 {
+	return &id
+}
+
+func TestValidateParent(t *testing.T) {
+	tests := []struct {
+		name      string
+		role      Role
+		ancestors [][2]interface{}
+		err       string
+	}{
+		{"no parent", Role{ID: 1}, nil, ""},
+		{"self parent", Role{ID: 1, ParentID: rolePointer(1)}, nil, ErrRoleCycle.Error()},
+		// 1 -> 2 -> 3 -> 1
+		{"indirect cycle", Role{ID: 1, ParentID: rolePointer(2)}, [][2]interface{}{{2, 3}, {3, 1}}, ErrRoleCycle.Error()},
+		// 4 -> 2 -> 3 -> 2, the loop above the role is caught as well.
+		{"cycle above the role", Role{ID: 4, ParentID: rolePointer(2)}, [][2]interface{}{{2, 3}, {3, 2}}, ErrRoleCycle.Error()},
+		{"chain", Role{ID: 1, ParentID: rolePointer(2)}, [][2]interface{}{{2, 3}, {3, nil}}, ""},
+		{"new role", Role{ParentID: rolePointer(2)}, [][2]interface{}{{2, nil}}, ""},
+		{"missing parent", Role{ID: 1, ParentID: rolePointer(2)}, [][2]interface{}{{2, 3}, {3, "missing"}}, "Parent role not found"},
+	}
+	for _, tt := range tests {
+		db, mock := newMockDB(t)
+		for _, ancestor := range tt.ancestors {
+			rows := sqlmock.NewRows([]string{"id", "name", "parent_id"})
+			if ancestor[1] != "missing" {
+				rows.AddRow(ancestor[0], "Role", ancestor[1])
+			}
+			mock.ExpectQuery(`SELECT \* FROM "roles" WHERE \(id = \$1\) LIMIT 1`).
+				WithArgs(int64(ancestor[0].(int))).
+				WillReturnRows(rows)
+		}
+		err := tt.role.ValidateParent(db)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("%s: ValidateParent = %v, want %q", tt.name, err, tt.err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// expectRoleLevel expects the lookup of a level of roles, given as id, name
+// and parent, with their permissions, given as role id, permission id and
+// name.
+func expectRoleLevel(mock sqlmock.Sqlmock, roles [][]driver.Value, permissions [][]driver.Value) {
+	roleRows := sqlmock.NewRows([]string{"id", "name", "parent_id"})
+	for _, role := range roles {
+		roleRows.AddRow(role...)
+	}
+	mock.ExpectQuery(`SELECT \* FROM "roles" WHERE \(id in \(.*\)\)`).
+		WillReturnRows(roleRows)
+	permissionRows := sqlmock.NewRows([]string{"id", "name", "role_id", "permission_id"})
+	for _, permission := range permissions {
+		permissionRows.AddRow(permission[1], permission[2], permission[0], permission[1])
+	}
+	mock.ExpectQuery(`SELECT \* FROM "permissions" INNER JOIN "role_permissions"`).
+		WillReturnRows(permissionRows)
+}
+
+func TestEffectivePermissionsInherited(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// Admin (1) inherits from Editor (2), which inherits from Viewer (3).
+	// Both Admin and Viewer grant read. Editor is asked for too, so Viewer
+	// is one level above the nearest role asked for.
+	expectRoleLevel(mock,
+		[][]driver.Value{{1, "Admin", 2}, {2, "Editor", 3}},
+		[][]driver.Value{{1, 3, "portfolio:delete"}, {1, 1, "portfolio:read"}, {2, 2, "portfolio:write"}})
+	expectRoleLevel(mock,
+		[][]driver.Value{{3, "Viewer", nil}},
+		[][]driver.Value{{3, 1, "portfolio:read"}})
+
+	permissions, err := EffectivePermissions(db, []uint32{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Effective_Permission{
+		{ID: 3, Name: "portfolio:delete", Sources: []Permission_Source{{1, "Admin", 0}}},
+		{ID: 1, Name: "portfolio:read", Sources: []Permission_Source{{1, "Admin", 0}, {3, "Viewer", 1}}},
+		{ID: 2, Name: "portfolio:write", Sources: []Permission_Source{{2, "Editor", 0}}},
+	}
+	if !reflect.DeepEqual(permissions, want) {
+		t.Errorf("EffectivePermissions = %+v, want %+v", permissions, want)
+	}
+}
+
+func TestEffectivePermissionsDeepChain(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// Each level is looked up once, the depth counts the levels up to the
+	// role granting the permission.
+	expectRoleLevel(mock, [][]driver.Value{{1, "Level 1", 2}}, nil)
+	expectRoleLevel(mock, [][]driver.Value{{2, "Level 2", 3}}, nil)
+	expectRoleLevel(mock, [][]driver.Value{{3, "Level 3", 4}}, [][]driver.Value{{3, 1, "portfolio:read"}})
+	expectRoleLevel(mock, [][]driver.Value{{4, "Level 4", nil}}, [][]driver.Value{{4, 2, "portfolio:write"}})
+
+	permissions, err := EffectivePermissions(db, []uint32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Effective_Permission{
+		{ID: 1, Name: "portfolio:read", Sources: []Permission_Source{{3, "Level 3", 2}}},
+		{ID: 2, Name: "portfolio:write", Sources: []Permission_Source{{4, "Level 4", 3}}},
+	}
+	if !reflect.DeepEqual(permissions, want) {
+		t.Errorf("EffectivePermissions = %+v, want %+v", permissions, want)
+	}
+}
+
+func TestEffectivePermissionsStoredCycle(t *testing.T) {
+	db, mock := newMockDB(t)
+
+	// A cycle that made it into the table ends the walk instead of looping.
+	expectRoleLevel(mock, [][]driver.Value{{1, "Admin", 2}}, [][]driver.Value{{1, 1, "portfolio:read"}})
+	expectRoleLevel(mock, [][]driver.Value{{2, "Editor", 1}}, [][]driver.Value{{2, 2, "portfolio:write"}})
+
+	permissions, err := EffectivePermissions(db, []uint32{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Effective_Permission{
+		{ID: 1, Name: "portfolio:read", Sources: []Permission_Source{{1, "Admin", 0}}},
+		{ID: 2, Name: "portfolio:write", Sources: []Permission_Source{{2, "Editor", 1}}},
+	}
+	if !reflect.DeepEqual(permissions, want) {
+		t.Errorf("EffectivePermissions = %+v, want %+v", permissions, want)
+	}
+}
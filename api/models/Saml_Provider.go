@@ -0,0 +1,220 @@
+package models
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/sso"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Saml_Provider is a SAML 2.0 identity provider users can log in with. Its
+// name appears in the URLs of the service provider, /saml/{name}/...
+type Saml_Provider struct {
+	ID                 uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	Name               string    `gorm:"size:100;not null;unique" json:"name"`
+	EntityID           string    `gorm:"size:1024;not null" json:"entity_id"`
+	SSOURL             string    `gorm:"column:sso_url;size:2048;not null" json:"sso_url"`
+	Binding            string    `gorm:"size:20;not null" json:"binding"`
+	Certificate        string    `gorm:"type:text;not null" json:"certificate"`
+	NameIDFormat       string    `gorm:"column:name_id_format;size:255" json:"name_id_format"`
+	EmailAttribute     string    `gorm:"size:255" json:"email_attribute"`
+	UserNameAttribute  string    `gorm:"size:255" json:"user_name_attribute"`
+	FirstNameAttribute string    `gorm:"size:255" json:"first_name_attribute"`
+	LastNameAttribute  string    `gorm:"size:255" json:"last_name_attribute"`
+	CreateUsers        bool      `json:"create_users"`
+	Enabled            bool      `json:"enabled"`
+	CreatedAt          time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy          uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	UpdatedAt          time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+	UpdatedBy          uuid.UUID `gorm:"type:uuid;not null" json:"updated_by"`
+}
+
+type Saml_Provider_Payload struct {
+	Name               string `json:"name"`
+	EntityID           string `json:"entity_id"`
+	SSOURL             string `json:"sso_url"`
+	Binding            string `json:"binding"`
+	Certificate        string `json:"certificate"`
+	NameIDFormat       string `json:"name_id_format"`
+	EmailAttribute     string `json:"email_attribute"`
+	UserNameAttribute  string `json:"user_name_attribute"`
+	FirstNameAttribute string `json:"first_name_attribute"`
+	LastNameAttribute  string `json:"last_name_attribute"`
+	CreateUsers        *bool  `json:"create_users,omitempty"`
+	Enabled            *bool  `json:"enabled,omitempty"`
+}
+
+// Saml_Provider_Response adds the URLs of the service provider, which are
+// configured at the identity provider.
+type Saml_Provider_Response struct {
+	Saml_Provider
+	MetadataURL string `json:"metadata_url"`
+	ACSURL      string `json:"acs_url"`
+	LoginURL    string `json:"login_url"`
+}
+
+var samlProviderName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Apply copies the payload onto the provider. The attribute names default
+// to the claims of Azure AD and ADFS, an empty email attribute takes the
+// email from the NameID.
+func (sp *Saml_Provider) Apply(payload Saml_Provider_Payload) {
+	sp.Name = strings.ToLower(strings.TrimSpace(payload.Name))
+	sp.EntityID = strings.TrimSpace(payload.EntityID)
+	sp.SSOURL = strings.TrimSpace(payload.SSOURL)
+	sp.Binding = strings.ToLower(strings.TrimSpace(payload.Binding))
+	if sp.Binding == "" {
+		sp.Binding = sso.BindingRedirect
+	}
+	sp.Certificate = strings.TrimSpace(payload.Certificate)
+	sp.NameIDFormat = strings.TrimSpace(payload.NameIDFormat)
+	sp.EmailAttribute = strings.TrimSpace(payload.EmailAttribute)
+	sp.UserNameAttribute = strings.TrimSpace(payload.UserNameAttribute)
+	sp.FirstNameAttribute = strings.TrimSpace(payload.FirstNameAttribute)
+	if sp.FirstNameAttribute == "" {
+		sp.FirstNameAttribute = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname"
+	}
+	sp.LastNameAttribute = strings.TrimSpace(payload.LastNameAttribute)
+	if sp.LastNameAttribute == "" {
+		sp.LastNameAttribute = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname"
+	}
+	if payload.CreateUsers != nil {
+		sp.CreateUsers = *payload.CreateUsers
+	}
+	if payload.Enabled != nil {
+		sp.Enabled = *payload.Enabled
+	}
+}
+
+func (sp *Saml_Provider) Prepare(tuid uuid.UUID) {
+	sp.ID = uuid.New()
+	sp.CreatedAt = time.Now()
+	sp.CreatedBy = tuid
+	sp.UpdatedAt = time.Now()
+	sp.UpdatedBy = tuid
+}
+
+func (sp *Saml_Provider) Validate() error {
+	if !samlProviderName.MatchString(sp.Name) {
+		return errors.New("Name must be lower case letters, digits, - and _")
+	}
+	if sp.EntityID == "" {
+		return errors.New("Required EntityID")
+	}
+	u, err := url.Parse(sp.SSOURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("Invalid SSO URL")
+	}
+	if sp.Binding != sso.BindingRedirect && sp.Binding != sso.BindingPost {
+		return errors.New("Binding must be redirect or post")
+	}
+	if _, err := sso.ParseCertificates(sp.Certificate); err != nil {
+		return errors.New("Invalid Certificate: " + err.Error())
+	}
+	return nil
+}
+
+// SAMLProvider returns the identity provider settings of the trust.
+func (sp *Saml_Provider) SAMLProvider() sso.SAMLProvider {
+	return sso.SAMLProvider{
+		EntityID:     sp.EntityID,
+		SSOURL:       sp.SSOURL,
+		Binding:      sp.Binding,
+		Certificate:  sp.Certificate,
+		NameIDFormat: sp.NameIDFormat,
+	}
+}
+
+func (sp *Saml_Provider) SaveSamlProvider(db *gorm.DB) (*Saml_Provider, error) {
+	err := db.Debug().Model(&Saml_Provider{}).Create(&sp).Error
+	if err != nil {
+		return &Saml_Provider{}, err
+	}
+	return sp, nil
+}
+
+func (sp *Saml_Provider) FindAllSamlProviders(db *gorm.DB) (*[]Saml_Provider, error) {
+	providers := []Saml_Provider{}
+	err := db.Debug().Model(&Saml_Provider{}).Order("name").Find(&providers).Error
+	if err != nil {
+		return &[]Saml_Provider{}, err
+	}
+	return &providers, nil
+}
+
+func (sp *Saml_Provider) FindSamlProviderByID(db *gorm.DB, pid uuid.UUID) (*Saml_Provider, error) {
+	err := db.Debug().Model(&Saml_Provider{}).Where("id = ?", pid).Take(&sp).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Saml_Provider{}, errors.New("SAML Provider Not Found")
+		}
+		return &Saml_Provider{}, err
+	}
+	return sp, nil
+}
+
+// FindSamlProviderByName returns the enabled provider called name.
+func (sp *Saml_Provider) FindSamlProviderByName(db *gorm.DB, name string) (*Saml_Provider, error) {
+	err := db.Debug().Model(&Saml_Provider{}).Where("name = ? AND enabled = ?", name, true).Take(&sp).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Saml_Provider{}, errors.New("SAML Provider Not Found")
+		}
+		return &Saml_Provider{}, err
+	}
+	return sp, nil
+}
+
+func (sp *Saml_Provider) UpdateASamlProvider(db *gorm.DB, tuid uuid.UUID) (*Saml_Provider, error) {
+	sp.UpdatedAt = time.Now()
+	sp.UpdatedBy = tuid
+	err := db.Debug().Model(&Saml_Provider{}).Where("id = ?", sp.ID).UpdateColumns(
+		map[string]interface{}{
+			"name":                 sp.Name,
+			"entity_id":            sp.EntityID,
+			"sso_url":              sp.SSOURL,
+			"binding":              sp.Binding,
+			"certificate":          sp.Certificate,
+			"name_id_format":       sp.NameIDFormat,
+			"email_attribute":      sp.EmailAttribute,
+			"user_name_attribute":  sp.UserNameAttribute,
+			"first_name_attribute": sp.FirstNameAttribute,
+			"last_name_attribute":  sp.LastNameAttribute,
+			"create_users":         sp.CreateUsers,
+			"enabled":              sp.Enabled,
+			"updated_at":           sp.UpdatedAt,
+			"updated_by":           sp.UpdatedBy,
+		},
+	).Error
+	if err != nil {
+		return &Saml_Provider{}, err
+	}
+	return sp, nil
+}
+
+// DeleteASamlProvider removes the provider together with its pending
+// requests.
+func (sp *Saml_Provider) DeleteASamlProvider(db *gorm.DB, pid uuid.UUID) (int64, error) {
+	var rows int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Debug().Where("provider_id = ?", pid).Delete(&Saml_Request{}).Error
+		if err != nil {
+			return err
+		}
+		result := tx.Debug().Where("id = ?", pid).Delete(&Saml_Provider{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("SAML Provider Not Found")
+		}
+		rows = result.RowsAffected
+		return nil
+	})
+	return rows, err
+}
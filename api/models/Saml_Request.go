@@ -0,0 +1,79 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Saml_Request is an AuthnRequest waiting for its response. The assertion
+// has to answer it, which keeps responses from being replayed or injected
+// into another login. The login is handed to the frontend at RedirectURI
+// through an Oauth_Code.
+type Saml_Request struct {
+	ID          string    `gorm:"primary_key;size:255" json:"id"`
+	ProviderID  uuid.UUID `gorm:"type:uuid;not null" json:"provider_id"`
+	DeviceID    string    `gorm:"size:255;not null" json:"device_id"`
+	RedirectURI string    `gorm:"size:2048" json:"redirect_uri"`
+	ExpiresAt   time.Time `gorm:"not null" json:"expires_at"`
+	CreatedAt   time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+}
+
+// SamlRequestExpiry is how long the user has to log in at the identity
+// provider, configured through SAML_REQUEST_EXPIRY_IN_MINUTES and defaulting
+// to ten minutes.
+func SamlRequestExpiry() time.Duration {
+	minutes := envInt("SAML_REQUEST_EXPIRY_IN_MINUTES", 10)
+	if minutes <= 0 {
+		minutes = 10
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (sr *Saml_Request) Prepare(id string, pid uuid.UUID, redirectURI string, deviceID string) {
+	sr.ID = id
+	sr.ProviderID = pid
+	sr.RedirectURI = redirectURI
+	sr.DeviceID = deviceID
+	sr.ExpiresAt = time.Now().Add(SamlRequestExpiry())
+	sr.CreatedAt = time.Now()
+}
+
+// SaveSamlRequest stores the request and drops the expired ones.
+func (sr *Saml_Request) SaveSamlRequest(db *gorm.DB) error {
+	err := db.Debug().Where("expires_at < ?", time.Now()).Delete(&Saml_Request{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Debug().Create(&sr).Error
+}
+
+// ConsumeSamlRequest takes the request of the provider out of the store. A
+// request can only be answered once and before it expires.
+func (sr *Saml_Request) ConsumeSamlRequest(db *gorm.DB, id string, pid uuid.UUID) (*Saml_Request, error) {
+	err := db.Debug().Model(&Saml_Request{}).Where("id = ? AND provider_id = ?", id, pid).Take(&sr).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Saml_Request{}, errors.New("Unknown or expired SAML request")
+		}
+		return &Saml_Request{}, err
+	}
+	db = db.Debug().Where("id = ?", id).Delete(&Saml_Request{})
+	if db.Error != nil {
+		return &Saml_Request{}, db.Error
+	}
+	// Requests stored before logins were handed off through a code have no
+	// redirect_uri to answer.
+	if db.RowsAffected == 0 || time.Now().After(sr.ExpiresAt) || sr.RedirectURI == "" {
+		return &Saml_Request{}, errors.New("Unknown or expired SAML request")
+	}
+	return sr, nil
+}
+
+// OauthRequest is the login handed to the frontend, for the Oauth_Code
+// exchanged at /auth/token.
+func (sr *Saml_Request) OauthRequest(provider string) *Oauth_Request {
+	return &Oauth_Request{Provider: provider, RedirectURI: sr.RedirectURI, DeviceID: sr.DeviceID}
+}
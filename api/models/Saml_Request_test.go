@@ -0,0 +1,109 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+var samlRequestColumns = []string{"id", "provider_id", "device_id", "redirect_uri", "expires_at"}
+
+const testRedirectURI = "https://app.example.com/login"
+
+func TestConsumeSamlRequestOnlyOnce(t *testing.T) {
+	db, mock := newMockDB(t)
+	pid := uuid.New()
+	expiresAt := time.Now().Add(time.Minute)
+
+	mock.ExpectQuery(`SELECT \* FROM "saml_requests" WHERE \(id = \$1 AND provider_id = \$2\)`).
+		WithArgs("id-1", pid).
+		WillReturnRows(sqlmock.NewRows(samlRequestColumns).AddRow("id-1", pid, "device", testRedirectURI, expiresAt))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "saml_requests" WHERE \(id = \$1\)`).
+		WithArgs("id-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// The replayed response finds nothing to answer.
+	mock.ExpectQuery(`SELECT \* FROM "saml_requests" WHERE \(id = \$1 AND provider_id = \$2\)`).
+		WithArgs("id-1", pid).
+		WillReturnRows(sqlmock.NewRows(samlRequestColumns))
+
+	request := Saml_Request{}
+	pending, err := request.ConsumeSamlRequest(db, "id-1", pid)
+	if err != nil || pending.ID != "id-1" || pending.DeviceID != "device" || pending.RedirectURI != testRedirectURI {
+		t.Fatalf("ConsumeSamlRequest = %+v, %v", pending, err)
+	}
+	replayed := Saml_Request{}
+	if _, err := replayed.ConsumeSamlRequest(db, "id-1", pid); err == nil || err.Error() != "Unknown or expired SAML request" {
+		t.Errorf("Replayed ConsumeSamlRequest = %v", err)
+	}
+}
+
+func TestConsumeSamlRequestRace(t *testing.T) {
+	db, mock := newMockDB(t)
+	pid := uuid.New()
+
+	// Another response consumed the request between the read and the delete.
+	mock.ExpectQuery(`SELECT \* FROM "saml_requests"`).
+		WillReturnRows(sqlmock.NewRows(samlRequestColumns).AddRow("id-1", pid, "device", testRedirectURI, time.Now().Add(time.Minute)))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "saml_requests"`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	request := Saml_Request{}
+	if _, err := request.ConsumeSamlRequest(db, "id-1", pid); err == nil {
+		t.Error("A request was consumed twice")
+	}
+}
+
+func TestConsumeSamlRequestExpired(t *testing.T) {
+	db, mock := newMockDB(t)
+	pid := uuid.New()
+
+	mock.ExpectQuery(`SELECT \* FROM "saml_requests"`).
+		WillReturnRows(sqlmock.NewRows(samlRequestColumns).AddRow("id-1", pid, "device", testRedirectURI, time.Now().Add(-time.Second)))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "saml_requests"`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	request := Saml_Request{}
+	if _, err := request.ConsumeSamlRequest(db, "id-1", pid); err == nil {
+		t.Error("An expired request was answered")
+	}
+}
+
+func TestConsumeSamlRequestOfAnotherProvider(t *testing.T) {
+	db, mock := newMockDB(t)
+	other := uuid.New()
+
+	mock.ExpectQuery(`SELECT \* FROM "saml_requests" WHERE \(id = \$1 AND provider_id = \$2\)`).
+		WithArgs("id-1", other).
+		WillReturnRows(sqlmock.NewRows(samlRequestColumns))
+
+	request := Saml_Request{}
+	if _, err := request.ConsumeSamlRequest(db, "id-1", other); err == nil {
+		t.Error("A request was answered through another provider")
+	}
+}
+
+func TestConsumeSamlRequestWithoutRedirectURI(t *testing.T) {
+	db, mock := newMockDB(t)
+	pid := uuid.New()
+
+	// Stored before logins were handed off through a code.
+	mock.ExpectQuery(`SELECT \* FROM "saml_requests"`).
+		WillReturnRows(sqlmock.NewRows(samlRequestColumns).AddRow("id-1", pid, "device", "", time.Now().Add(time.Minute)))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "saml_requests"`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	request := Saml_Request{}
+	if _, err := request.ConsumeSamlRequest(db, "id-1", pid); err == nil {
+		t.Error("A request without a redirect_uri was answered")
+	}
+}
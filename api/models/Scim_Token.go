@@ -0,0 +1,106 @@
+package models
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Scim_Token authenticates a SCIM provisioning client, such as an HR system
+// or an identity provider, as a bearer token. Only its hash is stored.
+type Scim_Token struct {
+	ID         uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	Name       string     `gorm:"size:255;not null" json:"name"`
+	TokenHash  string     `gorm:"size:64;not null;unique" json:"-"`
+	CreatedAt  time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy  uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type Scim_Token_Payload struct {
+	Name string `json:"name"`
+}
+
+// Scim_Token_Created is only returned when a token is issued, the token is
+// not shown again.
+type Scim_Token_Created struct {
+	Scim_Token
+	Token string `json:"token"`
+}
+
+func (st *Scim_Token) Prepare(tuid uuid.UUID, tokenHash string) {
+	st.ID = uuid.New()
+	st.Name = html.EscapeString(strings.TrimSpace(st.Name))
+	st.TokenHash = tokenHash
+	st.CreatedAt = time.Now()
+	st.CreatedBy = tuid
+}
+
+func (st *Scim_Token) Validate() error {
+	if st.Name == "" {
+		return errors.New("Required Name")
+	}
+	return nil
+}
+
+func (st *Scim_Token) SaveScimToken(db *gorm.DB) (*Scim_Token, error) {
+	err := db.Debug().Create(&st).Error
+	if err != nil {
+		return &Scim_Token{}, err
+	}
+	return st, nil
+}
+
+func (st *Scim_Token) FindAllScimTokens(db *gorm.DB) (*[]Scim_Token, error) {
+	tokens := []Scim_Token{}
+	err := db.Debug().Model(&Scim_Token{}).Order("created_at desc").Find(&tokens).Error
+	if err != nil {
+		return &[]Scim_Token{}, err
+	}
+	return &tokens, nil
+}
+
+func (st *Scim_Token) FindScimTokenByID(db *gorm.DB, id uuid.UUID) (*Scim_Token, error) {
+	err := db.Debug().Model(&Scim_Token{}).Where("id = ?", id).Take(&st).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Scim_Token{}, errors.New("SCIM token not found")
+		}
+		return &Scim_Token{}, err
+	}
+	return st, nil
+}
+
+// FindActiveScimToken returns the unrevoked token with the hash and records
+// that it was used, at most once a minute.
+func (st *Scim_Token) FindActiveScimToken(db *gorm.DB, tokenHash string) (*Scim_Token, error) {
+	err := db.Debug().Model(&Scim_Token{}).Where("token_hash = ? AND revoked_at IS NULL", tokenHash).Take(&st).Error
+	if err != nil {
+		return &Scim_Token{}, err
+	}
+	now := time.Now()
+	if st.LastUsedAt == nil || now.Sub(*st.LastUsedAt) > time.Minute {
+		err = db.Debug().Model(&Scim_Token{}).Where("id = ?", st.ID).UpdateColumn("last_used_at", now).Error
+		if err != nil {
+			return &Scim_Token{}, err
+		}
+		st.LastUsedAt = &now
+	}
+	return st, nil
+}
+
+func (st *Scim_Token) RevokeScimToken(db *gorm.DB, id uuid.UUID) (*Scim_Token, error) {
+	result := db.Debug().Model(&Scim_Token{}).Where("id = ? AND revoked_at IS NULL", id).UpdateColumn("revoked_at", time.Now())
+	if result.Error != nil {
+		return &Scim_Token{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &Scim_Token{}, errors.New("SCIM token not found")
+	}
+	return st.FindScimTokenByID(db.New(), id)
+}
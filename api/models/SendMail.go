@@ -34,17 +34,6 @@ func (sm *SendMail) SendEmail(password string) error {
 		Password: password,
 	 }
 
-	m := gomail.NewMessage()
-  
-	// Set E-Mail sender
-	m.SetHeader("From", os.Getenv("SYSTEM_EMAIL"))
-  
-	// Set E-Mail receivers
-	m.SetHeader("To", sm.Email)
-  
-	// Set E-Mail subject
-	m.SetHeader("Subject", "Set/Reset User Login Password")
-
 	var err error
 	t, err := template.ParseFiles("./html/email_template.html")
 	if err != nil {
@@ -55,10 +44,66 @@ func (sm *SendMail) SendEmail(password string) error {
 	if err := t.Execute(&tpl, templateData); err != nil {
 		return err
 	}
-	result := tpl.String()
+
+	return sm.send("Set/Reset User Login Password", tpl.String())
+}
+
+// SendLinkEmail sends a single call-to-action email, such as an invitation
+// or a login link, rendered from the link email template.
+func (sm *SendMail) SendLinkEmail(subject string, heading string, message string, link string, linkText string) error {
+
+	if len(sm.Email) < 1 {
+		return errors.New("Required Email")
+	}
+	if err := checkmail.ValidateFormat(sm.Email); err != nil {
+		return errors.New("Invalid Email")
+	}
+
+	templateData := struct {
+		Heading  string
+		Message  string
+		Link     string
+		LinkText string
+	}{
+		Heading:  heading,
+		Message:  message,
+		Link:     link,
+		LinkText: linkText,
+	}
+
+	t, err := template.ParseFiles("./html/link_email_template.html")
+	if err != nil {
+		return err
+	}
+
+	var tpl bytes.Buffer
+	if err := t.Execute(&tpl, templateData); err != nil {
+		return err
+	}
+
+	return sm.send(subject, tpl.String())
+}
+
+// SendNoticeEmail sends an informational email without a call-to-action.
+func (sm *SendMail) SendNoticeEmail(subject string, heading string, message string) error {
+	return sm.SendLinkEmail(subject, heading, message, "", "")
+}
+
+func (sm *SendMail) send(subject string, body string) error {
+
+	m := gomail.NewMessage()
+  
+	// Set E-Mail sender
+	m.SetHeader("From", os.Getenv("SYSTEM_EMAIL"))
+  
+	// Set E-Mail receivers
+	m.SetHeader("To", sm.Email)
+  
+	// Set E-Mail subject
+	m.SetHeader("Subject", subject)
   
 	// Set E-Mail body. You can set plain text or html with text/html
-	m.SetBody("text/html", result)
+	m.SetBody("text/html", body)
 
 	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
     if err != nil {
@@ -10,7 +10,6 @@ import (
 	"github.com/badoux/checkmail"
 	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
@@ -19,13 +18,18 @@ type User struct {
 	FirstName  	string    	`gorm:"size:255;not null" json:"firstname"`
 	LastName  	string    	`gorm:"size:255;not null" json:"lastname"`
 	Email     	string    	`gorm:"size:100;not null;unique" json:"email"`
-	Password  	string    	`gorm:"size:100;not null;" json:"password,omitempty"`
+	Password  	string    	`gorm:"size:255;not null;" json:"password,omitempty"`
 	CreatedAt 	time.Time 	`gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
 	CreatedBy 	uuid.UUID 	`gorm:"type:uuid;not null" json:"created_by"`
 	UpdatedAt 	time.Time 	`gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
 	UpdatedBy 	uuid.UUID 	`gorm:"type:uuid;not null" json:"updated_by"`
 	Enabled	  	bool		`gorm:"default:true" json:"enabled"`
 	Provider	string		`gorm:"size:255;not null" json:"provider"`
+	FailedLoginCount	int			`gorm:"default:0" json:"-"`
+	LastFailedLoginAt	*time.Time	`json:"-"`
+	LockedUntil			*time.Time	`json:"locked_until,omitempty"`
+	PasswordResetRequired	bool	`gorm:"default:false" json:"password_reset_required"`
+	SessionsRevokedAt	*time.Time	`json:"-"`
 	Roles	  	[]*Role		`gorm:"many2many:user_roles" json:"roles,omitempty"`
 }
 
@@ -59,7 +63,12 @@ type UserResponse struct {
 	UpdatedBy 	uuid.UUID 	`gorm:"type:uuid;not null" json:"updated_by"`
 	Enabled	  	bool		`gorm:"default:true" json:"enabled"`
 	Provider	string		`gorm:"size:255;not null" json:"provider"`
+	LockedUntil	*time.Time	`json:"locked_until,omitempty"`
+	PasswordResetRequired	bool	`json:"password_reset_required"`
 	Roles	  	[]*Role		`gorm:"many2many:user_roles" json:"roles,omitempty"`
+	Groups		[]*Group	`json:"groups,omitempty"`
+	Assignments	[]*Role_Assignment	`json:"assignments,omitempty"`
+	Permissions	[]string	`json:"permissions,omitempty"`
 }
 
 type LoginResponse struct {
@@ -76,17 +85,15 @@ type Set_User_Password_Payload struct {
 type Forgot_User_Password_Payload struct {
 	Email     	string    	`gorm:"size:100;not null;unique" json:"email"`
 	Password  	string    	`gorm:"size:100;not null;" json:"password,omitempty"`
+	Token     	string    	`json:"token"`
 }
 
-func Hash(password string) ([]byte, error) {
-	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-}
-
-func VerifyPassword(hashedPassword, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-}
-
-func (u *User) BeforeSave() error {
+// HashPassword replaces the plaintext password with its hash. It has to be
+// called explicitly before a new password is stored.
+func (u *User) HashPassword() error {
+	if u.Password == "" {
+		return nil
+	}
 	hashedPassword, err := Hash(u.Password)
 	if err != nil {
 		return err
@@ -139,6 +146,10 @@ func PrepareResponse(u *User) UserResponse {
 	ur.UpdatedBy = u.UpdatedBy
 	ur.Enabled = u.Enabled
 	ur.Provider = u.Provider
+	if u.LockedUntil != nil && time.Now().Before(*u.LockedUntil) {
+		ur.LockedUntil = u.LockedUntil
+	}
+	ur.PasswordResetRequired = u.PasswordResetRequired
 	ur.Roles = u.Roles
 	return ur
 }
@@ -179,16 +190,30 @@ func (u *User) Validate(action string) error {
 		if err := checkmail.ValidateFormat(u.Email); err != nil {
 			return errors.New("Invalid Email")
 		}
+		if u.Password != "" {
+			return CurrentPasswordPolicy().Validate(nil, u.Password, u)
+		}
 		return nil
 	}
 }
 
 func (u *User) SaveUser(db *gorm.DB) (*User, error) {
 	var err error
+	err = u.HashPassword()
+	if err != nil {
+		return &User{}, err
+	}
 	err = db.Debug().Create(&u).Error
 	if err != nil {
 		return &User{}, err
 	}
+	if u.Password != "" {
+		history := Password_History{}
+		err = history.RecordPasswordHistory(db, u.ID, u.Password, CurrentPasswordPolicy().HistoryCount)
+		if err != nil {
+			return &User{}, err
+		}
+	}
 	return u, nil
 }
 
@@ -265,8 +290,27 @@ func (u *User) EnableDisableUser(db *gorm.DB, uid uuid.UUID, tuid uuid.UUID) (*U
 	return u, nil
 }
 
+// MigratePasswordColumn widens the password column of databases created when
+// it held 100 characters, too short for argon2id hashes with a longer salt or
+// key.
+func MigratePasswordColumn(db *gorm.DB) error {
+	return db.Debug().Model(&User{}).ModifyColumn("password", "varchar(255)").Error
+}
+
 func (u *User) DeleteAUser(db *gorm.DB, uid uuid.UUID) (int64, error) {
 
+	err := db.Debug().Where("user_id = ?", uid).Delete(&External_Identity{}).Error
+	if err != nil {
+		return 0, err
+	}
+	err = db.Debug().Where("user_id = ?", uid).Delete(&Group_Member{}).Error
+	if err != nil {
+		return 0, err
+	}
+	err = db.Debug().Where("user_id = ?", uid).Delete(&Role_Assignment{}).Error
+	if err != nil {
+		return 0, err
+	}
 	db = db.Debug().Model(&User{}).Where("id = ?", uid).Take(&User{}).Delete(&User{})
 
 	if db.Error != nil {
@@ -281,56 +325,224 @@ func (sup *Set_User_Password_Payload) ResetPassword(db *gorm.DB, uid uuid.UUID,
 	if len(sup.Password) < 1 {
 		return errors.New("Required Password")
 	}
+	user := User{}
+	fetchUser, err := user.FindUserByID(db, uid)
+	if err != nil {
+		return err
+	}
+	policy := CurrentPasswordPolicy()
+	err = policy.Validate(db, sup.Password, fetchUser)
+	if err != nil {
+		return err
+	}
 	hashedPassword, err := Hash(sup.Password)
 	if err != nil {
 		return err
 	}
 	password := string(hashedPassword)
 
-	db = db.Debug().Model(&User{}).Where("id = ?", uid).Take(&User{}).UpdateColumns(
+	result := db.Debug().Model(&User{}).Where("id = ?", uid).Take(&User{}).UpdateColumns(
 		map[string]interface{}{
 			"password":  password,
+			"password_reset_required": false,
 			"updated_at": time.Now(),
 			"updated_by": tuid,
 		},
 	)
 
-	if db.Error != nil {
-		return db.Error
+	if result.Error != nil {
+		return result.Error
 	}
-	return nil
+	history := Password_History{}
+	return history.RecordPasswordHistory(db, uid, password, policy.HistoryCount)
 }
 
-func (fup *Forgot_User_Password_Payload) ForgetPassword(db *gorm.DB) error {
+// ForgetPassword sets the password of the user a reset link was emailed to
+// and ends all sessions of the user. The link is used up only when the new
+// password is accepted.
+func (fup *Forgot_User_Password_Payload) ForgetPassword(db *gorm.DB, tokenHash string) error {
 
 	// To hash the password
 	if len(fup.Password) < 1 {
 		return errors.New("Required Password")
 	}
-	hashedPassword, err := Hash(fup.Password)
+	return db.Transaction(func(tx *gorm.DB) error {
+		reset := Password_Reset{}
+		consumed, err := reset.ConsumePasswordReset(tx, tokenHash)
+		if err != nil {
+			return err
+		}
+		user := User{}
+		fetchUser, err := user.FindUserByID(tx, consumed.UserID)
+		if err != nil {
+			return err
+		}
+		if fup.Email != "" && !strings.EqualFold(fup.Email, fetchUser.Email) {
+			return errors.New("Invalid or expired link")
+		}
+		policy := CurrentPasswordPolicy()
+		err = policy.Validate(tx, fup.Password, fetchUser)
+		if err != nil {
+			return err
+		}
+		hashedPassword, err := Hash(fup.Password)
+		if err != nil {
+			return err
+		}
+		password := string(hashedPassword)
+
+		err = tx.Debug().Model(&User{}).Where("id = ?", fetchUser.ID).UpdateColumns(
+			map[string]interface{}{
+				"password":  password,
+				"password_reset_required": false,
+				"updated_at": time.Now(),
+			},
+		).Error
+		if err != nil {
+			return err
+		}
+		history := Password_History{}
+		err = history.RecordPasswordHistory(tx, fetchUser.ID, password, policy.HistoryCount)
+		if err != nil {
+			return err
+		}
+		return RevokeUserSessions(tx, fetchUser.ID)
+	})
+}
+
+// SessionsRevokedSince returns when all sessions of the user were last
+// revoked, nil if they never were or the user does not exist.
+func SessionsRevokedSince(db *gorm.DB, uid uuid.UUID) (*time.Time, error) {
+	user := User{}
+	err := db.Debug().Model(&User{}).Select("sessions_revoked_at").Where("id = ?", uid).Take(&user).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return user.SessionsRevokedAt, nil
+}
+
+// RehashPassword stores a fresh hash of a password that was just verified,
+// upgrading hashes made with an outdated algorithm or parameters.
+func (u *User) RehashPassword(db *gorm.DB, password string) error {
+	hashedPassword, err := Hash(password)
 	if err != nil {
 		return err
 	}
-	password := string(hashedPassword)
+	err = db.Debug().Model(&User{}).Where("id = ?", u.ID).UpdateColumns(
+		map[string]interface{}{
+			"password": string(hashedPassword),
+		},
+	).Error
+	if err != nil {
+		return err
+	}
+	u.Password = string(hashedPassword)
+	return nil
+}
 
-	if len(fup.Email) < 1 {
-		return errors.New("Required Email")
+// CheckLoginLock returns an AccountLockedError while the account is locked
+// and a LoginThrottledError while it is backing off after failed logins.
+func (u *User) CheckLoginLock() error {
+	now := time.Now()
+	if u.LockedUntil != nil && now.Before(*u.LockedUntil) {
+		return &AccountLockedError{Until: *u.LockedUntil}
+	}
+	if u.LastFailedLoginAt == nil {
+		return nil
+	}
+	failures := activeFailures(u.FailedLoginCount, *u.LastFailedLoginAt, now)
+	if wait := u.LastFailedLoginAt.Add(LoginBackoff(failures)).Sub(now); failures > 0 && wait > 0 {
+		return &LoginThrottledError{RetryAfter: wait}
 	}
-	if err := checkmail.ValidateFormat(fup.Email); err != nil {
-		return errors.New("Invalid Email")
+	return nil
+}
+
+// RecordFailedLogin counts a failed login against the account and locks it
+// once LOGIN_LOCKOUT_THRESHOLD is reached. It reports whether this failure
+// locked the account. The counters are read under a row lock rather than
+// taken from u, so that concurrent failures are each counted once.
+func (u *User) RecordFailedLogin(db *gorm.DB) (bool, error) {
+	now := time.Now()
+	locked := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		current := User{}
+		err := tx.Debug().Set("gorm:query_option", "FOR UPDATE").Model(&User{}).Select("failed_login_count, last_failed_login_at, locked_until").Where("id = ?", u.ID).Take(&current).Error
+		if err != nil {
+			return err
+		}
+		failures := 1
+		if current.LastFailedLoginAt != nil {
+			failures = activeFailures(current.FailedLoginCount, *current.LastFailedLoginAt, now) + 1
+		}
+		columns := map[string]interface{}{
+			"failed_login_count":   failures,
+			"last_failed_login_at": now,
+		}
+		threshold := LoginLockoutThreshold()
+		locked = threshold > 0 && failures >= threshold
+		if locked {
+			until := now.Add(LoginLockoutDuration())
+			columns["locked_until"] = until
+			columns["failed_login_count"] = 0
+			current.LockedUntil = &until
+		}
+		err = tx.Debug().Model(&User{}).Where("id = ?", u.ID).UpdateColumns(columns).Error
+		if err != nil {
+			return err
+		}
+		u.FailedLoginCount = columns["failed_login_count"].(int)
+		u.LastFailedLoginAt = &now
+		u.LockedUntil = current.LockedUntil
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
+	return locked, nil
+}
 
-	db = db.Debug().Model(&User{}).Where("email = ?", fup.Email).Take(&User{}).UpdateColumns(
+// ResetFailedLogins clears the counters and any temporary lock, after a
+// successful login or when an admin unlocks the account.
+func (u *User) ResetFailedLogins(db *gorm.DB) error {
+	if u.FailedLoginCount == 0 && u.LastFailedLoginAt == nil && u.LockedUntil == nil {
+		return nil
+	}
+	err := db.Debug().Model(&User{}).Where("id = ?", u.ID).UpdateColumns(
 		map[string]interface{}{
-			"password":  password,
-			"updated_at": time.Now(),
+			"failed_login_count":   0,
+			"last_failed_login_at": gorm.Expr("NULL"),
+			"locked_until":         gorm.Expr("NULL"),
 		},
-	)
+	).Error
+	if err != nil {
+		return err
+	}
+	u.FailedLoginCount = 0
+	u.LastFailedLoginAt = nil
+	u.LockedUntil = nil
+	return nil
+}
 
+func (u *User) UnlockUser(db *gorm.DB, uid uuid.UUID, tuid uuid.UUID) (*User, error) {
+	db = db.Debug().Model(&User{}).Where("id = ?", uid).UpdateColumns(
+		map[string]interface{}{
+			"failed_login_count":   0,
+			"last_failed_login_at": gorm.Expr("NULL"),
+			"locked_until":         gorm.Expr("NULL"),
+			"updated_at":           time.Now(),
+			"updated_by":           tuid,
+		},
+	)
 	if db.Error != nil {
-		return db.Error
+		return &User{}, db.Error
 	}
-	return nil
+	if db.RowsAffected == 0 {
+		return &User{}, errors.New("User Not Found")
+	}
+	return u.FindUserByID(db.New(), uid)
 }
 
 func (u *User) WhoAmI(db *gorm.DB, uid uuid.UUID) (*User, error) {
@@ -343,4 +555,49 @@ func (u *User) WhoAmI(db *gorm.DB, uid uuid.UUID) (*User, error) {
 		return &User{}, errors.New("User Not Found")
 	}
 	return u, nil
-}
\ No newline at end of file
+}
+// FindUsersWhere returns a page of users matching the condition, ordered by
+// creation, together with the number of all matching users.
+func (u *User) FindUsersWhere(db *gorm.DB, where string, args []interface{}, offset int, limit int) (*[]User, int, error) {
+	users := []User{}
+	total := 0
+	query := db.Debug().Model(&User{})
+	if where != "" {
+		query = query.Where(where, args...)
+	}
+	err := query.Count(&total).Error
+	if err != nil {
+		return &[]User{}, 0, err
+	}
+	if limit == 0 {
+		return &users, total, nil
+	}
+	err = query.Order("created_at, id").Offset(offset).Limit(limit).Preload("Roles").Find(&users).Error
+	if err != nil {
+		return &[]User{}, 0, err
+	}
+	return &users, total, nil
+}
+
+// ProvisionUser stores the profile and the enabled flag as sent by a
+// provisioning client, which, unlike UpdateAUser, includes the email.
+func (u *User) ProvisionUser(db *gorm.DB, uid uuid.UUID, tuid uuid.UUID) (*User, error) {
+	result := db.Debug().Model(&User{}).Where("id = ?", uid).UpdateColumns(
+		map[string]interface{}{
+			"user_name":  u.UserName,
+			"first_name": u.FirstName,
+			"last_name":  u.LastName,
+			"email":      u.Email,
+			"enabled":    u.Enabled,
+			"updated_at": time.Now(),
+			"updated_by": tuid,
+		},
+	)
+	if result.Error != nil {
+		return &User{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &User{}, errors.New("User Not Found")
+	}
+	return u.FindUserByID(db.New(), uid)
+}
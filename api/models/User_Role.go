@@ -7,9 +7,18 @@ import (
 	"github.com/jinzhu/gorm"
 )
 
+// The sources a role is granted by. A login only takes away the roles its
+// own mapping granted, never those an admin granted.
+const (
+	RoleSourceManual    = "manual"
+	RoleSourceMapping   = "mapping"
+	RoleSourceDirectory = "directory"
+)
+
 type User_Role struct {
-	UserID	uuid.UUID	`gorm:"type:uuid"json:"userid"`
+	UserID	uuid.UUID	`gorm:"type:uuid" json:"userid"`
 	RoleID	uint32		`json:"roleid"`
+	Source	string		`gorm:"size:20;not null;default:'manual'" json:"source"`
 }
 
 type User_Role_Payload struct {
@@ -17,8 +26,9 @@ type User_Role_Payload struct {
 }
 
 func (ur *User_Role) Prepare() {
-	ur.UserID = ur.UserID
-	ur.RoleID = ur.RoleID
+	if ur.Source == "" {
+		ur.Source = RoleSourceManual
+	}
 }
 
 func (ur *User_Role) Validate() error {
@@ -31,8 +41,21 @@ func (ur *User_Role) Validate() error {
 	return nil
 }
 
+// SaveUserToRole grants the role to the user. A manual grant of a role the
+// user holds through a mapping takes that grant over, so that logins leave it
+// alone from then on.
 func (ur *User_Role) SaveUserToRole(db *gorm.DB) (error) {
 	var err error
+	ur.Prepare()
+	if ur.Source == RoleSourceManual {
+		taken := db.Debug().Model(&User_Role{}).Where("role_id = ? and user_id = ? and source <> ?", ur.RoleID, ur.UserID, RoleSourceManual).UpdateColumn("source", RoleSourceManual)
+		if taken.Error != nil {
+			return taken.Error
+		}
+		if taken.RowsAffected > 0 {
+			return nil
+		}
+	}
 	err = db.Debug().Model(&User_Role{}).Create(&ur).Error
 	if err != nil {
 		return err
@@ -51,4 +74,46 @@ func (ur *User_Role) DeleteUsersFromRole(db *gorm.DB, rid uint32, uid uuid.UUID)
 		return 0, db.Error
 	}
 	return db.RowsAffected, nil
-}
\ No newline at end of file
+}
+
+// DeleteUserRoleBySource takes away the grant of the role from the user that
+// source made. Grants of the same role from other sources stay.
+func (ur *User_Role) DeleteUserRoleBySource(db *gorm.DB, rid uint32, uid uuid.UUID, source string) (int64, error) {
+	db = db.Debug().Where("role_id = ? and user_id = ? and source = ?", rid, uid, source).Delete(&User_Role{})
+	if db.Error != nil {
+		return 0, db.Error
+	}
+	return db.RowsAffected, nil
+}
+
+// FindUserRolesByUserID returns the role grants of the user with their
+// sources.
+func (ur *User_Role) FindUserRolesByUserID(db *gorm.DB, uid uuid.UUID) ([]User_Role, error) {
+	userRoles := []User_Role{}
+	err := db.Debug().Model(&User_Role{}).Where("user_id = ?", uid).Find(&userRoles).Error
+	if err != nil {
+		return []User_Role{}, err
+	}
+	return userRoles, nil
+}
+
+// FindUserIDsByRoleID returns the IDs of the users holding the role.
+func (ur *User_Role) FindUserIDsByRoleID(db *gorm.DB, rid uint32) ([]uuid.UUID, error) {
+	uids := []uuid.UUID{}
+	err := db.Debug().Model(&User_Role{}).Where("role_id = ?", rid).Order("user_id").Pluck("user_id", &uids).Error
+	if err != nil {
+		return []uuid.UUID{}, err
+	}
+	return uids, nil
+}
+
+// FindUsersByRoleID returns the users holding the role, without their roles.
+func (ur *User_Role) FindUsersByRoleID(db *gorm.DB, rid uint32) (*[]User, error) {
+	users := []User{}
+	err := db.Debug().Model(&User{}).Joins("JOIN user_roles ON user_roles.user_id = users.id").
+		Where("user_roles.role_id = ?", rid).Order("users.user_name").Find(&users).Error
+	if err != nil {
+		return &[]User{}, err
+	}
+	return &users, nil
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+func TestSaveUserToRoleTakesOverMappedGrant(t *testing.T) {
+	db, mock := newMockDB(t)
+	uid := uuid.New()
+
+	// The user holds the role through a mapping, the manual grant turns it
+	// into a manual one instead of adding a second grant.
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "user_roles" SET "source" = \$1 WHERE \(role_id = \$2 and user_id = \$3 and source <> \$4\)`).
+		WithArgs(RoleSourceManual, int64(3), uid, RoleSourceManual).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	userRole := User_Role{UserID: uid, RoleID: 3}
+	if err := userRole.SaveUserToRole(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveUserToRoleManual(t *testing.T) {
+	db, mock := newMockDB(t)
+	uid := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "user_roles" SET "source"`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "user_roles" \("user_id","role_id","source"\)`).
+		WithArgs(uid, int64(3), RoleSourceManual).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	userRole := User_Role{UserID: uid, RoleID: 3}
+	if err := userRole.SaveUserToRole(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveUserToRoleMapped(t *testing.T) {
+	db, mock := newMockDB(t)
+	uid := uuid.New()
+
+	// A mapping never takes over a manual grant.
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO "user_roles" \("user_id","role_id","source"\)`).
+		WithArgs(uid, int64(3), RoleSourceMapping).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	userRole := User_Role{UserID: uid, RoleID: 3, Source: RoleSourceMapping}
+	if err := userRole.SaveUserToRole(db); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,277 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+)
+
+// Webhook_Delivery is one event on its way to one subscription. Deliveries
+// are written in the same transaction as the change they report, and retried
+// with exponential backoff until they succeed or run out of attempts, after
+// which they stay dead until redelivered by hand.
+type Webhook_Delivery struct {
+	ID             uuid.UUID  `gorm:"primary_key;type:uuid" json:"id"`
+	SubscriptionID uuid.UUID  `gorm:"type:uuid;not null;index" json:"subscription_id"`
+	EventID        uuid.UUID  `gorm:"type:uuid;not null" json:"event_id"`
+	Event          string     `gorm:"size:64;not null" json:"event"`
+	Payload        JSONB      `gorm:"type:jsonb;not null" json:"payload"`
+	Status         string     `gorm:"size:16;not null;index" json:"status"`
+	Attempts       int        `gorm:"not null" json:"attempts"`
+	NextAttemptAt  time.Time  `gorm:"not null;index" json:"next_attempt_at"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `gorm:"size:512" json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	UpdatedAt      time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+}
+
+// WebhookPayload is the body posted to a subscription.
+type WebhookPayload struct {
+	ID        uuid.UUID   `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+func WebhookTimeout() time.Duration {
+	return time.Duration(envInt("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second
+}
+
+func WebhookPollInterval() time.Duration {
+	return time.Duration(envInt("WEBHOOK_POLL_INTERVAL_SECONDS", 5)) * time.Second
+}
+
+func WebhookMaxAttempts() int {
+	return envInt("WEBHOOK_MAX_ATTEMPTS", 8)
+}
+
+// WebhookBackoff is the wait after the given failed attempt, doubling from
+// WEBHOOK_RETRY_BASE_SECONDS up to WEBHOOK_RETRY_MAX_SECONDS.
+func WebhookBackoff(attempt int) time.Duration {
+	base := time.Duration(envInt("WEBHOOK_RETRY_BASE_SECONDS", 30)) * time.Second
+	max := time.Duration(envInt("WEBHOOK_RETRY_MAX_SECONDS", 3600)) * time.Second
+	backoff := base
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// SignWebhook computes the X-Webhook-Signature of a body sent at timestamp.
+// Receivers recompute it over "<timestamp>.<body>" with the shared secret and
+// should reject timestamps too far in the past.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// UserEventData is the data of the user.* events about a user.
+func UserEventData(u *User) interface{} {
+	return map[string]interface{}{
+		"user": PrepareResponse(u),
+	}
+}
+
+// RoleEventData is the data of the user.role_* events.
+func RoleEventData(uid uuid.UUID, rid uint32) interface{} {
+	return map[string]interface{}{
+		"user_id": uid,
+		"role_id": rid,
+	}
+}
+
+// EnqueueWebhookEvent queues the event for every enabled subscription that
+// wants it. Call it with the transaction of the change the event reports.
+func EnqueueWebhookEvent(db *gorm.DB, event string, data interface{}) error {
+	subscriptions := []Webhook_Subscription{}
+	err := db.Debug().Model(&Webhook_Subscription{}).Where("enabled = ?", true).Find(&subscriptions).Error
+	if err != nil {
+		return err
+	}
+	payload := WebhookPayload{ID: uuid.New(), Event: event, CreatedAt: time.Now(), Data: data}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if !subscription.Subscribes(event) {
+			continue
+		}
+		delivery := Webhook_Delivery{
+			ID:             uuid.New(),
+			SubscriptionID: subscription.ID,
+			EventID:        payload.ID,
+			Event:          event,
+			Payload:        body,
+			Status:         WebhookPending,
+			NextAttemptAt:  payload.CreatedAt,
+			CreatedAt:      payload.CreatedAt,
+			UpdatedAt:      payload.CreatedAt,
+		}
+		err = db.Debug().Create(&delivery).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClaimWebhookDeliveries takes up to limit due deliveries of enabled
+// subscriptions and holds them for lease, so that other instances skip them
+// while they are sent.
+func ClaimWebhookDeliveries(db *gorm.DB, limit int, lease time.Duration) ([]Webhook_Delivery, error) {
+	deliveries := []Webhook_Delivery{}
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Debug().Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+			Where("status = ? AND next_attempt_at <= ?", WebhookPending, now).
+			Where("subscription_id IN (?)", tx.Model(&Webhook_Subscription{}).Select("id").Where("enabled = ?", true).QueryExpr()).
+			Order("next_attempt_at").Limit(limit).Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+		ids := make([]uuid.UUID, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+		}
+		return tx.Debug().Model(&Webhook_Delivery{}).Where("id IN (?)", ids).UpdateColumns(
+			map[string]interface{}{
+				"next_attempt_at": now.Add(lease),
+			},
+		).Error
+	})
+	return deliveries, err
+}
+
+// Deliver posts the payload to the subscription once and returns the status
+// code received. Any status outside 2xx is an error.
+func (wd *Webhook_Delivery) Deliver(client *http.Client, subscription *Webhook_Subscription) (int, error) {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest("POST", subscription.URL, bytes.NewReader([]byte(wd.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Truvest-Webhooks/1.0")
+	req.Header.Set("X-Webhook-ID", wd.ID.String())
+	req.Header.Set("X-Webhook-Event", wd.Event)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", SignWebhook(subscription.Secret, timestamp, []byte(wd.Payload)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Receiver answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt and schedules the
+// next one, or gives up on the delivery after WEBHOOK_MAX_ATTEMPTS.
+func (wd *Webhook_Delivery) RecordWebhookAttempt(db *gorm.DB, statusCode int, deliveryErr error) error {
+	now := time.Now()
+	wd.Attempts++
+	wd.LastStatusCode = statusCode
+	wd.LastError = ""
+	if deliveryErr == nil {
+		wd.Status = WebhookDelivered
+		wd.DeliveredAt = &now
+	} else {
+		wd.LastError = deliveryErr.Error()
+		if len(wd.LastError) > 512 {
+			wd.LastError = wd.LastError[:512]
+		}
+		if wd.Attempts >= WebhookMaxAttempts() {
+			wd.Status = WebhookDead
+		} else {
+			wd.NextAttemptAt = now.Add(WebhookBackoff(wd.Attempts))
+		}
+	}
+	return db.Debug().Model(&Webhook_Delivery{}).Where("id = ?", wd.ID).UpdateColumns(
+		map[string]interface{}{
+			"status":           wd.Status,
+			"attempts":         wd.Attempts,
+			"next_attempt_at":  wd.NextAttemptAt,
+			"last_status_code": wd.LastStatusCode,
+			"last_error":       wd.LastError,
+			"delivered_at":     wd.DeliveredAt,
+			"updated_at":       now,
+		},
+	).Error
+}
+
+// FindWebhookDeliveries returns a page of deliveries, newest first. Empty
+// filters match everything.
+func (wd *Webhook_Delivery) FindWebhookDeliveries(db *gorm.DB, subscriptionID *uuid.UUID, status string, page int, perPage int) (*Page, error) {
+	query := db.Debug().Model(&Webhook_Delivery{})
+	if subscriptionID != nil {
+		query = query.Where("subscription_id = ?", *subscriptionID)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	total := 0
+	err := query.Count(&total).Error
+	if err != nil {
+		return &Page{}, err
+	}
+	deliveries := []Webhook_Delivery{}
+	err = query.Order("created_at desc").Offset((page - 1) * perPage).Limit(perPage).Find(&deliveries).Error
+	if err != nil {
+		return &Page{}, err
+	}
+	return &Page{Items: deliveries, Page: page, PerPage: perPage, Total: total}, nil
+}
+
+// Redeliver queues a delivery again right away with a fresh set of attempts,
+// whatever its current status.
+func (wd *Webhook_Delivery) Redeliver(db *gorm.DB, did uuid.UUID) (*Webhook_Delivery, error) {
+	now := time.Now()
+	result := db.Debug().Model(&Webhook_Delivery{}).Where("id = ?", did).UpdateColumns(
+		map[string]interface{}{
+			"status":          WebhookPending,
+			"attempts":        0,
+			"next_attempt_at": now,
+			"updated_at":      now,
+		},
+	)
+	if result.Error != nil {
+		return &Webhook_Delivery{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &Webhook_Delivery{}, errors.New("Delivery Not Found")
+	}
+	err := db.Debug().Model(&Webhook_Delivery{}).Where("id = ?", did).Take(&wd).Error
+	if err != nil {
+		return &Webhook_Delivery{}, err
+	}
+	return wd, nil
+}
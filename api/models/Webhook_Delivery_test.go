@@ -0,0 +1,222 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// newMockDB opens gorm on a mocked connection, the expected statements are
+// checked when the test ends.
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.LogMode(false)
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return db, mock
+}
+
+// setEnv sets an environment variable for the duration of the test.
+func setEnv(t *testing.T, key string, value string) {
+	t.Helper()
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// argEquals matches a statement argument equal to want.
+type argEquals struct {
+	want interface{}
+}
+
+func (a argEquals) Match(v driver.Value) bool {
+	return v == a.want
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"user.created"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := SignWebhook("s3cret", 1700000000, body); got != want {
+		t.Errorf("SignWebhook = %s, want %s", got, want)
+	}
+	if SignWebhook("s3cret", 1700000001, body) == want {
+		t.Error("The signature does not cover the timestamp")
+	}
+	if SignWebhook("other", 1700000000, body) == want {
+		t.Error("The signature does not depend on the secret")
+	}
+}
+
+func TestDeliverSignsTimestampAndBody(t *testing.T) {
+	payload := []byte(`{"id":"1","event":"user.created","data":{}}`)
+	received := make(chan error, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		switch {
+		case err != nil:
+			received <- errors.New("missing timestamp")
+		case time.Since(time.Unix(timestamp, 0)) > time.Minute:
+			received <- errors.New("stale timestamp")
+		case r.Header.Get("X-Webhook-Signature") != SignWebhook("s3cret", timestamp, body):
+			received <- errors.New("bad signature " + r.Header.Get("X-Webhook-Signature"))
+		case string(body) != string(payload) || r.Header.Get("X-Webhook-Event") != "user.created":
+			received <- errors.New("unexpected delivery " + string(body))
+		default:
+			received <- nil
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	delivery := Webhook_Delivery{ID: uuid.New(), Event: "user.created", Payload: payload}
+	status, err := delivery.Deliver(receiver.Client(), &Webhook_Subscription{URL: receiver.URL, Secret: "s3cret"})
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("Deliver = %d, %v", status, err)
+	}
+	if err := <-received; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	setEnv(t, "WEBHOOK_RETRY_BASE_SECONDS", "30")
+	setEnv(t, "WEBHOOK_RETRY_MAX_SECONDS", "3600")
+	want := []int{30, 60, 120, 240, 480, 960, 1920, 3600, 3600}
+	for i, seconds := range want {
+		if got := WebhookBackoff(i + 1); got != time.Duration(seconds)*time.Second {
+			t.Errorf("WebhookBackoff(%d) = %s, want %ds", i+1, got, seconds)
+		}
+	}
+}
+
+func TestRecordWebhookAttemptGivesUpAfterMaxAttempts(t *testing.T) {
+	setEnv(t, "WEBHOOK_MAX_ATTEMPTS", "3")
+	setEnv(t, "WEBHOOK_RETRY_BASE_SECONDS", "30")
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+	db, mock := newMockDB(t)
+	subscription := &Webhook_Subscription{URL: receiver.URL, Secret: "s3cret"}
+	delivery := Webhook_Delivery{ID: uuid.New(), Event: "user.created", Payload: []byte(`{}`), Status: WebhookPending}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		status := WebhookPending
+		if attempt == 3 {
+			status = WebhookDead
+		}
+		// attempts, delivered_at, last_error, last_status_code,
+		// next_attempt_at, status, updated_at, id
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE "webhook_deliveries" SET`).
+			WithArgs(argEquals{int64(attempt)}, sqlmock.AnyArg(), "Receiver answered 503", argEquals{int64(503)}, sqlmock.AnyArg(), status, sqlmock.AnyArg(), delivery.ID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		before := time.Now()
+		code, err := delivery.Deliver(receiver.Client(), subscription)
+		if err == nil {
+			t.Fatal("Deliver succeeded against a failing receiver")
+		}
+		if err := delivery.RecordWebhookAttempt(db, code, err); err != nil {
+			t.Fatal(err)
+		}
+		if delivery.Status != status || delivery.Attempts != attempt {
+			t.Fatalf("After attempt %d the delivery is %s with %d attempts", attempt, delivery.Status, delivery.Attempts)
+		}
+		if status == WebhookPending && delivery.NextAttemptAt.Before(before.Add(WebhookBackoff(attempt))) {
+			t.Errorf("Attempt %d is retried at %s, before its backoff", attempt, delivery.NextAttemptAt)
+		}
+	}
+	if delivery.DeliveredAt != nil {
+		t.Error("A dead delivery is marked delivered")
+	}
+}
+
+func TestRecordWebhookAttemptDelivered(t *testing.T) {
+	db, mock := newMockDB(t)
+	delivery := Webhook_Delivery{ID: uuid.New(), Status: WebhookPending, Attempts: 2, LastError: "Receiver answered 503"}
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "webhook_deliveries" SET`).
+		WithArgs(argEquals{int64(3)}, sqlmock.AnyArg(), "", argEquals{int64(200)}, sqlmock.AnyArg(), WebhookDelivered, sqlmock.AnyArg(), delivery.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := delivery.RecordWebhookAttempt(db, http.StatusOK, nil); err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Status != WebhookDelivered || delivery.DeliveredAt == nil || delivery.LastError != "" {
+		t.Errorf("Delivery is %+v", delivery)
+	}
+}
+
+func TestRedeliverResetsAttempts(t *testing.T) {
+	db, mock := newMockDB(t)
+	did := uuid.New()
+	// attempts, next_attempt_at, status, updated_at, id
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "webhook_deliveries" SET`).
+		WithArgs(argEquals{int64(0)}, sqlmock.AnyArg(), WebhookPending, sqlmock.AnyArg(), did).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT \* FROM "webhook_deliveries" WHERE \(id = \$1\)`).
+		WithArgs(did).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "status", "attempts", "event"}).AddRow(did, WebhookPending, 0, "user.created"))
+
+	delivery := Webhook_Delivery{}
+	redelivered, err := delivery.Redeliver(db, did)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redelivered.ID != did || redelivered.Status != WebhookPending || redelivered.Attempts != 0 {
+		t.Errorf("Redelivered %+v", redelivered)
+	}
+}
+
+func TestRedeliverUnknownDelivery(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE "webhook_deliveries" SET`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	delivery := Webhook_Delivery{}
+	if _, err := delivery.Redeliver(db, uuid.New()); err == nil || err.Error() != "Delivery Not Found" {
+		t.Errorf("Redeliver = %v, want Delivery Not Found", err)
+	}
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+// Identity lifecycle events, published to the outbox and the webhooks.
+const (
+	EventUserCreated      = "user.created"
+	EventUserUpdated      = "user.updated"
+	EventUserEnabled      = "user.enabled"
+	EventUserDisabled     = "user.disabled"
+	EventUserDeleted      = "user.deleted"
+	EventUserRoleAssigned = "user.role_assigned"
+	EventUserRoleRemoved  = "user.role_removed"
+)
+
+var WebhookEvents = []string{
+	EventUserCreated,
+	EventUserUpdated,
+	EventUserEnabled,
+	EventUserDisabled,
+	EventUserDeleted,
+	EventUserRoleAssigned,
+	EventUserRoleRemoved,
+}
+
+// Webhook_Subscription sends the events it subscribes to, "*" for all of
+// them, to its URL, signed with its secret.
+type Webhook_Subscription struct {
+	ID        uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	URL       string    `gorm:"size:2048;not null" json:"url"`
+	Events    string    `gorm:"size:1024;not null" json:"events"`
+	Secret    string    `gorm:"size:255;not null" json:"-"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	CreatedBy uuid.UUID `gorm:"type:uuid;not null" json:"created_by"`
+	UpdatedAt time.Time `gorm:"default:CURRENT_TIMESTAMP" json:"updated_at"`
+	UpdatedBy uuid.UUID `gorm:"type:uuid;not null" json:"updated_by"`
+}
+
+type Webhook_Subscription_Payload struct {
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"`
+	Enabled *bool    `json:"enabled,omitempty"`
+}
+
+// Webhook_Subscription_Created is only returned when a subscription is
+// created, the secret is not shown again.
+type Webhook_Subscription_Created struct {
+	Webhook_Subscription
+	Secret string `json:"secret"`
+}
+
+// Apply copies the payload onto the subscription. A missing secret keeps the
+// current one, or generates one for a new subscription.
+func (ws *Webhook_Subscription) Apply(payload Webhook_Subscription_Payload) error {
+	ws.URL = strings.TrimSpace(payload.URL)
+	events := []string{}
+	for _, event := range payload.Events {
+		event = strings.TrimSpace(event)
+		if event == "" {
+			continue
+		}
+		if event != "*" && !isWebhookEvent(event) {
+			return errors.New("Unknown event " + event)
+		}
+		events = append(events, event)
+	}
+	ws.Events = strings.Join(events, ",")
+	if payload.Secret != "" {
+		ws.Secret = payload.Secret
+	}
+	if ws.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		ws.Secret = hex.EncodeToString(secret)
+	}
+	if payload.Enabled != nil {
+		ws.Enabled = *payload.Enabled
+	}
+	return nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, known := range WebhookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (ws *Webhook_Subscription) Prepare(tuid uuid.UUID) {
+	ws.ID = uuid.New()
+	ws.CreatedAt = time.Now()
+	ws.CreatedBy = tuid
+	ws.UpdatedAt = time.Now()
+	ws.UpdatedBy = tuid
+}
+
+func (ws *Webhook_Subscription) Validate() error {
+	if ws.URL == "" {
+		return errors.New("Required URL")
+	}
+	u, err := url.Parse(ws.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("Invalid URL")
+	}
+	if ws.Events == "" {
+		return errors.New("Required Events")
+	}
+	if len(ws.Secret) < 16 {
+		return errors.New("Secret must be at least 16 characters")
+	}
+	return nil
+}
+
+// Subscribes reports whether the subscription wants the event.
+func (ws *Webhook_Subscription) Subscribes(event string) bool {
+	for _, subscribed := range strings.Split(ws.Events, ",") {
+		if subscribed == "*" || subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (ws *Webhook_Subscription) SaveWebhookSubscription(db *gorm.DB) (*Webhook_Subscription, error) {
+	err := db.Debug().Model(&Webhook_Subscription{}).Create(&ws).Error
+	if err != nil {
+		return &Webhook_Subscription{}, err
+	}
+	return ws, nil
+}
+
+func (ws *Webhook_Subscription) FindAllWebhookSubscriptions(db *gorm.DB) (*[]Webhook_Subscription, error) {
+	subscriptions := []Webhook_Subscription{}
+	err := db.Debug().Model(&Webhook_Subscription{}).Order("created_at").Find(&subscriptions).Error
+	if err != nil {
+		return &[]Webhook_Subscription{}, err
+	}
+	return &subscriptions, nil
+}
+
+func (ws *Webhook_Subscription) FindWebhookSubscriptionByID(db *gorm.DB, wid uuid.UUID) (*Webhook_Subscription, error) {
+	err := db.Debug().Model(&Webhook_Subscription{}).Where("id = ?", wid).Take(&ws).Error
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return &Webhook_Subscription{}, errors.New("Webhook Not Found")
+		}
+		return &Webhook_Subscription{}, err
+	}
+	return ws, nil
+}
+
+func (ws *Webhook_Subscription) UpdateAWebhookSubscription(db *gorm.DB, tuid uuid.UUID) (*Webhook_Subscription, error) {
+	ws.UpdatedAt = time.Now()
+	ws.UpdatedBy = tuid
+	err := db.Debug().Model(&Webhook_Subscription{}).Where("id = ?", ws.ID).UpdateColumns(
+		map[string]interface{}{
+			"url":        ws.URL,
+			"events":     ws.Events,
+			"secret":     ws.Secret,
+			"enabled":    ws.Enabled,
+			"updated_at": ws.UpdatedAt,
+			"updated_by": ws.UpdatedBy,
+		},
+	).Error
+	if err != nil {
+		return &Webhook_Subscription{}, err
+	}
+	return ws, nil
+}
+
+// DeleteAWebhookSubscription removes the subscription together with its
+// deliveries.
+func (ws *Webhook_Subscription) DeleteAWebhookSubscription(db *gorm.DB, wid uuid.UUID) (int64, error) {
+	var rows int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Debug().Where("subscription_id = ?", wid).Delete(&Webhook_Delivery{}).Error
+		if err != nil {
+			return err
+		}
+		result := tx.Debug().Where("id = ?", wid).Delete(&Webhook_Subscription{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("Webhook Not Found")
+		}
+		rows = result.RowsAffected
+		return nil
+	})
+	return rows, err
+}
@@ -14,7 +14,24 @@ func JSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	}
 }
 
+// detailedError is implemented by errors that carry structured details, such
+// as every rule a password failed, which are returned next to the message.
+type detailedError interface {
+	error
+	Details() interface{}
+}
+
 func ERROR(w http.ResponseWriter, statusCode int, err error) {
+	if de, ok := err.(detailedError); ok {
+		JSON(w, statusCode, struct {
+			Error   string      `json:"error"`
+			Details interface{} `json:"details"`
+		}{
+			Error:   de.Error(),
+			Details: de.Details(),
+		})
+		return
+	}
 	if err != nil {
 		JSON(w, statusCode, struct {
 			Error string `json:"error"`
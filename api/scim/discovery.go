@@ -0,0 +1,137 @@
+package scim
+
+// The discovery documents of RFC 7643 sections 5 to 7, describing what this
+// server supports.
+
+type attribute struct {
+	Name          string      `json:"name"`
+	Type          string      `json:"type"`
+	MultiValued   bool        `json:"multiValued"`
+	Description   string      `json:"description"`
+	Required      bool        `json:"required"`
+	CaseExact     bool        `json:"caseExact"`
+	Mutability    string      `json:"mutability"`
+	Returned      string      `json:"returned"`
+	Uniqueness    string      `json:"uniqueness"`
+	SubAttributes []attribute `json:"subAttributes,omitempty"`
+}
+
+func simple(name string, description string) attribute {
+	return attribute{Name: name, Type: "string", Description: description, Mutability: "readWrite", Returned: "default", Uniqueness: "none"}
+}
+
+func multiValued(name string, description string, mutability string, subAttributes ...attribute) attribute {
+	return attribute{Name: name, Type: "complex", MultiValued: true, Description: description, Mutability: mutability, Returned: "default", Uniqueness: "none", SubAttributes: subAttributes}
+}
+
+func userSchema() map[string]interface{} {
+	userName := simple("userName", "Unique identifier of the user, used to log in.")
+	userName.Required = true
+	userName.Uniqueness = "server"
+	name := simple("name", "The name of the user.")
+	name.Type = "complex"
+	name.SubAttributes = []attribute{
+		simple("formatted", "The full name."),
+		simple("familyName", "The family name, the last name."),
+		simple("givenName", "The given name, the first name."),
+	}
+	active := simple("active", "Whether the user may log in. Deactivated users are kept.")
+	active.Type = "boolean"
+	password := simple("password", "The password, never returned.")
+	password.Mutability = "writeOnly"
+	password.Returned = "never"
+	value := simple("value", "The email address.")
+	value.Uniqueness = "server"
+	groupValue := simple("value", "The id of the group.")
+	groupValue.Mutability = "readOnly"
+	return map[string]interface{}{
+		"schemas":     []string{SchemaSchema},
+		"id":          SchemaUser,
+		"name":        "User",
+		"description": "User Account",
+		"attributes": []attribute{
+			userName,
+			name,
+			simple("displayName", "The name of the user, suitable for display."),
+			multiValued("emails", "Email address of the user, only the primary one is kept.", "readWrite",
+				value, simple("type", "work, home or other."), attribute{Name: "primary", Type: "boolean", Description: "Whether this is the primary email.", Mutability: "readWrite", Returned: "default", Uniqueness: "none"}),
+			active,
+			password,
+			multiValued("groups", "The groups the user belongs to, managed through the Groups endpoint.", "readOnly",
+				groupValue, simple("display", "The name of the group.")),
+		},
+	}
+}
+
+func groupSchema() map[string]interface{} {
+	displayName := simple("displayName", "The name of the group.")
+	displayName.Required = true
+	displayName.Uniqueness = "server"
+	return map[string]interface{}{
+		"schemas":     []string{SchemaSchema},
+		"id":          SchemaGroup,
+		"name":        "Group",
+		"description": "Group, a role of the platform",
+		"attributes": []attribute{
+			displayName,
+			multiValued("members", "The users in the group.", "readWrite",
+				simple("value", "The id of the user."), simple("display", "The userName of the user.")),
+		},
+	}
+}
+
+// Schemas lists the User and Group schemas.
+func Schemas(baseURL string) []interface{} {
+	schemas := []interface{}{}
+	for _, schema := range []map[string]interface{}{userSchema(), groupSchema()} {
+		schema["meta"] = map[string]string{"resourceType": "Schema", "location": baseURL + "/Schemas/" + schema["id"].(string)}
+		schemas = append(schemas, schema)
+	}
+	return schemas
+}
+
+func ResourceTypes(baseURL string) []interface{} {
+	return []interface{}{
+		map[string]interface{}{
+			"schemas":     []string{SchemaResourceType},
+			"id":          "User",
+			"name":        "User",
+			"endpoint":    "/Users",
+			"description": "User Account",
+			"schema":      SchemaUser,
+			"meta":        map[string]string{"resourceType": "ResourceType", "location": baseURL + "/ResourceTypes/User"},
+		},
+		map[string]interface{}{
+			"schemas":     []string{SchemaResourceType},
+			"id":          "Group",
+			"name":        "Group",
+			"endpoint":    "/Groups",
+			"description": "Group",
+			"schema":      SchemaGroup,
+			"meta":        map[string]string{"resourceType": "ResourceType", "location": baseURL + "/ResourceTypes/Group"},
+		},
+	}
+}
+
+func ServiceProviderConfig(baseURL string) map[string]interface{} {
+	unsupported := map[string]bool{"supported": false}
+	return map[string]interface{}{
+		"schemas":          []string{SchemaServiceProviderConfig},
+		"documentationUri": "https://datatracker.ietf.org/doc/html/rfc7644",
+		"patch":            map[string]bool{"supported": true},
+		"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]interface{}{"supported": true, "maxResults": MaxResults},
+		"changePassword":   map[string]bool{"supported": true},
+		"sort":             unsupported,
+		"etag":             unsupported,
+		"authenticationSchemes": []map[string]interface{}{
+			{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer Token",
+				"description": "A SCIM client token, issued through /scim-tokens, in the Authorization header.",
+				"primary":     true,
+			},
+		},
+		"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": baseURL + "/ServiceProviderConfig"},
+	}
+}
@@ -0,0 +1,414 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter is a parsed filter expression, see RFC 7644 section 3.4.2.2. It is
+// one of *Logical, *Not or *Comparison.
+type Filter interface {
+	String() string
+}
+
+type Logical struct {
+	Op    string
+	Left  Filter
+	Right Filter
+}
+
+type Not struct {
+	Filter Filter
+}
+
+// Comparison compares an attribute to a value. Value is a string, bool,
+// float64 or nil and unused by the pr operator.
+type Comparison struct {
+	Attr  string
+	Op    string
+	Value interface{}
+}
+
+func (l *Logical) String() string {
+	return "(" + l.Left.String() + " " + l.Op + " " + l.Right.String() + ")"
+}
+
+func (n *Not) String() string {
+	return "not (" + n.Filter.String() + ")"
+}
+
+func (c *Comparison) String() string {
+	if c.Op == "pr" {
+		return c.Attr + " pr"
+	}
+	value, _ := json.Marshal(c.Value)
+	return c.Attr + " " + c.Op + " " + string(value)
+}
+
+var comparisonOps = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+// ParseFilter parses filters combining comparisons with and, or, not and
+// parentheses. Complex attribute filters such as emails[type eq "work"] are
+// not supported in a filter, only in a PATCH path.
+func ParseFilter(s string) (Filter, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, invalidFilter("Unexpected " + p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+func invalidFilter(detail string) *Error {
+	return BadRequest("invalidFilter", "Invalid filter: "+detail)
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+func tokenize(s string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, invalidFilter("Unterminated string")
+			}
+			value := ""
+			if err := json.Unmarshal([]byte(s[i:end+1]), &value); err != nil {
+				return nil, invalidFilter("Invalid string " + s[i:end+1])
+			}
+			tokens = append(tokens, token{text: value, quoted: true})
+			i = end + 1
+		case c == '[' || c == ']':
+			return nil, invalidFilter("Complex attribute filters are not supported")
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t()[]\"", rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, token{text: s[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+func (p *filterParser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseTerm() (Filter, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, invalidFilter("Unexpected end")
+	}
+	if p.peekKeyword("not") {
+		p.pos++
+		if !p.peekKeyword("(") {
+			return nil, invalidFilter("Expected ( after not")
+		}
+		f, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Filter: f}, nil
+	}
+	if p.peekKeyword("(") {
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekKeyword(")") {
+			return nil, invalidFilter("Expected )")
+		}
+		p.pos++
+		return f, nil
+	}
+
+	attr := p.tokens[p.pos]
+	if attr.quoted {
+		return nil, invalidFilter("Expected an attribute, got \"" + attr.text + "\"")
+	}
+	p.pos++
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].quoted {
+		return nil, invalidFilter("Expected an operator after " + attr.text)
+	}
+	op := strings.ToLower(p.tokens[p.pos].text)
+	p.pos++
+	if op == "pr" {
+		return &Comparison{Attr: attr.text, Op: op}, nil
+	}
+	if !comparisonOps[op] {
+		return nil, invalidFilter("Unknown operator " + op)
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, invalidFilter("Expected a value after " + op)
+	}
+	value := p.tokens[p.pos]
+	p.pos++
+	if value.quoted {
+		return &Comparison{Attr: attr.text, Op: op, Value: value.text}, nil
+	}
+	switch strings.ToLower(value.text) {
+	case "true":
+		return &Comparison{Attr: attr.text, Op: op, Value: true}, nil
+	case "false":
+		return &Comparison{Attr: attr.text, Op: op, Value: false}, nil
+	case "null":
+		return &Comparison{Attr: attr.text, Op: op, Value: nil}, nil
+	}
+	number, err := strconv.ParseFloat(value.text, 64)
+	if err != nil {
+		return nil, invalidFilter("Invalid value " + value.text)
+	}
+	return &Comparison{Attr: attr.text, Op: op, Value: number}, nil
+}
+
+// Attribute types a filter can compare.
+const (
+	TypeString   = "string"
+	TypeBoolean  = "boolean"
+	TypeDateTime = "dateTime"
+)
+
+// Column maps a filterable attribute onto an SQL column or expression.
+type Column struct {
+	Name      string
+	Type      string
+	CaseExact bool
+}
+
+// SQL translates the filter into a WHERE clause over columns, keyed by the
+// lower case attribute name without its schema URN. Comparing an attribute
+// missing from columns is an invalidFilter error.
+func SQL(f Filter, columns map[string]Column) (string, []interface{}, error) {
+	switch f := f.(type) {
+	case *Logical:
+		left, leftArgs, err := SQL(f.Left, columns)
+		if err != nil {
+			return "", nil, err
+		}
+		right, rightArgs, err := SQL(f.Right, columns)
+		if err != nil {
+			return "", nil, err
+		}
+		return "(" + left + " " + strings.ToUpper(f.Op) + " " + right + ")", append(leftArgs, rightArgs...), nil
+	case *Not:
+		clause, args, err := SQL(f.Filter, columns)
+		if err != nil {
+			return "", nil, err
+		}
+		return "NOT (" + clause + ")", args, nil
+	case *Comparison:
+		column, ok := columns[AttributeName(f.Attr)]
+		if !ok {
+			return "", nil, invalidFilter("Unsupported attribute " + f.Attr)
+		}
+		return comparisonSQL(f, column)
+	}
+	return "", nil, invalidFilter("Unsupported expression")
+}
+
+func comparisonSQL(c *Comparison, column Column) (string, []interface{}, error) {
+	if c.Op == "pr" {
+		if column.Type == TypeString {
+			return "(" + column.Name + " IS NOT NULL AND " + column.Name + " <> '')", nil, nil
+		}
+		return column.Name + " IS NOT NULL", nil, nil
+	}
+	if c.Value == nil {
+		switch c.Op {
+		case "eq":
+			return column.Name + " IS NULL", nil, nil
+		case "ne":
+			return column.Name + " IS NOT NULL", nil, nil
+		}
+		return "", nil, invalidFilter("null can only be compared with eq or ne")
+	}
+
+	switch column.Type {
+	case TypeBoolean:
+		value, ok := c.Value.(bool)
+		if !ok {
+			return "", nil, invalidFilter(c.Attr + " is a boolean")
+		}
+		switch c.Op {
+		case "eq":
+			return column.Name + " = ?", []interface{}{value}, nil
+		case "ne":
+			return column.Name + " <> ?", []interface{}{value}, nil
+		}
+		return "", nil, invalidFilter(c.Op + " cannot compare the boolean " + c.Attr)
+	case TypeDateTime:
+		value, ok := c.Value.(string)
+		if !ok {
+			return "", nil, invalidFilter(c.Attr + " is a dateTime")
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return "", nil, invalidFilter("Invalid dateTime " + value)
+		}
+		op, ok := orderingSQL[c.Op]
+		if !ok {
+			return "", nil, invalidFilter(c.Op + " cannot compare the dateTime " + c.Attr)
+		}
+		return column.Name + " " + op + " ?", []interface{}{t}, nil
+	}
+
+	value, ok := c.Value.(string)
+	if !ok {
+		return "", nil, invalidFilter(c.Attr + " is a string")
+	}
+	// Names and emails are stored HTML escaped, see User.Prepare and
+	// Group.Apply, so the value has to be escaped the same way to match.
+	value = html.EscapeString(value)
+	name := column.Name
+	placeholder := "?"
+	if !column.CaseExact {
+		name = "LOWER(" + name + ")"
+		placeholder = "LOWER(?)"
+	}
+	switch c.Op {
+	case "co":
+		return name + " LIKE " + placeholder, []interface{}{"%" + escapeLike(value) + "%"}, nil
+	case "sw":
+		return name + " LIKE " + placeholder, []interface{}{escapeLike(value) + "%"}, nil
+	case "ew":
+		return name + " LIKE " + placeholder, []interface{}{"%" + escapeLike(value)}, nil
+	}
+	return name + " " + orderingSQL[c.Op] + " " + placeholder, []interface{}{value}, nil
+}
+
+var orderingSQL = map[string]string{
+	"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<=",
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Match evaluates the filter against the attributes of one value of a multi
+// valued attribute, e.g. {"value": "...", "type": "work"}. Strings compare
+// case insensitively.
+func Match(f Filter, attributes map[string]interface{}) bool {
+	switch f := f.(type) {
+	case *Logical:
+		if f.Op == "and" {
+			return Match(f.Left, attributes) && Match(f.Right, attributes)
+		}
+		return Match(f.Left, attributes) || Match(f.Right, attributes)
+	case *Not:
+		return !Match(f.Filter, attributes)
+	case *Comparison:
+		value, ok := attributes[AttributeName(f.Attr)]
+		if f.Op == "pr" {
+			return ok && value != nil && value != ""
+		}
+		return compare(value, f.Op, f.Value)
+	}
+	return false
+}
+
+func compare(value interface{}, op string, expected interface{}) bool {
+	a := strings.ToLower(fmt.Sprint(value))
+	b := strings.ToLower(fmt.Sprint(expected))
+	switch op {
+	case "eq":
+		return a == b
+	case "ne":
+		return a != b
+	case "co":
+		return strings.Contains(a, b)
+	case "sw":
+		return strings.HasPrefix(a, b)
+	case "ew":
+		return strings.HasSuffix(a, b)
+	case "gt":
+		return a > b
+	case "ge":
+		return a >= b
+	case "lt":
+		return a < b
+	case "le":
+		return a <= b
+	}
+	return false
+}
+
+// AttributeName strips the schema URN off an attribute and lower cases it,
+// attribute names are case insensitive.
+func AttributeName(attr string) string {
+	for _, schema := range []string{SchemaUser, SchemaGroup} {
+		if len(attr) > len(schema) && strings.EqualFold(attr[:len(schema)+1], schema+":") {
+			attr = attr[len(schema)+1:]
+			break
+		}
+	}
+	return strings.ToLower(attr)
+}
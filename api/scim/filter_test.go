@@ -0,0 +1,196 @@
+package scim
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{`userName eq "bjensen"`, `userName eq "bjensen"`},
+		// and binds tighter than or, both associate to the left.
+		{`a eq "1" or b eq "2" and c eq "3"`, `(a eq "1" or (b eq "2" and c eq "3"))`},
+		{`a pr and b pr and c pr`, `((a pr and b pr) and c pr)`},
+		{`a pr or b pr or c pr`, `((a pr or b pr) or c pr)`},
+		{`(a eq "1" or b eq "2") and c eq "3"`, `((a eq "1" or b eq "2") and c eq "3")`},
+		{`not (a eq "1") and b pr`, `(not (a eq "1") and b pr)`},
+		{`not (a eq "1" or b pr)`, `not ((a eq "1" or b pr))`},
+		{`a EQ "x" AND b Pr`, `(a eq "x" and b pr)`},
+		// Keywords, parentheses and brackets inside quotes are values.
+		{`displayName eq "and"`, `displayName eq "and"`},
+		{`displayName eq "x) or (y"`, `displayName eq "x) or (y"`},
+		{`displayName eq "a[b]"`, `displayName eq "a[b]"`},
+		{`displayName eq "say \"hi\" \\ é"`, `displayName eq "say \"hi\" \\ é"`},
+		{`active eq true`, `active eq true`},
+		{`active ne FALSE`, `active ne false`},
+		{`externalId eq null`, `externalId eq null`},
+		{`count gt 5`, `count gt 5`},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "j"`, `urn:ietf:params:scim:schemas:core:2.0:User:userName sw "j"`},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%s): %v", tt.filter, err)
+			continue
+		}
+		if f.String() != tt.want {
+			t.Errorf("ParseFilter(%s) = %s, want %s", tt.filter, f.String(), tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName foo "x"`,
+		`userName eq "x`,
+		`userName eq "x" or`,
+		`userName eq "x" userName`,
+		`"userName" eq "x"`,
+		`userName "eq" "x"`,
+		`userName eq bjensen`,
+		`not userName eq "x"`,
+		`(userName pr`,
+		`userName pr)`,
+		`()`,
+		`emails[type eq "work"]`,
+	} {
+		_, err := ParseFilter(filter)
+		scimErr, ok := err.(*Error)
+		if !ok || scimErr.ScimType != "invalidFilter" {
+			t.Errorf("ParseFilter(%s) = %v, want an invalidFilter error", filter, err)
+		}
+	}
+}
+
+var testColumns = map[string]Column{
+	"id":                {Name: "id", Type: TypeString, CaseExact: true},
+	"username":          {Name: "user_name", Type: TypeString},
+	"active":            {Name: "enabled", Type: TypeBoolean},
+	"meta.lastmodified": {Name: "updated_at", Type: TypeDateTime},
+}
+
+func TestSQL(t *testing.T) {
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		filter string
+		clause string
+		args   []interface{}
+	}{
+		{`userName eq "Jane"`, `LOWER(user_name) = LOWER(?)`, []interface{}{"Jane"}},
+		{`userName ne "Jane"`, `LOWER(user_name) <> LOWER(?)`, []interface{}{"Jane"}},
+		{`userName gt "j"`, `LOWER(user_name) > LOWER(?)`, []interface{}{"j"}},
+		{`id eq "AbC"`, `id = ?`, []interface{}{"AbC"}},
+		{`id co "AbC"`, `id LIKE ?`, []interface{}{"%AbC%"}},
+		{`userName co "50%_off\\"`, `LOWER(user_name) LIKE LOWER(?)`, []interface{}{`%50\%\_off\\%`}},
+		{`userName sw "j_"`, `LOWER(user_name) LIKE LOWER(?)`, []interface{}{`j\_%`}},
+		{`userName ew "%"`, `LOWER(user_name) LIKE LOWER(?)`, []interface{}{`%\%`}},
+		// Values are HTML escaped like the stored names, before the LIKE
+		// escaping.
+		{`userName eq "O'Brien & <Co>"`, `LOWER(user_name) = LOWER(?)`, []interface{}{"O&#39;Brien &amp; &lt;Co&gt;"}},
+		{`userName sw "a&b_"`, `LOWER(user_name) LIKE LOWER(?)`, []interface{}{`a&amp;b\_%`}},
+		{`userName pr`, `(user_name IS NOT NULL AND user_name <> '')`, nil},
+		{`active pr`, `enabled IS NOT NULL`, nil},
+		{`userName eq null`, `user_name IS NULL`, nil},
+		{`userName ne null`, `user_name IS NOT NULL`, nil},
+		{`active eq true`, `enabled = ?`, []interface{}{true}},
+		{`active ne false`, `enabled <> ?`, []interface{}{false}},
+		{`meta.lastModified gt "2024-01-02T03:04:05Z"`, `updated_at > ?`, []interface{}{lastModified}},
+		{`meta.lastModified le "2024-01-02T04:04:05+01:00"`, `updated_at <= ?`, []interface{}{lastModified}},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:UserName eq "jane"`, `LOWER(user_name) = LOWER(?)`, []interface{}{"jane"}},
+		{
+			`not (userName eq "a") or active eq true and id eq "1"`,
+			`(NOT (LOWER(user_name) = LOWER(?)) OR (enabled = ? AND id = ?))`,
+			[]interface{}{"a", true, "1"},
+		},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("ParseFilter(%s): %v", tt.filter, err)
+		}
+		clause, args, err := SQL(f, testColumns)
+		if err != nil {
+			t.Errorf("SQL(%s): %v", tt.filter, err)
+			continue
+		}
+		if clause != tt.clause {
+			t.Errorf("SQL(%s) = %s, want %s", tt.filter, clause, tt.clause)
+		}
+		if len(args) != len(tt.args) {
+			t.Errorf("SQL(%s) args = %v, want %v", tt.filter, args, tt.args)
+			continue
+		}
+		for i := range args {
+			if want, ok := tt.args[i].(time.Time); ok {
+				if got, ok := args[i].(time.Time); !ok || !got.Equal(want) {
+					t.Errorf("SQL(%s) arg %d = %v, want %v", tt.filter, i, args[i], want)
+				}
+			} else if !reflect.DeepEqual(args[i], tt.args[i]) {
+				t.Errorf("SQL(%s) arg %d = %#v, want %#v", tt.filter, i, args[i], tt.args[i])
+			}
+		}
+	}
+}
+
+func TestSQLErrors(t *testing.T) {
+	for _, filter := range []string{
+		`title eq "Boss"`,
+		`userName eq 5`,
+		`userName eq true`,
+		`userName gt null`,
+		`active eq "true"`,
+		`active gt true`,
+		`active co true`,
+		`meta.lastModified gt "yesterday"`,
+		`meta.lastModified gt 5`,
+		`meta.lastModified co "2024"`,
+		`active eq true and title pr`,
+		`not (title pr)`,
+	} {
+		f, err := ParseFilter(filter)
+		if err != nil {
+			t.Fatalf("ParseFilter(%s): %v", filter, err)
+		}
+		_, _, err = SQL(f, testColumns)
+		scimErr, ok := err.(*Error)
+		if !ok || scimErr.ScimType != "invalidFilter" {
+			t.Errorf("SQL(%s) = %v, want an invalidFilter error", filter, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	attributes := map[string]interface{}{"value": "2819c223", "display": "Babs Jensen", "type": ""}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`value eq "2819C223"`, true},
+		{`value ne "2819c223"`, false},
+		{`display sw "babs"`, true},
+		{`display ew "JENSEN"`, true},
+		{`display co "s j"`, true},
+		{`display pr`, true},
+		{`type pr`, false},
+		{`primary pr`, false},
+		{`value eq "other" or display co "babs"`, true},
+		{`value eq "other" and display co "babs"`, false},
+		{`not (value eq "other")`, true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("ParseFilter(%s): %v", tt.filter, err)
+		}
+		if got := Match(f, attributes); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package scim
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// PatchRequest is the body of a PATCH, see RFC 7644 section 3.5.2.
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Path is a parsed PATCH path such as name.givenName or
+// members[value eq "2819c223"]. Attr and SubAttr are lower case.
+type Path struct {
+	Attr        string
+	ValueFilter Filter
+	SubAttr     string
+}
+
+func (pr *PatchRequest) Validate() error {
+	if len(pr.Operations) == 0 {
+		return BadRequest("invalidValue", "Required Operations")
+	}
+	for i := range pr.Operations {
+		op := strings.ToLower(pr.Operations[i].Op)
+		if op != "add" && op != "remove" && op != "replace" {
+			return BadRequest("invalidSyntax", "Unknown operation "+pr.Operations[i].Op)
+		}
+		if op == "remove" && pr.Operations[i].Path == "" {
+			return BadRequest("noTarget", "Required path for remove")
+		}
+		pr.Operations[i].Op = op
+	}
+	return nil
+}
+
+func ParsePath(s string) (Path, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Path{}, BadRequest("invalidPath", "Required path")
+	}
+	path := Path{}
+	if open := strings.IndexByte(s, '['); open >= 0 {
+		end := strings.LastIndexByte(s, ']')
+		if end < open {
+			return Path{}, BadRequest("invalidPath", "Invalid path "+s)
+		}
+		f, err := ParseFilter(s[open+1 : end])
+		if err != nil {
+			return Path{}, BadRequest("invalidPath", "Invalid path "+s)
+		}
+		path.Attr = AttributeName(s[:open])
+		path.ValueFilter = f
+		rest := s[end+1:]
+		if rest != "" {
+			if rest[0] != '.' || len(rest) == 1 {
+				return Path{}, BadRequest("invalidPath", "Invalid path "+s)
+			}
+			path.SubAttr = strings.ToLower(rest[1:])
+		}
+		return path, nil
+	}
+	name := AttributeName(s)
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		path.Attr = name[:dot]
+		path.SubAttr = name[dot+1:]
+	} else {
+		path.Attr = name
+	}
+	return path, nil
+}
+
+// Bool reads a boolean value, also accepting "true" and "false" as strings,
+// which some clients send.
+func Bool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		switch strings.ToLower(s) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, BadRequest("invalidValue", "Expected a boolean, got "+string(value))
+}
+
+func String(value json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return "", BadRequest("invalidValue", "Expected a string, got "+string(value))
+	}
+	return s, nil
+}
+
+// Patch applies one operation to the user. Attributes outside the User
+// schema, such as the enterprise extension, are ignored.
+func (u *User) Patch(op PatchOperation) error {
+	if op.Path == "" {
+		attributes := map[string]json.RawMessage{}
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return BadRequest("invalidValue", "Expected an object as value without path")
+		}
+		for name, value := range attributes {
+			path, err := ParsePath(name)
+			if err != nil {
+				return err
+			}
+			if err := u.patchAttribute(op.Op, path, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	path, err := ParsePath(op.Path)
+	if err != nil {
+		return err
+	}
+	return u.patchAttribute(op.Op, path, op.Value)
+}
+
+func (u *User) patchAttribute(op string, path Path, value json.RawMessage) error {
+	remove := op == "remove"
+	var s string
+	var err error
+	switch path.Attr {
+	case "username", "displayname", "externalid", "password":
+		if remove {
+			break
+		}
+		if s, err = String(value); err != nil {
+			return err
+		}
+	}
+	switch path.Attr {
+	case "username":
+		if remove {
+			return BadRequest("mutability", "userName cannot be removed")
+		}
+		u.UserName = strings.TrimSpace(s)
+	case "displayname":
+		u.DisplayName = s
+	case "externalid":
+		u.ExternalID = s
+	case "password":
+		if remove {
+			return BadRequest("mutability", "password cannot be removed")
+		}
+		u.Password = s
+	case "active":
+		if remove {
+			return BadRequest("mutability", "active cannot be removed")
+		}
+		active, err := Bool(value)
+		if err != nil {
+			return err
+		}
+		u.Active = &active
+	case "name":
+		if u.Name == nil {
+			u.Name = &Name{}
+		}
+		if path.SubAttr == "" {
+			name := Name{}
+			if !remove {
+				if err := json.Unmarshal(value, &name); err != nil {
+					return BadRequest("invalidValue", "Expected an object as name")
+				}
+			}
+			if op == "add" {
+				if name.GivenName == "" {
+					name.GivenName = u.Name.GivenName
+				}
+				if name.FamilyName == "" {
+					name.FamilyName = u.Name.FamilyName
+				}
+				if name.Formatted == "" {
+					name.Formatted = u.Name.Formatted
+				}
+			}
+			u.Name = &name
+			return nil
+		}
+		if !remove {
+			if s, err = String(value); err != nil {
+				return err
+			}
+		}
+		switch path.SubAttr {
+		case "givenname":
+			u.Name.GivenName = s
+		case "familyname":
+			u.Name.FamilyName = s
+		case "formatted":
+			u.Name.Formatted = s
+		}
+	case "emails":
+		if remove {
+			u.Emails = nil
+			return nil
+		}
+		if path.ValueFilter != nil || path.SubAttr != "" {
+			if s, err = String(value); err != nil {
+				return err
+			}
+			u.Emails = []MultiValue{{Value: s, Type: "work", Primary: true}}
+			return nil
+		}
+		emails := []MultiValue{}
+		if err := json.Unmarshal(value, &emails); err != nil {
+			return BadRequest("invalidValue", "Expected a list of emails")
+		}
+		if op == "add" {
+			emails = append(emails, u.Emails...)
+		}
+		u.Emails = emails
+	}
+	return nil
+}
+
+// Patch applies one operation to the group.
+func (g *Group) Patch(op PatchOperation) error {
+	if op.Path == "" {
+		attributes := map[string]json.RawMessage{}
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return BadRequest("invalidValue", "Expected an object as value without path")
+		}
+		for name, value := range attributes {
+			path, err := ParsePath(name)
+			if err != nil {
+				return err
+			}
+			if err := g.patchAttribute(op.Op, path, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	path, err := ParsePath(op.Path)
+	if err != nil {
+		return err
+	}
+	return g.patchAttribute(op.Op, path, op.Value)
+}
+
+func (g *Group) patchAttribute(op string, path Path, value json.RawMessage) error {
+	switch path.Attr {
+	case "displayname":
+		if op == "remove" {
+			return BadRequest("mutability", "displayName cannot be removed")
+		}
+		s, err := String(value)
+		if err != nil {
+			return err
+		}
+		g.DisplayName = strings.TrimSpace(s)
+	case "externalid":
+		if op == "remove" {
+			g.ExternalID = ""
+			return nil
+		}
+		s, err := String(value)
+		if err != nil {
+			return err
+		}
+		g.ExternalID = s
+	case "members":
+		members := []MultiValue{}
+		if len(value) > 0 && string(value) != "null" {
+			if err := json.Unmarshal(value, &members); err != nil {
+				return BadRequest("invalidValue", "Expected a list of members")
+			}
+		}
+		switch op {
+		case "add":
+			for _, member := range members {
+				if !g.hasMember(member.Value) {
+					g.Members = append(g.Members, member)
+				}
+			}
+		case "replace":
+			g.Members = members
+		case "remove":
+			kept := []MultiValue{}
+			for _, member := range g.Members {
+				attributes := map[string]interface{}{"value": member.Value, "display": member.Display}
+				removed := path.ValueFilter == nil && len(members) == 0
+				if path.ValueFilter != nil && Match(path.ValueFilter, attributes) {
+					removed = true
+				}
+				for _, other := range members {
+					if other.Value == member.Value {
+						removed = true
+					}
+				}
+				if !removed {
+					kept = append(kept, member)
+				}
+			}
+			g.Members = kept
+		}
+	}
+	return nil
+}
+
+func (g *Group) hasMember(value string) bool {
+	for _, member := range g.Members {
+		if member.Value == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package scim
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		attr    string
+		filter  string
+		subAttr string
+	}{
+		{`userName`, "username", "", ""},
+		{`name.givenName`, "name", "", "givenname"},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:name.familyName`, "name", "", "familyname"},
+		{`members[value eq "2819c223"]`, "members", `value eq "2819c223"`, ""},
+		{`members[value eq "a]b"]`, "members", `value eq "a]b"`, ""},
+		{`emails[type eq "work" and primary eq true].Value`, "emails", `(type eq "work" and primary eq true)`, "value"},
+	}
+	for _, tt := range tests {
+		path, err := ParsePath(tt.path)
+		if err != nil {
+			t.Errorf("ParsePath(%s): %v", tt.path, err)
+			continue
+		}
+		filter := ""
+		if path.ValueFilter != nil {
+			filter = path.ValueFilter.String()
+		}
+		if path.Attr != tt.attr || filter != tt.filter || path.SubAttr != tt.subAttr {
+			t.Errorf("ParsePath(%s) = %s[%s].%s, want %s[%s].%s", tt.path, path.Attr, filter, path.SubAttr, tt.attr, tt.filter, tt.subAttr)
+		}
+	}
+}
+
+func TestParsePathErrors(t *testing.T) {
+	for _, path := range []string{
+		` `,
+		`members[value eq "x"`,
+		`members]value eq "x"[`,
+		`members[value eq "x"]value`,
+		`members[value eq "x"].`,
+		`members[value]`,
+		`members[]`,
+	} {
+		_, err := ParsePath(path)
+		scimErr, ok := err.(*Error)
+		if !ok || scimErr.ScimType != "invalidPath" {
+			t.Errorf("ParsePath(%q) = %v, want an invalidPath error", path, err)
+		}
+	}
+}
+
+func TestPatchRequestValidate(t *testing.T) {
+	request := PatchRequest{Operations: []PatchOperation{{Op: "Replace", Path: "active"}, {Op: "ADD"}}}
+	if err := request.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if request.Operations[0].Op != "replace" || request.Operations[1].Op != "add" {
+		t.Errorf("Operations are %s and %s, want them lower case", request.Operations[0].Op, request.Operations[1].Op)
+	}
+	for _, tt := range []struct {
+		operations []PatchOperation
+		scimType   string
+	}{
+		{nil, "invalidValue"},
+		{[]PatchOperation{{Op: "move", Path: "active"}}, "invalidSyntax"},
+		{[]PatchOperation{{Op: "remove"}}, "noTarget"},
+	} {
+		request := PatchRequest{Operations: tt.operations}
+		err := request.Validate()
+		if scimErr, ok := err.(*Error); !ok || scimErr.ScimType != tt.scimType {
+			t.Errorf("Validate(%+v) = %v, want a %s error", tt.operations, err, tt.scimType)
+		}
+	}
+}
+
+func members(values ...string) []MultiValue {
+	result := []MultiValue{}
+	for _, value := range values {
+		result = append(result, MultiValue{Value: value, Display: "User " + value})
+	}
+	return result
+}
+
+func TestGroupPatchMembers(t *testing.T) {
+	tests := []struct {
+		name string
+		op   PatchOperation
+		want []MultiValue
+	}{
+		{
+			"add skips present members",
+			PatchOperation{Op: "add", Path: "members", Value: json.RawMessage(`[{"value":"b"},{"value":"d","display":"User d"}]`)},
+			members("a", "b", "c", "d"),
+		},
+		{
+			"replace",
+			PatchOperation{Op: "replace", Path: "members", Value: json.RawMessage(`[{"value":"d","display":"User d"}]`)},
+			members("d"),
+		},
+		{
+			"remove by value filter",
+			PatchOperation{Op: "remove", Path: `members[value eq "b"]`},
+			members("a", "c"),
+		},
+		{
+			"remove by a filter on display",
+			PatchOperation{Op: "remove", Path: `members[value eq "a" or display ew " C"]`},
+			members("b"),
+		},
+		{
+			"remove with a filter matching nobody",
+			PatchOperation{Op: "remove", Path: `members[value eq "z"]`},
+			members("a", "b", "c"),
+		},
+		{
+			"remove listed members",
+			PatchOperation{Op: "remove", Path: "members", Value: json.RawMessage(`[{"value":"a"},{"value":"c"}]`)},
+			members("b"),
+		},
+		{
+			"remove all members",
+			PatchOperation{Op: "remove", Path: "members"},
+			members(),
+		},
+		{
+			"replace without path",
+			PatchOperation{Op: "replace", Value: json.RawMessage(`{"members":[{"value":"d","display":"User d"}]}`)},
+			members("d"),
+		},
+	}
+	for _, tt := range tests {
+		group := Group{DisplayName: "Admins", Members: members("a", "b", "c")}
+		if err := group.Patch(tt.op); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(group.Members, tt.want) {
+			t.Errorf("%s: members %+v, want %+v", tt.name, group.Members, tt.want)
+		}
+	}
+}
+
+func TestGroupPatchAttributes(t *testing.T) {
+	group := Group{DisplayName: "Admins", ExternalID: "ext"}
+	if err := group.Patch(PatchOperation{Op: "replace", Value: json.RawMessage(`{"displayName":" Operators ","externalId":"ext-2"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if group.DisplayName != "Operators" || group.ExternalID != "ext-2" {
+		t.Errorf("Patched group %+v", group)
+	}
+	if err := group.Patch(PatchOperation{Op: "remove", Path: "externalId"}); err != nil || group.ExternalID != "" {
+		t.Errorf("Removing externalId = %v, left %q", err, group.ExternalID)
+	}
+	if err := group.Patch(PatchOperation{Op: "remove", Path: "displayName"}); err == nil {
+		t.Error("displayName removed")
+	}
+	if err := group.Patch(PatchOperation{Op: "replace", Path: "displayName", Value: json.RawMessage(`5`)}); err == nil {
+		t.Error("displayName replaced with a number")
+	}
+}
+
+func TestUserPatch(t *testing.T) {
+	active := true
+	newUser := func() User {
+		return User{
+			UserName: "jane",
+			Name:     &Name{GivenName: "Jane", FamilyName: "Doe"},
+			Emails:   []MultiValue{{Value: "jane@example.com", Type: "work", Primary: true}},
+			Active:   &active,
+		}
+	}
+	tests := []struct {
+		name  string
+		op    PatchOperation
+		check func(u User) bool
+	}{
+		{
+			"deactivate with a string boolean",
+			PatchOperation{Op: "replace", Path: "active", Value: json.RawMessage(`"False"`)},
+			func(u User) bool { return u.Active != nil && !*u.Active },
+		},
+		{
+			"replace without path",
+			PatchOperation{Op: "replace", Value: json.RawMessage(`{"userName":" janed ","name.givenName":"Janet","active":false}`)},
+			func(u User) bool { return u.UserName == "janed" && u.Name.GivenName == "Janet" && !*u.Active },
+		},
+		{
+			"add name keeps the other parts",
+			PatchOperation{Op: "add", Path: "name", Value: json.RawMessage(`{"formatted":"Jane Doe"}`)},
+			func(u User) bool {
+				return *u.Name == Name{GivenName: "Jane", FamilyName: "Doe", Formatted: "Jane Doe"}
+			},
+		},
+		{
+			"replace name drops the other parts",
+			PatchOperation{Op: "replace", Path: "name", Value: json.RawMessage(`{"givenName":"Janet"}`)},
+			func(u User) bool { return *u.Name == Name{GivenName: "Janet"} },
+		},
+		{
+			"remove a name part",
+			PatchOperation{Op: "remove", Path: "name.familyName"},
+			func(u User) bool { return *u.Name == Name{GivenName: "Jane"} },
+		},
+		{
+			"replace the value of the work email",
+			PatchOperation{Op: "replace", Path: `emails[type eq "work"].value`, Value: json.RawMessage(`"jane.doe@example.com"`)},
+			func(u User) bool {
+				return reflect.DeepEqual(u.Emails, []MultiValue{{Value: "jane.doe@example.com", Type: "work", Primary: true}})
+			},
+		},
+		{
+			"add emails",
+			PatchOperation{Op: "add", Path: "emails", Value: json.RawMessage(`[{"value":"jd@example.com","type":"home"}]`)},
+			func(u User) bool {
+				return len(u.Emails) == 2 && u.Emails[0].Value == "jd@example.com" && u.Emails[1].Value == "jane@example.com"
+			},
+		},
+		{
+			"remove emails",
+			PatchOperation{Op: "remove", Path: "emails"},
+			func(u User) bool { return u.Emails == nil },
+		},
+		{
+			"ignore extension attributes",
+			PatchOperation{Op: "replace", Path: "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department", Value: json.RawMessage(`"Sales"`)},
+			func(u User) bool { return reflect.DeepEqual(u, newUser()) },
+		},
+	}
+	for _, tt := range tests {
+		user := newUser()
+		if err := user.Patch(tt.op); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(user) {
+			t.Errorf("%s: patched user %+v, name %+v", tt.name, user, user.Name)
+		}
+	}
+}
+
+func TestUserPatchErrors(t *testing.T) {
+	tests := []struct {
+		op       PatchOperation
+		scimType string
+	}{
+		{PatchOperation{Op: "remove", Path: "userName"}, "mutability"},
+		{PatchOperation{Op: "remove", Path: "active"}, "mutability"},
+		{PatchOperation{Op: "remove", Path: "password"}, "mutability"},
+		{PatchOperation{Op: "replace", Path: "active", Value: json.RawMessage(`"yes"`)}, "invalidValue"},
+		{PatchOperation{Op: "replace", Path: "userName", Value: json.RawMessage(`{"value":"jane"}`)}, "invalidValue"},
+		{PatchOperation{Op: "replace", Value: json.RawMessage(`"jane"`)}, "invalidValue"},
+		{PatchOperation{Op: "replace", Path: `emails[type eq]`, Value: json.RawMessage(`"x"`)}, "invalidPath"},
+	}
+	for _, tt := range tests {
+		user := User{UserName: "jane"}
+		err := user.Patch(tt.op)
+		if scimErr, ok := err.(*Error); !ok || scimErr.ScimType != tt.scimType {
+			t.Errorf("Patch(%+v) = %v, want a %s error", tt.op, err, tt.scimType)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package scim
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+}
+
+// MultiValue is one value of a multi valued attribute such as emails,
+// groups or members.
+type MultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type User struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	UserName    string       `json:"userName"`
+	Name        *Name        `json:"name,omitempty"`
+	DisplayName string       `json:"displayName,omitempty"`
+	Emails      []MultiValue `json:"emails,omitempty"`
+	Active      *bool        `json:"active,omitempty"`
+	Password    string       `json:"password,omitempty"`
+	Groups      []MultiValue `json:"groups,omitempty"`
+	Meta        *Meta        `json:"meta,omitempty"`
+}
+
+type Group struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []MultiValue `json:"members"`
+	Meta        *Meta        `json:"meta,omitempty"`
+}
+
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+func NewListResponse(resources []interface{}, total int, startIndex int) ListResponse {
+	return ListResponse{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+// PrimaryEmail returns the primary email, or the first one when none is
+// marked primary.
+func (u *User) PrimaryEmail() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+// DecodeUser reads a User resource. Clients differ in how they send active,
+// a boolean or a "True"/"False" string, both are accepted.
+func DecodeUser(body []byte) (*User, error) {
+	raw := struct {
+		User
+		Active json.RawMessage `json:"active,omitempty"`
+	}{}
+	err := json.Unmarshal(body, &raw)
+	if err != nil {
+		return nil, BadRequest("invalidSyntax", err.Error())
+	}
+	user := raw.User
+	if len(raw.Active) > 0 && string(raw.Active) != "null" {
+		active, err := Bool(raw.Active)
+		if err != nil {
+			return nil, err
+		}
+		user.Active = &active
+	}
+	user.UserName = strings.TrimSpace(user.UserName)
+	if user.UserName == "" {
+		return nil, BadRequest("invalidValue", "Required userName")
+	}
+	return &user, nil
+}
+
+func DecodeGroup(body []byte) (*Group, error) {
+	group := Group{}
+	err := json.Unmarshal(body, &group)
+	if err != nil {
+		return nil, BadRequest("invalidSyntax", err.Error())
+	}
+	group.DisplayName = strings.TrimSpace(group.DisplayName)
+	if group.DisplayName == "" {
+		return nil, BadRequest("invalidValue", "Required displayName")
+	}
+	return &group, nil
+}
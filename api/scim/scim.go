@@ -0,0 +1,86 @@
+// Package scim implements the protocol side of SCIM 2.0 (RFC 7643, RFC 7644):
+// resource representations, filters, PATCH paths, errors and the discovery
+// documents. Mapping resources onto users and roles is left to the caller.
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const (
+	SchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+const ContentType = "application/scim+json"
+
+// MaxResults is the most resources a list returns, whatever count asks for.
+const MaxResults = 200
+
+// Error is a SCIM error response. ScimType is one of the detail error
+// keywords of RFC 7644 section 3.12, e.g. invalidFilter or uniqueness.
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail,omitempty"`
+	}{
+		Schemas:  []string{SchemaError},
+		Status:   fmt.Sprint(e.Status),
+		ScimType: e.ScimType,
+		Detail:   e.Detail,
+	})
+}
+
+func BadRequest(scimType string, detail string) *Error {
+	return &Error{Status: http.StatusBadRequest, ScimType: scimType, Detail: detail}
+}
+
+func NotFound(detail string) *Error {
+	return &Error{Status: http.StatusNotFound, Detail: detail}
+}
+
+func Conflict(detail string) *Error {
+	return &Error{Status: http.StatusConflict, ScimType: "uniqueness", Detail: detail}
+}
+
+func JSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(statusCode)
+	if data == nil {
+		return
+	}
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err.Error())
+	}
+}
+
+// ERROR writes err as a SCIM error. Errors other than *Error are answered
+// with status 500.
+func ERROR(w http.ResponseWriter, err error) {
+	scimErr, ok := err.(*Error)
+	if !ok {
+		scimErr = &Error{Status: http.StatusInternalServerError, Detail: err.Error()}
+	}
+	JSON(w, scimErr.Status, scimErr)
+}
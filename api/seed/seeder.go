@@ -42,67 +42,93 @@ var users_roles = []models.User_Role{
 	{
 		UserID: ConstID,
 		RoleID:	1,
+		Source: models.RoleSourceManual,
 	},
 }
 
 var permissions = []models.Permission{
 	{
-		Name: 	"SYSTEM_ADMIN",
+		Name: 	"identity:SYSTEM_ADMIN",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
 	{
-		Name: 	"USERS_CREATE",
+		Name: 	"identity:USERS_CREATE",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
 	{
-		Name:   "USERS_VIEW",
+		Name:   "identity:USERS_VIEW",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
 	{
-		Name:   "USERS_UNLOCK",
+		Name:   "identity:USERS_UNLOCK",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
 	{
-		Name:   "USERS_ACTIVATE",
+		Name:   "identity:USERS_ACTIVATE",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
 	{
-		Name:   "USERS_CHANGE_PWD",
+		Name:   "identity:USERS_CHANGE_PWD",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
 	{
-		Name:   "USERS_ASSIGN_TO_ROLE",
+		Name:   "identity:USERS_ASSIGN_TO_ROLE",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},	
 	{
-		Name:   "ROLES_VIEW",
+		Name:   "identity:ROLES_VIEW",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},	
 	{
-		Name:   "MANAGE_ROLES",
+		Name:   "identity:MANAGE_ROLES",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},	
 	{
-		Name:   "VIEW_PERMISSION",
+		Name:   "identity:VIEW_PERMISSION",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},	
 	{
-		Name:   "MANAGE_PERMISSION",
+		Name:   "identity:MANAGE_PERMISSION",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
 	{
-		Name:   "PERMISSION_ASSIGN_TO_ROLE",
+		Name:   "identity:PERMISSION_ASSIGN_TO_ROLE",
+		CreatedBy: ConstID,
+		UpdatedBy: ConstID,
+	},
+	{
+		Name:   "identity:AUDIT_VIEW",
+		CreatedBy: ConstID,
+		UpdatedBy: ConstID,
+	},
+	{
+		Name:   "identity:MANAGE_WEBHOOKS",
+		CreatedBy: ConstID,
+		UpdatedBy: ConstID,
+	},
+	{
+		Name:   "identity:MANAGE_SCIM",
+		CreatedBy: ConstID,
+		UpdatedBy: ConstID,
+	},
+	{
+		Name:   "identity:MANAGE_IDENTITY_PROVIDERS",
+		CreatedBy: ConstID,
+		UpdatedBy: ConstID,
+	},
+	{
+		Name:   "identity:MANAGE_GROUPS",
 		CreatedBy: ConstID,
 		UpdatedBy: ConstID,
 	},
@@ -157,6 +183,26 @@ var roles_permissions = []models.Role_Permission{
 		PermissionID: 12,
 		RoleID: 1,
 	},
+	{
+		PermissionID: 13,
+		RoleID: 1,
+	},
+	{
+		PermissionID: 14,
+		RoleID: 1,
+	},
+	{
+		PermissionID: 15,
+		RoleID: 1,
+	},
+	{
+		PermissionID: 16,
+		RoleID: 1,
+	},
+	{
+		PermissionID: 17,
+		RoleID: 1,
+	},
 	{
 		PermissionID: 2,
 		RoleID: 2,
@@ -201,6 +247,26 @@ var roles_permissions = []models.Role_Permission{
 		PermissionID: 12,
 		RoleID: 2,
 	},
+	{
+		PermissionID: 13,
+		RoleID: 2,
+	},
+	{
+		PermissionID: 14,
+		RoleID: 2,
+	},
+	{
+		PermissionID: 15,
+		RoleID: 2,
+	},
+	{
+		PermissionID: 16,
+		RoleID: 2,
+	},
+	{
+		PermissionID: 17,
+		RoleID: 2,
+	},
 }
 
 // Load DB with seed data
@@ -208,16 +274,36 @@ func Load(db *gorm.DB, username string, firstname string, lastname string, email
 
 	if os.Getenv("GORM_AUTOMIGRATE") == "true" {
 		// Enable below if you want to drop the existing tables
-		err := db.Debug().DropTableIfExists(&models.Role{}, &models.User{}, &models.User_Role{}, &models.Permission{}, &models.Role_Permission{}, models.User_Device{}, models.Refresh_Token{}).Error
+		err := db.Debug().DropTableIfExists(&models.Role{}, &models.User{}, &models.User_Role{}, &models.Permission{}, &models.Role_Permission{}, models.User_Device{}, models.Refresh_Token{}, &models.Invitation{}, &models.Magic_Link{}, &models.Password_Reset{}, &models.Password_History{}, &models.Login_Throttle{}, &models.Rate_Limit_Bucket{}, &models.Login_Event{}, &models.Login_Alert{}, &models.Audit_Event{}, &models.Ledger_Entry{}, &models.Ledger_Checkpoint{}, &models.Webhook_Subscription{}, &models.Webhook_Delivery{}, &models.Outbox_Message{}, &models.Scim_Token{}, &models.Saml_Provider{}, &models.Saml_Request{}, &models.Oidc_Provider{}, &models.Oauth_Request{}, &models.External_Identity{}, &models.Oauth_Code{}, &models.Role_Mapping_Rule{}, &models.Group{}, &models.Group_Member{}, &models.Group_Role{}, &models.Role_Assignment{}, "invitation_roles").Error
 		if err != nil {
 			log.Fatalf("cannot drop table: %v", err)
 		}
 	
-		err = db.Debug().AutoMigrate(&models.User{}, &models.Role{}, &models.User_Role{}, &models.Permission{}, &models.Role_Permission{}, models.User_Device{}, models.Refresh_Token{}).Error
+		err = db.Debug().AutoMigrate(&models.User{}, &models.Role{}, &models.User_Role{}, &models.Permission{}, &models.Role_Permission{}, models.User_Device{}, models.Refresh_Token{}, &models.Invitation{}, &models.Magic_Link{}, &models.Password_Reset{}, &models.Password_History{}, &models.Login_Throttle{}, &models.Rate_Limit_Bucket{}, &models.Login_Event{}, &models.Login_Alert{}, &models.Audit_Event{}, &models.Ledger_Entry{}, &models.Ledger_Checkpoint{}, &models.Webhook_Subscription{}, &models.Webhook_Delivery{}, &models.Outbox_Message{}, &models.Scim_Token{}, &models.Saml_Provider{}, &models.Saml_Request{}, &models.Oidc_Provider{}, &models.Oauth_Request{}, &models.External_Identity{}, &models.Oauth_Code{}, &models.Role_Mapping_Rule{}, &models.Group{}, &models.Group_Member{}, &models.Group_Role{}, &models.Role_Assignment{}).Error
 		if err != nil {
 			log.Fatalf("cannot migrate table: %v", err)
 		}
+
+		err = models.EnforceAuditAppendOnly(db)
+		if err != nil {
+			log.Fatalf("cannot protect the audit log: %v", err)
+		}
+		err = models.EnforceLedger(db)
+		if err != nil {
+			log.Fatalf("cannot install the audit ledger: %v", err)
+		}
 	
+		admin := models.User{UserName: username, FirstName: firstname, LastName: lastname, Email: email}
+		err = models.CurrentPasswordPolicy().Validate(nil, password, &admin)
+		if err != nil {
+			log.Fatalf("cannot seed users table, SYSTEM_ADMIN_PASSWORD is rejected: %v", err)
+		}
+
+		hashedPassword, err := models.Hash(password)
+		if err != nil {
+			log.Fatalf("cannot hash the system admin password: %v", err)
+		}
+
 		var users = []models.User{
 			{
 				ID:			 ConstID,
@@ -225,7 +311,7 @@ func Load(db *gorm.DB, username string, firstname string, lastname string, email
 				FirstName:	 firstname,
 				LastName:	 lastname,
 				Email:		 email,
-				Password:	 password,
+				Password:	 string(hashedPassword),
 				Provider: 	 "local",
 				CreatedBy:	 ConstID,
 				UpdatedBy:	 ConstID,
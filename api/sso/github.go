@@ -0,0 +1,87 @@
+package sso
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GitHubAPI is the base URL of the GitHub REST API, GitHub Enterprise
+// servers have theirs under /api/v3.
+var GitHubAPI = "https://api.github.com"
+
+var githubClient = &http.Client{Timeout: 10 * time.Second}
+
+// GitHubMemberships returns the organizations of the user the token belongs
+// to, and its teams as org/team. Private memberships need the read:org
+// scope.
+func GitHubMemberships(accessToken string) ([]string, []string, error) {
+	orgs := []string{}
+	err := githubPages(accessToken, "/user/orgs", func(data []byte) (int, error) {
+		page := []struct {
+			Login string `json:"login"`
+		}{}
+		err := json.Unmarshal(data, &page)
+		for _, org := range page {
+			orgs = append(orgs, org.Login)
+		}
+		return len(page), err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	teams := []string{}
+	err = githubPages(accessToken, "/user/teams", func(data []byte) (int, error) {
+		page := []struct {
+			Slug         string `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}{}
+		err := json.Unmarshal(data, &page)
+		for _, team := range page {
+			teams = append(teams, team.Organization.Login+"/"+team.Slug)
+		}
+		return len(page), err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return orgs, teams, nil
+}
+
+// githubPages hands the pages of a list to f until one is not full.
+func githubPages(accessToken, path string, f func([]byte) (int, error)) error {
+	const perPage = 100
+	for page := 1; page <= 10; page++ {
+		req, err := http.NewRequest("GET", GitHubAPI+path+"?per_page="+strconv.Itoa(perPage)+"&page="+strconv.Itoa(page), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "token "+accessToken)
+		req.Header.Set("Accept", "application/vnd.github+json")
+		resp, err := githubClient.Do(req)
+		if err != nil {
+			return err
+		}
+		var data json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&data)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GitHub answered %s with %d", path, resp.StatusCode)
+		}
+		if err != nil {
+			return err
+		}
+		n, err := f(data)
+		if err != nil {
+			return err
+		}
+		if n < perPage {
+			return nil
+		}
+	}
+	return nil
+}
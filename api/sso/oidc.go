@@ -0,0 +1,154 @@
+package sso
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
+)
+
+// OIDCProvider is an upstream OpenID Connect provider, such as Azure AD,
+// Okta, Keycloak or Auth0. It is found through its discovery URL, the
+// .well-known/openid-configuration of the issuer.
+type OIDCProvider struct {
+	Name         string       `json:"name"`
+	DisplayName  string       `json:"display_name"`
+	DiscoveryURL string       `json:"discovery_url"`
+	ClientID     string       `json:"client_id"`
+	ClientSecret string       `json:"client_secret"`
+	Scopes       []string     `json:"scopes"`
+	Claims       ClaimMapping `json:"claims"`
+}
+
+// ClaimMapping names the claims the user fields are read from. Empty fields
+// keep the standard claims: sub, email, preferred_username, given_name,
+// family_name and name.
+type ClaimMapping struct {
+	Subject   string `json:"subject"`
+	Email     string `json:"email"`
+	UserName  string `json:"user_name"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Name      string `json:"name"`
+}
+
+var providerName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Validate checks the provider can be registered.
+func (p OIDCProvider) Validate() error {
+	if !providerName.MatchString(p.Name) {
+		return errors.New("Name must be lower case letters, digits, - and _")
+	}
+	if !strings.HasPrefix(p.DiscoveryURL, "https://") && !strings.HasPrefix(p.DiscoveryURL, "http://") {
+		return errors.New("Invalid discovery URL")
+	}
+	if p.ClientID == "" {
+		return errors.New("Required client ID")
+	}
+	return nil
+}
+
+// GothProvider discovers the provider and returns it as a goth provider
+// redirecting back to callbackURL.
+func (p OIDCProvider) GothProvider(callbackURL string) (goth.Provider, error) {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	provider, err := openidConnect.New(p.ClientID, p.ClientSecret, callbackURL, p.DiscoveryURL, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	provider.SetName(p.Name)
+	if p.Claims.Subject != "" {
+		provider.UserIdClaims = []string{p.Claims.Subject}
+	}
+	if p.Claims.Email != "" {
+		provider.EmailClaims = []string{p.Claims.Email}
+	}
+	if p.Claims.UserName != "" {
+		provider.NickNameClaims = []string{p.Claims.UserName}
+	}
+	if p.Claims.FirstName != "" {
+		provider.FirstNameClaims = []string{p.Claims.FirstName}
+	}
+	if p.Claims.LastName != "" {
+		provider.LastNameClaims = []string{p.Claims.LastName}
+	}
+	if p.Claims.Name != "" {
+		provider.NameClaims = []string{p.Claims.Name}
+	}
+	return provider, nil
+}
+
+// LoadOIDCFile reads a JSON list of providers. Client IDs and secrets may
+// reference environment variables as ${NAME}, keeping secrets out of the
+// file.
+func LoadOIDCFile(path string) ([]OIDCProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	providers := []OIDCProvider{}
+	err = json.Unmarshal(data, &providers)
+	if err != nil {
+		return nil, err
+	}
+	for i := range providers {
+		providers[i].ClientID = os.ExpandEnv(providers[i].ClientID)
+		providers[i].ClientSecret = os.ExpandEnv(providers[i].ClientSecret)
+		err = providers[i].Validate()
+		if err != nil {
+			return nil, errors.New(providers[i].Name + ": " + err.Error())
+		}
+	}
+	return providers, nil
+}
+
+var (
+	providersMu  sync.RWMutex
+	displayNames = map[string]string{}
+)
+
+// UseProviders replaces the providers goth logs in with. displayNames maps
+// their names to the names shown to users.
+func UseProviders(providers []goth.Provider, names map[string]string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	goth.ClearProviders()
+	goth.UseProviders(providers...)
+	displayNames = names
+}
+
+// ReadProviders runs f while the providers cannot be replaced. goth keeps
+// them in a plain map, so every use of gothic has to go through here.
+func ReadProviders(f func()) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	f()
+}
+
+// ProviderNames returns the names of the providers in use, sorted, and
+// their display names.
+func ProviderNames() ([]string, map[string]string) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := []string{}
+	display := map[string]string{}
+	for name := range goth.GetProviders() {
+		names = append(names, name)
+		display[name] = displayNames[name]
+		if display[name] == "" {
+			display[name] = name
+		}
+	}
+	sort.Strings(names)
+	return names, display
+}
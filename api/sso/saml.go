@@ -0,0 +1,231 @@
+// Package sso lets the service act as the relying party of external
+// identity providers. It turns their configuration into protocol clients and
+// their assertions into plain attributes; accounts are left to the caller.
+package sso
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SAML bindings an identity provider can receive the AuthnRequest on.
+const (
+	BindingRedirect = "redirect"
+	BindingPost     = "post"
+)
+
+// SAMLProvider is the identity provider side of a SAML trust.
+type SAMLProvider struct {
+	EntityID string
+	SSOURL   string
+	Binding  string
+	// Certificate holds the PEM encoded signing certificates of the
+	// identity provider, more than one during a rollover.
+	Certificate  string
+	NameIDFormat string
+}
+
+var (
+	mu     sync.RWMutex
+	spKey  *rsa.PrivateKey
+	spCert *x509.Certificate
+)
+
+// LoadSAMLKeyPair loads the key pair of the service provider. It signs the
+// AuthnRequests and decrypts encrypted assertions, without it requests go
+// out unsigned and assertions have to come in clear.
+func LoadSAMLKeyPair(certFile string, keyFile string) error {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("the SAML key must be an RSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	spKey = key
+	spCert = cert
+	return nil
+}
+
+// ParseCertificates decodes every certificate of a PEM bundle. Bare base64
+// as copied from IdP metadata is accepted as well.
+func ParseCertificates(data string) ([]*x509.Certificate, error) {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, "-----BEGIN") {
+		data = "-----BEGIN CERTIFICATE-----\n" + data + "\n-----END CERTIFICATE-----"
+	}
+	certs := []*x509.Certificate{}
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+// NewServiceProvider builds the service provider trusting p. metadataURL is
+// also the entity ID of the service provider.
+func NewServiceProvider(p SAMLProvider, metadataURL string, acsURL string) (*saml.ServiceProvider, error) {
+	metadata, err := url.Parse(metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	acs, err := url.Parse(acsURL)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := ParseCertificates(p.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	keyDescriptors := []saml.KeyDescriptor{}
+	for _, cert := range certs {
+		keyDescriptors = append(keyDescriptors, saml.KeyDescriptor{
+			Use: "signing",
+			KeyInfo: saml.KeyInfo{X509Data: saml.X509Data{
+				X509Certificates: []saml.X509Certificate{{Data: encodeCertificate(cert)}},
+			}},
+		})
+	}
+	binding := saml.HTTPRedirectBinding
+	if p.Binding == BindingPost {
+		binding = saml.HTTPPostBinding
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:    metadata.String(),
+		MetadataURL: *metadata,
+		AcsURL:      *acs,
+		IDPMetadata: &saml.EntityDescriptor{
+			EntityID: p.EntityID,
+			IDPSSODescriptors: []saml.IDPSSODescriptor{{
+				SSODescriptor: saml.SSODescriptor{
+					RoleDescriptor: saml.RoleDescriptor{
+						ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+						KeyDescriptors:             keyDescriptors,
+					},
+				},
+				SingleSignOnServices: []saml.Endpoint{{Binding: binding, Location: p.SSOURL}},
+			}},
+		},
+		AuthnNameIDFormat: saml.NameIDFormat(p.NameIDFormat),
+	}
+	if sp.AuthnNameIDFormat == "" {
+		sp.AuthnNameIDFormat = saml.UnspecifiedNameIDFormat
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if spKey != nil {
+		sp.Key = spKey
+		sp.Certificate = spCert
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+	return sp, nil
+}
+
+// Metadata renders the metadata of the service provider. Responses are only
+// accepted through the HTTP-POST binding, artifacts are not resolved.
+func Metadata(sp *saml.ServiceProvider) ([]byte, error) {
+	descriptor := sp.Metadata()
+	for i := range descriptor.SPSSODescriptors {
+		services := []saml.IndexedEndpoint{}
+		for _, service := range descriptor.SPSSODescriptors[i].AssertionConsumerServices {
+			if service.Binding == saml.HTTPPostBinding {
+				services = append(services, service)
+			}
+		}
+		descriptor.SPSSODescriptors[i].AssertionConsumerServices = services
+	}
+	body, err := xml.MarshalIndent(descriptor, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// AuthnRequest starts a login at the identity provider. It returns the ID of
+// the request, which is also sent as RelayState and has to be answered by
+// the assertion, and either the URL to redirect the browser to or the HTML
+// form posting the request to the identity provider.
+func AuthnRequest(sp *saml.ServiceProvider) (string, *url.URL, []byte, error) {
+	binding := saml.HTTPRedirectBinding
+	location := sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if location == "" {
+		binding = saml.HTTPPostBinding
+		location = sp.GetSSOBindingLocation(saml.HTTPPostBinding)
+	}
+	req, err := sp.MakeAuthenticationRequest(location, binding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if binding == saml.HTTPPostBinding {
+		return req.ID, nil, req.Post(req.ID), nil
+	}
+	redirect, err := req.Redirect(req.ID, sp)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return req.ID, redirect, nil, nil
+}
+
+// AssertionValue returns the first value of the attribute called name,
+// matched against the Name or FriendlyName of the attributes.
+func AssertionValue(assertion *saml.Assertion, name string) string {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if !strings.EqualFold(attribute.Name, name) && !strings.EqualFold(attribute.FriendlyName, name) {
+				continue
+			}
+			for _, value := range attribute.Values {
+				if value.Value != "" {
+					return strings.TrimSpace(value.Value)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// NameID returns the subject of the assertion.
+func NameID(assertion *saml.Assertion) string {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		return ""
+	}
+	return strings.TrimSpace(assertion.Subject.NameID.Value)
+}
+
+func encodeCertificate(cert *x509.Certificate) string {
+	return base64.StdEncoding.EncodeToString(cert.Raw)
+}
@@ -0,0 +1,251 @@
+package sso
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testIDP         = "https://idp.example.com/metadata"
+	testMetadataURL = "https://id.example.com/saml/corp/metadata"
+	testACSURL      = "https://id.example.com/saml/corp/acs"
+	testRequestID   = "id-4c1f0e9a2b7d"
+)
+
+// testIdentityProvider is a signing key with its self-signed certificate.
+type testIdentityProvider struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIdentityProvider{key: key, cert: cert}
+}
+
+func (idp *testIdentityProvider) certificatePEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.cert.Raw}))
+}
+
+// serviceProvider returns the service provider trusting idp.
+func (idp *testIdentityProvider) serviceProvider(t *testing.T) *saml.ServiceProvider {
+	t.Helper()
+	sp, err := NewServiceProvider(SAMLProvider{
+		EntityID:    testIDP,
+		SSOURL:      "https://idp.example.com/sso",
+		Certificate: idp.certificatePEM(),
+	}, testMetadataURL, testACSURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func (idp *testIdentityProvider) sign(t *testing.T, el *etree.Element) *etree.Element {
+	t.Helper()
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{idp.cert.Raw},
+		PrivateKey:  idp.key,
+	}))
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := ctx.SetSignatureMethod(dsig.RSASHA256SignatureMethod); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ctx.SignEnveloped(el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed.Child[len(signed.Child)-1].(*etree.Element)
+}
+
+// response returns the SAMLResponse answering inResponseTo for
+// jane@example.com, with the assertion signed by signer unless it is nil.
+// tamper changes the assertion after it was signed.
+func response(t *testing.T, signer *testIdentityProvider, inResponseTo string, tamper func(*etree.Element)) string {
+	t.Helper()
+	now := saml.TimeNow()
+	assertion := &saml.Assertion{
+		ID:           "id-assertion-1",
+		IssueInstant: now,
+		Version:      "2.0",
+		Issuer:       saml.Issuer{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity", Value: testIDP},
+		Subject: &saml.Subject{
+			NameID: &saml.NameID{Format: string(saml.EmailAddressNameIDFormat), Value: "jane@example.com"},
+			SubjectConfirmations: []saml.SubjectConfirmation{{
+				Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+				SubjectConfirmationData: &saml.SubjectConfirmationData{
+					InResponseTo: inResponseTo,
+					NotOnOrAfter: now.Add(5 * time.Minute),
+					Recipient:    testACSURL,
+				},
+			}},
+		},
+		Conditions: &saml.Conditions{
+			NotBefore:            now.Add(-time.Minute),
+			NotOnOrAfter:         now.Add(5 * time.Minute),
+			AudienceRestrictions: []saml.AudienceRestriction{{Audience: saml.Audience{Value: testMetadataURL}}},
+		},
+		AttributeStatements: []saml.AttributeStatement{{
+			Attributes: []saml.Attribute{{
+				Name:   "givenName",
+				Values: []saml.AttributeValue{{Type: "xs:string", Value: "Jane"}},
+			}},
+		}},
+	}
+	if signer != nil {
+		assertion.Signature = signer.sign(t, assertion.Element())
+	}
+	assertionEl := assertion.Element()
+	if tamper != nil {
+		tamper(assertionEl)
+	}
+
+	resp := saml.Response{
+		ID:           "id-response-1",
+		InResponseTo: inResponseTo,
+		Destination:  testACSURL,
+		IssueInstant: now,
+		Version:      "2.0",
+		Issuer:       &saml.Issuer{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity", Value: testIDP},
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+	responseEl := resp.Element()
+	responseEl.AddChild(assertionEl)
+	doc := etree.NewDocument()
+	doc.SetRoot(responseEl)
+	body, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(body)
+}
+
+// parse posts the SAMLResponse to the service provider like the browser
+// does and returns the assertion it accepts.
+func parse(t *testing.T, sp *saml.ServiceProvider, samlResponse string, requestIDs ...string) (*saml.Assertion, error) {
+	t.Helper()
+	form := url.Values{"SAMLResponse": {samlResponse}, "RelayState": {testRequestID}}
+	r, err := http.NewRequest("POST", testACSURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := r.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	return sp.ParseResponse(r, requestIDs)
+}
+
+func TestParseSignedAssertion(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	sp := idp.serviceProvider(t)
+
+	assertion, err := parse(t, sp, response(t, idp, testRequestID, nil), testRequestID)
+	if err != nil {
+		t.Fatalf("Signed assertion rejected: %v", err.(*saml.InvalidResponseError).PrivateErr)
+	}
+	if NameID(assertion) != "jane@example.com" || AssertionValue(assertion, "GIVENNAME") != "Jane" {
+		t.Errorf("Assertion of %q named %q", NameID(assertion), AssertionValue(assertion, "givenName"))
+	}
+}
+
+func TestParseRejectsUnsignedAssertion(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	sp := idp.serviceProvider(t)
+
+	if _, err := parse(t, sp, response(t, nil, testRequestID, nil), testRequestID); err == nil {
+		t.Error("Unsigned assertion accepted")
+	}
+}
+
+func TestParseRejectsTamperedAssertion(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	sp := idp.serviceProvider(t)
+
+	samlResponse := response(t, idp, testRequestID, func(assertion *etree.Element) {
+		assertion.FindElement("./Subject/NameID").SetText("admin@example.com")
+	})
+	if _, err := parse(t, sp, samlResponse, testRequestID); err == nil {
+		t.Error("Tampered assertion accepted")
+	}
+}
+
+func TestParseRejectsUnknownCertificate(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	sp := idp.serviceProvider(t)
+	other := newTestIdentityProvider(t)
+
+	if _, err := parse(t, sp, response(t, other, testRequestID, nil), testRequestID); err == nil {
+		t.Error("Assertion signed with an untrusted certificate accepted")
+	}
+}
+
+func TestParseAcceptsRolledOverCertificate(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	next := newTestIdentityProvider(t)
+	sp, err := NewServiceProvider(SAMLProvider{
+		EntityID:    testIDP,
+		SSOURL:      "https://idp.example.com/sso",
+		Certificate: idp.certificatePEM() + next.certificatePEM(),
+	}, testMetadataURL, testACSURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signer := range []*testIdentityProvider{idp, next} {
+		if _, err := parse(t, sp, response(t, signer, testRequestID, nil), testRequestID); err != nil {
+			t.Errorf("Assertion signed with a trusted certificate rejected: %v", err.(*saml.InvalidResponseError).PrivateErr)
+		}
+	}
+}
+
+func TestParseRejectsUnknownInResponseTo(t *testing.T) {
+	idp := newTestIdentityProvider(t)
+	sp := idp.serviceProvider(t)
+
+	// A response to another login, or an unsolicited one, answers none of
+	// the pending requests.
+	for _, inResponseTo := range []string{"id-other-request", ""} {
+		if _, err := parse(t, sp, response(t, idp, inResponseTo, nil), testRequestID); err == nil {
+			t.Errorf("Response to %q accepted", inResponseTo)
+		}
+	}
+	// Once the request was consumed nothing answers it any more.
+	if _, err := parse(t, sp, response(t, idp, testRequestID, nil)); err == nil {
+		t.Error("Response to a consumed request accepted")
+	}
+}
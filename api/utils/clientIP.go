@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ClientIP returns the address of the caller. X-Forwarded-For is only
+// honoured when TRUST_PROXY_HEADERS is set, as clients can forge it. Each
+// proxy appends the address it received the request from, so the caller is
+// the entry TRUSTED_PROXY_HOPS from the right; the entries left of it are
+// whatever the client sent.
+func ClientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		forwarded := []string{}
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, address := range strings.Split(header, ",") {
+				if address = strings.TrimSpace(address); address != "" {
+					forwarded = append(forwarded, address)
+				}
+			}
+		}
+		if len(forwarded) > 0 {
+			hops, err := strconv.Atoi(os.Getenv("TRUSTED_PROXY_HOPS"))
+			if err != nil || hops < 1 {
+				hops = 1
+			}
+			if hops > len(forwarded) {
+				hops = len(forwarded)
+			}
+			return forwarded[len(forwarded)-hops]
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
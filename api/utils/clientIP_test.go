@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer os.Unsetenv("TRUST_PROXY_HEADERS")
+	defer os.Unsetenv("TRUSTED_PROXY_HOPS")
+
+	tests := []struct {
+		name      string
+		trust     string
+		hops      string
+		forwarded []string
+		want      string
+	}{
+		{"untrusted header", "false", "", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"no header", "true", "", nil, "192.0.2.1"},
+		{"proxy entry", "true", "", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"forged entries", "true", "", []string{"198.51.100.1, 198.51.100.2, 203.0.113.7"}, "203.0.113.7"},
+		{"two proxies", "true", "2", []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"split headers", "true", "2", []string{"198.51.100.1, 203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{"fewer entries than hops", "true", "3", []string{"203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"invalid hops", "true", "none", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		os.Setenv("TRUST_PROXY_HEADERS", tt.trust)
+		os.Setenv("TRUSTED_PROXY_HOPS", tt.hops)
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = "192.0.2.1:51234"
+		for _, header := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := ClientIP(r); got != tt.want {
+			t.Errorf("%s: ClientIP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package utils
+
+import "testing"
+
+func TestContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		required []string
+		granted  []string
+		want     bool
+	}{
+		{"all granted", []string{"USERS_VIEW", "ROLES_VIEW"}, []string{"identity:roles_view", "USERS_VIEW"}, true},
+		{"one missing", []string{"USERS_VIEW", "ROLES_VIEW"}, []string{"USERS_VIEW"}, false},
+		{"namespace wildcard", []string{"USERS_VIEW", "ROLES_VIEW"}, []string{"identity:*"}, true},
+		{"global wildcard", []string{"USERS_VIEW", "portfolio:orders:read"}, []string{"*"}, true},
+		{"wildcard of another namespace", []string{"USERS_VIEW"}, []string{"portfolio:*"}, false},
+		{"deeper name", []string{"portfolio:orders:read"}, []string{"portfolio:orders"}, false},
+		{"nothing granted", []string{"USERS_VIEW"}, nil, false},
+		// Nothing required is not a check that passes.
+		{"nothing required", nil, []string{"*"}, false},
+	}
+	for _, tt := range tests {
+		if got := Contains(tt.required, tt.granted); got != tt.want {
+			t.Errorf("%s: Contains(%v, %v) = %v, want %v", tt.name, tt.required, tt.granted, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// PermissionNamespace is the namespace of the permissions of this service.
+// Names without a namespace belong to it, so USERS_VIEW is
+// identity:USERS_VIEW.
+const PermissionNamespace = "identity"
+
+// PermissionWildcard as the last segment of a name grants every permission
+// below the segments before it, portfolio:* grants portfolio:orders:read.
+// On its own it grants every permission.
+const PermissionWildcard = "*"
+
+var permissionSegment = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// QualifyPermission puts a name without namespace into PermissionNamespace.
+func QualifyPermission(name string) string {
+	if name == PermissionWildcard || strings.Contains(name, ":") {
+		return name
+	}
+	return PermissionNamespace + ":" + name
+}
+
+// ValidatePermissionName checks that the name is made of segments of
+// letters, digits, _, . and -, separated by colons, of which only the last
+// may be the wildcard.
+func ValidatePermissionName(name string) error {
+	if name == "" {
+		return errors.New("Required Name")
+	}
+	if len(name) > 255 {
+		return errors.New("Invalid Name")
+	}
+	segments := strings.Split(name, ":")
+	for i, segment := range segments {
+		if segment == PermissionWildcard && i == len(segments)-1 {
+			continue
+		}
+		if !permissionSegment.MatchString(segment) {
+			return errors.New("Invalid Name, use segments of letters, digits, _, . and - separated by : with an optional * at the end")
+		}
+	}
+	return nil
+}
+
+// PermissionMatches tells whether the granted permission covers the
+// required one. Segments are compared case-insensitively.
+func PermissionMatches(granted string, required string) bool {
+	grantedSegments := strings.Split(QualifyPermission(granted), ":")
+	requiredSegments := strings.Split(QualifyPermission(required), ":")
+	for i, segment := range grantedSegments {
+		if segment == PermissionWildcard && i == len(grantedSegments)-1 {
+			return len(requiredSegments) > i
+		}
+		if i >= len(requiredSegments) || !strings.EqualFold(segment, requiredSegments[i]) {
+			return false
+		}
+	}
+	return len(grantedSegments) == len(requiredSegments)
+}
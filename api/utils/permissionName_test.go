@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPermissionMatches(t *testing.T) {
+	tests := []struct {
+		granted  string
+		required string
+		want     bool
+	}{
+		{"*", "USERS_VIEW", true},
+		{"*", "portfolio:orders:read", true},
+		{"*", "*", true},
+		{"portfolio:*", "portfolio:read", true},
+		{"portfolio:*", "portfolio:orders:read", true},
+		{"portfolio:*", "portfolio:*", true},
+		{"portfolio:*", "portfolio", false},
+		{"portfolio:*", "portfolios:read", false},
+		{"portfolio:*", "billing:read", false},
+		{"portfolio:orders:*", "portfolio:read", false},
+		// Only a wildcard at the end is one, elsewhere it is a literal.
+		{"portfolio:*:read", "portfolio:orders:read", false},
+		{"portfolio:read", "portfolio:read", true},
+		{"portfolio:read", "portfolio:write", false},
+		{"portfolio:read", "portfolio:read:all", false},
+		{"portfolio:orders:read", "portfolio:orders", false},
+		{"Portfolio:READ", "portfolio:read", true},
+		{"portfolio:read", "PORTFOLIO:Read", true},
+		// Names without a namespace are in the identity namespace.
+		{"USERS_VIEW", "USERS_VIEW", true},
+		{"USERS_VIEW", "identity:users_view", true},
+		{"identity:USERS_VIEW", "USERS_VIEW", true},
+		{"identity:*", "ROLES_VIEW", true},
+		{"identity:*", "portfolio:read", false},
+		{"USERS_VIEW", "portfolio:USERS_VIEW", false},
+	}
+	for _, tt := range tests {
+		if got := PermissionMatches(tt.granted, tt.required); got != tt.want {
+			t.Errorf("PermissionMatches(%s, %s) = %v, want %v", tt.granted, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePermissionName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"USERS_VIEW", true},
+		{"portfolio:orders.v2:read-all", true},
+		{"*", true},
+		{"portfolio:*", true},
+		{strings.Repeat("a", 255), true},
+		{"", false},
+		{strings.Repeat("a", 256), false},
+		{"portfolio:*:read", false},
+		{"*:read", false},
+		{"portfolio:**", false},
+		{"portfolio::read", false},
+		{":read", false},
+		{"portfolio:", false},
+		{"portfolio:read all", false},
+		{"portfolio:rëad", false},
+		{"portfolio/read", false},
+	}
+	for _, tt := range tests {
+		if err := ValidatePermissionName(tt.name); (err == nil) != tt.valid {
+			t.Errorf("ValidatePermissionName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestQualifyPermission(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"USERS_VIEW", "identity:USERS_VIEW"},
+		{"identity:USERS_VIEW", "identity:USERS_VIEW"},
+		{"portfolio:read", "portfolio:read"},
+		{"*", "*"},
+		{"portfolio:*", "portfolio:*"},
+	}
+	for _, tt := range tests {
+		if got := QualifyPermission(tt.name); got != tt.want {
+			t.Errorf("QualifyPermission(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Command breach-index builds the breached password index read by the
+// service from a dump of SHA-1 hashes, such as the ordered-by-hash download
+// of Have I Been Pwned.
+//
+//	breach-index -in pwned-passwords-sha1-ordered-by-hash.txt -out breached.idx
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/breach"
+)
+
+func main() {
+	in := flag.String("in", "", "dump file with one hex SHA-1 hash per line, optionally followed by :count")
+	out := flag.String("out", "breached.idx", "index file to write")
+	sortInput := flag.Bool("sort", false, "sort the dump in memory first, for dumps that are not ordered by hash")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dump, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("cannot open dump: %v", err)
+	}
+	defer dump.Close()
+
+	tmp := *out + ".tmp"
+	index, err := os.Create(tmp)
+	if err != nil {
+		log.Fatalf("cannot create index: %v", err)
+	}
+	count, err := breach.Build(dump, index, *sortInput)
+	if err == nil {
+		err = index.Close()
+	} else {
+		index.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Fatalf("cannot build index: %v", err)
+	}
+	if err := os.Rename(tmp, *out); err != nil {
+		log.Fatalf("cannot write index: %v", err)
+	}
+
+	fmt.Printf("Wrote %d hashes to %s\n", count, *out)
+}
@@ -0,0 +1,78 @@
+// Command ledger verifies the hash-chained audit ledger and creates the key
+// pair its checkpoints are signed with. It reads the DB_* and LEDGER_*
+// settings from the environment or .env, like the service.
+//
+//	ledger verify
+//	ledger keygen
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"bitbucket.org/staydigital/truvest-identity-management/api/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres" //postgres database driver
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		usage()
+	}
+	godotenv.Load()
+
+	switch os.Args[1] {
+	case "verify":
+		verify()
+	case "keygen":
+		keygen()
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ledger verify|keygen")
+	os.Exit(2)
+}
+
+// verify walks the ledger and exits with status 1 at the first broken link.
+func verify() {
+	publicKey, err := models.LedgerVerifyKey()
+	if err != nil {
+		log.Fatalf("cannot read the verify key: %v", err)
+	}
+	DBURL := fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable password=%s", os.Getenv("DB_HOST"), os.Getenv("DB_PORT"), os.Getenv("DB_USER"), os.Getenv("DB_NAME"), os.Getenv("DB_PASSWORD"))
+	db, err := gorm.Open("postgres", DBURL)
+	if err != nil {
+		log.Fatalf("cannot connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	verification, err := models.VerifyLedger(db, publicKey)
+	if err != nil {
+		log.Fatalf("cannot verify the ledger: %v", err)
+	}
+	report, _ := json.MarshalIndent(verification, "", "  ")
+	fmt.Println(string(report))
+	if !verification.Valid {
+		os.Exit(1)
+	}
+}
+
+// keygen prints a new LEDGER_SIGNING_KEY for the service and the matching
+// LEDGER_VERIFY_KEY for auditors.
+func keygen() {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("cannot generate a key: %v", err)
+	}
+	fmt.Printf("LEDGER_SIGNING_KEY=%s\n", base64.StdEncoding.EncodeToString(privateKey.Seed()))
+	fmt.Printf("LEDGER_VERIFY_KEY=%s\n", base64.StdEncoding.EncodeToString(publicKey))
+}
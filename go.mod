@@ -3,23 +3,32 @@ module bitbucket.org/staydigital/truvest-identity-management
 go 1.15
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/ReneKroon/ttlcache/v2 v2.7.0
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751
 	github.com/badoux/checkmail v1.2.1
+	github.com/beevik/etree v1.1.0
+	github.com/crewjam/saml v0.4.14
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.6
 	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/google/uuid v1.1.2
+	github.com/google/uuid v1.3.1
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/sessions v1.1.1
 	github.com/jinzhu/gorm v1.9.16
 	github.com/joho/godotenv v1.3.0
 	github.com/markbates/goth v1.67.1
+	github.com/nats-io/nats.go v1.31.0
+	github.com/oschwald/geoip2-golang v1.9.0
 	github.com/rs/cors v1.7.0
+	github.com/russellhaering/goxmldsig v1.3.0
+	github.com/segmentio/kafka-go v0.4.47
 	github.com/sendgrid/rest v2.6.2+incompatible // indirect
 	github.com/sendgrid/sendgrid-go v3.7.2+incompatible
 	github.com/swaggo/http-swagger v1.0.0
 	github.com/swaggo/swag v1.7.0
-	golang.org/x/crypto v0.0.0-20201208171446-5f87f3452ae9
-	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
+	golang.org/x/crypto v0.14.0
 	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
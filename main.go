@@ -19,6 +19,9 @@ import (
 // @securityDefinitions.apikey ApiKeyAuth
 // @in header
 // @name Authorization
+// @securityDefinitions.apikey ScimBearer
+// @in header
+// @name Authorization
 func main() {
 	var sb strings.Builder
 	// sb.WriteString(os.Getenv("APP_PROTOCOL"))